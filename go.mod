@@ -3,14 +3,20 @@ module github.com/m-mizutani/vxcap
 go 1.12
 
 require (
+	github.com/BurntSushi/toml v0.3.1
+	github.com/Shopify/sarama v1.23.1
 	github.com/aws/aws-sdk-go v1.23.21
 	github.com/caarlos0/env/v6 v6.0.0
 	github.com/google/gopacket v1.1.17
 	github.com/google/uuid v1.1.1
 	github.com/pkg/errors v0.8.1
+	github.com/prometheus/client_golang v0.9.2
 	github.com/sirupsen/logrus v1.4.2
 	github.com/stretchr/testify v1.3.0
 	github.com/urfave/cli v1.22.1
-	golang.org/x/net v0.0.0-20190620200207-3b0461eec859 // indirect
+	github.com/xdg/scram v0.0.0-20180814205039-7eeb5667e42c
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
+	golang.org/x/sys v0.0.0-20190422165155-953cdadca894
+	gopkg.in/yaml.v2 v2.2.2
 	honnef.co/go/pcap v0.0.0-20150201073351-599e2bd32de1
 )
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/m-mizutani/vxcap/pkg/vxcap"
 	"github.com/sirupsen/logrus"
@@ -11,18 +12,17 @@ import (
 
 const vxcapVersion = "0.1.0"
 
-var logLevelMap = map[string]logrus.Level{
-	"trace": logrus.TraceLevel,
-	"debug": logrus.DebugLevel,
-	"info":  logrus.InfoLevel,
-	"warn":  logrus.WarnLevel,
-	"error": logrus.ErrorLevel,
-}
-
 func main() {
-	cap := vxcap.New()
-	var args vxcap.PacketProcessorArgument
-	var logLevel string
+	// Options given by command line. They overwrite options of config file
+	// and environment variables only if set explicitly.
+	var flags vxcap.Config
+	// Comma separated list options are split into fields of flags.
+	lists := map[string]*listFlag{
+		"json-fields":   {dst: &flags.Processor.DumperArgs.JSONFields},
+		"kafka-brokers": {dst: &flags.Processor.EmitterArgs.KafkaBrokers},
+		"aws-s3-tags":   {dst: &flags.Processor.EmitterArgs.AwsS3Tags},
+	}
+	var configPath string
 
 	app := cli.NewApp()
 	app.Name = "vxcap"
@@ -36,141 +36,430 @@ func main() {
 	}
 
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:        "config, c",
+			Usage:       "Path of config file (YAML, or TOML if extension is .toml). Keys are same as long option names",
+			Destination: &configPath,
+		},
 		cli.StringFlag{
 			Name: "emitter, e", Value: "fs",
-			Usage:       "Destination to save data [fs,s3,firehose]",
-			Destination: &args.EmitterArgs.Name,
+			Usage:       "Destination to save data [fs,s3,firehose,kinesis,kafka]",
+			Destination: &flags.Processor.EmitterArgs.Name,
 		},
 		cli.StringFlag{
 			Name: "dumper, d", Value: "pcap",
-			Usage:       "Write format [pcap,json]",
-			Destination: &args.DumperArgs.Format,
+			Usage:       "Write format [pcap,pcapng,json]",
+			Destination: &flags.Processor.DumperArgs.Format,
 		},
 		cli.StringFlag{
 			Name: "log-level, l", Value: "info",
 			Usage:       "Log level [trace,debug,info,warn,error]",
-			Destination: &logLevel,
+			Destination: &flags.LogLevel,
+		},
+		cli.StringFlag{
+			Name:        "metrics-addr",
+			Usage:       "Listen address of HTTP server exposing Prometheus metrics at /metrics, e.g. ':9100' (default: disabled)",
+			Destination: &flags.MetricsAddr,
+		},
+		cli.BoolFlag{
+			Name:        "metrics-per-sender",
+			Usage:       "Enable metrics of received packets by VNI and sender (outer source address), number of series grows with senders",
+			Destination: &flags.MetricsPerSender,
+		},
+		cli.StringSliceFlag{
+			Name:  "route",
+			Usage: "Route packets by VNI to another destination, '<VNI>[-<VNI>]=<emitter>:<destination>' (e.g. '100-199=s3:bucket/prefix/')",
+			Value: (*cli.StringSlice)(&flags.Routes),
+		},
+		cli.BoolFlag{
+			Name:        "drop-unmatched",
+			Usage:       "Drop packets not matched with any route instead of sending to default emitter",
+			Destination: &flags.Processor.DropUnmatched,
+		},
+		cli.StringFlag{
+			Name:        "filter, f",
+			Usage:       "tcpdump style filter expression applied to inner packets (e.g. 'tcp port 443')",
+			Destination: &flags.Processor.Filter,
+		},
+		cli.StringFlag{
+			Name: "target, t", Value: "packet",
+			Usage:       "Record unit [packet,session], session is available only for json",
+			Destination: &flags.Processor.DumperArgs.Target,
+		},
+		cli.IntFlag{
+			Name: "session-idle-timeout", Value: vxcap.DefaultSessionIdleTimeout,
+			Usage:       "Seconds to close session without any packet",
+			Destination: &flags.Processor.SessionIdleTimeout,
+		},
+		cli.IntFlag{
+			Name: "session-active-timeout", Value: vxcap.DefaultSessionActiveTimeout,
+			Usage:       "Seconds to emit record of long lived session",
+			Destination: &flags.Processor.SessionActiveTimeout,
 		},
-		/*
-			TODO: this option is not available for now
-			cli.StringFlag{
-				Name: "target, t", Value: "packet",
-				Destination: &args.DumperArgs.Target,
-			},
-		*/
 		cli.IntFlag{
 			Name: "port, p", Value: vxcap.DefaultVxlanPort,
 			Usage:       "UDP port of VXLAN receiver",
-			Destination: &cap.RecvPort,
+			Destination: &flags.Capture.RecvPort,
+		},
+		cli.IntFlag{
+			Name:        "geneve-port",
+			Usage:       fmt.Sprintf("UDP port of GENEVE receiver, e.g. %d (disabled if 0)", vxcap.DefaultGenevePort),
+			Destination: &flags.Capture.GenevePort,
+		},
+		cli.BoolFlag{
+			Name:        "erspan",
+			Usage:       "Enable ERSPAN (type I, II and III over GRE) receiver, root privilege is required",
+			Destination: &flags.Capture.EnableERSPAN,
+		},
+		cli.StringFlag{
+			Name:        "read-file, r",
+			Usage:       "Read outer packets from pcap/pcapng file instead of receiving",
+			Destination: &flags.Capture.InputFile,
 		},
 		cli.IntFlag{
 			Name: "receiver-queue-size", Value: vxcap.DefaultReceiverQueueSize,
 			Usage:       "Queue size between UDP server and packet processor",
-			Destination: &cap.QueueSize,
+			Destination: &flags.Capture.QueueSize,
+		},
+		cli.StringFlag{
+			Name: "receiver-queue-policy", Value: vxcap.DefaultQueuePolicy,
+			Usage:       "Behavior when the queue is full [block,drop-newest,drop-oldest]",
+			Destination: &flags.Capture.QueuePolicy,
+		},
+		cli.IntFlag{
+			Name: "receivers", Value: 1,
+			Usage:       "Number of sockets for each UDP port with SO_REUSEPORT (Linux only)",
+			Destination: &flags.Capture.Receivers,
+		},
+		cli.IntFlag{
+			Name: "workers", Value: 1,
+			Usage:       "Number of workers to process packets, order of packets is not kept if more than 1",
+			Destination: &flags.Capture.Workers,
+		},
+		cli.IntFlag{
+			Name: "shutdown-timeout", Value: vxcap.DefaultShutdownTimeout,
+			Usage:       "Seconds to wait for each of draining queued packets and flush of emitters in shutdown, 0 means no timeout",
+			Destination: &flags.Capture.ShutdownTimeout,
 		},
 		// Options for fsEmitter
 		cli.StringFlag{
 			Name: "fs-filename", Value: "dump",
-			Usage:       "Base file name for FS emitter",
-			Destination: &args.EmitterArgs.FsFileName,
+			Usage:       "Base file name for FS emitter, strftime format (e.g. dump_%Y%m%d_%H%M%S.pcap) is available",
+			Destination: &flags.Processor.EmitterArgs.FsFileName,
 		},
 		cli.StringFlag{
 			Name: "fs-dirpath", Value: ".",
 			Usage:       "Output directory for FS emitter",
-			Destination: &args.EmitterArgs.FsDirPath,
+			Destination: &flags.Processor.EmitterArgs.FsDirPath,
+		},
+		cli.IntFlag{
+			Name: "fs-rotate-size", Value: 0, // Not rotate
+			Usage:       "Threshold size (bytes) of file rotation for FS emitter",
+			Destination: &flags.Processor.EmitterArgs.FsRotateSize,
+		},
+		cli.IntFlag{
+			Name: "fs-rotate-count", Value: 0, // Not rotate
+			Usage:       "Threshold packet count of file rotation for FS emitter",
+			Destination: &flags.Processor.EmitterArgs.FsRotateCount,
+		},
+		cli.IntFlag{
+			Name: "fs-rotate-interval", Value: 0, // Not rotate
+			Usage:       "Interval (seconds) of file rotation for FS emitter, rotated at every boundary",
+			Destination: &flags.Processor.EmitterArgs.FsRotateInterval,
+		},
+		cli.IntFlag{
+			Name:        "fs-ring-files",
+			Usage:       "Keep only newest N rotated files in ring buffer mode for FS emitter",
+			Destination: &flags.Processor.EmitterArgs.FsRingFiles,
+		},
+		cli.IntFlag{
+			Name:        "fs-ring-size",
+			Usage:       "Keep total size (bytes) of rotated files under the value in ring buffer mode for FS emitter",
+			Destination: &flags.Processor.EmitterArgs.FsRingSize,
 		},
-		/*
-			TODO: Implement rotation mechanism
-			cli.IntFlag{
-				Name: "fs-rotate-size", Value: 0, // Not rotate
-				Usage:       "Threshold size of file rotation for FS emitter",
-				Destination: &args.EmitterArgs.FsRotateSize,
-			},
-		*/
 
 		// Options for AWS emitter
 		cli.StringFlag{
 			Name:        "aws-region",
 			Usage:       "AWS region for emitter to AWS",
-			Destination: &args.EmitterArgs.AwsRegion,
+			Destination: &flags.Processor.EmitterArgs.AwsRegion,
+		},
+		cli.StringFlag{
+			Name:        "aws-profile",
+			Usage:       "Profile name of AWS shared config and credentials files",
+			Destination: &flags.Processor.EmitterArgs.AwsProfile,
+		},
+		cli.StringFlag{
+			Name:        "aws-access-key-id",
+			Usage:       "Access key ID of static AWS credentials",
+			Destination: &flags.Processor.EmitterArgs.AwsAccessKeyID,
+		},
+		cli.StringFlag{
+			Name:        "aws-secret-access-key",
+			Usage:       "Secret access key of static AWS credentials",
+			Destination: &flags.Processor.EmitterArgs.AwsSecretAccessKey,
+		},
+		cli.StringFlag{
+			Name:        "aws-session-token",
+			Usage:       "Session token of static AWS credentials",
+			Destination: &flags.Processor.EmitterArgs.AwsSessionToken,
+		},
+		cli.StringFlag{
+			Name:        "aws-assume-role-arn",
+			Usage:       "ARN of IAM role to assume for emitter to AWS",
+			Destination: &flags.Processor.EmitterArgs.AwsAssumeRoleARN,
+		},
+		cli.StringFlag{
+			Name:        "aws-ca-bundle",
+			Usage:       "Path of CA certificates (PEM) to verify endpoint of AWS (or S3 compatible) service",
+			Destination: &flags.Processor.EmitterArgs.AwsCABundle,
 		},
 		// == s3Emitter
 		cli.StringFlag{
 			Name:        "aws-s3-bucket",
 			Usage:       "AWS S3 bucket name for S3 emitter",
-			Destination: &args.EmitterArgs.AwsS3Bucket,
+			Destination: &flags.Processor.EmitterArgs.AwsS3Bucket,
 		},
 		cli.StringFlag{
 			Name:        "aws-s3-prefix",
 			Usage:       "Prefix of AWS S3 object key for S3 emitter",
-			Destination: &args.EmitterArgs.AwsS3Prefix,
+			Destination: &flags.Processor.EmitterArgs.AwsS3Prefix,
 		},
 		cli.BoolFlag{
 			Name:        "aws-s3-add-time-key",
 			Usage:       "Enable to add time key to S3 object key for S3 emitter",
-			Destination: &args.EmitterArgs.AwsS3AddTimeKey,
+			Destination: &flags.Processor.EmitterArgs.AwsS3AddTimeKey,
+		},
+		cli.StringFlag{
+			Name:        "aws-s3-key-template",
+			Usage:       "Template of S3 object key (e.g. '{prefix}/vni={vni}/dt={yyyy-MM-dd}/{start}_{uuid}.{ext}')",
+			Destination: &flags.Processor.EmitterArgs.AwsS3KeyTemplate,
 		},
 		cli.IntFlag{
 			Name:        "aws-s3-flush-count",
 			Usage:       "Threshold of record number to flush object to AWS S3 bucket",
-			Destination: &args.EmitterArgs.AwsS3FlushCount,
+			Destination: &flags.Processor.EmitterArgs.AwsS3FlushCount,
 		},
 		cli.IntFlag{
 			Name:        "aws-s3-flush-interval",
 			Usage:       "Flush interval (seconds) to AWS S3 bucket",
-			Destination: &args.EmitterArgs.AwsS3FlushInterval,
+			Destination: &flags.Processor.EmitterArgs.AwsS3FlushInterval,
+		},
+		cli.StringFlag{
+			Name:        "aws-s3-endpoint",
+			Usage:       "Endpoint URL of S3 compatible service (e.g. 'http://localhost:9000' for MinIO)",
+			Destination: &flags.Processor.EmitterArgs.AwsS3Endpoint,
+		},
+		cli.BoolFlag{
+			Name:        "aws-s3-force-path-style",
+			Usage:       "Use path style addressing (e.g. 'https://endpoint/bucket/key') for S3",
+			Destination: &flags.Processor.EmitterArgs.AwsS3ForcePathStyle,
+		},
+		cli.StringFlag{
+			Name:        "aws-s3-sse",
+			Usage:       "Server side encryption of S3 object [AES256,aws:kms]",
+			Destination: &flags.Processor.EmitterArgs.AwsS3SSE,
+		},
+		cli.StringFlag{
+			Name:        "aws-s3-sse-kms-key-id",
+			Usage:       "KMS key ID (or ARN) for aws:kms encryption of S3 object",
+			Destination: &flags.Processor.EmitterArgs.AwsS3SSEKMSKeyID,
+		},
+		cli.StringFlag{
+			Name:        "aws-s3-storage-class",
+			Usage:       "Storage class of S3 object (e.g. STANDARD_IA, GLACIER_IR)",
+			Destination: &flags.Processor.EmitterArgs.AwsS3StorageClass,
+		},
+		cli.StringFlag{
+			Name:        "aws-s3-content-type",
+			Usage:       "Content-Type of S3 object, default is by format (e.g. application/vnd.tcpdump.pcap)",
+			Destination: &flags.Processor.EmitterArgs.AwsS3ContentType,
+		},
+		cli.StringFlag{
+			Name:        "aws-s3-content-encoding",
+			Usage:       "Content-Encoding of S3 object",
+			Destination: &flags.Processor.EmitterArgs.AwsS3ContentEncoding,
+		},
+		cli.StringFlag{
+			Name:        "aws-s3-tags",
+			Usage:       "Comma separated tags of S3 object (e.g. 'env=prod,team=sec')",
+			Destination: &lists["aws-s3-tags"].value,
+		},
+		cli.StringFlag{
+			Name:        "aws-s3-sensor-id",
+			Usage:       "Sensor ID in metadata of S3 object, default is host name",
+			Destination: &flags.Processor.EmitterArgs.AwsS3SensorID,
 		},
 		// == firehoseEmitter
 		cli.StringFlag{
 			Name:        "aws-firehose-name",
 			Usage:       "Name of AWS Firehose for Firehose emitter",
-			Destination: &args.EmitterArgs.AwsFirehoseName,
+			Destination: &flags.Processor.EmitterArgs.AwsFirehoseName,
 		},
 		cli.IntFlag{
 			Name:        "aws-firehose-flush-size",
 			Usage:       "Threshold of record size to flush object to AWS Firehose",
-			Destination: &args.EmitterArgs.AwsFirehoseFlushSize,
+			Destination: &flags.Processor.EmitterArgs.AwsFirehoseFlushSize,
 		},
 		cli.IntFlag{
 			Name:        "aws-firehose-flush-interval",
 			Usage:       "Flush interval (seconds) to AWS Firehose",
-			Destination: &args.EmitterArgs.AwsS3FlushInterval,
+			Destination: &flags.Processor.EmitterArgs.AwsFirehoseFlushInterval,
+		},
+		// == kinesisEmitter
+		cli.StringFlag{
+			Name:        "aws-kinesis-stream-name",
+			Usage:       "Name of AWS Kinesis Data Streams for Kinesis emitter",
+			Destination: &flags.Processor.EmitterArgs.AwsKinesisStreamName,
+		},
+		cli.IntFlag{
+			Name:        "aws-kinesis-flush-size",
+			Usage:       "Threshold of record size to flush records to AWS Kinesis Data Streams",
+			Destination: &flags.Processor.EmitterArgs.AwsKinesisFlushSize,
+		},
+		cli.IntFlag{
+			Name:        "aws-kinesis-flush-interval",
+			Usage:       "Flush interval (seconds) to AWS Kinesis Data Streams",
+			Destination: &flags.Processor.EmitterArgs.AwsKinesisFlushInterval,
+		},
+		// == kafkaEmitter
+		cli.StringFlag{
+			Name:        "kafka-brokers",
+			Usage:       "Comma separated addresses of Kafka brokers (e.g. 'kafka1:9092,kafka2:9092')",
+			Destination: &lists["kafka-brokers"].value,
+		},
+		cli.StringFlag{
+			Name:        "kafka-topic",
+			Usage:       "Topic name for Kafka emitter",
+			Destination: &flags.Processor.EmitterArgs.KafkaTopic,
+		},
+		cli.StringFlag{
+			Name:        "kafka-partition-key",
+			Usage:       "Key of Kafka message to choose partition [vni,flow,none] (default: vni)",
+			Destination: &flags.Processor.EmitterArgs.KafkaPartitionKey,
+		},
+		cli.StringFlag{
+			Name:        "kafka-compression",
+			Usage:       "Compression of Kafka message [none,gzip,snappy,lz4,zstd] (default: none)",
+			Destination: &flags.Processor.EmitterArgs.KafkaCompression,
+		},
+		cli.StringFlag{
+			Name:        "kafka-acks",
+			Usage:       "Required acks of Kafka brokers [none,leader,all] (default: leader)",
+			Destination: &flags.Processor.EmitterArgs.KafkaAcks,
+		},
+		cli.IntFlag{
+			Name:        "kafka-flush-size",
+			Usage:       "Threshold of buffered bytes to send to Kafka, also max size of a pcap chunk",
+			Destination: &flags.Processor.EmitterArgs.KafkaFlushSize,
+		},
+		cli.IntFlag{
+			Name:        "kafka-flush-interval",
+			Usage:       "Flush interval (seconds) to Kafka",
+			Destination: &flags.Processor.EmitterArgs.KafkaFlushInterval,
+		},
+		cli.BoolFlag{
+			Name:        "kafka-tls",
+			Usage:       "Enable TLS to connect Kafka brokers",
+			Destination: &flags.Processor.EmitterArgs.KafkaTLS,
+		},
+		cli.StringFlag{
+			Name:        "kafka-tls-ca-cert",
+			Usage:       "Path of CA certificate (PEM) to verify Kafka brokers",
+			Destination: &flags.Processor.EmitterArgs.KafkaTLSCACert,
+		},
+		cli.StringFlag{
+			Name:        "kafka-tls-cert",
+			Usage:       "Path of client certificate (PEM) for Kafka",
+			Destination: &flags.Processor.EmitterArgs.KafkaTLSCert,
+		},
+		cli.StringFlag{
+			Name:        "kafka-tls-key",
+			Usage:       "Path of client key (PEM) for Kafka",
+			Destination: &flags.Processor.EmitterArgs.KafkaTLSKey,
+		},
+		cli.BoolFlag{
+			Name:        "kafka-tls-skip-verify",
+			Usage:       "Skip verification of Kafka broker certificate",
+			Destination: &flags.Processor.EmitterArgs.KafkaTLSSkipVerify,
+		},
+		cli.StringFlag{
+			Name:        "kafka-sasl-mechanism",
+			Usage:       "SASL mechanism for Kafka [plain,scram-sha-256,scram-sha-512], SASL is disabled if not set",
+			Destination: &flags.Processor.EmitterArgs.KafkaSASLMechanism,
+		},
+		cli.StringFlag{
+			Name:        "kafka-sasl-user",
+			Usage:       "SASL user name for Kafka",
+			Destination: &flags.Processor.EmitterArgs.KafkaSASLUser,
+		},
+		cli.StringFlag{
+			Name:        "kafka-sasl-password",
+			Usage:       "SASL password for Kafka",
+			Destination: &flags.Processor.EmitterArgs.KafkaSASLPassword,
 		},
 
 		// Options for Dumper
+		cli.IntFlag{
+			Name:        "snaplen, s",
+			Usage:       "Max bytes to store per packet, 0 means no truncation",
+			Destination: &flags.Processor.DumperArgs.SnapLen,
+		},
 		cli.BoolFlag{
 			Name:        "enable-json-text",
 			Usage:       "Enable human readable application layer payload in json format",
-			Destination: &args.DumperArgs.EnableJSONTextPayload,
+			Destination: &flags.Processor.DumperArgs.EnableJSONTextPayload,
 		},
 		cli.BoolFlag{
 			Name:        "enable-json-raw",
 			Usage:       "Enable raw application layer payload (base64 encoded) in json format",
-			Destination: &args.DumperArgs.EnableJSONRawPayload,
+			Destination: &flags.Processor.DumperArgs.EnableJSONRawPayload,
+		},
+		cli.StringFlag{
+			Name:        "json-fields",
+			Usage:       "Comma separated fields to output in json format for packet target (e.g. 'timestamp,src_addr,dst_addr'), all fields by default",
+			Destination: &lists["json-fields"].value,
 		},
 	}
 
-	// Target option can use only "packet" for now
-	args.DumperArgs.Target = "packet"
-
 	app.Action = func(c *cli.Context) error {
-		level, ok := logLevelMap[logLevel]
-		if !ok {
-			return fmt.Errorf("Invalid log level: %s", logLevel)
+		// Config is loaded again on SIGHUP with same command line options
+		loadConfig := func() (*vxcap.Config, error) {
+			return newConfig(c, &flags, configPath, lists)
 		}
-		vxcap.Logger.SetLevel(level)
 
-		vxcap.Logger.WithFields(logrus.Fields{
-			"PacketProcessorArgument": args,
-			"logLevel":                logLevel,
-		}).Debug("Given options")
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
 
-		proc, err := vxcap.NewPacketProcessor(args)
+		proc, err := newProcessor(cfg)
 		if err != nil {
 			return err
 		}
 
-		if err := cap.Start(proc); err != nil {
+		if cfg.MetricsAddr != "" {
+			vxcap.SetSenderMetrics(cfg.MetricsPerSender)
+			server, err := vxcap.StartMetricsServer(cfg.MetricsAddr)
+			if err != nil {
+				return err
+			}
+			defer server.Close()
+		}
+
+		capture := &cfg.Capture
+		capture.ReloadProcessor = func() (vxcap.Processor, error) {
+			newCfg, err := loadConfig()
+			if err != nil {
+				return nil, err
+			}
+			if receiverChanged(cfg, newCfg) {
+				vxcap.Logger.Warn("Options of UDP server and metrics are not reloaded, restart is required")
+			}
+			return newProcessor(newCfg)
+		}
+
+		if err := capture.Start(proc); err != nil {
 			return err
 		}
 		return nil
@@ -180,3 +469,101 @@ func main() {
 		vxcap.Logger.WithError(err).Fatal("Fatal Error")
 	}
 }
+
+// newConfig builds Config. Precedence of options is command line options (only
+// explicitly set), environment variables, config file and default values.
+func newConfig(c *cli.Context, flags *vxcap.Config, configPath string, lists map[string]*listFlag) (*vxcap.Config, error) {
+	cfg := vxcap.DefaultConfig()
+	if configPath != "" {
+		if err := cfg.LoadFile(configPath); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.LoadEnv(); err != nil {
+		return nil, err
+	}
+
+	var setFlags []string
+	for _, name := range c.GlobalFlagNames() {
+		if c.IsSet(name) && name != "config" {
+			setFlags = append(setFlags, name)
+		}
+		if l, ok := lists[name]; ok && c.IsSet(name) {
+			*l.dst = splitList(l.value)
+		}
+	}
+	if err := cfg.Overwrite(flags, setFlags); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// maskSecrets returns copy of args with credentials replaced for logging.
+func maskSecrets(args vxcap.PacketProcessorArgument) vxcap.PacketProcessorArgument {
+	mask := func(e *vxcap.EmitterArguments) {
+		for _, s := range []*string{&e.AwsSecretAccessKey, &e.AwsSessionToken, &e.KafkaSASLPassword} {
+			if *s != "" {
+				*s = "********"
+			}
+		}
+	}
+
+	mask(&args.EmitterArgs)
+	args.Routes = append([]vxcap.RouteArgument{}, args.Routes...)
+	for i := range args.Routes {
+		mask(&args.Routes[i].EmitterArgs)
+	}
+	return args
+}
+
+// listFlag is a comma separated list option. value is given by command line
+// and dst is the field of flags to store split values.
+type listFlag struct {
+	value string
+	dst   *[]string
+}
+
+// splitList splits comma separated option value.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		list = append(list, strings.TrimSpace(v))
+	}
+	return list
+}
+
+// newProcessor applies log level and constructs PacketProcessor with routes.
+func newProcessor(cfg *vxcap.Config) (*vxcap.PacketProcessor, error) {
+	level, _ := logrus.ParseLevel(cfg.LogLevel) // Already validated
+	vxcap.Logger.SetLevel(level)
+
+	args := cfg.Processor
+	for _, spec := range cfg.Routes {
+		route, err := vxcap.ParseRoute(spec, args)
+		if err != nil {
+			return nil, err
+		}
+		args.Routes = append(args.Routes, route)
+	}
+
+	vxcap.Logger.WithFields(logrus.Fields{
+		"PacketProcessorArgument": maskSecrets(args),
+		"logLevel":                cfg.LogLevel,
+	}).Debug("Given options")
+
+	return vxcap.NewPacketProcessor(args)
+}
+
+// receiverChanged returns true if options not applied by reload are changed.
+func receiverChanged(oldCfg, newCfg *vxcap.Config) bool {
+	a, b := oldCfg.Capture, newCfg.Capture
+	return oldCfg.MetricsAddr != newCfg.MetricsAddr || oldCfg.MetricsPerSender != newCfg.MetricsPerSender ||
+		a.RecvPort != b.RecvPort || a.GenevePort != b.GenevePort || a.EnableERSPAN != b.EnableERSPAN ||
+		a.QueueSize != b.QueueSize || a.QueuePolicy != b.QueuePolicy ||
+		a.Receivers != b.Receivers || a.Workers != b.Workers || a.InputFile != b.InputFile ||
+		a.ShutdownTimeout != b.ShutdownTimeout
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/m-mizutani/vxcap/pkg/vxcap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaskSecrets(t *testing.T) {
+	args := vxcap.PacketProcessorArgument{
+		EmitterArgs: vxcap.EmitterArguments{
+			Name:              "kafka",
+			KafkaSASLUser:     "blue",
+			KafkaSASLPassword: "five",
+		},
+		Routes: []vxcap.RouteArgument{
+			{EmitterArgs: vxcap.EmitterArguments{KafkaSASLPassword: "six"}},
+		},
+	}
+
+	masked := maskSecrets(args)
+	assert.Equal(t, "********", masked.EmitterArgs.KafkaSASLPassword)
+	assert.Equal(t, "********", masked.Routes[0].EmitterArgs.KafkaSASLPassword)
+	assert.Equal(t, "kafka", masked.EmitterArgs.Name)
+	assert.Equal(t, "blue", masked.EmitterArgs.KafkaSASLUser)
+
+	// Original arguments are not changed
+	assert.Equal(t, "five", args.EmitterArgs.KafkaSASLPassword)
+	assert.Equal(t, "six", args.Routes[0].EmitterArgs.KafkaSASLPassword)
+
+	args = vxcap.PacketProcessorArgument{
+		EmitterArgs: vxcap.EmitterArguments{
+			Name:               "s3",
+			AwsS3Bucket:        "blue",
+			AwsAccessKeyID:     "AKIAEXAMPLE",
+			AwsSecretAccessKey: "secret",
+			AwsSessionToken:    "token",
+		},
+		Routes: []vxcap.RouteArgument{
+			{VNIFrom: 1, VNITo: 2, EmitterArgs: vxcap.EmitterArguments{AwsSecretAccessKey: "secret2"}},
+		},
+	}
+	masked = maskSecrets(args)
+	assert.Equal(t, "********", masked.EmitterArgs.AwsSecretAccessKey)
+	assert.Equal(t, "********", masked.EmitterArgs.AwsSessionToken)
+	assert.Equal(t, "********", masked.Routes[0].EmitterArgs.AwsSecretAccessKey)
+	assert.Equal(t, "", masked.Routes[0].EmitterArgs.AwsSessionToken) // Empty is kept
+	assert.Equal(t, "AKIAEXAMPLE", masked.EmitterArgs.AwsAccessKeyID)
+	assert.Equal(t, "blue", masked.EmitterArgs.AwsS3Bucket)
+	assert.Equal(t, uint32(2), masked.Routes[0].VNITo)
+	assert.Equal(t, "secret", args.EmitterArgs.AwsSecretAccessKey)
+}
@@ -0,0 +1,343 @@
+package vxcap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/caarlos0/env/v6"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is a set of options of vxcap command. Keys of configuration file
+// are same as long option names of the command (e.g. "fs-rotate-size") and
+// environment variables are upper snake case of them with "VXCAP_" prefix
+// (e.g. VXCAP_FS_ROTATE_SIZE).
+type Config struct {
+	LogLevel         string   `yaml:"log-level" env:"VXCAP_LOG_LEVEL"`
+	MetricsAddr      string   `yaml:"metrics-addr" env:"VXCAP_METRICS_ADDR"`
+	MetricsPerSender bool     `yaml:"metrics-per-sender" env:"VXCAP_METRICS_PER_SENDER"` // See SetSenderMetrics
+	Routes           []string `yaml:"route" env:"VXCAP_ROUTE" envSeparator:" "`          // Route specs for ParseRoute()
+
+	Capture   VXCap                   `yaml:",inline"`
+	Processor PacketProcessorArgument `yaml:",inline"`
+}
+
+// DefaultConfig returns Config having default values of all options.
+func DefaultConfig() *Config {
+	return &Config{
+		LogLevel: "info",
+		Capture:  *New(),
+		Processor: PacketProcessorArgument{
+			DumperArgs: DumperArguments{
+				Format: "pcap",
+				Target: "packet",
+			},
+			EmitterArgs: EmitterArguments{
+				Name:       "fs",
+				FsFileName: "dump",
+				FsDirPath:  ".",
+			},
+			SessionIdleTimeout:   DefaultSessionIdleTimeout,
+			SessionActiveTimeout: DefaultSessionActiveTimeout,
+		},
+	}
+}
+
+// LoadFile overwrites options by configuration file. The file is parsed as
+// TOML if extension is ".toml", otherwise YAML. Unknown keys are error.
+func (x *Config) LoadFile(path string) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "Fail to read config file")
+	}
+
+	if strings.ToLower(filepath.Ext(path)) == ".toml" {
+		// Convert to YAML to share keys of yaml tag including inline structs.
+		var values map[string]interface{}
+		if _, err := toml.Decode(string(raw), &values); err != nil {
+			return errors.Wrapf(err, "Fail to parse TOML config file: %s", path)
+		}
+		if raw, err = yaml.Marshal(values); err != nil {
+			return errors.Wrapf(err, "Fail to convert TOML config file: %s", path)
+		}
+	}
+
+	if err := yaml.UnmarshalStrict(raw, x); err != nil {
+		return errors.Wrapf(err, "Fail to parse config file: %s", path)
+	}
+	return nil
+}
+
+// LoadEnv overwrites options by VXCAP_* environment variables.
+func (x *Config) LoadEnv() error {
+	if err := env.Parse(x); err != nil {
+		return errors.Wrap(err, "Fail to load environment variables")
+	}
+	return nil
+}
+
+// Overwrite copies options specified by keys (e.g. "fs-dirpath") from src.
+// It's used to give priority to command line options that are explicitly set.
+func (x *Config) Overwrite(src *Config, keys []string) error {
+	dstFields := configFields(reflect.ValueOf(x).Elem())
+	srcFields := configFields(reflect.ValueOf(src).Elem())
+
+	for _, key := range keys {
+		dst, ok := dstFields[key]
+		if !ok {
+			return fmt.Errorf("Unknown config key: %s", key)
+		}
+		dst.Set(srcFields[key])
+	}
+	return nil
+}
+
+// configFields returns fields of v by key of yaml tag. Inline structs are
+// expanded.
+func configFields(v reflect.Value) map[string]reflect.Value {
+	fields := make(map[string]reflect.Value)
+
+	for i := 0; i < v.NumField(); i++ {
+		tag := v.Type().Field(i).Tag.Get("yaml")
+		if tag == "" || tag == "-" {
+			continue
+		}
+
+		if tag == ",inline" {
+			for key, field := range configFields(v.Field(i)) {
+				fields[key] = field
+			}
+			continue
+		}
+
+		fields[strings.Split(tag, ",")[0]] = v.Field(i)
+	}
+
+	return fields
+}
+
+// ConfigError has all invalid options found by Config.Validate.
+type ConfigError struct {
+	Errors []string
+}
+
+func (x *ConfigError) Error() string {
+	return "Invalid configuration: " + strings.Join(x.Errors, "; ")
+}
+
+func (x *ConfigError) add(format string, args ...interface{}) {
+	x.Errors = append(x.Errors, fmt.Sprintf(format, args...))
+}
+
+// Validate checks all options and returns *ConfigError having every invalid
+// option if any.
+func (x *Config) Validate() error {
+	var cfgErr ConfigError
+	capture, proc := x.Capture, x.Processor
+
+	if _, err := logrus.ParseLevel(x.LogLevel); err != nil {
+		cfgErr.add("log-level: %v", err)
+	}
+
+	// Receiver
+	if capture.RecvPort < 1 || 65535 < capture.RecvPort {
+		cfgErr.add("port: must be 1-65535, got %d", capture.RecvPort)
+	}
+	if capture.GenevePort < 0 || 65535 < capture.GenevePort {
+		cfgErr.add("geneve-port: must be 0-65535, got %d", capture.GenevePort)
+	} else if capture.GenevePort == capture.RecvPort {
+		cfgErr.add("geneve-port: must be different from port %d", capture.RecvPort)
+	}
+	if capture.QueueSize < 0 {
+		cfgErr.add("receiver-queue-size: must not be negative, got %d", capture.QueueSize)
+	}
+	if capture.QueuePolicy != "" {
+		if err := validateQueuePolicy(capture.QueuePolicy); err != nil {
+			cfgErr.add("receiver-queue-policy: %v", err)
+		}
+	}
+	if capture.Receivers < 1 {
+		cfgErr.add("receivers: must be 1 or more, got %d", capture.Receivers)
+	}
+	if capture.Workers < 1 {
+		cfgErr.add("workers: must be 1 or more, got %d", capture.Workers)
+	}
+	if capture.ShutdownTimeout < 0 {
+		cfgErr.add("shutdown-timeout: must not be negative, got %d", capture.ShutdownTimeout)
+	}
+
+	// Processor
+	if _, err := compileFilter(proc.Filter); err != nil {
+		cfgErr.add("filter: %v", err)
+	}
+	if proc.SessionIdleTimeout < 0 {
+		cfgErr.add("session-idle-timeout: must not be negative, got %d", proc.SessionIdleTimeout)
+	}
+	if proc.SessionActiveTimeout < 0 {
+		cfgErr.add("session-active-timeout: must not be negative, got %d", proc.SessionActiveTimeout)
+	}
+	if proc.DropUnmatched && len(x.Routes) == 0 && len(proc.Routes) == 0 {
+		cfgErr.add("drop-unmatched: route is required")
+	}
+	for _, spec := range x.Routes {
+		route, err := ParseRoute(spec, proc)
+		if err != nil {
+			cfgErr.add("route: %v", err)
+			continue
+		}
+		validateOutput(&cfgErr, "route "+spec+": ", route.DumperArgs, route.EmitterArgs)
+	}
+
+	if !proc.DropUnmatched {
+		validateOutput(&cfgErr, "", proc.DumperArgs, proc.EmitterArgs)
+	}
+
+	if len(cfgErr.Errors) > 0 {
+		return &cfgErr
+	}
+	return nil
+}
+
+// validateOutput checks options of a pair of dumper and emitter.
+func validateOutput(cfgErr *ConfigError, prefix string, dumperArgs DumperArguments, emitterArgs EmitterArguments) {
+	modeKey := emitterModeKey{
+		Emitter: emitterArgs.Name,
+		Format:  dumperArgs.Format,
+		Target:  dumperArgs.Target,
+	}
+	if _, ok := lookupEmitterParams(modeKey); !ok {
+		cfgErr.add("%semitter, dumper and target: combination of %s, %s and %s is not supported",
+			prefix, emitterArgs.Name, dumperArgs.Format, dumperArgs.Target)
+	}
+
+	if dumperArgs.SnapLen < 0 {
+		cfgErr.add("%ssnaplen: must not be negative, got %d", prefix, dumperArgs.SnapLen)
+	}
+	if err := validateJSONFields(dumperArgs.JSONFields); err != nil {
+		cfgErr.add("%sjson-fields: %v", prefix, err)
+	} else if len(dumperArgs.JSONFields) > 0 && dumperArgs.Target == "session" {
+		cfgErr.add("%sjson-fields: not available for session target", prefix)
+	}
+
+	for _, opt := range []struct {
+		key   string
+		value int
+	}{
+		{"fs-rotate-size", emitterArgs.FsRotateSize},
+		{"fs-rotate-count", emitterArgs.FsRotateCount},
+		{"fs-rotate-interval", emitterArgs.FsRotateInterval},
+		{"fs-ring-files", emitterArgs.FsRingFiles},
+		{"fs-ring-size", emitterArgs.FsRingSize},
+		{"aws-s3-flush-count", emitterArgs.AwsS3FlushCount},
+		{"aws-s3-flush-interval", emitterArgs.AwsS3FlushInterval},
+		{"aws-firehose-flush-size", emitterArgs.AwsFirehoseFlushSize},
+		{"aws-firehose-flush-interval", emitterArgs.AwsFirehoseFlushInterval},
+		{"aws-kinesis-flush-size", emitterArgs.AwsKinesisFlushSize},
+		{"aws-kinesis-flush-interval", emitterArgs.AwsKinesisFlushInterval},
+		{"kafka-flush-size", emitterArgs.KafkaFlushSize},
+		{"kafka-flush-interval", emitterArgs.KafkaFlushInterval},
+	} {
+		if opt.value < 0 {
+			cfgErr.add("%s%s: must not be negative, got %d", prefix, opt.key, opt.value)
+		}
+	}
+
+	switch emitterArgs.Name {
+	case "fs":
+		if (emitterArgs.FsRingFiles > 0 || emitterArgs.FsRingSize > 0) &&
+			emitterArgs.FsRotateSize <= 0 && emitterArgs.FsRotateCount <= 0 && emitterArgs.FsRotateInterval <= 0 {
+			cfgErr.add("%sfs-ring-files and fs-ring-size: rotation by size, count or interval is required", prefix)
+		}
+
+	case "s3":
+		if emitterArgs.AwsRegion == "" {
+			cfgErr.add("%saws-region: required for s3 emitter", prefix)
+		}
+		if emitterArgs.AwsS3Bucket == "" {
+			cfgErr.add("%saws-s3-bucket: required for s3 emitter", prefix)
+		}
+		if ep := emitterArgs.AwsS3Endpoint; ep != "" {
+			if u, err := url.Parse(ep); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				cfgErr.add("%saws-s3-endpoint: must be URL of http or https, got %q", prefix, ep)
+			}
+		}
+		switch emitterArgs.AwsS3SSE {
+		case "", s3SSEAES256, s3SSEKMS:
+		default:
+			cfgErr.add("%saws-s3-sse: must be %s or %s, got %q", prefix, s3SSEAES256, s3SSEKMS, emitterArgs.AwsS3SSE)
+		}
+		if emitterArgs.AwsS3SSEKMSKeyID != "" && emitterArgs.AwsS3SSE != s3SSEKMS {
+			cfgErr.add("%saws-s3-sse-kms-key-id: aws-s3-sse must be %s", prefix, s3SSEKMS)
+		}
+		if emitterArgs.AwsS3KeyTemplate != "" {
+			if _, err := parseS3KeyTemplate(emitterArgs.AwsS3KeyTemplate); err != nil {
+				cfgErr.add("%saws-s3-key-template: %v", prefix, err)
+			}
+			if emitterArgs.AwsS3AddTimeKey {
+				cfgErr.add("%saws-s3-add-time-key: can not be used with aws-s3-key-template", prefix)
+			}
+		}
+		if _, err := encodeS3Tags(emitterArgs.AwsS3Tags); err != nil {
+			cfgErr.add("%saws-s3-tags: %v", prefix, err)
+		}
+		validateAwsCredentials(cfgErr, prefix, emitterArgs)
+
+	case "firehose":
+		if emitterArgs.AwsRegion == "" {
+			cfgErr.add("%saws-region: required for firehose emitter", prefix)
+		}
+		if emitterArgs.AwsFirehoseName == "" {
+			cfgErr.add("%saws-firehose-name: required for firehose emitter", prefix)
+		}
+		validateAwsCredentials(cfgErr, prefix, emitterArgs)
+
+	case "kinesis":
+		if emitterArgs.AwsRegion == "" {
+			cfgErr.add("%saws-region: required for kinesis emitter", prefix)
+		}
+		if emitterArgs.AwsKinesisStreamName == "" {
+			cfgErr.add("%saws-kinesis-stream-name: required for kinesis emitter", prefix)
+		}
+		validateAwsCredentials(cfgErr, prefix, emitterArgs)
+
+	case "kafka":
+		if len(emitterArgs.KafkaBrokers) == 0 {
+			cfgErr.add("%skafka-brokers: required for kafka emitter", prefix)
+		}
+		if emitterArgs.KafkaTopic == "" {
+			cfgErr.add("%skafka-topic: required for kafka emitter", prefix)
+		}
+		if err := validateKafkaPartitionKey(emitterArgs.KafkaPartitionKey); err != nil {
+			cfgErr.add("%skafka-partition-key: %v", prefix, err)
+		}
+		if _, err := parseKafkaCompression(emitterArgs.KafkaCompression); err != nil {
+			cfgErr.add("%skafka-compression: %v", prefix, err)
+		}
+		if _, err := parseKafkaAcks(emitterArgs.KafkaAcks); err != nil {
+			cfgErr.add("%skafka-acks: %v", prefix, err)
+		}
+		if _, err := parseKafkaSASLMechanism(emitterArgs.KafkaSASLMechanism); err != nil {
+			cfgErr.add("%skafka-sasl-mechanism: %v", prefix, err)
+		}
+	}
+}
+
+// validateAwsCredentials checks credential options of AWS emitters.
+func validateAwsCredentials(cfgErr *ConfigError, prefix string, emitterArgs EmitterArguments) {
+	if (emitterArgs.AwsAccessKeyID == "") != (emitterArgs.AwsSecretAccessKey == "") {
+		cfgErr.add("%saws-access-key-id and aws-secret-access-key: both are required for static credentials", prefix)
+	}
+	if emitterArgs.AwsSessionToken != "" && emitterArgs.AwsAccessKeyID == "" {
+		cfgErr.add("%saws-session-token: aws-access-key-id and aws-secret-access-key are required", prefix)
+	}
+	if emitterArgs.AwsAccessKeyID != "" && emitterArgs.AwsProfile != "" {
+		cfgErr.add("%saws-profile: can not be used with static credentials", prefix)
+	}
+}
@@ -0,0 +1,190 @@
+package vxcap_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/m-mizutani/vxcap/pkg/vxcap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfigFile(t *testing.T, name, data string) (string, func()) {
+	dir, err := ioutil.TempDir("", "vxcap_config")
+	require.NoError(t, err)
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, []byte(data), 0644))
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func setEnv(t *testing.T, key, value string) func() {
+	require.NoError(t, os.Setenv(key, value))
+	return func() { os.Unsetenv(key) }
+}
+
+func TestConfigDefault(t *testing.T) {
+	cfg := vxcap.DefaultConfig()
+	assert.NoError(t, cfg.Validate())
+	assert.Equal(t, vxcap.DefaultVxlanPort, cfg.Capture.RecvPort)
+	assert.Equal(t, "fs", cfg.Processor.EmitterArgs.Name)
+	assert.Equal(t, "pcap", cfg.Processor.DumperArgs.Format)
+}
+
+func TestConfigLoadYAML(t *testing.T) {
+	path, cleanup := writeConfigFile(t, "vxcap.yml", `
+log-level: debug
+port: 14789
+receiver-queue-policy: drop-oldest
+emitter: s3
+dumper: json
+json-fields: [timestamp, src_addr]
+aws-region: ap-northeast-1
+aws-s3-bucket: my-bucket
+aws-firehose-flush-interval: 30
+route:
+  - "100=fs:/var/log/vxcap/a.json"
+`)
+	defer cleanup()
+
+	cfg := vxcap.DefaultConfig()
+	require.NoError(t, cfg.LoadFile(path))
+	assert.Equal(t, "debug", cfg.LogLevel)
+	assert.Equal(t, 14789, cfg.Capture.RecvPort)
+	assert.Equal(t, vxcap.QueuePolicyDropOldest, cfg.Capture.QueuePolicy)
+	assert.Equal(t, "s3", cfg.Processor.EmitterArgs.Name)
+	assert.Equal(t, "json", cfg.Processor.DumperArgs.Format)
+	assert.Equal(t, []string{"timestamp", "src_addr"}, cfg.Processor.DumperArgs.JSONFields)
+	assert.Equal(t, "my-bucket", cfg.Processor.EmitterArgs.AwsS3Bucket)
+	assert.Equal(t, 30, cfg.Processor.EmitterArgs.AwsFirehoseFlushInterval)
+	assert.Equal(t, 0, cfg.Processor.EmitterArgs.AwsS3FlushInterval)
+	assert.Equal(t, []string{"100=fs:/var/log/vxcap/a.json"}, cfg.Routes)
+	// Not specified options keep default values
+	assert.Equal(t, "packet", cfg.Processor.DumperArgs.Target)
+	assert.Equal(t, vxcap.DefaultReceiverQueueSize, cfg.Capture.QueueSize)
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestConfigLoadTOML(t *testing.T) {
+	path, cleanup := writeConfigFile(t, "vxcap.toml", `
+port = 14789
+erspan = true
+fs-dirpath = "/var/log/vxcap"
+fs-rotate-size = 1048576
+route = ["100=fs:/tmp/a.pcap", "200=fs:/tmp/b.pcap"]
+`)
+	defer cleanup()
+
+	cfg := vxcap.DefaultConfig()
+	require.NoError(t, cfg.LoadFile(path))
+	assert.Equal(t, 14789, cfg.Capture.RecvPort)
+	assert.True(t, cfg.Capture.EnableERSPAN)
+	assert.Equal(t, "/var/log/vxcap", cfg.Processor.EmitterArgs.FsDirPath)
+	assert.Equal(t, 1048576, cfg.Processor.EmitterArgs.FsRotateSize)
+	assert.Equal(t, 2, len(cfg.Routes))
+}
+
+func TestConfigLoadUnknownKey(t *testing.T) {
+	path, cleanup := writeConfigFile(t, "vxcap.yml", "fs-dir-path: /tmp\n")
+	defer cleanup()
+
+	cfg := vxcap.DefaultConfig()
+	assert.Error(t, cfg.LoadFile(path))
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path, cleanup := writeConfigFile(t, "vxcap.yml", `
+port: 10001
+workers: 2
+fs-dirpath: /from/file
+`)
+	defer cleanup()
+	defer setEnv(t, "VXCAP_WORKERS", "3")()
+	defer setEnv(t, "VXCAP_FS_DIRPATH", "/from/env")()
+	defer setEnv(t, "VXCAP_JSON_FIELDS", "timestamp,vni")()
+
+	cfg := vxcap.DefaultConfig()
+	require.NoError(t, cfg.LoadFile(path))
+	require.NoError(t, cfg.LoadEnv())
+
+	var flags vxcap.Config
+	flags.Processor.EmitterArgs.FsDirPath = "/from/flag"
+	flags.Capture.RecvPort = 10002 // Not overwritten because not in keys
+	require.NoError(t, cfg.Overwrite(&flags, []string{"fs-dirpath"}))
+
+	assert.Equal(t, 10001, cfg.Capture.RecvPort)                           // file
+	assert.Equal(t, 3, cfg.Capture.Workers)                                // env
+	assert.Equal(t, "/from/flag", cfg.Processor.EmitterArgs.FsDirPath)     // flag
+	assert.Equal(t, vxcap.DefaultReceiverQueueSize, cfg.Capture.QueueSize) // default
+	assert.Equal(t, []string{"timestamp", "vni"}, cfg.Processor.DumperArgs.JSONFields)
+
+	assert.Error(t, cfg.Overwrite(&flags, []string{"no-such-option"}))
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := vxcap.DefaultConfig()
+	cfg.LogLevel = "verbose"
+	cfg.Capture.RecvPort = 70000
+	cfg.Capture.QueuePolicy = "drop-all"
+	cfg.Capture.Workers = 0
+	cfg.Capture.ShutdownTimeout = -1
+	cfg.Processor.Filter = "tcp port"
+	cfg.Processor.EmitterArgs.Name = "firehose"
+	cfg.Processor.DumperArgs.JSONFields = []string{"no_such_field"}
+	cfg.Routes = []string{"100=s3:bucket", "abc=fs:/tmp/a.pcap", "200=kafka:topic", "300=kinesis:stream"}
+	cfg.Processor.EmitterArgs.KafkaCompression = "brotli"
+	cfg.Processor.EmitterArgs.AwsS3Endpoint = "localhost:9000"
+	cfg.Processor.EmitterArgs.AwsAccessKeyID = "AKIDEXAMPLE"
+	cfg.Processor.EmitterArgs.AwsS3SSE = "kms"
+	cfg.Processor.EmitterArgs.AwsS3Tags = []string{"team"}
+	cfg.Processor.EmitterArgs.AwsS3KeyTemplate = "{prefix}/{vni}.{ext}"
+
+	err := cfg.Validate()
+	require.Error(t, err)
+	cfgErr, ok := err.(*vxcap.ConfigError)
+	require.True(t, ok)
+
+	// All invalid options are reported at once
+	for _, msg := range []string{
+		"log-level: ",
+		"port: must be 1-65535, got 70000",
+		"receiver-queue-policy: ",
+		"workers: must be 1 or more, got 0",
+		"shutdown-timeout: must not be negative, got -1",
+		"filter: ",
+		"route: Invalid VNI: abc",
+		"route 100=s3:bucket: aws-region: required for s3 emitter",
+		"route 100=s3:bucket: json-fields: Unknown JSON field: no_such_field",
+		"route 300=kinesis:stream: aws-region: required for kinesis emitter",
+		"route 100=s3:bucket: aws-s3-endpoint: must be URL of http or https",
+		"route 100=s3:bucket: aws-access-key-id and aws-secret-access-key: both are required",
+		"route 100=s3:bucket: aws-s3-sse: must be AES256 or aws:kms",
+		"route 100=s3:bucket: aws-s3-tags: Tag must be 'key=value'",
+		"route 100=s3:bucket: aws-s3-key-template: S3 key template must have {uuid}",
+		"route 200=kafka:topic: kafka-brokers: required for kafka emitter",
+		"route 200=kafka:topic: kafka-compression: Invalid compression: \"brotli\"",
+		"emitter, dumper and target: combination of firehose, pcap and packet is not supported",
+		"aws-firehose-name: required for firehose emitter",
+	} {
+		found := false
+		for _, e := range cfgErr.Errors {
+			if strings.HasPrefix(e, msg) {
+				found = true
+			}
+		}
+		assert.True(t, found, "%q is not in %v", msg, cfgErr.Errors)
+	}
+}
+
+func TestConfigValidateJSONFieldsForSession(t *testing.T) {
+	cfg := vxcap.DefaultConfig()
+	cfg.Processor.DumperArgs.Format = "json"
+	cfg.Processor.DumperArgs.Target = "session"
+	cfg.Processor.DumperArgs.JSONFields = []string{"src_addr"}
+
+	err := cfg.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "json-fields: not available for session target")
+}
@@ -1,37 +1,67 @@
 package vxcap
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
+	"reflect"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/gopacket/layers"
 	"github.com/pkg/errors"
 	"honnef.co/go/pcap"
 )
 
-type dumper interface {
-	open(io.Writer) error
-	dump([]*packetData, io.Writer) error
-	close(io.Writer) error
+// Dumper encodes packets (or session records) to a stream. Open is called
+// when a new stream (e.g. file, S3 object) starts, Dump for every batch of
+// packets and Close before the stream ends. A Dumper is used by only one
+// emitter and calls are serialized by PacketProcessor.
+type Dumper interface {
+	Open(w io.Writer) error
+	Dump(packets []*Packet, w io.Writer) error
+	Close(w io.Writer) error
 }
 
-type dumperConstructor func(DumperArguments) dumper
+// DumperConstructor creates a Dumper with arguments. It can be registered by
+// RegisterDumper.
+type DumperConstructor func(args DumperArguments) (Dumper, error)
+
+type dumperConstructor func(DumperArguments) Dumper
 
 // DumperArguments is arguments for constructor of dumper.
 type DumperArguments struct {
-	Format string
-	Target string // packet or session
+	Format string `yaml:"dumper" env:"VXCAP_DUMPER"`
+	Target string `yaml:"target" env:"VXCAP_TARGET"` // packet or session
+
+	EnableJSONTextPayload bool     `yaml:"enable-json-text" env:"VXCAP_ENABLE_JSON_TEXT"`
+	EnableJSONRawPayload  bool     `yaml:"enable-json-raw" env:"VXCAP_ENABLE_JSON_RAW"`
+	JSONFields            []string `yaml:"json-fields" env:"VXCAP_JSON_FIELDS"` // Output only the fields of JSON packet record if specified
 
-	EnableJSONTextPayload bool
-	EnableJSONRawPayload  bool
+	// SnapLen is max length of stored bytes per packet. Bytes of pcap record
+	// and payload of JSON are truncated to SnapLen. 0 means no truncation.
+	SnapLen int `yaml:"snaplen" env:"VXCAP_SNAPLEN"`
+}
+
+// snapData returns data truncated to snapLen. data is returned as is if
+// snapLen is 0 or data is shorter than snapLen.
+func snapData(data []byte, snapLen int) []byte {
+	if snapLen > 0 && len(data) > snapLen {
+		return data[:snapLen]
+	}
+	return data
 }
 
 var dumperMap = map[dumperKey]dumperConstructor{
-	{Format: "json", Target: "packet"}:   newJSONPacketDumper,
-	{Format: "ndjson", Target: "packet"}: newNdJSONPacketDumper,
-	{Format: "pcap", Target: "packet"}:   newPcapDumper,
+	{Format: "json", Target: "packet"}:    newJSONPacketDumper,
+	{Format: "ndjson", Target: "packet"}:  newNdJSONPacketDumper,
+	{Format: "pcap", Target: "packet"}:    newPcapDumper,
+	{Format: "pcapng", Target: "packet"}:  newPcapngDumper,
+	{Format: "json", Target: "session"}:   newJSONSessionDumper,
+	{Format: "ndjson", Target: "session"}: newNdJSONSessionDumper,
 }
 
 type dumperKey struct {
@@ -39,40 +69,78 @@ type dumperKey struct {
 	Target string // packet or session
 }
 
-func newDumper(args DumperArguments) (dumper, error) {
+func newDumper(args DumperArguments) (Dumper, error) {
 	key := dumperKey{
 		Format: args.Format,
 		Target: args.Target,
 	}
-	constructor, ok := dumperMap[key]
+
+	if builtin, ok := dumperMap[key]; ok {
+		if len(args.JSONFields) > 0 {
+			if args.Target != "packet" {
+				return nil, fmt.Errorf("JSONFields is available only for packet target")
+			}
+			if err := validateJSONFields(args.JSONFields); err != nil {
+				return nil, err
+			}
+		}
+		return builtin(args), nil
+	}
+
+	constructor, ok := lookupDumperPlugin(key)
 	if !ok {
 		return nil, fmt.Errorf("The pair is not supported: %v", key)
 	}
 
-	return constructor(args), nil
+	dumper, err := constructor(args)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to create dumper %s for %s", args.Format, args.Target)
+	}
+	if dumper == nil {
+		return nil, fmt.Errorf("Dumper constructor for %v returned nil", key)
+	}
+	return dumper, nil
 }
 
 type baseDumper struct{}
 
-func (x *baseDumper) open(io.Writer) error  { return nil }
-func (x *baseDumper) close(io.Writer) error { return nil }
+func (x *baseDumper) Open(io.Writer) error  { return nil }
+func (x *baseDumper) Close(io.Writer) error { return nil }
 
 type jsonPacketDumper struct {
 	baseDumper
 	args    DumperArguments
+	fields  []jsonField // Selected by JSONFields, nil means all fields
 	newline bool
 }
 
-func newJSONPacketDumper(args DumperArguments) dumper {
-	return &jsonPacketDumper{args: args, newline: false}
+func newJSONPacketDumper(args DumperArguments) Dumper {
+	return &jsonPacketDumper{args: args, fields: selectJSONFields(args.JSONFields), newline: false}
 }
 
 // NdJSON stands for Newline Delimitered JSON. This dumper add a new line "\n" between JSON records.
-func newNdJSONPacketDumper(args DumperArguments) dumper {
-	return &jsonPacketDumper{args: args, newline: true}
+func newNdJSONPacketDumper(args DumperArguments) Dumper {
+	return &jsonPacketDumper{args: args, fields: selectJSONFields(args.JSONFields), newline: true}
 }
 
 type jsonRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+
+	// Tunnel
+	VNI          uint32 `json:"vni,omitempty"`
+	OuterSrcAddr string `json:"outer_src_addr,omitempty"`
+	OuterSrcPort int    `json:"outer_src_port,omitempty"`
+	OuterDstPort int    `json:"outer_dst_port,omitempty"`
+
+	// Length
+	FrameLength int  `json:"frame_len"`           // Original length of inner frame
+	Truncated   bool `json:"truncated,omitempty"` // Payload is truncated by snap length
+
+	// Ethernet
+	SrcMAC string   `json:"src_mac,omitempty"`
+	DstMAC string   `json:"dst_mac,omitempty"`
+	VLAN   []uint16 `json:"vlan,omitempty"` // VLAN IDs from outer to inner
+
 	// Five tuple
 	Protocol string `json:"proto"`
 	SrcAddr  string `json:"src_addr"`
@@ -80,52 +148,276 @@ type jsonRecord struct {
 	SrcPort  int    `json:"src_port,omitempty"`
 	DstPort  int    `json:"dst_port,omitempty"`
 
+	// IP. Pointer fields are set only if the packet has the header.
+	IPTTL       uint8   `json:"ip_ttl,omitempty"` // Hop limit for IPv6
+	IPID        *uint16 `json:"ip_id,omitempty"`
+	IPDSCP      *uint8  `json:"ip_dscp,omitempty"`
+	IPFlags     string  `json:"ip_flags,omitempty"` // DF and/or MF
+	IPFlowLabel uint32  `json:"ip6_flow_label,omitempty"`
+
 	// TCP
-	TCPFlag string `json:"tcp_flag,omitempty"`
-	TCPSeq  uint32 `json:"tcp_seq,omitempty"`
+	TCPFlag    string   `json:"tcp_flag,omitempty"`
+	TCPSeq     uint32   `json:"tcp_seq,omitempty"`
+	TCPAck     uint32   `json:"tcp_ack,omitempty"`
+	TCPWindow  *uint16  `json:"tcp_window,omitempty"`
+	TCPOptions []string `json:"tcp_options,omitempty"` // e.g. ["MSS=1460", "SACKPermitted"]
+
+	// ICMP and ICMPv6
+	ICMPType *uint8 `json:"icmp_type,omitempty"`
+	ICMPCode *uint8 `json:"icmp_code,omitempty"`
+
+	// UDP
+	UDPLength uint16 `json:"udp_len,omitempty"`
 
 	// Data part
 	TextPayload string `json:"text,omitempty"`
 	RawPayload  []byte `json:"raw,omitempty"`
 }
 
-func (x *jsonPacketDumper) dump(packets []*packetData, w io.Writer) error {
-	for _, pkt := range packets {
-		var record jsonRecord
-		if netLayer := (*pkt.Packet).NetworkLayer(); netLayer != nil {
-			netFlow := netLayer.NetworkFlow()
-			src, dst := netFlow.Endpoints()
-			record.SrcAddr = src.String()
-			record.DstAddr = dst.String()
-
-			if ipv4, ok := netLayer.(*layers.IPv4); ok {
-				record.Protocol = ipv4.Protocol.String()
-			} else if ipv6, ok := netLayer.(*layers.IPv6); ok {
-				record.Protocol = ipv6.NextHeader.String()
-			}
+// jsonField is a field of jsonRecord to be encoded.
+type jsonField struct {
+	name      string
+	index     int // Index of struct field
+	omitEmpty bool
+}
+
+// jsonRecordFields returns all JSON fields of jsonRecord in order of struct.
+func jsonRecordFields() []jsonField {
+	var fields []jsonField
+	t := reflect.TypeOf(jsonRecord{})
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")
+		fields = append(fields, jsonField{
+			name:      tag[0],
+			index:     i,
+			omitEmpty: len(tag) > 1 && tag[1] == "omitempty",
+		})
+	}
+	return fields
+}
+
+// selectJSONFields returns fields of jsonRecord in names. Order of jsonRecord
+// is kept. It returns nil if names is empty.
+func selectJSONFields(names []string) []jsonField {
+	if len(names) == 0 {
+		return nil
+	}
+
+	selected := make(map[string]bool)
+	for _, name := range names {
+		selected[name] = true
+	}
+
+	var fields []jsonField
+	for _, f := range jsonRecordFields() {
+		if selected[f.name] {
+			fields = append(fields, f)
 		}
+	}
+	return fields
+}
+
+func validateJSONFields(fields []string) error {
+	available := make(map[string]bool)
+	for _, f := range jsonRecordFields() {
+		available[f.name] = true
+	}
+	for _, f := range fields {
+		if !available[f] {
+			return fmt.Errorf("Unknown JSON field: %s", f)
+		}
+	}
+	return nil
+}
+
+// isEmptyJSONValue returns true if the value is omitted by omitempty.
+func isEmptyJSONValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
 
-		if tpLayer := (*pkt.Packet).TransportLayer(); tpLayer != nil {
-			tpFlow := tpLayer.TransportFlow()
-			src, dst := tpFlow.Endpoints()
-			if n, err := strconv.Atoi(src.String()); err == nil {
-				record.SrcPort = n
+func formatTCPOption(opt layers.TCPOption) string {
+	name := opt.OptionType.String()
+	switch opt.OptionType {
+	case layers.TCPOptionKindMSS:
+		if len(opt.OptionData) == 2 {
+			return fmt.Sprintf("%s=%d", name, binary.BigEndian.Uint16(opt.OptionData))
+		}
+	case layers.TCPOptionKindWindowScale:
+		if len(opt.OptionData) == 1 {
+			return fmt.Sprintf("%s=%d", name, opt.OptionData[0])
+		}
+	case layers.TCPOptionKindTimestamps:
+		if len(opt.OptionData) == 8 {
+			return fmt.Sprintf("%s=%d/%d", name,
+				binary.BigEndian.Uint32(opt.OptionData[0:4]), binary.BigEndian.Uint32(opt.OptionData[4:8]))
+		}
+	}
+	return name
+}
+
+func (x *jsonPacketDumper) newRecord(pkt *Packet) jsonRecord {
+	record := jsonRecord{
+		Timestamp:    pkt.Timestamp,
+		VNI:          pkt.VNI,
+		OuterSrcPort: pkt.OuterSrcPort,
+		OuterDstPort: pkt.OuterDstPort,
+		FrameLength:  len(pkt.Data),
+	}
+	if pkt.OuterSrcAddr != nil {
+		record.OuterSrcAddr = pkt.OuterSrcAddr.String()
+	}
+
+	for _, layer := range (*pkt.Packet).Layers() {
+		switch v := layer.(type) {
+		case *layers.Ethernet:
+			record.SrcMAC = v.SrcMAC.String()
+			record.DstMAC = v.DstMAC.String()
+
+		case *layers.Dot1Q:
+			record.VLAN = append(record.VLAN, v.VLANIdentifier)
+
+		case *layers.IPv4:
+			id, dscp := v.Id, v.TOS>>2
+			record.IPTTL = v.TTL
+			record.IPID = &id
+			record.IPDSCP = &dscp
+
+			var flags []string
+			if v.Flags&layers.IPv4DontFragment != 0 {
+				flags = append(flags, "DF")
+			}
+			if v.Flags&layers.IPv4MoreFragments != 0 {
+				flags = append(flags, "MF")
 			}
-			if n, err := strconv.Atoi(dst.String()); err == nil {
-				record.DstPort = n
+			record.IPFlags = strings.Join(flags, ",")
+
+		case *layers.IPv6:
+			dscp := v.TrafficClass >> 2
+			record.IPTTL = v.HopLimit
+			record.IPDSCP = &dscp
+			record.IPFlowLabel = v.FlowLabel
+
+		case *layers.TCP:
+			window := v.Window
+			record.TCPFlag = tcpFlagString(tcpFlagBits(v))
+			record.TCPSeq = v.Seq
+			record.TCPAck = v.Ack
+			record.TCPWindow = &window
+			for _, opt := range v.Options {
+				if opt.OptionType == layers.TCPOptionKindNop || opt.OptionType == layers.TCPOptionKindEndList {
+					continue
+				}
+				record.TCPOptions = append(record.TCPOptions, formatTCPOption(opt))
 			}
+
+		case *layers.UDP:
+			record.UDPLength = v.Length
+
+		case *layers.ICMPv4:
+			icmpType, icmpCode := v.TypeCode.Type(), v.TypeCode.Code()
+			record.ICMPType, record.ICMPCode = &icmpType, &icmpCode
+
+		case *layers.ICMPv6:
+			icmpType, icmpCode := v.TypeCode.Type(), v.TypeCode.Code()
+			record.ICMPType, record.ICMPCode = &icmpType, &icmpCode
+		}
+	}
+
+	if netLayer := (*pkt.Packet).NetworkLayer(); netLayer != nil {
+		netFlow := netLayer.NetworkFlow()
+		src, dst := netFlow.Endpoints()
+		record.SrcAddr = src.String()
+		record.DstAddr = dst.String()
+
+		if ipv4, ok := netLayer.(*layers.IPv4); ok {
+			record.Protocol = ipv4.Protocol.String()
+		} else if ipv6, ok := netLayer.(*layers.IPv6); ok {
+			record.Protocol = ipv6.NextHeader.String()
 		}
+	}
 
-		if app := (*pkt.Packet).ApplicationLayer(); app != nil {
-			if x.args.EnableJSONRawPayload {
-				record.RawPayload = app.Payload()
+	if tpLayer := (*pkt.Packet).TransportLayer(); tpLayer != nil {
+		tpFlow := tpLayer.TransportFlow()
+		src, dst := tpFlow.Endpoints()
+		if n, err := strconv.Atoi(src.String()); err == nil {
+			record.SrcPort = n
+		}
+		if n, err := strconv.Atoi(dst.String()); err == nil {
+			record.DstPort = n
+		}
+	}
+
+	if app := (*pkt.Packet).ApplicationLayer(); app != nil {
+		payload := app.Payload()
+		if x.args.SnapLen > 0 && len(pkt.Data) > x.args.SnapLen {
+			// Keep only bytes of payload within snap length of the frame
+			remain := x.args.SnapLen - (len(pkt.Data) - len(payload))
+			if remain < 0 {
+				remain = 0
 			}
-			if x.args.EnableJSONTextPayload {
-				record.TextPayload = string(app.Payload())
+			if remain < len(payload) {
+				payload = payload[:remain]
+				record.Truncated = true
 			}
 		}
 
-		data, err := json.Marshal(&record)
+		if x.args.EnableJSONRawPayload && len(payload) > 0 {
+			record.RawPayload = payload
+		}
+		if x.args.EnableJSONTextPayload {
+			record.TextPayload = string(payload)
+		}
+	}
+
+	return record
+}
+
+// marshal encodes record with only fields in JSONFields if specified.
+func (x *jsonPacketDumper) marshal(record *jsonRecord) ([]byte, error) {
+	if x.fields == nil {
+		return json.Marshal(record)
+	}
+
+	v := reflect.ValueOf(record).Elem()
+	buf := bytes.NewBufferString("{")
+	for _, f := range x.fields {
+		fv := v.Field(f.index)
+		if f.omitEmpty && isEmptyJSONValue(fv) {
+			continue
+		}
+
+		data, err := json.Marshal(fv.Interface())
+		if err != nil {
+			return nil, err
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(strconv.Quote(f.name))
+		buf.WriteByte(':')
+		buf.Write(data)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+func (x *jsonPacketDumper) Dump(packets []*Packet, w io.Writer) error {
+	for _, pkt := range packets {
+		record := x.newRecord(pkt)
+		data, err := x.marshal(&record)
 		if err != nil {
 			return errors.Wrap(err, "Fail to marshal jsonRecord")
 		}
@@ -143,14 +435,52 @@ func (x *jsonPacketDumper) dump(packets []*packetData, w io.Writer) error {
 	return nil
 }
 
+type jsonSessionDumper struct {
+	baseDumper
+	newline bool
+}
+
+func newJSONSessionDumper(args DumperArguments) Dumper {
+	return &jsonSessionDumper{newline: false}
+}
+
+func newNdJSONSessionDumper(args DumperArguments) Dumper {
+	return &jsonSessionDumper{newline: true}
+}
+
+func (x *jsonSessionDumper) Dump(packets []*Packet, w io.Writer) error {
+	for _, pkt := range packets {
+		if pkt.Session == nil {
+			return fmt.Errorf("Session record is not set, assertion error")
+		}
+
+		data, err := json.Marshal(pkt.Session)
+		if err != nil {
+			return errors.Wrap(err, "Fail to marshal SessionRecord")
+		}
+
+		if _, err := w.Write(data); err != nil {
+			return errors.Wrap(err, "Fail to write JSON data")
+		}
+		if x.newline {
+			if _, err := w.Write([]byte("\n")); err != nil {
+				return errors.Wrap(err, "Fail to write JSON data (LF)")
+			}
+		}
+	}
+
+	return nil
+}
+
 // pcapDumper is not concurrency safe for now
 type pcapDumper struct {
 	writer     *pcap.Writer
+	snapLen    int
 	baseDumper //nolint
 }
 
-func newPcapDumper(args DumperArguments) dumper {
-	return &pcapDumper{}
+func newPcapDumper(args DumperArguments) Dumper {
+	return &pcapDumper{snapLen: args.SnapLen}
 }
 
 type pcapPayload []byte
@@ -159,9 +489,12 @@ func (x pcapPayload) Payload() []byte {
 	return x
 }
 
-func (x *pcapDumper) open(writer io.Writer) error {
+func (x *pcapDumper) Open(writer io.Writer) error {
 	w := pcap.NewWriter(writer)
 	w.Header.Network = pcap.DLT_EN10MB
+	if x.snapLen > 0 {
+		w.Header.SnapshotLength = uint32(x.snapLen)
+	}
 	if err := w.WriteHeader(); err != nil {
 		return errors.Wrap(err, "Fail to write header of pcap")
 	}
@@ -169,22 +502,25 @@ func (x *pcapDumper) open(writer io.Writer) error {
 	return nil
 }
 
-func (x *pcapDumper) close(writer io.Writer) error {
+func (x *pcapDumper) Close(writer io.Writer) error {
 	x.writer = nil
 	return nil
 }
 
-func (x *pcapDumper) dump(packets []*packetData, writer io.Writer) error {
+func (x *pcapDumper) Dump(packets []*Packet, writer io.Writer) error {
 	if x.writer == nil {
 		return fmt.Errorf("pcapDumper.writer is not set, assertion error")
 	}
 
 	for _, pkt := range packets {
-		p := pcapPayload(pkt.Data)
+		p := pcapPayload(snapData(pkt.Data, x.snapLen))
 		pcapPkt := pcap.Packet{
-			// Specify a timestamp
-			Header: pcap.PacketHeader{Timestamp: pkt.Timestamp},
-			Data:   p,
+			// Specify a timestamp and original length before truncation
+			Header: pcap.PacketHeader{
+				Timestamp:      pkt.Timestamp,
+				OriginalLength: uint32(len(pkt.Data)),
+			},
+			Data: p,
 		}
 
 		if err := x.writer.WritePacket(pcapPkt); err != nil {
@@ -196,6 +532,6 @@ func (x *pcapDumper) dump(packets []*packetData, writer io.Writer) error {
 }
 
 /*
-func dumpGzipJSON([]*packetData, io.writer) error {}
-func dumpParquet([]*packetData, io.writer) error {}
+func dumpGzipJSON([]*Packet, io.writer) error {}
+func dumpParquet([]*Packet, io.writer) error {}
 */
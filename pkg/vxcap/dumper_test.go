@@ -3,13 +3,19 @@ package vxcap_test
 import (
 	"bytes"
 	"encoding/json"
+	"io"
+	"net"
 
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
 	"github.com/m-mizutani/vxcap/pkg/vxcap"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"os"
 	"testing"
+	"time"
 )
 
 // var vxcapTestFS = os.Getenv("VXCAP_TEST_FS")
@@ -25,6 +31,17 @@ func genSamplePacketData() []byte {
 	return payload
 }
 
+// dumpAll writes packets as a complete stream of the dumper.
+func dumpAll(d vxcap.Dumper, packets []*vxcap.Packet, w io.Writer) error {
+	if err := d.Open(w); err != nil {
+		return err
+	}
+	if err := d.Dump(packets, w); err != nil {
+		return err
+	}
+	return d.Close(w)
+}
+
 func TestPcapDumpFileSystem(t *testing.T) {
 	if vxcapTestFS == "" {
 		t.Skip("VXCAP_TEST_FS is not set")
@@ -40,7 +57,7 @@ func TestPcapDumpFileSystem(t *testing.T) {
 		Format: "pcap",
 		Target: "packet",
 	})
-	err = vxcap.PcapDumperDump(dumper, vxcap.ToPacketDataSlice(pkt), w)
+	err = dumpAll(dumper, []*vxcap.Packet{pkt}, w)
 	require.NoError(t, err)
 }
 
@@ -59,7 +76,7 @@ func TestJsonDumpFileSystem(t *testing.T) {
 		Format: "pcap",
 		Target: "packet",
 	})
-	err = vxcap.JSONPacketDumperDump(dumper, vxcap.ToPacketDataSlice(pkt), w)
+	err = dumpAll(dumper, []*vxcap.Packet{pkt}, w)
 	require.NoError(t, err)
 }
 
@@ -74,7 +91,7 @@ func TestJsonDumpBuffer(t *testing.T) {
 		Target:                "packet",
 		EnableJSONTextPayload: true,
 	})
-	err := vxcap.JSONPacketDumperDump(dumper, vxcap.ToPacketDataSlice(pkt), buf)
+	err := dumpAll(dumper, []*vxcap.Packet{pkt}, buf)
 	require.NoError(t, err)
 
 	var d vxcap.JSONRecord
@@ -101,7 +118,7 @@ func TestJsonDumpNoText(t *testing.T) {
 		Target:               "packet",
 		EnableJSONRawPayload: true,
 	})
-	err := vxcap.JSONPacketDumperDump(dumper, vxcap.ToPacketDataSlice(pkt), buf)
+	err := dumpAll(dumper, []*vxcap.Packet{pkt}, buf)
 	require.NoError(t, err)
 
 	var d vxcap.JSONRecord
@@ -111,3 +128,247 @@ func TestJsonDumpNoText(t *testing.T) {
 	assert.NotContains(t, d.TextPayload, "POST /ws/v1/cluster/apps/new-application")
 	assert.NotEqual(t, 0, len(d.RawPayload))
 }
+
+func TestJsonDumpTunnelInfo(t *testing.T) {
+	var data []byte
+	data = append(data, sampleHeader...)
+	data = append(data, genSamplePacketData()...)
+	pkt, err := vxcap.ParseVXLAN(data, len(data))
+	require.NoError(t, err)
+	pkt.OuterSrcAddr = net.ParseIP("10.1.2.3")
+	pkt.OuterSrcPort = 65432
+	pkt.OuterDstPort = 4789
+
+	buf := new(bytes.Buffer)
+	dumper := vxcap.NewJSONPacketDumper(vxcap.DumperArguments{
+		Format: "json",
+		Target: "packet",
+	})
+	err = dumpAll(dumper, []*vxcap.Packet{pkt}, buf)
+	require.NoError(t, err)
+
+	var d vxcap.JSONRecord
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &d))
+	assert.Equal(t, uint32(0xa8eed6), d.VNI)
+	assert.Equal(t, "10.1.2.3", d.OuterSrcAddr)
+	assert.Equal(t, 65432, d.OuterSrcPort)
+	assert.Equal(t, 4789, d.OuterDstPort)
+	assert.Equal(t, "167.71.184.66", d.SrcAddr)
+}
+
+func TestPcapDumpSnapLen(t *testing.T) {
+	payload := genSamplePacketData()
+	pkt := vxcap.NewPacketData(payload)
+
+	buf := new(bytes.Buffer)
+	dumper := vxcap.NewPcapDumper(vxcap.DumperArguments{
+		Format:  "pcap",
+		Target:  "packet",
+		SnapLen: 64,
+	})
+	err := dumpAll(dumper, []*vxcap.Packet{pkt}, buf)
+	require.NoError(t, err)
+
+	r, err := pcapgo.NewReader(buf)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(64), r.Snaplen())
+
+	data, ci, err := r.ReadPacketData()
+	require.NoError(t, err)
+	assert.Equal(t, 64, ci.CaptureLength)
+	assert.Equal(t, len(payload), ci.Length)
+	assert.Equal(t, payload[:64], data)
+}
+
+func TestJsonDumpSnapLen(t *testing.T) {
+	payload := genSamplePacketData()
+	pkt := vxcap.NewPacketData(payload)
+	headerLen := len(payload) - len(samplePayload)
+
+	dump := func(snapLen int) vxcap.JSONRecord {
+		buf := new(bytes.Buffer)
+		dumper := vxcap.NewJSONPacketDumper(vxcap.DumperArguments{
+			Format:                "json",
+			Target:                "packet",
+			EnableJSONTextPayload: true,
+			SnapLen:               snapLen,
+		})
+		err := dumpAll(dumper, []*vxcap.Packet{pkt}, buf)
+		require.NoError(t, err)
+
+		var d vxcap.JSONRecord
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &d))
+		return d
+	}
+
+	// No truncation
+	d := dump(0)
+	assert.Equal(t, len(payload), d.FrameLength)
+	assert.False(t, d.Truncated)
+	assert.Equal(t, string(samplePayload), d.TextPayload)
+
+	// Truncated in payload
+	d = dump(headerLen + 4)
+	assert.Equal(t, len(payload), d.FrameLength)
+	assert.True(t, d.Truncated)
+	assert.Equal(t, "POST", d.TextPayload)
+	assert.Equal(t, 8088, d.DstPort)
+
+	// Only headers
+	d = dump(headerLen)
+	assert.True(t, d.Truncated)
+	assert.Equal(t, "", d.TextPayload)
+
+	// Larger than frame
+	d = dump(65535)
+	assert.False(t, d.Truncated)
+	assert.Equal(t, string(samplePayload), d.TextPayload)
+}
+
+func dumpJSONRecord(t *testing.T, args vxcap.DumperArguments, pkt *vxcap.Packet) []byte {
+	buf := new(bytes.Buffer)
+	dumper := vxcap.NewJSONPacketDumper(args)
+	err := dumpAll(dumper, []*vxcap.Packet{pkt}, buf)
+	require.NoError(t, err)
+	return buf.Bytes()
+}
+
+func TestJsonDumpRichFields(t *testing.T) {
+	eth := layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeDot1Q,
+	}
+	vlan := layers.Dot1Q{VLANIdentifier: 42, Type: layers.EthernetTypeIPv4}
+	ip := layers.IPv4{
+		Version:  4,
+		TTL:      63,
+		Id:       0x1234,
+		TOS:      46 << 2, // DSCP EF
+		Flags:    layers.IPv4DontFragment,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.ParseIP("10.0.0.1"),
+		DstIP:    net.ParseIP("10.0.0.2"),
+	}
+	tcp := layers.TCP{
+		SrcPort: 40000,
+		DstPort: 443,
+		Seq:     100,
+		Ack:     200,
+		SYN:     true,
+		ACK:     true,
+		Window:  0,
+		Options: []layers.TCPOption{
+			{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}},
+			{OptionType: layers.TCPOptionKindNop, OptionLength: 1},
+			{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{7}},
+			{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2},
+		},
+	}
+	require.NoError(t, tcp.SetNetworkLayerForChecksum(&ip))
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	require.NoError(t, gopacket.SerializeLayers(buf, opts, &eth, &vlan, &ip, &tcp))
+
+	pkt := vxcap.NewPacketData(buf.Bytes())
+	pkt.VNI = 100
+	pkt.Timestamp = time.Date(2019, 9, 1, 10, 0, 0, 0, time.UTC)
+
+	var d vxcap.JSONRecord
+	require.NoError(t, json.Unmarshal(dumpJSONRecord(t, vxcap.DumperArguments{}, pkt), &d))
+	assert.Equal(t, pkt.Timestamp, d.Timestamp)
+	assert.Equal(t, len(buf.Bytes()), d.FrameLength)
+	assert.Equal(t, uint32(100), d.VNI)
+	assert.Equal(t, "02:00:00:00:00:01", d.SrcMAC)
+	assert.Equal(t, "02:00:00:00:00:02", d.DstMAC)
+	assert.Equal(t, []uint16{42}, d.VLAN)
+	assert.Equal(t, uint8(63), d.IPTTL)
+	require.NotNil(t, d.IPID)
+	assert.Equal(t, uint16(0x1234), *d.IPID)
+	require.NotNil(t, d.IPDSCP)
+	assert.Equal(t, uint8(46), *d.IPDSCP)
+	assert.Equal(t, "DF", d.IPFlags)
+	assert.Equal(t, "SYN,ACK", d.TCPFlag)
+	assert.Equal(t, uint32(100), d.TCPSeq)
+	assert.Equal(t, uint32(200), d.TCPAck)
+	require.NotNil(t, d.TCPWindow)
+	assert.Equal(t, uint16(0), *d.TCPWindow)
+	assert.Equal(t, []string{"MSS=1460", "WindowScale=7", "SACKPermitted"}, d.TCPOptions)
+	assert.Nil(t, d.ICMPType)
+}
+
+func TestJsonDumpICMPAndUDP(t *testing.T) {
+	eth := layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip6 := layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		FlowLabel:  0x12345,
+		NextHeader: layers.IPProtocolICMPv6,
+		SrcIP:      net.ParseIP("2001:db8::1"),
+		DstIP:      net.ParseIP("2001:db8::2"),
+	}
+	icmp := layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, 0)}
+	require.NoError(t, icmp.SetNetworkLayerForChecksum(&ip6))
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	require.NoError(t, gopacket.SerializeLayers(buf, opts, &eth, &ip6, &icmp))
+
+	var d vxcap.JSONRecord
+	raw := dumpJSONRecord(t, vxcap.DumperArguments{}, vxcap.NewPacketData(buf.Bytes()))
+	require.NoError(t, json.Unmarshal(raw, &d))
+	assert.Equal(t, uint8(64), d.IPTTL)
+	assert.Equal(t, uint32(0x12345), d.IPFlowLabel)
+	assert.Nil(t, d.IPID)
+	require.NotNil(t, d.ICMPType)
+	assert.Equal(t, uint8(1), *d.ICMPType)
+	require.NotNil(t, d.ICMPCode)
+	assert.Equal(t, uint8(0), *d.ICMPCode)
+
+	udpPkt := vxcap.NewPacketData(genInnerPacket(t, "10.0.0.1", "10.0.0.53", 5353, 53, nil, []byte("query")))
+	d = vxcap.JSONRecord{}
+	require.NoError(t, json.Unmarshal(dumpJSONRecord(t, vxcap.DumperArguments{}, udpPkt), &d))
+	assert.Equal(t, uint16(8+5), d.UDPLength)
+	assert.Equal(t, "UDP", d.Protocol)
+}
+
+func TestJsonDumpFieldSelection(t *testing.T) {
+	pkt := vxcap.NewPacketData(genSamplePacketData())
+	args := vxcap.DumperArguments{
+		Format:     "json",
+		Target:     "packet",
+		JSONFields: []string{"timestamp", "src_addr", "dst_port", "vlan"},
+	}
+
+	raw := dumpJSONRecord(t, args, pkt)
+	var m map[string]interface{}
+	require.NoError(t, json.Unmarshal(raw, &m))
+	assert.Equal(t, 3, len(m)) // vlan is omitted because it's empty
+	assert.Contains(t, m, "timestamp")
+	assert.Equal(t, "167.71.184.66", m["src_addr"])
+	assert.Equal(t, float64(8088), m["dst_port"])
+
+	// Fields are in same order as full record
+	ts, err := json.Marshal(pkt.Timestamp)
+	require.NoError(t, err)
+	assert.Equal(t, `{"timestamp":`+string(ts)+`,"src_addr":"167.71.184.66","dst_port":8088}`, string(raw))
+
+	args.JSONFields = []string{"dst_port", "frame_len", "tcp_window"}
+	assert.Equal(t, `{"frame_len":303,"dst_port":8088,"tcp_window":14600}`, string(dumpJSONRecord(t, args, pkt)))
+
+	_, err = vxcap.NewDumper(args)
+	assert.NoError(t, err)
+
+	args.JSONFields = []string{"src_addr", "no_such_field"}
+	_, err = vxcap.NewDumper(args)
+	assert.Error(t, err)
+
+	// Not available for session record
+	args.JSONFields = []string{"src_addr"}
+	args.Target = "session"
+	_, err = vxcap.NewDumper(args)
+	assert.Error(t, err)
+}
@@ -4,14 +4,22 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/sirupsen/logrus"
 
@@ -19,48 +27,131 @@ import (
 	"github.com/pkg/errors"
 )
 
-type recordEmitter interface {
-	setup() error
-	emit([]*packetData) error
-	teardown() error
-	tick(t time.Time) error
-	setDumper(dumper)
-	getDumper() dumper
+// Emitter forwards packets (or session records) encoded by Dumper to
+// destination. Setup is called before the first Emit, Tick every second and
+// Teardown at shutdown (or replacement by reload). Calls are serialized by
+// PacketProcessor, so an implementation does not need to be concurrency safe.
+type Emitter interface {
+	Setup() error
+	Emit(packets []*Packet) error
+	Tick(now time.Time) error
+	Teardown() error
+}
+
+// EmitterConstructor creates an Emitter with arguments and Dumper to encode
+// packets. It can be registered by RegisterEmitter.
+type EmitterConstructor func(args EmitterArguments, dumper Dumper) (Emitter, error)
+
+// syncEmitter serializes access to an emitter because emitters and dumpers
+// are not concurrency safe.
+type syncEmitter struct {
+	Emitter
+	mutex sync.Mutex
+}
+
+func (x *syncEmitter) Setup() error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return x.Emitter.Setup()
+}
+
+func (x *syncEmitter) Emit(packets []*Packet) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return x.Emitter.Emit(packets)
+}
+
+func (x *syncEmitter) Tick(now time.Time) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return x.Emitter.Tick(now)
+}
+
+func (x *syncEmitter) Teardown() error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return x.Emitter.Teardown()
 }
 
 type emitterKey struct {
 	Name string
 	Mode string // batch or stream
 }
-type emitterConstructor func(EmitterArguments) (recordEmitter, error)
 
 // EmitterArguments is for construction of emitter
 type EmitterArguments struct {
-	Name string
+	Name string `yaml:"emitter" env:"VXCAP_EMITTER"`
 	mode string // batch or stream, the field should be set by PacketProcessor
 
-	dumper    dumper
 	extension string
 
-	// For fsEmitter
-	FsFileName   string
-	FsDirPath    string
-	FsRotateSize int
+	// Destination is given by route spec for emitter registered by
+	// RegisterEmitter, e.g. "my-dest" of "100=my-emitter:my-dest".
+	Destination string `yaml:"-"`
 
-	// For aws service
-	AwsRegion string
+	// For fsEmitter
+	FsFileName       string `yaml:"fs-filename" env:"VXCAP_FS_FILENAME"` // strftime style directives (e.g. %Y%m%d) are available
+	FsDirPath        string `yaml:"fs-dirpath" env:"VXCAP_FS_DIRPATH"`
+	FsRotateSize     int    `yaml:"fs-rotate-size" env:"VXCAP_FS_ROTATE_SIZE"`         // Rotate file if its size exceeds the bytes
+	FsRotateCount    int    `yaml:"fs-rotate-count" env:"VXCAP_FS_ROTATE_COUNT"`       // Rotate file if number of packets in the file exceeds it
+	FsRotateInterval int    `yaml:"fs-rotate-interval" env:"VXCAP_FS_ROTATE_INTERVAL"` // Rotate file at every boundary of the interval (seconds)
+	FsRingFiles      int    `yaml:"fs-ring-files" env:"VXCAP_FS_RING_FILES"`           // Keep only newest N segment files, rotation is required
+	FsRingSize       int    `yaml:"fs-ring-size" env:"VXCAP_FS_RING_SIZE"`             // Keep total size of segment files under the bytes, rotation is required
+
+	// For aws service. Credentials are retrieved by default provider chain of
+	// AWS SDK (environment variables, shared config, instance role, etc.) if
+	// neither static credentials nor profile is set.
+	AwsRegion          string `yaml:"aws-region" env:"VXCAP_AWS_REGION"`
+	AwsProfile         string `yaml:"aws-profile" env:"VXCAP_AWS_PROFILE"`
+	AwsAccessKeyID     string `yaml:"aws-access-key-id" env:"VXCAP_AWS_ACCESS_KEY_ID"`
+	AwsSecretAccessKey string `yaml:"aws-secret-access-key" env:"VXCAP_AWS_SECRET_ACCESS_KEY"`
+	AwsSessionToken    string `yaml:"aws-session-token" env:"VXCAP_AWS_SESSION_TOKEN"`
+	AwsAssumeRoleARN   string `yaml:"aws-assume-role-arn" env:"VXCAP_AWS_ASSUME_ROLE_ARN"` // Role assumed with the credentials above
+	AwsCABundle        string `yaml:"aws-ca-bundle" env:"VXCAP_AWS_CA_BUNDLE"`             // PEM file of CA certificates to verify endpoint
 
 	// For s3Emitter
-	AwsS3Bucket        string
-	AwsS3Prefix        string
-	AwsS3AddTimeKey    bool
-	AwsS3FlushCount    int
-	AwsS3FlushInterval int
+	AwsS3Bucket          string   `yaml:"aws-s3-bucket" env:"VXCAP_AWS_S3_BUCKET"`
+	AwsS3Prefix          string   `yaml:"aws-s3-prefix" env:"VXCAP_AWS_S3_PREFIX"`
+	AwsS3AddTimeKey      bool     `yaml:"aws-s3-add-time-key" env:"VXCAP_AWS_S3_ADD_TIME_KEY"` // Same as key template "{prefix}{yyyy}/{MM}/{dd}/{HH}/{start}_{uuid}.{ext}"
+	AwsS3KeyTemplate     string   `yaml:"aws-s3-key-template" env:"VXCAP_AWS_S3_KEY_TEMPLATE"` // e.g. "{prefix}/vni={vni}/dt={yyyy-MM-dd}/{start}_{uuid}.{ext}"
+	AwsS3FlushCount      int      `yaml:"aws-s3-flush-count" env:"VXCAP_AWS_S3_FLUSH_COUNT"`
+	AwsS3FlushInterval   int      `yaml:"aws-s3-flush-interval" env:"VXCAP_AWS_S3_FLUSH_INTERVAL"`
+	AwsS3Endpoint        string   `yaml:"aws-s3-endpoint" env:"VXCAP_AWS_S3_ENDPOINT"` // URL of S3 compatible service, e.g. http://localhost:9000
+	AwsS3ForcePathStyle  bool     `yaml:"aws-s3-force-path-style" env:"VXCAP_AWS_S3_FORCE_PATH_STYLE"`
+	AwsS3SSE             string   `yaml:"aws-s3-sse" env:"VXCAP_AWS_S3_SSE"`                       // Server side encryption, AES256 (SSE-S3) or aws:kms (SSE-KMS)
+	AwsS3SSEKMSKeyID     string   `yaml:"aws-s3-sse-kms-key-id" env:"VXCAP_AWS_S3_SSE_KMS_KEY_ID"` // KMS key for aws:kms, default key of S3 is used if not set
+	AwsS3StorageClass    string   `yaml:"aws-s3-storage-class" env:"VXCAP_AWS_S3_STORAGE_CLASS"`   // e.g. STANDARD_IA, GLACIER_IR
+	AwsS3ContentType     string   `yaml:"aws-s3-content-type" env:"VXCAP_AWS_S3_CONTENT_TYPE"`     // Default is by format, e.g. application/vnd.tcpdump.pcap
+	AwsS3ContentEncoding string   `yaml:"aws-s3-content-encoding" env:"VXCAP_AWS_S3_CONTENT_ENCODING"`
+	AwsS3Tags            []string `yaml:"aws-s3-tags" env:"VXCAP_AWS_S3_TAGS"`           // Object tags, "key=value"
+	AwsS3SensorID        string   `yaml:"aws-s3-sensor-id" env:"VXCAP_AWS_S3_SENSOR_ID"` // sensor-id of object metadata, default is host name
 
 	// For firehoseEmitter
-	AwsFirehoseName          string
-	AwsFirehoseFlushSize     int
-	AwsFirehoseFlushInterval int
+	AwsFirehoseName          string `yaml:"aws-firehose-name" env:"VXCAP_AWS_FIREHOSE_NAME"`
+	AwsFirehoseFlushSize     int    `yaml:"aws-firehose-flush-size" env:"VXCAP_AWS_FIREHOSE_FLUSH_SIZE"`
+	AwsFirehoseFlushInterval int    `yaml:"aws-firehose-flush-interval" env:"VXCAP_AWS_FIREHOSE_FLUSH_INTERVAL"`
+
+	// For kinesisEmitter
+	AwsKinesisStreamName    string `yaml:"aws-kinesis-stream-name" env:"VXCAP_AWS_KINESIS_STREAM_NAME"`
+	AwsKinesisFlushSize     int    `yaml:"aws-kinesis-flush-size" env:"VXCAP_AWS_KINESIS_FLUSH_SIZE"`
+	AwsKinesisFlushInterval int    `yaml:"aws-kinesis-flush-interval" env:"VXCAP_AWS_KINESIS_FLUSH_INTERVAL"`
+
+	// For kafkaEmitter
+	KafkaBrokers       []string `yaml:"kafka-brokers" env:"VXCAP_KAFKA_BROKERS"`
+	KafkaTopic         string   `yaml:"kafka-topic" env:"VXCAP_KAFKA_TOPIC"`
+	KafkaPartitionKey  string   `yaml:"kafka-partition-key" env:"VXCAP_KAFKA_PARTITION_KEY"` // vni, flow or none
+	KafkaCompression   string   `yaml:"kafka-compression" env:"VXCAP_KAFKA_COMPRESSION"`     // none, gzip, snappy, lz4 or zstd
+	KafkaAcks          string   `yaml:"kafka-acks" env:"VXCAP_KAFKA_ACKS"`                   // none, leader or all
+	KafkaFlushSize     int      `yaml:"kafka-flush-size" env:"VXCAP_KAFKA_FLUSH_SIZE"`
+	KafkaFlushInterval int      `yaml:"kafka-flush-interval" env:"VXCAP_KAFKA_FLUSH_INTERVAL"`
+	KafkaTLS           bool     `yaml:"kafka-tls" env:"VXCAP_KAFKA_TLS"`
+	KafkaTLSCACert     string   `yaml:"kafka-tls-ca-cert" env:"VXCAP_KAFKA_TLS_CA_CERT"`
+	KafkaTLSCert       string   `yaml:"kafka-tls-cert" env:"VXCAP_KAFKA_TLS_CERT"`
+	KafkaTLSKey        string   `yaml:"kafka-tls-key" env:"VXCAP_KAFKA_TLS_KEY"`
+	KafkaTLSSkipVerify bool     `yaml:"kafka-tls-skip-verify" env:"VXCAP_KAFKA_TLS_SKIP_VERIFY"`
+	KafkaSASLMechanism string   `yaml:"kafka-sasl-mechanism" env:"VXCAP_KAFKA_SASL_MECHANISM"` // plain, scram-sha-256 or scram-sha-512
+	KafkaSASLUser      string   `yaml:"kafka-sasl-user" env:"VXCAP_KAFKA_SASL_USER"`
+	KafkaSASLPassword  string   `yaml:"kafka-sasl-password" env:"VXCAP_KAFKA_SASL_PASSWORD"`
 }
 
 const (
@@ -68,6 +159,10 @@ const (
 	DefaultAwsS3FlushCount = 4096
 	// DefaultAwsS3FlushInterval is seconds of interval to flush data for S3 emitter
 	DefaultAwsS3FlushInterval = 300
+	// s3RetainFactor limits packets kept for retry after failed upload to
+	// s3RetainFactor times of flush count. Oldest packets are dropped beyond
+	// the limit.
+	s3RetainFactor = 4
 
 	// DefaultAwsFirehoseFlushSize is threshold of flush to firehose.
 	DefaultAwsFirehoseFlushSize = 2 * 1024 * 1024 // 2MB
@@ -75,43 +170,54 @@ const (
 	DefaultAwsFIrehoseFlushInterval = 300
 )
 
+// Extension returns file extension (without ".") for format of Dumper.
+func (x EmitterArguments) Extension() string {
+	return x.extension
+}
+
 type baseEmitter struct {
-	Dumper dumper
+	Dumper Dumper
 }
 
-func (x *baseEmitter) setDumper(f dumper)       { x.Dumper = f }
-func (x *baseEmitter) getDumper() dumper        { return x.Dumper }
-func (x *baseEmitter) setup() error             { return nil }
-func (x *baseEmitter) teardown() error          { return nil }
-func (x *baseEmitter) tick(now time.Time) error { return nil }
+func (x *baseEmitter) Setup() error             { return nil }
+func (x *baseEmitter) Teardown() error          { return nil }
+func (x *baseEmitter) Tick(now time.Time) error { return nil }
+
+var emitterMap = map[emitterKey]EmitterConstructor{
+	{Name: "s3", Mode: "stream"}:       newS3StreamEmitter,
+	{Name: "fs", Mode: "batch"}:        newFsBatchEmitter,
+	{Name: "fs", Mode: "stream"}:       newFsStreamEmitter,
+	{Name: "firehose", Mode: "stream"}: newFirehoseEmitter,
+	{Name: "kinesis", Mode: "stream"}:  newKinesisEmitter,
+	{Name: "kafka", Mode: "stream"}:    newKafkaEmitter,
+	{Name: "kafka", Mode: "batch"}:     newKafkaEmitter,
+}
 
-func newEmitter(args EmitterArguments) (recordEmitter, error) {
-	emitterMap := map[emitterKey]emitterConstructor{
-		{Name: "s3", Mode: "stream"}:       newS3StreamEmitter,
-		{Name: "fs", Mode: "batch"}:        newFsBatchEmitter,
-		{Name: "fs", Mode: "stream"}:       newFsStreamEmitter,
-		{Name: "firehose", Mode: "stream"}: newFirehoseEmitter,
+func newEmitter(args EmitterArguments, dumper Dumper) (Emitter, error) {
+	if dumper == nil {
+		return nil, fmt.Errorf("No Dumper. Dumper is required for new emitter")
 	}
 
 	key := emitterKey{
 		Name: args.Name,
 		Mode: args.mode,
 	}
-	constructor, ok := emitterMap[key]
+	if constructor, ok := emitterMap[key]; ok {
+		return constructor(args, dumper)
+	}
+
+	constructor, ok := lookupEmitterPlugin(args.Name)
 	if !ok {
 		return nil, fmt.Errorf("The pair is not supported: %v", key)
 	}
 
-	emitter, err := constructor(args)
+	emitter, err := constructor(args, dumper)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrapf(err, "Fail to create emitter %s", args.Name)
 	}
-
-	if args.dumper == nil {
-		return nil, fmt.Errorf("No Dumper. Dumper is required for new emitter")
+	if emitter == nil {
+		return nil, fmt.Errorf("Emitter constructor for %s returned nil", args.Name)
 	}
-
-	emitter.setDumper(args.dumper)
 	return emitter, nil
 }
 
@@ -120,12 +226,12 @@ type fsBatchEmitter struct {
 	Argument EmitterArguments
 }
 
-func newFsBatchEmitter(args EmitterArguments) (recordEmitter, error) {
-	e := fsBatchEmitter{Argument: args}
+func newFsBatchEmitter(args EmitterArguments, dumper Dumper) (Emitter, error) {
+	e := fsBatchEmitter{baseEmitter: baseEmitter{Dumper: dumper}, Argument: args}
 	return &e, nil
 }
 
-func (x *fsBatchEmitter) emit(pkt []*packetData) error {
+func (x *fsBatchEmitter) Emit(pkt []*Packet) error {
 
 	fd, err := os.Create(filepath.Join(x.Argument.FsDirPath, x.Argument.FsFileName))
 	if err != nil {
@@ -133,33 +239,77 @@ func (x *fsBatchEmitter) emit(pkt []*packetData) error {
 	}
 	defer fd.Close()
 
-	if err := x.Dumper.open(fd); err != nil {
+	if err := x.Dumper.Open(fd); err != nil {
 		return err
 	}
-	if err := x.Dumper.dump(pkt, fd); err != nil {
+	if err := x.Dumper.Dump(pkt, fd); err != nil {
 		return err
 	}
-	if err := x.Dumper.close(fd); err != nil {
+	if err := x.Dumper.Close(fd); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// countWriter counts written bytes to decide file rotation.
+type countWriter struct {
+	w       io.Writer
+	n       int64
+	discard bool // Drops written data, e.g. pcap header when appending to a file
+}
+
+func (x *countWriter) Write(p []byte) (int, error) {
+	if x.discard {
+		return len(p), nil
+	}
+	n, err := x.w.Write(p)
+	x.n += int64(n)
+	return n, err
+}
+
 type fsStreamEmitter struct {
 	baseEmitter
-	Argument    EmitterArguments
-	DirPath     string
-	FileName    string
-	RotateLimit int
-	fd          *os.File
+	Argument       EmitterArguments
+	DirPath        string
+	FileName       string
+	RotateLimit    int
+	rotateCount    int
+	rotateInterval time.Duration
+	ringFiles      int
+	ringSize       int64
+	ringPattern    *regexp.Regexp
+
+	fd           *os.File
+	writer       *countWriter
+	pktCount     int
+	nextRotation time.Time
+	lastPath     string
+	seq          int
+	path         string // File opened last
+	handoff      *fsHandoff
+	now          func() time.Time
 }
 
-func newFsStreamEmitter(args EmitterArguments) (recordEmitter, error) {
+// fsHandoff is fs emitters of previous processor replaced by reload. A file
+// written by them without rotation is appended instead of truncated.
+type fsHandoff struct {
+	prev []*fsStreamEmitter
+	done <-chan struct{} // Closed when previous processor has been shut down
+}
+
+func newFsStreamEmitter(args EmitterArguments, dumper Dumper) (Emitter, error) {
 	emitter := fsStreamEmitter{
-		Argument: args,
-		DirPath:  ".",
-		FileName: "dump." + args.extension,
+		baseEmitter:    baseEmitter{Dumper: dumper},
+		Argument:       args,
+		DirPath:        ".",
+		FileName:       "dump." + args.extension,
+		RotateLimit:    args.FsRotateSize,
+		rotateCount:    args.FsRotateCount,
+		rotateInterval: time.Duration(args.FsRotateInterval) * time.Second,
+		ringFiles:      args.FsRingFiles,
+		ringSize:       int64(args.FsRingSize),
+		now:            time.Now,
 	}
 
 	if args.FsDirPath != "" {
@@ -169,56 +319,428 @@ func newFsStreamEmitter(args EmitterArguments) (recordEmitter, error) {
 		emitter.FileName = args.FsFileName
 	}
 
+	if emitter.ringFiles > 0 || emitter.ringSize > 0 {
+		if !emitter.rotationEnabled() {
+			return nil, fmt.Errorf("Ring buffer of FS emitter requires rotation by size, count or interval")
+		}
+
+		// Segment files are named as <FileName>[.<seq>]<ext>, see nextFilePath().
+		// Only files in DirPath are searched and ext is matched literally.
+		name := emitter.FileName
+		if strings.ContainsAny(name, "/"+string(filepath.Separator)) {
+			return nil, fmt.Errorf("File name of FS emitter must not have directory in ring buffer mode: %s", name)
+		}
+		ext := filepath.Ext(name)
+		if strings.Contains(ext, "%") {
+			return nil, fmt.Errorf("Extension of file name must not have strftime directive in ring buffer mode: %s", name)
+		}
+		emitter.ringPattern = regexp.MustCompile("^" + strftimePattern(strings.TrimSuffix(name, ext)) +
+			`(\.\d+)?` + regexp.QuoteMeta(ext) + "$")
+	}
+
 	Logger.WithFields(logrus.Fields{
-		"dirpath":  emitter.DirPath,
-		"fileName": emitter.FileName,
+		"dirpath":        emitter.DirPath,
+		"fileName":       emitter.FileName,
+		"rotateSize":     emitter.RotateLimit,
+		"rotateCount":    emitter.rotateCount,
+		"rotateInterval": emitter.rotateInterval,
+		"ringFiles":      emitter.ringFiles,
+		"ringSize":       emitter.ringSize,
 	}).Info("Configured FileSystem Emitter (Stream)")
 
 	return &emitter, nil
 }
 
-func (x *fsStreamEmitter) emit(packets []*packetData) error {
-	if x.fd == nil {
-		path := filepath.Join(x.DirPath, x.FileName)
-		Logger.WithField("filepath", path).Debug("Opening output file")
-		fd, err := os.Create(path)
-		if err != nil {
-			return errors.Wrap(err, "Fail to create a dump file for emitter")
+func (x *fsStreamEmitter) rotationEnabled() bool {
+	return x.RotateLimit > 0 || x.rotateCount > 0 || x.rotateInterval > 0
+}
+
+// nextFilePath expands strftime directives in FileName. If rotation is enabled
+// and the file already exists, sequence number is inserted before extension
+// (e.g. dump.1.pcap) to avoid overwriting previous segment. The sequence number
+// keeps increasing while the expanded file name is same. Without rotation, an
+// existing file is overwritten (or appended, see inherited()).
+func (x *fsStreamEmitter) nextFilePath(now time.Time) string {
+	path := filepath.Join(x.DirPath, strftime(x.FileName, now))
+	if !x.rotationEnabled() {
+		return path
+	}
+
+	if path != x.lastPath {
+		x.lastPath = path
+		x.seq = 0
+	}
+
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for ; ; x.seq++ {
+		candidate := path
+		if x.seq > 0 {
+			candidate = fmt.Sprintf("%s.%d%s", base, x.seq, ext)
+		}
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// inherited returns true if an emitter of previous processor has written to
+// path without rotation. It waits for shutdown of previous processor, which
+// closes the file, only if the emitter has same settings of file name.
+func (x *fsStreamEmitter) inherited(path string) bool {
+	if x.handoff == nil || x.rotationEnabled() {
+		return false
+	}
+
+	waited := false
+	for _, prev := range x.handoff.prev {
+		if prev.rotationEnabled() || prev.DirPath != x.DirPath || prev.FileName != x.FileName {
+			continue
+		}
+		if !waited {
+			<-x.handoff.done
+			waited = true
+		}
+		if prev.path == path {
+			return true
+		}
+	}
+	return false
+}
+
+func (x *fsStreamEmitter) open(now time.Time) error {
+	path := x.nextFilePath(now)
+	appending := x.inherited(path)
+	Logger.WithFields(logrus.Fields{
+		"filepath": path,
+		"append":   appending,
+	}).Debug("Opening output file")
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appending {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	fd, err := os.OpenFile(path, flag, 0666)
+	if err != nil {
+		return errors.Wrap(err, "Fail to create a dump file for emitter")
+	}
+	x.fd = fd
+	x.path = path
+	x.writer = &countWriter{w: fd}
+	x.pktCount = 0
+	if x.rotateInterval > 0 {
+		x.nextRotation = now.Truncate(x.rotateInterval).Add(x.rotateInterval)
+	}
+
+	// pcap file can have only one header at the beginning
+	if appending && x.Argument.extension == "pcap" {
+		if info, err := fd.Stat(); err == nil && info.Size() > 0 {
+			x.writer.discard = true
 		}
-		x.fd = fd
+	}
+	err = x.Dumper.Open(x.writer)
+	x.writer.discard = false
+	if err != nil {
+		return err
+	}
 
-		if err := x.Dumper.open(x.fd); err != nil {
+	if x.ringPattern != nil {
+		if err := x.removeOldSegments(path); err != nil {
 			return err
 		}
 	}
+	return nil
+}
+
+// removeOldSegments deletes oldest segment files in the directory until both
+// of number and total size of segments are within ring buffer settings.
+// Segment files written by previous process are also counted. current (file
+// opened or closed just now) is never deleted.
+func (x *fsStreamEmitter) removeOldSegments(current string) error {
+	dir := filepath.Dir(current)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errors.Wrap(err, "Fail to read directory of ring buffer")
+	}
 
-	if err := x.Dumper.dump(packets, x.fd); err != nil {
+	var segments []os.FileInfo
+	var totalSize int64
+	for _, f := range files {
+		if f.Mode().IsRegular() && x.ringPattern.MatchString(f.Name()) {
+			segments = append(segments, f)
+			totalSize += f.Size()
+		}
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].ModTime().Before(segments[j].ModTime())
+	})
+
+	remains := len(segments)
+	for _, f := range segments {
+		if (x.ringFiles <= 0 || remains <= x.ringFiles) && (x.ringSize <= 0 || totalSize <= x.ringSize) {
+			break
+		}
+
+		path := filepath.Join(dir, f.Name())
+		if path == current {
+			continue
+		}
+
+		Logger.WithField("filepath", path).Debug("Removing old segment file")
+		if err := os.Remove(path); err != nil {
+			return errors.Wrap(err, "Fail to remove old segment file")
+		}
+		remains--
+		totalSize -= f.Size()
+	}
+
+	return nil
+}
+
+func (x *fsStreamEmitter) close() error {
+	if x.fd == nil {
+		return nil
+	}
+
+	fd := x.fd
+	x.fd, x.writer = nil, nil
+
+	if err := x.Dumper.Close(fd); err != nil {
+		fd.Close()
 		return err
 	}
+	if err := fd.Close(); err != nil {
+		return errors.Wrap(err, "Fail to close a dump file for emitter")
+	}
+
+	Logger.WithField("filepath", fd.Name()).Debug("Closed output file")
+
+	if x.ringPattern != nil {
+		if err := x.removeOldSegments(fd.Name()); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (x *fsStreamEmitter) teardown() error {
-	defer x.fd.Close()
+func (x *fsStreamEmitter) Emit(packets []*Packet) error {
+	now := x.now()
+	if x.fd != nil && x.rotateInterval > 0 && !now.Before(x.nextRotation) {
+		if err := x.close(); err != nil {
+			return err
+		}
+	}
+
+	if x.fd == nil {
+		if err := x.open(now); err != nil {
+			return err
+		}
+	}
+
+	if err := x.Dumper.Dump(packets, x.writer); err != nil {
+		return err
+	}
+	x.pktCount += len(packets)
 
-	if x.fd != nil {
-		if err := x.Dumper.close(x.fd); err != nil {
+	if (x.RotateLimit > 0 && x.writer.n >= int64(x.RotateLimit)) ||
+		(x.rotateCount > 0 && x.pktCount >= x.rotateCount) {
+		if err := x.close(); err != nil {
 			return err
 		}
 	}
+
 	return nil
 }
 
+func (x *fsStreamEmitter) Tick(now time.Time) error {
+	if x.fd != nil && x.rotateInterval > 0 && !now.Before(x.nextRotation) {
+		return x.close()
+	}
+	return nil
+}
+
+func (x *fsStreamEmitter) Teardown() error {
+	return x.close()
+}
+
+// newAwsSession creates session of AWS SDK with region, credentials and CA
+// bundle of the arguments.
+func newAwsSession(args EmitterArguments) (*session.Session, error) {
+	opts := session.Options{
+		Config:  *aws.NewConfig().WithRegion(args.AwsRegion),
+		Profile: args.AwsProfile,
+	}
+	if args.AwsProfile != "" {
+		opts.SharedConfigState = session.SharedConfigEnable
+	}
+	if args.AwsAccessKeyID != "" {
+		opts.Config.Credentials = credentials.NewStaticCredentials(
+			args.AwsAccessKeyID, args.AwsSecretAccessKey, args.AwsSessionToken)
+	}
+
+	if args.AwsCABundle != "" {
+		fd, err := os.Open(args.AwsCABundle)
+		if err != nil {
+			return nil, errors.Wrap(err, "Fail to open CA bundle")
+		}
+		defer fd.Close()
+		opts.CustomCABundle = fd
+	}
+
+	ssn, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to create AWS session")
+	}
+
+	if args.AwsAssumeRoleARN != "" {
+		ssn = ssn.Copy(&aws.Config{
+			Credentials: stscreds.NewCredentials(ssn, args.AwsAssumeRoleARN),
+		})
+	}
+
+	return ssn, nil
+}
+
+type vxcapS3Uploader interface {
+	Upload(*s3manager.UploadInput, ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error)
+}
+
+var newS3Uploader = func(args EmitterArguments) (vxcapS3Uploader, error) {
+	ssn, err := newAwsSession(args)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := aws.NewConfig().WithS3ForcePathStyle(args.AwsS3ForcePathStyle)
+	if args.AwsS3Endpoint != "" {
+		cfg = cfg.WithEndpoint(args.AwsS3Endpoint)
+	}
+
+	return s3manager.NewUploaderWithClient(s3.New(ssn, cfg)), nil
+}
+
+// s3ContentTypes is default Content-Type of S3 object by file extension.
+var s3ContentTypes = map[string]string{
+	"pcap":   "application/vnd.tcpdump.pcap",
+	"pcapng": "application/x-pcapng",
+	"json":   "application/x-ndjson",
+}
+
+// Values of server side encryption for S3 object.
+const (
+	s3SSEAES256 = "AES256"
+	s3SSEKMS    = "aws:kms"
+)
+
+// encodeS3Tags converts "key=value" tags to Tagging of S3 object, e.g.
+// "env=prod&team=sec".
+func encodeS3Tags(tags []string) (string, error) {
+	values := url.Values{}
+	for _, tag := range tags {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return "", fmt.Errorf("Tag must be 'key=value': %q", tag)
+		}
+		values.Add(kv[0], kv[1])
+	}
+	return values.Encode(), nil
+}
+
+// s3MaxVNIMetadataSize is max length of "vni" user metadata. User metadata of
+// S3 object is limited to 2KB in total.
+const s3MaxVNIMetadataSize = 1024
+
+// formatVNISet returns sorted VNIs with consecutive ones compressed to range,
+// e.g. "1-3,100". If it exceeds s3MaxVNIMetadataSize, only min, max and number
+// of VNIs are returned, e.g. "1-4000 (1500 VNIs)".
+func formatVNISet(vniSet map[uint32]struct{}) string {
+	var vniList []uint32
+	for vni := range vniSet {
+		vniList = append(vniList, vni)
+	}
+	sort.Slice(vniList, func(i, j int) bool { return vniList[i] < vniList[j] })
+
+	var ranges []string
+	for i := 0; i < len(vniList); {
+		j := i
+		for j+1 < len(vniList) && vniList[j+1] == vniList[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, fmt.Sprintf("%d", vniList[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", vniList[i], vniList[j]))
+		}
+		i = j + 1
+	}
+
+	v := strings.Join(ranges, ",")
+	if len(v) > s3MaxVNIMetadataSize {
+		v = fmt.Sprintf("%d-%d (%d VNIs)", vniList[0], vniList[len(vniList)-1], len(vniList))
+	}
+	return v
+}
+
+// packetTimeRange returns time of first and last packet and number of
+// packets. Time and number of packets in session are used for session record.
+func packetTimeRange(packets []*Packet) (first, last time.Time, count uint64) {
+	for _, pkt := range packets {
+		begin, end, n := pkt.Timestamp, pkt.Timestamp, uint64(1)
+		if ssn := pkt.Session; ssn != nil {
+			begin, end, n = ssn.StartTime, ssn.EndTime, ssn.SrcPackets+ssn.DstPackets
+		}
+
+		if !begin.IsZero() && (first.IsZero() || begin.Before(first)) {
+			first = begin
+		}
+		if end.After(last) {
+			last = end
+		}
+		count += n
+	}
+	return
+}
+
+// s3Metadata returns user metadata of S3 object having the packets (or
+// session records).
+func s3Metadata(sensorID string, packets []*Packet) map[string]*string {
+	first, last, count := packetTimeRange(packets)
+	vniSet := make(map[uint32]struct{})
+	for _, pkt := range packets {
+		vniSet[pkt.VNI] = struct{}{}
+	}
+
+	meta := map[string]*string{
+		"vni":          aws.String(formatVNISet(vniSet)),
+		"packet-count": aws.String(fmt.Sprintf("%d", count)),
+	}
+	if sensorID != "" {
+		meta["sensor-id"] = aws.String(sensorID)
+	}
+	if !first.IsZero() {
+		meta["first-packet-time"] = aws.String(first.UTC().Format(time.RFC3339Nano))
+		meta["last-packet-time"] = aws.String(last.UTC().Format(time.RFC3339Nano))
+	}
+	return meta
+}
+
 type s3StreamEmitter struct {
 	baseEmitter
 	Argument      EmitterArguments
-	pktBuffer     []*packetData
+	uploader      vxcapS3Uploader
+	sensorID      string
+	contentType   string
+	tagging       string
+	keyTemplate   *s3KeyTemplate
+	pktBuffer     []*Packet
 	flushCount    int
 	flushInterval int
 	lastFlush     time.Time
+	retrying      bool // Last flush failed and packets are kept for retry
 }
 
-func newS3StreamEmitter(args EmitterArguments) (recordEmitter, error) {
+func newS3StreamEmitter(args EmitterArguments, dumper Dumper) (Emitter, error) {
 	if args.AwsRegion == "" {
 		return nil, fmt.Errorf("AwsRegion is not set for S3 emitter")
 	}
@@ -226,13 +748,45 @@ func newS3StreamEmitter(args EmitterArguments) (recordEmitter, error) {
 		return nil, fmt.Errorf("AwsS3Bucket is not set for S3 emitter")
 	}
 
+	tagging, err := encodeS3Tags(args.AwsS3Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := args.AwsS3KeyTemplate
+	if tmpl == "" {
+		tmpl = defaultS3KeyTemplate
+		if args.AwsS3AddTimeKey {
+			tmpl = defaultS3TimeKeyTemplate
+		}
+	}
+	keyTemplate, err := parseS3KeyTemplate(tmpl)
+	if err != nil {
+		return nil, err
+	}
+
 	emitter := s3StreamEmitter{
+		baseEmitter:   baseEmitter{Dumper: dumper},
 		Argument:      args,
+		sensorID:      args.AwsS3SensorID,
+		contentType:   args.AwsS3ContentType,
+		tagging:       tagging,
+		keyTemplate:   keyTemplate,
 		flushCount:    DefaultAwsS3FlushCount,
 		flushInterval: DefaultAwsS3FlushInterval,
 		lastFlush:     time.Now(),
 	}
 
+	if emitter.sensorID == "" {
+		emitter.sensorID, _ = os.Hostname()
+	}
+	if emitter.contentType == "" {
+		emitter.contentType = "application/octet-stream"
+		if ct, ok := s3ContentTypes[args.extension]; ok {
+			emitter.contentType = ct
+		}
+	}
+
 	if args.AwsS3FlushCount > 0 {
 		emitter.flushCount = args.AwsS3FlushCount
 	}
@@ -245,7 +799,11 @@ func newS3StreamEmitter(args EmitterArguments) (recordEmitter, error) {
 		"region":        emitter.Argument.AwsRegion,
 		"S3Bucket":      emitter.Argument.AwsS3Bucket,
 		"S3Prefix":      emitter.Argument.AwsS3Prefix,
-		"addTimeKey":    emitter.Argument.AwsS3AddTimeKey,
+		"S3Endpoint":    emitter.Argument.AwsS3Endpoint,
+		"keyTemplate":   tmpl,
+		"SSE":           emitter.Argument.AwsS3SSE,
+		"storageClass":  emitter.Argument.AwsS3StorageClass,
+		"sensorID":      emitter.sensorID,
 		"flushCount":    emitter.flushCount,
 		"flushInterval": emitter.flushInterval,
 	}).Info("Configured AWS S3 Emitter")
@@ -253,55 +811,82 @@ func newS3StreamEmitter(args EmitterArguments) (recordEmitter, error) {
 	return &emitter, nil
 }
 
+// flush uploads buffered packets. They are split into objects by VNI if key
+// template has {vni}.
 func (x *s3StreamEmitter) flush() error {
 	x.lastFlush = time.Now()
+	x.retrying = false
 	if len(x.pktBuffer) == 0 {
 		return nil
 	}
 
-	Logger.WithField("bufferLength", len(x.pktBuffer)).Trace("trying flush to S3")
-
-	reader, writer := io.Pipe()
-	errCh := make(chan error)
+	groups := [][]*Packet{x.pktBuffer}
+	if x.keyTemplate.hasVNI {
+		groups = splitPacketsByVNI(x.pktBuffer)
+	}
+	x.pktBuffer = []*Packet{}
 
-	go func() {
-		defer writer.Close()
-		defer close(errCh)
+	for i, packets := range groups {
+		start := time.Now()
+		body := &countWriter{}
+		if err := x.upload(packets, body); err != nil {
+			observeFlush("s3", start, 0, err)
 
-		if err := x.Dumper.open(writer); err != nil {
-			errCh <- errors.Wrap(err, "Fail to open dumper for S3 object")
-		}
-		if err := x.Dumper.dump(x.pktBuffer, writer); err != nil {
-			errCh <- errors.Wrap(err, "Fail to dump packets for S3 object")
-		}
-		if err := x.Dumper.close(writer); err != nil {
-			errCh <- errors.Wrap(err, "Fail to close dumper for S3 object")
+			// Failed and remaining groups are uploaded again at next flush
+			for _, remaining := range groups[i:] {
+				x.pktBuffer = append(x.pktBuffer, remaining...)
+			}
+			x.retrying = true
+			Logger.WithFields(logrus.Fields{
+				"kept":   len(x.pktBuffer),
+				"groups": len(groups) - i,
+			}).Warn("Fail to upload to S3, packets are kept in buffer")
+			return err
 		}
+		observeFlush("s3", start, int(body.n), nil)
+	}
 
-		x.pktBuffer = []*packetData{}
-	}()
-
-	ssn := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(x.Argument.AwsRegion),
-	}))
+	return nil
+}
 
-	s3Key := x.Argument.AwsS3Prefix
-	now := time.Now().UTC()
-	if x.Argument.AwsS3AddTimeKey {
-		s3Key += now.Format("2006/01/02/15/")
+// objectKey returns S3 key of object having the packets.
+func (x *s3StreamEmitter) objectKey(packets []*Packet) string {
+	first, _, _ := packetTimeRange(packets)
+	if first.IsZero() {
+		first = time.Now()
 	}
-	s3Key += now.Format("20160102_150405_") +
-		strings.Replace(uuid.New().String(), "-", "", -1) + "." +
-		x.Argument.extension
 
-	uploader := s3manager.NewUploader(ssn)
-	resp, err := uploader.Upload(&s3manager.UploadInput{
-		Body:   reader,
-		Bucket: &x.Argument.AwsS3Bucket,
-		Key:    &s3Key,
+	return x.keyTemplate.render(s3KeyParams{
+		Prefix: x.Argument.AwsS3Prefix,
+		VNI:    packets[0].VNI,
+		Sensor: x.sensorID,
+		Time:   first,
+		UUID:   strings.Replace(uuid.New().String(), "-", "", -1),
+		Ext:    x.Argument.extension,
 	})
+}
+
+// upload dumps packets to a new S3 object. Bytes of the object are counted by
+// body.
+func (x *s3StreamEmitter) upload(packets []*Packet, body *countWriter) error {
+	Logger.WithField("bufferLength", len(packets)).Trace("trying flush to S3")
+
+	reader, pipeWriter := io.Pipe()
+	body.w = pipeWriter
+	errCh := make(chan error, 1)
+
+	go func() {
+		err := x.dump(packets, body)
+		pipeWriter.CloseWithError(err) // nolint:errcheck
+		errCh <- err
+	}()
+
+	s3Key := x.objectKey(packets)
+	resp, err := x.uploader.Upload(x.uploadInput(packets, s3Key, reader))
 
 	if err != nil {
+		reader.CloseWithError(err) // nolint:errcheck
+		<-errCh
 		return errors.Wrap(err, "Fail to PutObject in Emitter")
 	}
 
@@ -318,10 +903,67 @@ func (x *s3StreamEmitter) flush() error {
 	return nil
 }
 
-func (x *s3StreamEmitter) emit(packets []*packetData) error {
+// uploadInput builds UploadInput of S3 object having the packets with
+// encryption, storage class, tags and metadata.
+func (x *s3StreamEmitter) uploadInput(packets []*Packet, key string, body io.Reader) *s3manager.UploadInput {
+	input := &s3manager.UploadInput{
+		Body:        body,
+		Bucket:      aws.String(x.Argument.AwsS3Bucket),
+		Key:         aws.String(key),
+		ContentType: aws.String(x.contentType),
+		Metadata:    s3Metadata(x.sensorID, packets),
+	}
+
+	if x.Argument.AwsS3ContentEncoding != "" {
+		input.ContentEncoding = aws.String(x.Argument.AwsS3ContentEncoding)
+	}
+	if x.Argument.AwsS3SSE != "" {
+		input.ServerSideEncryption = aws.String(x.Argument.AwsS3SSE)
+	}
+	if x.Argument.AwsS3SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(x.Argument.AwsS3SSEKMSKeyID)
+	}
+	if x.Argument.AwsS3StorageClass != "" {
+		input.StorageClass = aws.String(x.Argument.AwsS3StorageClass)
+	}
+	if x.tagging != "" {
+		input.Tagging = aws.String(x.tagging)
+	}
+
+	return input
+}
+
+// dump writes packets as a complete stream of the dumper to w.
+func (x *s3StreamEmitter) dump(packets []*Packet, w io.Writer) error {
+	if err := x.Dumper.Open(w); err != nil {
+		return errors.Wrap(err, "Fail to open dumper for S3 object")
+	}
+	if err := x.Dumper.Dump(packets, w); err != nil {
+		return errors.Wrap(err, "Fail to dump packets for S3 object")
+	}
+	if err := x.Dumper.Close(w); err != nil {
+		return errors.Wrap(err, "Fail to close dumper for S3 object")
+	}
+	return nil
+}
+
+func (x *s3StreamEmitter) Setup() error {
+	uploader, err := newS3Uploader(x.Argument)
+	if err != nil {
+		return err
+	}
+	x.uploader = uploader
+	return nil
+}
+
+// Emit buffers packets and uploads them when buffer reaches flush count. After
+// failed upload, kept packets are retried only by Tick at flush interval.
+func (x *s3StreamEmitter) Emit(packets []*Packet) error {
 	x.pktBuffer = append(x.pktBuffer, packets...)
 
-	if len(x.pktBuffer) >= x.Argument.AwsS3FlushCount {
+	if x.retrying {
+		x.dropOldest()
+	} else if len(x.pktBuffer) >= x.flushCount {
 		if err := x.flush(); err != nil {
 			return errors.Wrap(err, "Fail to upload object to S3")
 		}
@@ -330,7 +972,22 @@ func (x *s3StreamEmitter) emit(packets []*packetData) error {
 	return nil
 }
 
-func (x *s3StreamEmitter) teardown() error {
+// dropOldest discards oldest packets beyond limit of packets kept for retry.
+func (x *s3StreamEmitter) dropOldest() {
+	n := len(x.pktBuffer) - x.flushCount*s3RetainFactor
+	if n <= 0 {
+		return
+	}
+
+	x.pktBuffer = x.pktBuffer[n:]
+	observeDropped("s3", n)
+	Logger.WithFields(logrus.Fields{
+		"dropped": n,
+		"kept":    len(x.pktBuffer),
+	}).Debug("S3 buffer is full, oldest packets are dropped")
+}
+
+func (x *s3StreamEmitter) Teardown() error {
 	if err := x.flush(); err != nil {
 		return errors.Wrap(err, "Fail to upload object to S3 in closing")
 	}
@@ -338,7 +995,7 @@ func (x *s3StreamEmitter) teardown() error {
 	return nil
 }
 
-func (x *s3StreamEmitter) tick(now time.Time) error {
+func (x *s3StreamEmitter) Tick(now time.Time) error {
 	if now.Sub(x.lastFlush) > time.Second*time.Duration(x.flushInterval) {
 		if err := x.flush(); err != nil {
 			return err
@@ -351,14 +1008,15 @@ type vxcapFirehoseClient interface {
 	PutRecordBatch(*firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error)
 }
 
-var newFirehoseClient = func(awsRegion string) vxcapFirehoseClient {
-	ssn := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(awsRegion),
-	}))
+var newFirehoseClient = func(args EmitterArguments) (vxcapFirehoseClient, error) {
+	ssn, err := newAwsSession(args)
+	if err != nil {
+		return nil, err
+	}
 
 	client := firehose.New(ssn)
 
-	return client
+	return client, nil
 }
 
 type firehoseEmitter struct {
@@ -372,9 +1030,10 @@ type firehoseEmitter struct {
 	lastFlush      time.Time
 }
 
-func newFirehoseEmitter(args EmitterArguments) (recordEmitter, error) {
+func newFirehoseEmitter(args EmitterArguments, dumper Dumper) (Emitter, error) {
 
 	emitter := firehoseEmitter{
+		baseEmitter:   baseEmitter{Dumper: dumper},
 		Argument:      args,
 		flushSize:     DefaultAwsFirehoseFlushSize,
 		flushInterval: DefaultAwsFIrehoseFlushInterval,
@@ -419,6 +1078,7 @@ func (x *firehoseEmitter) flush() error {
 	recordsBatchInput = recordsBatchInput.SetRecords(records)
 
 	resp, err := x.firehoseClient.PutRecordBatch(recordsBatchInput)
+	observeFlush("firehose", x.lastFlush, x.pktBufferSize, err)
 	if err != nil {
 		return errors.Wrap(err, "Fail to put firehose records")
 	}
@@ -435,15 +1095,19 @@ func (x *firehoseEmitter) flush() error {
 	return nil
 }
 
-func (x *firehoseEmitter) setup() error {
-	x.firehoseClient = newFirehoseClient(x.Argument.AwsRegion)
+func (x *firehoseEmitter) Setup() error {
+	client, err := newFirehoseClient(x.Argument)
+	if err != nil {
+		return err
+	}
+	x.firehoseClient = client
 	return nil
 }
 
-func (x *firehoseEmitter) emit(pkt []*packetData) error {
+func (x *firehoseEmitter) Emit(pkt []*Packet) error {
 	for _, p := range pkt {
 		buf := new(bytes.Buffer)
-		if err := x.Dumper.dump([]*packetData{p}, buf); err != nil {
+		if err := x.Dumper.Dump([]*Packet{p}, buf); err != nil {
 			return errors.Wrap(err, "Fail to encode data for firehose record")
 		}
 
@@ -461,7 +1125,7 @@ func (x *firehoseEmitter) emit(pkt []*packetData) error {
 	return nil
 }
 
-func (x *firehoseEmitter) teardown() error {
+func (x *firehoseEmitter) Teardown() error {
 	if err := x.flush(); err != nil {
 		return err
 	}
@@ -469,7 +1133,7 @@ func (x *firehoseEmitter) teardown() error {
 	return nil
 }
 
-func (x *firehoseEmitter) tick(now time.Time) error {
+func (x *firehoseEmitter) Tick(now time.Time) error {
 	if now.Sub(x.lastFlush) > time.Second*time.Duration(x.flushInterval) {
 		if err := x.flush(); err != nil {
 			return err
@@ -1,15 +1,599 @@
 package vxcap_test
 
 import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/gopacket/pcapgo"
 	"github.com/m-mizutani/vxcap/pkg/vxcap"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestEmitterNoName(t *testing.T) {
 	var args vxcap.EmitterArguments
-	emitter, err := vxcap.NewEmitter(args)
+	emitter, err := vxcap.NewEmitter(args, nil)
 	assert.Error(t, err)
 	assert.Nil(t, emitter)
 }
+
+func countPcapPackets(t *testing.T, path string) int {
+	fd, err := os.Open(path)
+	require.NoError(t, err)
+	defer fd.Close()
+
+	r, err := pcapgo.NewReader(fd)
+	require.NoError(t, err)
+	n := 0
+	for {
+		if _, _, err := r.ReadPacketData(); err != nil {
+			return n
+		}
+		n++
+	}
+}
+
+// fsPcapArgs returns arguments of processor writing pcap file to dir by fs emitter.
+func fsPcapArgs(dir, fileName string) vxcap.PacketProcessorArgument {
+	return vxcap.PacketProcessorArgument{
+		DumperArgs: vxcap.DumperArguments{Format: "pcap", Target: "packet"},
+		EmitterArgs: vxcap.EmitterArguments{
+			Name:       "fs",
+			FsDirPath:  dir,
+			FsFileName: fileName,
+		},
+	}
+}
+
+func TestFsEmitterRotateCount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vxcap_rotate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	args := fsPcapArgs(dir, "dump.pcap")
+	args.EmitterArgs.FsRotateCount = 2
+	proc := newTestProcessor(t, args)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+	}
+	require.NoError(t, proc.Shutdown())
+
+	assert.Equal(t, 2, countPcapPackets(t, filepath.Join(dir, "dump.pcap")))
+	assert.Equal(t, 2, countPcapPackets(t, filepath.Join(dir, "dump.1.pcap")))
+	assert.Equal(t, 1, countPcapPackets(t, filepath.Join(dir, "dump.2.pcap")))
+}
+
+func TestFsEmitterRotateSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vxcap_rotate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Header (24 bytes) + 2 packets (16 + 323 bytes each) exceeds 500 bytes
+	args := fsPcapArgs(dir, "dump.pcap")
+	args.EmitterArgs.FsRotateSize = 500
+	proc := newTestProcessor(t, args)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+	}
+	require.NoError(t, proc.Shutdown())
+
+	assert.Equal(t, 2, countPcapPackets(t, filepath.Join(dir, "dump.pcap")))
+	assert.Equal(t, 1, countPcapPackets(t, filepath.Join(dir, "dump.1.pcap")))
+}
+
+func TestFsEmitterRotateInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vxcap_rotate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	args := fsPcapArgs(dir, "dump_%Y%m%d.pcap")
+	args.EmitterArgs.FsRotateInterval = 300
+	proc := newTestProcessor(t, args)
+	now := time.Date(2019, 9, 1, 10, 0, 0, 0, time.Local)
+	vxcap.SetFsEmitterClock(proc, func() time.Time { return now })
+
+	require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+	require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+	now = now.Add(301 * time.Second)
+	require.NoError(t, proc.Tick(now))
+	require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+	require.NoError(t, proc.Shutdown())
+
+	base := "dump_20190901"
+	assert.Equal(t, 2, countPcapPackets(t, filepath.Join(dir, base+".pcap")))
+	assert.Equal(t, 1, countPcapPackets(t, filepath.Join(dir, base+".1.pcap")))
+}
+
+// setSegmentModTime sets modification time of i-th segment file closed just
+// now to base time + i seconds, and then the next segment is always newer.
+func setSegmentModTime(t *testing.T, base string, i int, past time.Time) {
+	path := base + ".pcap"
+	if i > 0 {
+		path = fmt.Sprintf("%s.%d.pcap", base, i)
+	}
+	mtime := past.Add(time.Duration(i) * time.Second)
+	require.NoError(t, os.Chtimes(path, mtime, mtime))
+}
+
+func TestFsEmitterRingFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vxcap_ring")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// A file written by previous process and unrelated file
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "dump_19700101.pcap"), []byte("old"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "other.pcap"), []byte("other"), 0644))
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "dump_19700101.pcap"), past, past))
+
+	args := fsPcapArgs(dir, "dump_%Y%m%d.pcap")
+	args.EmitterArgs.FsRotateCount = 1
+	args.EmitterArgs.FsRingFiles = 3
+	proc := newTestProcessor(t, args)
+	vxcap.SetFsEmitterClock(proc, func() time.Time { return time.Date(2019, 9, 1, 10, 0, 0, 0, time.Local) })
+
+	base := "dump_20190901"
+	for i := 0; i < 5; i++ {
+		require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+		setSegmentModTime(t, filepath.Join(dir, base), i, past.Add(time.Minute))
+	}
+	require.NoError(t, proc.Shutdown())
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	assert.ElementsMatch(t, []string{base + ".2.pcap", base + ".3.pcap", base + ".4.pcap", "other.pcap"}, names)
+}
+
+func TestFsEmitterRingSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vxcap_ring")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// One segment has pcap header (24 bytes) + 1 packet (16 + 323 bytes) = 363 bytes
+	args := fsPcapArgs(dir, "dump.pcap")
+	args.EmitterArgs.FsRotateCount = 1
+	args.EmitterArgs.FsRingSize = 800
+	proc := newTestProcessor(t, args)
+	past := time.Now().Add(-time.Hour)
+	for i := 0; i < 4; i++ {
+		require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+		setSegmentModTime(t, filepath.Join(dir, "dump"), i, past)
+	}
+	require.NoError(t, proc.Shutdown())
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	assert.ElementsMatch(t, []string{"dump.2.pcap", "dump.3.pcap"}, names)
+}
+
+func TestFsEmitterRingRequiresRotation(t *testing.T) {
+	args := fsPcapArgs("", "")
+	args.EmitterArgs.FsRingFiles = 3
+	_, err := vxcap.NewPacketProcessor(args)
+	assert.Error(t, err)
+}
+
+func TestFsEmitterRingInvalidFileName(t *testing.T) {
+	for _, fileName := range []string{
+		"%Y%m%d/dump.pcap", // Directory is not searched for old segments
+		"dump.%H%M",        // Directive in extension never matches segment files
+	} {
+		args := fsPcapArgs("", fileName)
+		args.EmitterArgs.FsRotateCount = 1
+		args.EmitterArgs.FsRingFiles = 3
+		_, err := vxcap.NewPacketProcessor(args)
+		assert.Error(t, err, fileName)
+	}
+}
+
+func TestFsEmitterTakeOver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vxcap_takeover")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	args := fsPcapArgs(dir, "dump.pcap")
+	path := filepath.Join(dir, "dump.pcap")
+
+	oldProc := newTestProcessor(t, args)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, oldProc.Put(vxcap.NewPacketData(genSamplePacketData())))
+	}
+
+	newProc, err := vxcap.NewPacketProcessor(args)
+	require.NoError(t, err)
+	vxcap.TakeOver(newProc, oldProc)
+	require.NoError(t, newProc.Setup())
+
+	// New processor waits for old one closing the file
+	putCh := make(chan error)
+	go func() { putCh <- newProc.Put(vxcap.NewPacketData(genSamplePacketData())) }()
+	select {
+	case <-putCh:
+		require.Fail(t, "Put must wait for shutdown of old processor")
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.NoError(t, oldProc.Shutdown())
+	require.NoError(t, <-putCh)
+	require.NoError(t, newProc.Shutdown())
+
+	// Packets are appended to a valid pcap file
+	assert.Equal(t, 3, countPcapPackets(t, path))
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+
+	// Processor not taking over truncates the file
+	proc := newTestProcessor(t, args)
+	require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+	require.NoError(t, proc.Shutdown())
+	assert.Equal(t, 1, countPcapPackets(t, path))
+}
+
+// s3TestArgs returns arguments of processor uploading JSON records to S3
+// bucket "blue".
+func s3TestArgs() vxcap.PacketProcessorArgument {
+	return vxcap.PacketProcessorArgument{
+		DumperArgs: vxcap.DumperArguments{Format: "json", Target: "packet"},
+		EmitterArgs: vxcap.EmitterArguments{
+			Name:        "s3",
+			AwsRegion:   "us-east-1",
+			AwsS3Bucket: "blue",
+		},
+	}
+}
+
+func TestS3Emitter(t *testing.T) {
+	uploader := &vxcap.S3TestUploader{}
+	defer vxcap.ReplaceNewS3Uploader(uploader)()
+
+	args := s3TestArgs()
+	args.EmitterArgs.AwsS3Prefix = "mirror/"
+	args.EmitterArgs.AwsS3FlushCount = 2
+	proc := newTestProcessor(t, args)
+	pkt := vxcap.NewPacketData(genSamplePacketData())
+	for i := 0; i < 3; i++ {
+		require.NoError(t, proc.Put(pkt))
+	}
+	assert.Equal(t, 1, len(uploader.Objects))
+	require.NoError(t, proc.Shutdown())
+
+	require.Equal(t, 2, len(uploader.Input))
+	var lines int
+	for key, body := range uploader.Objects {
+		assert.True(t, strings.HasPrefix(key, "mirror/"), key)
+		assert.True(t, strings.HasSuffix(key, ".json"), key)
+		lines += strings.Count(string(body), "\n")
+	}
+	assert.Equal(t, 3, lines)
+	assert.Equal(t, "blue", *uploader.Input[0].Bucket)
+}
+
+func TestS3EmitterDefaultFlushCount(t *testing.T) {
+	uploader := &vxcap.S3TestUploader{}
+	defer vxcap.ReplaceNewS3Uploader(uploader)()
+
+	// AwsS3FlushCount is not set, then packets must not be uploaded one by one
+	proc := newTestProcessor(t, s3TestArgs())
+	pkt := vxcap.NewPacketData(genSamplePacketData())
+	for i := 0; i < vxcap.DefaultAwsS3FlushCount-1; i++ {
+		require.NoError(t, proc.Put(pkt))
+	}
+	assert.Equal(t, 0, len(uploader.Input))
+	require.NoError(t, proc.Put(pkt))
+	assert.Equal(t, 1, len(uploader.Input))
+
+	require.NoError(t, proc.Put(pkt))
+	require.NoError(t, proc.Shutdown())
+	require.Equal(t, 2, len(uploader.Input))
+	body := uploader.Objects[*uploader.Input[0].Key]
+	assert.Equal(t, vxcap.DefaultAwsS3FlushCount, strings.Count(string(body), "\n"))
+}
+
+func TestS3EmitterUploadError(t *testing.T) {
+	uploader := &vxcap.S3TestUploader{Err: fmt.Errorf("no such bucket")}
+	defer vxcap.ReplaceNewS3Uploader(uploader)()
+
+	proc := newTestProcessor(t, s3TestArgs())
+	require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+	err := proc.Shutdown()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no such bucket")
+}
+
+func TestS3EmitterEndpoint(t *testing.T) {
+	type s3Request struct {
+		method string
+		path   string
+		auth   string
+		body   []byte
+	}
+	reqCh := make(chan s3Request, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		reqCh <- s3Request{r.Method, r.URL.Path, r.Header.Get("Authorization"), body}
+		w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+	}))
+	defer server.Close()
+
+	// Certificate of the test server is trusted only by CA bundle
+	caFile, err := ioutil.TempFile("", "vxcap-ca")
+	require.NoError(t, err)
+	defer os.Remove(caFile.Name())
+	require.NoError(t, pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+	require.NoError(t, caFile.Close())
+
+	args := s3TestArgs()
+	args.EmitterArgs.AwsS3Prefix = "mirror/"
+	args.EmitterArgs.AwsS3Endpoint = server.URL
+	args.EmitterArgs.AwsS3ForcePathStyle = true
+	args.EmitterArgs.AwsAccessKeyID = "AKIDEXAMPLE"
+	args.EmitterArgs.AwsSecretAccessKey = "secret"
+	args.EmitterArgs.AwsCABundle = caFile.Name()
+	proc := newTestProcessor(t, args)
+	require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+	require.NoError(t, proc.Shutdown())
+
+	req := <-reqCh
+	assert.Equal(t, "PUT", req.method)
+	assert.True(t, strings.HasPrefix(req.path, "/blue/mirror/"), req.path)
+	assert.Contains(t, req.auth, "Credential=AKIDEXAMPLE/")
+	assert.Equal(t, 1, strings.Count(string(req.body), "\n"))
+}
+
+func TestS3EmitterCABundleError(t *testing.T) {
+	args := s3TestArgs()
+	args.EmitterArgs.AwsCABundle = "no-such-file.pem"
+	proc, err := vxcap.NewPacketProcessor(args)
+	require.NoError(t, err)
+	assert.Error(t, proc.Setup())
+}
+
+func TestS3EmitterObjectOptions(t *testing.T) {
+	uploader := &vxcap.S3TestUploader{}
+	defer vxcap.ReplaceNewS3Uploader(uploader)()
+
+	args := s3TestArgs()
+	args.EmitterArgs.AwsS3SSE = "aws:kms"
+	args.EmitterArgs.AwsS3SSEKMSKeyID = "alias/vxcap"
+	args.EmitterArgs.AwsS3StorageClass = "GLACIER_IR"
+	args.EmitterArgs.AwsS3ContentEncoding = "identity"
+	args.EmitterArgs.AwsS3Tags = []string{"team=sec", "env=prod"}
+	args.EmitterArgs.AwsS3SensorID = "sensor-a"
+	proc := newTestProcessor(t, args)
+
+	base := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	for i, vni := range []uint32{3, 1, 2, 100, 2} {
+		pkt := vxcap.NewPacketData(genSamplePacketData())
+		pkt.VNI = vni
+		pkt.Timestamp = base.Add(time.Duration(i) * time.Second)
+		require.NoError(t, proc.Put(pkt))
+	}
+	require.NoError(t, proc.Shutdown())
+
+	require.Equal(t, 1, len(uploader.Input))
+	input := uploader.Input[0]
+	assert.Equal(t, "aws:kms", *input.ServerSideEncryption)
+	assert.Equal(t, "alias/vxcap", *input.SSEKMSKeyId)
+	assert.Equal(t, "GLACIER_IR", *input.StorageClass)
+	assert.Equal(t, "application/x-ndjson", *input.ContentType)
+	assert.Equal(t, "identity", *input.ContentEncoding)
+	assert.Equal(t, "env=prod&team=sec", *input.Tagging)
+
+	meta := make(map[string]string)
+	for k, v := range input.Metadata {
+		meta[k] = *v
+	}
+	assert.Equal(t, map[string]string{
+		"sensor-id":         "sensor-a",
+		"vni":               "1-3,100",
+		"packet-count":      "5",
+		"first-packet-time": "2019-10-01T12:00:00Z",
+		"last-packet-time":  "2019-10-01T12:00:04Z",
+	}, meta)
+}
+
+func TestS3EmitterManyVNIs(t *testing.T) {
+	uploader := &vxcap.S3TestUploader{}
+	defer vxcap.ReplaceNewS3Uploader(uploader)()
+
+	args := s3TestArgs()
+	args.EmitterArgs.AwsS3SensorID = "sensor-a"
+	proc := newTestProcessor(t, args)
+	// Not consecutive VNIs can not be compressed to range
+	for i := 0; i < 1000; i++ {
+		pkt := vxcap.NewPacketData(genSamplePacketData())
+		pkt.VNI = uint32(10000 + i*2)
+		require.NoError(t, proc.Put(pkt))
+	}
+	require.NoError(t, proc.Shutdown())
+
+	require.Equal(t, 1, len(uploader.Input))
+	meta := uploader.Input[0].Metadata
+	assert.Equal(t, "10000-11998 (1000 VNIs)", *meta["vni"])
+
+	// User metadata is limited to 2KB
+	var size int
+	for k, v := range meta {
+		size += len(k) + len(*v)
+	}
+	assert.True(t, size <= 2048, "metadata size %d", size)
+}
+
+func TestS3EmitterDefaultObjectOptions(t *testing.T) {
+	uploader := &vxcap.S3TestUploader{}
+	defer vxcap.ReplaceNewS3Uploader(uploader)()
+
+	args := s3TestArgs()
+	args.DumperArgs.Format = "pcap"
+	proc, err := vxcap.NewPacketProcessor(args)
+	require.NoError(t, err)
+	require.NoError(t, proc.Setup())
+	require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+	require.NoError(t, proc.Shutdown())
+
+	require.Equal(t, 1, len(uploader.Input))
+	input := uploader.Input[0]
+	assert.Equal(t, "application/vnd.tcpdump.pcap", *input.ContentType)
+	assert.Nil(t, input.ServerSideEncryption)
+	assert.Nil(t, input.StorageClass)
+	assert.Nil(t, input.Tagging)
+
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	assert.Equal(t, hostname, *input.Metadata["sensor-id"])
+}
+
+func TestS3EmitterKeyTemplate(t *testing.T) {
+	uploader := &vxcap.S3TestUploader{}
+	defer vxcap.ReplaceNewS3Uploader(uploader)()
+
+	args := s3TestArgs()
+	args.EmitterArgs.AwsS3Prefix = "mirror"
+	args.EmitterArgs.AwsS3KeyTemplate = "{prefix}/vni={vni}/dt={yyyy-MM-dd}/hour={HH}/{sensor}_{start}_{uuid}.{ext}"
+	args.EmitterArgs.AwsS3SensorID = "sensor-a"
+	proc := newTestProcessor(t, args)
+
+	base := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	for i, vni := range []uint32{200, 100, 200, 100, 100} {
+		pkt := vxcap.NewPacketData(genSamplePacketData())
+		pkt.VNI = vni
+		pkt.Timestamp = base.Add(time.Duration(i) * time.Minute)
+		require.NoError(t, proc.Put(pkt))
+	}
+	require.NoError(t, proc.Shutdown())
+
+	// Split into objects by VNI
+	require.Equal(t, 2, len(uploader.Input))
+	keyPattern := regexp.MustCompile(`^mirror/vni=(\d+)/dt=2019-10-01/hour=12/sensor-a_(\d{8}_\d{6})_[0-9a-f]{32}\.json$`)
+	expected := map[string]struct {
+		start string
+		lines int
+	}{
+		"100": {"20191001_120100", 3},
+		"200": {"20191001_120000", 2},
+	}
+	for _, input := range uploader.Input {
+		m := keyPattern.FindStringSubmatch(*input.Key)
+		require.NotNil(t, m, *input.Key)
+		assert.Equal(t, expected[m[1]].start, m[2])
+		assert.Equal(t, expected[m[1]].lines, strings.Count(string(uploader.Objects[*input.Key]), "\n"))
+		assert.Equal(t, m[1], *input.Metadata["vni"])
+	}
+}
+
+func TestS3EmitterKeepFailedGroups(t *testing.T) {
+	// Upload of second VNI group fails
+	uploader := &vxcap.S3TestUploader{
+		Err:  fmt.Errorf("SlowDown"),
+		Fail: func(key string) bool { return strings.HasPrefix(key, "2/") },
+	}
+	defer vxcap.ReplaceNewS3Uploader(uploader)()
+
+	args := s3TestArgs()
+	args.EmitterArgs.AwsS3KeyTemplate = "{vni}/{uuid}.{ext}"
+	proc := newTestProcessor(t, args)
+	for _, vni := range []uint32{1, 2, 3, 2, 3, 3} {
+		pkt := vxcap.NewPacketData(genSamplePacketData())
+		pkt.VNI = vni
+		require.NoError(t, proc.Put(pkt))
+	}
+	err := proc.Tick(time.Now().Add(time.Hour))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "SlowDown")
+	require.Equal(t, 1, len(uploader.Objects))
+
+	// Failed and remaining groups are uploaded at next flush
+	uploader.Err = nil
+	require.NoError(t, proc.Shutdown())
+	lines := make(map[string]int)
+	for key, body := range uploader.Objects {
+		lines[strings.SplitN(key, "/", 2)[0]] += strings.Count(string(body), "\n")
+	}
+	assert.Equal(t, map[string]int{"1": 1, "2": 2, "3": 3}, lines)
+}
+
+func TestS3EmitterDropOldest(t *testing.T) {
+	server, err := vxcap.StartMetricsServer("127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+	const dropped = `vxcap_emitter_dropped_packets_total{emitter="s3"}`
+	before := scrapeMetrics(t, server.Addr)
+
+	uploader := &vxcap.S3TestUploader{Err: fmt.Errorf("SlowDown")}
+	defer vxcap.ReplaceNewS3Uploader(uploader)()
+
+	// Flush by 2 packets, and up to 8 packets are kept after failure
+	args := s3TestArgs()
+	args.EmitterArgs.AwsS3FlushCount = 2
+	proc := newTestProcessor(t, args)
+	base := time.Date(2019, 9, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 12; i++ {
+		pkt := vxcap.NewPacketData(genSamplePacketData())
+		pkt.Timestamp = base.Add(time.Duration(i) * time.Second)
+		if i == 1 {
+			require.Error(t, proc.Put(pkt))
+		} else {
+			require.NoError(t, proc.Put(pkt))
+		}
+	}
+
+	// Oldest packets are dropped instead of retry by Put after failure
+	require.Equal(t, 1, len(uploader.Input))
+
+	// Kept packets are uploaded by Tick at flush interval
+	uploader.Err = nil
+	require.NoError(t, proc.Tick(time.Now()))
+	require.Equal(t, 1, len(uploader.Input))
+	require.NoError(t, proc.Tick(time.Now().Add(time.Hour)))
+	require.Equal(t, 2, len(uploader.Input))
+
+	var sent []int
+	body := strings.TrimSpace(string(uploader.Objects[*uploader.Input[1].Key]))
+	for _, line := range strings.Split(body, "\n") {
+		var v struct {
+			Timestamp time.Time `json:"timestamp"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(line), &v))
+		sent = append(sent, int(v.Timestamp.Sub(base)/time.Second))
+	}
+	assert.Equal(t, []int{4, 5, 6, 7, 8, 9, 10, 11}, sent)
+	require.NoError(t, proc.Shutdown())
+
+	after := scrapeMetrics(t, server.Addr)
+	assert.Equal(t, float64(4), after[dropped]-before[dropped])
+}
+
+func TestS3EmitterDefaultKey(t *testing.T) {
+	uploader := &vxcap.S3TestUploader{}
+	defer vxcap.ReplaceNewS3Uploader(uploader)()
+
+	args := s3TestArgs()
+	args.EmitterArgs.AwsS3Prefix = "mirror/"
+	args.EmitterArgs.AwsS3AddTimeKey = true
+	proc := newTestProcessor(t, args)
+	pkt := vxcap.NewPacketData(genSamplePacketData())
+	pkt.Timestamp = time.Date(2019, 10, 1, 12, 34, 56, 0, time.UTC)
+	require.NoError(t, proc.Put(pkt))
+	require.NoError(t, proc.Shutdown())
+
+	require.Equal(t, 1, len(uploader.Input))
+	assert.Regexp(t, `^mirror/2019/10/01/12/20191001_123456_[0-9a-f]{32}\.json$`, *uploader.Input[0].Key)
+}
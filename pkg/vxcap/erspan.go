@@ -0,0 +1,156 @@
+package vxcap
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	greHeaderLength       = 4
+	greFlagChecksum       = 0x8000
+	greFlagKey            = 0x2000
+	greFlagSequence       = 0x1000
+	greVersionMask        = 0x0007
+	greProtoERSPAN        = 0x88BE // ERSPAN type I and II
+	greProtoERSPANTypeIII = 0x22EB
+
+	erspanTypeIIHeaderLength       = 8
+	erspanTypeIIIHeaderLength      = 12
+	erspanTypeIIIPlatformSubLength = 8
+
+	// erspanNetwork is network name of raw IP socket for GRE (IP protocol 47).
+	erspanNetwork = "ip4:47"
+)
+
+// ERSPANHeader is decoded ERSPAN header. Fields that are not available in
+// the ERSPAN type are left as zero value.
+type ERSPANHeader struct {
+	Type      uint8 // 1, 2 or 3
+	Version   uint8
+	VLAN      uint16
+	COS       uint8
+	SessionID uint16
+
+	// Type II only
+	Index uint32
+
+	// Type III only
+	Timestamp   uint32 // Hardware timestamp, unit depends on Granularity
+	SGT         uint16
+	HardwareID  uint8
+	Direction   uint8
+	Granularity uint8
+}
+
+func parseERSPANTypeII(raw []byte) (*ERSPANHeader, int, error) {
+	if len(raw) < erspanTypeIIHeaderLength {
+		return nil, 0, fmt.Errorf("Too short data for ERSPAN type II header: %d", len(raw))
+	}
+
+	hdr := ERSPANHeader{
+		Type:      2,
+		Version:   raw[0] >> 4,
+		VLAN:      binary.BigEndian.Uint16(raw[0:2]) & 0x0fff,
+		COS:       raw[2] >> 5,
+		SessionID: binary.BigEndian.Uint16(raw[2:4]) & 0x03ff,
+		Index:     binary.BigEndian.Uint32(raw[4:8]) & 0x000fffff,
+	}
+
+	return &hdr, erspanTypeIIHeaderLength, nil
+}
+
+func parseERSPANTypeIII(raw []byte) (*ERSPANHeader, int, error) {
+	if len(raw) < erspanTypeIIIHeaderLength {
+		return nil, 0, fmt.Errorf("Too short data for ERSPAN type III header: %d", len(raw))
+	}
+
+	hdr := ERSPANHeader{
+		Type:        3,
+		Version:     raw[0] >> 4,
+		VLAN:        binary.BigEndian.Uint16(raw[0:2]) & 0x0fff,
+		COS:         raw[2] >> 5,
+		SessionID:   binary.BigEndian.Uint16(raw[2:4]) & 0x03ff,
+		Timestamp:   binary.BigEndian.Uint32(raw[4:8]),
+		SGT:         binary.BigEndian.Uint16(raw[8:10]),
+		HardwareID:  uint8(binary.BigEndian.Uint16(raw[10:12])>>4) & 0x3f,
+		Direction:   (raw[11] >> 3) & 0x01,
+		Granularity: (raw[11] >> 1) & 0x03,
+	}
+
+	if frameType := (raw[10] >> 2) & 0x1f; frameType != 0 {
+		return nil, 0, fmt.Errorf("Unsupported ERSPAN type III frame type: %d", frameType)
+	}
+
+	length := erspanTypeIIIHeaderLength
+	if raw[11]&0x01 != 0 { // Optional platform specific sub-header
+		length += erspanTypeIIIPlatformSubLength
+		if len(raw) < length {
+			return nil, 0, fmt.Errorf("Too short data for ERSPAN type III sub-header: %d", len(raw))
+		}
+	}
+
+	return &hdr, length, nil
+}
+
+// parseERSPAN decodes GRE header and following ERSPAN header. raw must start
+// from GRE header, IP header has already been stripped by raw socket.
+func parseERSPAN(raw []byte, length int) (*Packet, error) {
+	if length < greHeaderLength {
+		return nil, fmt.Errorf("Too short data for GRE header: %d", length)
+	}
+
+	flags := binary.BigEndian.Uint16(raw[0:2])
+	proto := binary.BigEndian.Uint16(raw[2:4])
+	if v := flags & greVersionMask; v != 0 {
+		return nil, fmt.Errorf("Unsupported GRE version: %d", v)
+	}
+
+	offset := greHeaderLength
+	for _, flag := range []uint16{greFlagChecksum, greFlagKey, greFlagSequence} {
+		if flags&flag != 0 {
+			offset += 4
+		}
+	}
+	if length < offset {
+		return nil, fmt.Errorf("Too short data for GRE optional fields: %d < %d", length, offset)
+	}
+
+	var hdr *ERSPANHeader
+	var hdrLen int
+	var err error
+
+	switch {
+	case proto == greProtoERSPAN && flags&greFlagSequence == 0:
+		// ERSPAN type I has no ERSPAN header and no sequence number
+		hdr = &ERSPANHeader{Type: 1}
+	case proto == greProtoERSPAN:
+		hdr, hdrLen, err = parseERSPANTypeII(raw[offset:length])
+	case proto == greProtoERSPANTypeIII:
+		hdr, hdrLen, err = parseERSPANTypeIII(raw[offset:length])
+	default:
+		return nil, fmt.Errorf("Not ERSPAN, GRE protocol type: 0x%04x", proto)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pkt := newPacketData(raw[offset+hdrLen : length])
+	pkt.ERSPAN = hdr
+
+	return pkt, nil
+}
+
+// newERSPANSource opens raw IP socket for GRE. It requires root privilege
+// (or CAP_NET_RAW).
+func newERSPANSource() *packetConnSource {
+	return &packetConnSource{
+		network: erspanNetwork,
+		address: "0.0.0.0",
+		tunnel:  tunnelERSPAN,
+		parse:   parseERSPAN,
+	}
+}
+
+func listenERSPAN(queueSize int) chan *udpQueue {
+	return startSources([]packetSource{newERSPANSource()}, newReceiveQueue(queueSize, QueuePolicyBlock, nil))
+}
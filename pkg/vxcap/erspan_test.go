@@ -0,0 +1,84 @@
+package vxcap_test
+
+import (
+	"testing"
+
+	"github.com/m-mizutani/vxcap/pkg/vxcap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	// GRE header with sequence number and ERSPAN type II header (session ID: 0x123, index: 0x45678)
+	sampleERSPANTypeII = []byte{
+		0x10, 0x00, 0x88, 0xbe, 0x00, 0x00, 0x00, 0x01,
+		0x10, 0x64, 0x01, 0x23, 0x00, 0x04, 0x56, 0x78,
+	}
+	// GRE header with sequence number and ERSPAN type III header
+	// (session ID: 0x2a, timestamp: 0x01020304, hardware ID: 0x15, granularity: 3)
+	sampleERSPANTypeIII = []byte{
+		0x10, 0x00, 0x22, 0xeb, 0x00, 0x00, 0x00, 0x01,
+		0x20, 0x00, 0x00, 0x2a, 0x01, 0x02, 0x03, 0x04, 0x00, 0x00, 0x01, 0x56,
+	}
+	// GRE header without sequence number, it's ERSPAN type I
+	sampleERSPANTypeI = []byte{0x00, 0x00, 0x88, 0xbe}
+)
+
+func TestParseERSPANTypeII(t *testing.T) {
+	var data []byte
+	data = append(data, sampleERSPANTypeII...)
+	data = append(data, sampleEther...)
+
+	pkt, err := vxcap.ParseERSPAN(data, len(data))
+	require.NoError(t, err)
+	assert.Equal(t, len(sampleEther), len(pkt.Data))
+	require.NotNil(t, pkt.ERSPAN)
+	assert.Equal(t, uint8(2), pkt.ERSPAN.Type)
+	assert.Equal(t, uint8(1), pkt.ERSPAN.Version)
+	assert.Equal(t, uint16(100), pkt.ERSPAN.VLAN)
+	assert.Equal(t, uint16(0x123), pkt.ERSPAN.SessionID)
+	assert.Equal(t, uint32(0x45678), pkt.ERSPAN.Index)
+}
+
+func TestParseERSPANTypeIII(t *testing.T) {
+	var data []byte
+	data = append(data, sampleERSPANTypeIII...)
+	data = append(data, sampleEther...)
+
+	pkt, err := vxcap.ParseERSPAN(data, len(data))
+	require.NoError(t, err)
+	assert.Equal(t, len(sampleEther), len(pkt.Data))
+	require.NotNil(t, pkt.ERSPAN)
+	assert.Equal(t, uint8(3), pkt.ERSPAN.Type)
+	assert.Equal(t, uint8(2), pkt.ERSPAN.Version)
+	assert.Equal(t, uint16(0x2a), pkt.ERSPAN.SessionID)
+	assert.Equal(t, uint32(0x01020304), pkt.ERSPAN.Timestamp)
+	assert.Equal(t, uint8(0x15), pkt.ERSPAN.HardwareID)
+	assert.Equal(t, uint8(3), pkt.ERSPAN.Granularity)
+}
+
+func TestParseERSPANTypeI(t *testing.T) {
+	var data []byte
+	data = append(data, sampleERSPANTypeI...)
+	data = append(data, sampleEther...)
+
+	pkt, err := vxcap.ParseERSPAN(data, len(data))
+	require.NoError(t, err)
+	assert.Equal(t, len(sampleEther), len(pkt.Data))
+	assert.Equal(t, uint8(1), pkt.ERSPAN.Type)
+}
+
+func TestParseERSPANError(t *testing.T) {
+	// Not ERSPAN (GRE over IPv4)
+	_, err := vxcap.ParseERSPAN([]byte{0x00, 0x00, 0x08, 0x00}, 4)
+	assert.Error(t, err)
+
+	// Too short GRE header
+	_, err = vxcap.ParseERSPAN(sampleERSPANTypeII[:3], 3)
+	assert.Error(t, err)
+
+	// Too short ERSPAN header
+	short := sampleERSPANTypeIII[:14]
+	_, err = vxcap.ParseERSPAN(short, len(short))
+	assert.Error(t, err)
+}
@@ -2,53 +2,106 @@
 package vxcap
 
 import (
-	"io"
+	"io/ioutil"
+	"time"
 
+	"github.com/Shopify/sarama"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"golang.org/x/net/bpf"
 )
 
 var (
 	ParseVXLAN    = parseVXLAN
 	ListenVXLAN   = listenVXLAN
+	ParseGENEVE   = parseGENEVE
+	ListenGENEVE  = listenGENEVE
+	ParseERSPAN   = parseERSPAN
 	NewPacketData = newPacketData
 	NewEmitter    = newEmitter
 	NewDumper     = newDumper
+	Strftime      = strftime
 
 	NewJSONPacketDumper = newJSONPacketDumper
 	NewPcapDumper       = newPcapDumper
+	NewPcapngDumper     = newPcapngDumper
+	StrftimePattern     = strftimePattern
 )
 
-type PacketData packetData
 type JSONRecord jsonRecord
 
-func ToPacketDataSlice(pkt *packetData) []*packetData {
-	return []*packetData{pkt}
-}
-
-func JSONPacketDumperDump(d dumper, packets []*packetData, w io.Writer) error {
-	if err := d.(*jsonPacketDumper).open(w); err != nil {
-		return err
-	}
-	if err := d.(*jsonPacketDumper).dump(packets, w); err != nil {
-		return err
+func StartUDPSources(port, receivers, batchSize, queueSize int, policy string) (chan *udpQueue, func() ReceiveStats, func()) {
+	sources := newUDPSources(port, receivers, tunnelVXLAN, parseVXLAN)
+	for _, src := range sources {
+		src.(*packetConnSource).batchSize = batchSize
 	}
-	if err := d.(*jsonPacketDumper).close(w); err != nil {
-		return err
+	queue := newReceiveQueue(queueSize, policy, nil)
+	ch := startSources(sources, queue)
+	return ch, queue.stats.snapshot, func() {
+		for _, src := range sources {
+			src.(*packetConnSource).close()
+		}
 	}
-	return nil
 }
 
-func PcapDumperDump(d dumper, packets []*packetData, w io.Writer) error {
-	if err := d.(*pcapDumper).open(w); err != nil {
-		return err
-	}
-	if err := d.(*pcapDumper).dump(packets, w); err != nil {
-		return err
+func NewReceiveQueue(size int, policy string) *receiveQueue {
+	return newReceiveQueue(size, policy, nil)
+}
+
+func ReceiveQueuePush(q *receiveQueue, pkt *Packet) {
+	q.push(pkt)
+}
+
+func ReceiveQueuePushError(q *receiveQueue, err error) {
+	q.pushError(err)
+}
+
+func ReceiveQueuePutBack(q *receiveQueue, err error) {
+	q.putBack(&udpQueue{Err: err})
+}
+
+func ReceiveQueueAbort(q *receiveQueue) {
+	q.abort()
+}
+
+func ReceiveQueueChan(q *receiveQueue) chan *udpQueue {
+	return q.ch
+}
+
+func ReceiveQueueStats(q *receiveQueue) ReceiveStats {
+	return q.stats.snapshot()
+}
+
+func StartWorkers(proc Processor, queueCh chan *udpQueue, n int) (chan struct{}, func()) {
+	workers := startWorkers(proc, queueCh, n)
+	return workers.done, workers.stop
+}
+
+func TakeOver(proc, prev *PacketProcessor) {
+	proc.takeOver(prev)
+}
+
+// SetFsEmitterClock replaces current time of fs emitter of default route.
+func SetFsEmitterClock(proc *PacketProcessor, now func() time.Time) {
+	proc.emitter.(*syncEmitter).Emitter.(*fsStreamEmitter).now = now
+}
+
+func MatchFilter(expr string, data []byte) (bool, error) {
+	f, err := compileFilter(expr)
+	if err != nil {
+		return false, err
 	}
-	if err := d.(*pcapDumper).close(w); err != nil {
-		return err
+	return f.match(data), nil
+}
+
+func AssembleFilter(expr string) ([]bpf.RawInstruction, error) {
+	f, err := compileFilter(expr)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return bpf.Assemble(f.program)
 }
 
 // -------------------------
@@ -63,7 +116,130 @@ func (x *FirehoseTestClient) PutRecordBatch(input *firehose.PutRecordBatchInput)
 }
 
 func ReplaceNewFirehoseClient(client vxcapFirehoseClient) {
-	newFirehoseClient = func(string) vxcapFirehoseClient {
-		return client
+	newFirehoseClient = func(EmitterArguments) (vxcapFirehoseClient, error) {
+		return client, nil
+	}
+}
+
+// -------------------------
+// S3 uploader mock
+type S3TestUploader struct {
+	Input   []*s3manager.UploadInput
+	Objects map[string][]byte // Body by key
+	Err     error
+	Fail    func(key string) bool // Upload fails with Err only if true, all fail if nil
+}
+
+func (x *S3TestUploader) Upload(input *s3manager.UploadInput, opts ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	x.Input = append(x.Input, input)
+	if x.Err != nil && (x.Fail == nil || x.Fail(*input.Key)) {
+		return nil, x.Err
+	}
+
+	body, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	if x.Objects == nil {
+		x.Objects = make(map[string][]byte)
+	}
+	x.Objects[*input.Key] = body
+	return &s3manager.UploadOutput{}, nil
+}
+
+// ReplaceNewS3Uploader replaces uploader of S3 emitter and returns function
+// to restore it.
+func ReplaceNewS3Uploader(uploader vxcapS3Uploader) func() {
+	orig := newS3Uploader
+	newS3Uploader = func(EmitterArguments) (vxcapS3Uploader, error) {
+		return uploader, nil
+	}
+	return func() { newS3Uploader = orig }
+}
+
+// -------------------------
+// Kinesis client mock
+type KinesisTestClient struct {
+	Input []*kinesis.PutRecordsInput
+	Fail  func(record *kinesis.PutRecordsRequestEntry) bool // Record fails if true
+}
+
+func (x *KinesisTestClient) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	x.Input = append(x.Input, input)
+
+	output := &kinesis.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+	for _, record := range input.Records {
+		result := &kinesis.PutRecordsResultEntry{}
+		if x.Fail != nil && x.Fail(record) {
+			result.ErrorCode = aws.String("ProvisionedThroughputExceededException")
+			*output.FailedRecordCount++
+		}
+		output.Records = append(output.Records, result)
+	}
+	return output, nil
+}
+
+// ReplaceNewKinesisClient replaces client of Kinesis emitter and shortens wait
+// of retry, and returns function to restore them.
+func ReplaceNewKinesisClient(client vxcapKinesisClient) func() {
+	orig, origWait := newKinesisClient, kinesisRetryWait
+	newKinesisClient = func(EmitterArguments) (vxcapKinesisClient, error) {
+		return client, nil
+	}
+	kinesisRetryWait = time.Millisecond
+	return func() { newKinesisClient, kinesisRetryWait = orig, origWait }
+}
+
+// -------------------------
+// Kafka producer mock
+type KafkaTestProducer struct {
+	Messages []*sarama.ProducerMessage
+	Err      error
+	Closed   bool
+}
+
+func (x *KafkaTestProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	return 0, 0, x.SendMessages([]*sarama.ProducerMessage{msg})
+}
+
+func (x *KafkaTestProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	if x.Err != nil {
+		return x.Err
+	}
+	x.Messages = append(x.Messages, msgs...)
+	return nil
+}
+
+func (x *KafkaTestProducer) Close() error {
+	x.Closed = true
+	return nil
+}
+
+// ReplaceNewKafkaProducer replaces producer of Kafka emitter and returns
+// function to restore it.
+func ReplaceNewKafkaProducer(producer sarama.SyncProducer) func() {
+	orig := newKafkaProducer
+	newKafkaProducer = func([]string, *sarama.Config) (sarama.SyncProducer, error) {
+		return producer, nil
+	}
+	return func() { newKafkaProducer = orig }
+}
+
+func NewKafkaConfig(args EmitterArguments) (*sarama.Config, error) {
+	return newKafkaConfig(args)
+}
+
+func RenderS3Key(tmpl, prefix string, vni uint32, sensor string, t time.Time, uuid, ext string) (string, error) {
+	x, err := parseS3KeyTemplate(tmpl)
+	if err != nil {
+		return "", err
 	}
+	return x.render(s3KeyParams{
+		Prefix: prefix,
+		VNI:    vni,
+		Sensor: sensor,
+		Time:   t,
+		UUID:   uuid,
+		Ext:    ext,
+	}), nil
 }
@@ -0,0 +1,1103 @@
+package vxcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/bpf"
+)
+
+// packetFilter is tcpdump style filter expression compiled to BPF program.
+// The program runs on inner (decapsulated) Ethernet frame. Supported syntax is
+// pcap-filter(7) except host and port names:
+//
+//   - [ether|ip|ip6|arp|rarp] [src|dst] host <address>
+//   - [ip|ip6|arp|rarp] [src|dst] net <network> [mask <mask>]
+//   - [ip|ip6|tcp|udp|sctp] [src|dst] port <number>
+//   - [ip|ip6|tcp|udp|sctp] [src|dst] portrange <number>-<number>
+//   - [ip|ip6] proto <number|name>, ether proto <number|name>
+//   - ether|ip|ip6|arp|rarp|tcp|udp|sctp|icmp|icmp6|igmp
+//   - [ether|ip|ip6] broadcast|multicast
+//   - vlan [<VLAN ID>]
+//   - less <length>, greater <length>
+//   - <arithmetic expression> <relop> <arithmetic expression>, e.g. "tcp[13] & 2 != 0"
+//   - and (&&), or (||), not (!) and parentheses
+//
+// As libpcap, "and" and "or" have the same precedence and are left associative,
+// qualifiers can be omitted after and/or, e.g. "host 10.0.0.1 or 10.0.0.2", and
+// "vlan" shifts offsets of network layer for following primitives.
+type packetFilter struct {
+	vm      *bpf.VM
+	program []bpf.Instruction
+}
+
+func (x *packetFilter) match(data []byte) bool {
+	n, err := x.vm.Run(data)
+	return err == nil && n > 0
+}
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeIPv6 = 0x86dd
+	etherTypeARP  = 0x0806
+	etherTypeRARP = 0x8035
+)
+
+// filterProtos is names of protocol qualifier. They can be also used for
+// packet access, e.g. "tcp[13]".
+var filterProtos = map[string]bool{
+	"ether": true, "ip": true, "ip6": true, "arp": true, "rarp": true,
+	"tcp": true, "udp": true, "sctp": true, "icmp": true, "icmp6": true, "igmp": true,
+}
+
+var filterEtherTypes = map[string]uint32{
+	"ip":   etherTypeIPv4,
+	"ip6":  etherTypeIPv6,
+	"arp":  etherTypeARP,
+	"rarp": etherTypeRARP,
+}
+
+// filterIPProtocols is names of protocol for "proto" primitive.
+var filterIPProtocols = map[string]uint32{
+	"icmp":  1,
+	"igmp":  2,
+	"tcp":   6,
+	"udp":   17,
+	"gre":   47,
+	"esp":   50,
+	"ah":    51,
+	"icmp6": 58,
+	"sctp":  132,
+}
+
+// filterArithConsts is named constants in arithmetic expression.
+var filterArithConsts = map[string]uint32{
+	"tcpflags": 13,
+	"tcp-fin":  0x01,
+	"tcp-syn":  0x02,
+	"tcp-rst":  0x04,
+	"tcp-push": 0x08,
+	"tcp-ack":  0x10,
+	"tcp-urg":  0x20,
+	"tcp-ece":  0x40,
+	"tcp-cwr":  0x80,
+
+	"icmptype":           0,
+	"icmpcode":           1,
+	"icmp-echoreply":     0,
+	"icmp-unreach":       3,
+	"icmp-sourcequench":  4,
+	"icmp-redirect":      5,
+	"icmp-echo":          8,
+	"icmp-routeradvert":  9,
+	"icmp-routersolicit": 10,
+	"icmp-timxceed":      11,
+	"icmp-paramprob":     12,
+	"icmp-tstamp":        13,
+	"icmp-tstampreply":   14,
+	"icmp-ireq":          15,
+	"icmp-ireqreply":     16,
+	"icmp-maskreq":       17,
+	"icmp-maskreply":     18,
+
+	"icmp6type":             0,
+	"icmp6code":             1,
+	"icmp6-echo":            128,
+	"icmp6-echoreply":       129,
+	"icmp6-routersolicit":   133,
+	"icmp6-routeradvert":    134,
+	"icmp6-neighborsolicit": 135,
+	"icmp6-neighboradvert":  136,
+}
+
+// filterArithOps is binary operators of arithmetic expression from lower precedence.
+var filterArithOps = []map[string]bpf.ALUOp{
+	{"|": bpf.ALUOpOr, "^": bpf.ALUOpXor},
+	{"&": bpf.ALUOpAnd},
+	{"<<": bpf.ALUOpShiftLeft, ">>": bpf.ALUOpShiftRight},
+	{"+": bpf.ALUOpAdd, "-": bpf.ALUOpSub},
+	{"*": bpf.ALUOpMul, "/": bpf.ALUOpDiv, "%": bpf.ALUOpMod},
+}
+
+var filterRelOps = map[string]bpf.JumpTest{
+	">":  bpf.JumpGreaterThan,
+	"<":  bpf.JumpLessThan,
+	">=": bpf.JumpGreaterOrEqual,
+	"<=": bpf.JumpLessOrEqual,
+	"=":  bpf.JumpEqual,
+	"==": bpf.JumpEqual,
+	"!=": bpf.JumpNotEqual,
+}
+
+var filterTwoCharOps = map[string]bool{
+	"&&": true, "||": true, "==": true, "!=": true, ">=": true, "<=": true, "<<": true, ">>": true,
+}
+
+// filterQualifier is a set of qualifiers of primitive, e.g. "tcp src port".
+type filterQualifier struct {
+	proto string
+	dir   string
+	typ   string
+}
+
+type filterParser struct {
+	tokens  []string
+	pos     int
+	last    *filterQualifier // Qualifiers of the last primitive to be inherited
+	linkOff uint32           // Length of VLAN tags before network layer
+	scratch uint32           // Number of used scratch memory slots
+}
+
+func tokenizeFilter(expr string) []string {
+	var tokens []string
+	var cur strings.Builder
+	depth := 0 // Depth of brackets. '-', '/' and ':' are operators in brackets
+
+	flush := func() {
+		if cur.Len() > 0 {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+		}
+	}
+
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			flush()
+
+		case depth == 0 && (c == ':' || (c == '-' || c == '/') && cur.Len() > 0):
+			// Part of address, network, port range or named constant
+			cur.WriteByte(c)
+
+		case strings.IndexByte("()[]:+-*/%&|^<>=!", c) >= 0:
+			flush()
+			op := string(c)
+			if i+1 < len(expr) && filterTwoCharOps[expr[i:i+2]] {
+				op = expr[i : i+2]
+				i++
+			}
+
+			switch op {
+			case "[":
+				depth++
+			case "]":
+				depth--
+			case "&&":
+				op = "and"
+			case "||":
+				op = "or"
+			case "!":
+				op = "not"
+			}
+			tokens = append(tokens, op)
+
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	flush()
+
+	return tokens
+}
+
+// compileFilter compiles filter expression to BPF program. It returns nil if
+// expr is empty.
+func compileFilter(expr string) (*packetFilter, error) {
+	p := &filterParser{tokens: tokenizeFilter(expr)}
+	if len(p.tokens) == 0 {
+		return nil, nil
+	}
+
+	node, err := p.parseExpr()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid filter expression: %s", expr)
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("Invalid filter expression: %s, unexpected token '%s'", expr, p.tokens[p.pos])
+	}
+
+	program, err := generateFilterProgram(node)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to compile filter expression: %s", expr)
+	}
+
+	vm, err := bpf.NewVM(program)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to load BPF program of filter: %s", expr)
+	}
+
+	return &packetFilter{vm: vm, program: program}, nil
+}
+
+func (x *filterParser) peek() string {
+	return x.peekAt(0)
+}
+
+func (x *filterParser) peekAt(n int) string {
+	if x.pos+n < len(x.tokens) {
+		return x.tokens[x.pos+n]
+	}
+	return ""
+}
+
+func (x *filterParser) next() (string, error) {
+	if x.pos >= len(x.tokens) {
+		return "", fmt.Errorf("Unexpected end of expression")
+	}
+	x.pos++
+	return x.tokens[x.pos-1], nil
+}
+
+func (x *filterParser) expect(tkn string) error {
+	if next, err := x.next(); err != nil || next != tkn {
+		return fmt.Errorf("'%s' is required", tkn)
+	}
+	return nil
+}
+
+func (x *filterParser) parseExpr() (filterNode, error) {
+	left, err := x.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+
+	for x.peek() == "and" || x.peek() == "or" {
+		op, _ := x.next()
+		right, err := x.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+
+		if op == "and" {
+			left = &filterAnd{left, right}
+		} else {
+			left = &filterOr{left, right}
+		}
+	}
+	return left, nil
+}
+
+func (x *filterParser) parseTerm() (filterNode, error) {
+	switch {
+	case x.peek() == "not":
+		x.pos++
+		node, err := x.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNot{node}, nil
+
+	case x.peek() == "(":
+		// Parenthesis is either of boolean expression and arithmetic expression
+		saved := *x
+		x.pos++
+		node, err := x.parseExpr()
+		if err == nil && x.peek() == ")" && !isFilterOperator(x.peekAt(1)) {
+			x.pos++
+			return node, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("Parenthesis is not closed")
+		}
+
+		*x = saved
+		rel, relErr := x.parseRelation()
+		if relErr != nil {
+			return nil, err
+		}
+		return rel, nil
+
+	case x.isRelation():
+		return x.parseRelation()
+	}
+
+	return x.parsePrimitive()
+}
+
+func isFilterDelimiter(tkn string) bool {
+	return tkn == "" || tkn == "and" || tkn == "or" || tkn == ")"
+}
+
+func isFilterOperator(tkn string) bool {
+	if _, ok := filterRelOps[tkn]; ok {
+		return true
+	}
+	for _, ops := range filterArithOps {
+		if _, ok := ops[tkn]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func parseFilterNumber(tkn string) (uint32, error) {
+	n, err := strconv.ParseUint(tkn, 0, 32)
+	return uint32(n), err
+}
+
+func (x *filterParser) isRelation() bool {
+	tkn := x.peek()
+	switch {
+	case tkn == "len" || tkn == "-":
+		return true
+	case filterProtos[tkn]:
+		return x.peekAt(1) == "["
+	}
+
+	_, isConst := filterArithConsts[tkn]
+	if _, err := parseFilterNumber(tkn); err == nil || isConst {
+		return isFilterOperator(x.peekAt(1))
+	}
+	return false
+}
+
+func (x *filterParser) parsePrimitive() (filterNode, error) {
+	tkn, err := x.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tkn {
+	case "less", "greater":
+		arg, err := x.next()
+		if err != nil {
+			return nil, err
+		}
+		n, err := parseFilterNumber(arg)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid length for %s: %s", tkn, arg)
+		}
+		cond := bpf.JumpLessOrEqual
+		if tkn == "greater" {
+			cond = bpf.JumpGreaterOrEqual
+		}
+		return &filterTest{load: []bpf.Instruction{bpf.LoadExtension{Num: bpf.ExtLen}}, cond: cond, val: n}, nil
+
+	case "vlan":
+		return x.vlanNode()
+	}
+
+	var q filterQualifier
+	if filterProtos[tkn] {
+		q.proto = tkn
+		if isFilterDelimiter(x.peek()) {
+			return x.protoAbbrevNode(tkn)
+		}
+		if tkn, err = x.next(); err != nil {
+			return nil, err
+		}
+	}
+	if tkn == "src" || tkn == "dst" {
+		q.dir = tkn
+		if op := x.peek(); (op == "or" || op == "and") && x.peekAt(1) != tkn &&
+			(x.peekAt(1) == "src" || x.peekAt(1) == "dst") {
+			q.dir = "src " + op + " dst"
+			x.pos += 2
+		}
+		if tkn, err = x.next(); err != nil {
+			return nil, err
+		}
+	}
+	switch tkn {
+	case "host", "net", "port", "portrange", "proto":
+		q.typ = tkn
+		if tkn, err = x.next(); err != nil {
+			return nil, err
+		}
+	case "broadcast", "multicast":
+		if q.dir == "" {
+			return x.castNode(q.proto, tkn)
+		}
+	}
+	if isFilterDelimiter(tkn) {
+		return nil, fmt.Errorf("ID is required after qualifiers")
+	}
+
+	if q == (filterQualifier{}) && x.last != nil {
+		// No qualifier, inherit from the last primitive
+		q = *x.last
+	} else if q.typ == "" {
+		q.typ = "host"
+	}
+	x.last = &q
+
+	switch q.typ {
+	case "host":
+		return x.hostNode(q, tkn)
+	case "net":
+		return x.netNode(q, tkn)
+	case "port", "portrange":
+		return x.portNode(q, tkn)
+	case "proto":
+		return x.protoNode(q, tkn)
+	}
+
+	return nil, fmt.Errorf("Unknown type: %s", q.typ)
+}
+
+// -------------------------
+// Arithmetic expression
+
+// filterArith is arithmetic expression. It's constant val if code is nil,
+// otherwise code leaves the value in register A. conds are protocol checks
+// required to load the value, e.g. "tcp[0]" requires TCP over IPv4.
+type filterArith struct {
+	val   uint32
+	code  []bpf.Instruction
+	conds []filterNode
+}
+
+func (x *filterArith) load() []bpf.Instruction {
+	if x.code == nil {
+		return []bpf.Instruction{bpf.LoadConstant{Dst: bpf.RegA, Val: x.val}}
+	}
+	return x.code
+}
+
+func concatInsts(insts []bpf.Instruction, more ...bpf.Instruction) []bpf.Instruction {
+	return append(append([]bpf.Instruction{}, insts...), more...)
+}
+
+func concatNodes(nodes []filterNode, more ...filterNode) []filterNode {
+	return append(append([]filterNode{}, nodes...), more...)
+}
+
+func (x *filterParser) allocScratch() (int, error) {
+	if x.scratch >= 16 {
+		return 0, fmt.Errorf("Filter expression is too complex, no more scratch memory")
+	}
+	x.scratch++
+	return int(x.scratch - 1), nil
+}
+
+func (x *filterParser) parseRelation() (filterNode, error) {
+	left, err := x.parseArith(0)
+	if err != nil {
+		return nil, err
+	}
+
+	op, err := x.next()
+	if err != nil {
+		return nil, err
+	}
+	cond, ok := filterRelOps[op]
+	if !ok {
+		return nil, fmt.Errorf("Relational operator is required, but got '%s'", op)
+	}
+
+	right, err := x.parseArith(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if left.code == nil && right.code == nil {
+		return filterConst(evalFilterRel(cond, left.val, right.val)), nil
+	}
+
+	conds := concatNodes(left.conds, right.conds...)
+	if right.code == nil {
+		return andNodes(append(conds, &filterTest{load: left.load(), cond: cond, val: right.val})...), nil
+	}
+
+	slot, err := x.allocScratch()
+	if err != nil {
+		return nil, err
+	}
+	load := concatInsts(right.code, bpf.StoreScratch{Src: bpf.RegA, N: slot})
+	load = concatInsts(load, left.load()...)
+	load = concatInsts(load, bpf.LoadScratch{Dst: bpf.RegX, N: slot})
+	return andNodes(append(conds, &filterTest{load: load, cond: cond, cmpX: true})...), nil
+}
+
+func (x *filterParser) parseArith(level int) (*filterArith, error) {
+	if level == len(filterArithOps) {
+		return x.parseArithUnary()
+	}
+
+	left, err := x.parseArith(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op, ok := filterArithOps[level][x.peek()]
+		if !ok {
+			return left, nil
+		}
+		x.pos++
+
+		right, err := x.parseArith(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		if left, err = x.arithOp(op, left, right); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (x *filterParser) parseArithUnary() (*filterArith, error) {
+	tkn, err := x.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case tkn == "-":
+		arith, err := x.parseArithUnary()
+		if err != nil {
+			return nil, err
+		}
+		if arith.code == nil {
+			return &filterArith{val: -arith.val}, nil
+		}
+		return &filterArith{code: concatInsts(arith.code, bpf.NegateA{}), conds: arith.conds}, nil
+
+	case tkn == "(":
+		arith, err := x.parseArith(0)
+		if err != nil {
+			return nil, err
+		}
+		if err := x.expect(")"); err != nil {
+			return nil, err
+		}
+		return arith, nil
+
+	case tkn == "len":
+		return &filterArith{code: []bpf.Instruction{bpf.LoadExtension{Num: bpf.ExtLen}}}, nil
+
+	case filterProtos[tkn]:
+		if err := x.expect("["); err != nil {
+			return nil, err
+		}
+		idx, err := x.parseArith(0)
+		if err != nil {
+			return nil, err
+		}
+
+		size := 1
+		if x.peek() == ":" {
+			x.pos++
+			arg, err := x.next()
+			if err != nil {
+				return nil, err
+			}
+			if size, err = strconv.Atoi(arg); err != nil || (size != 1 && size != 2 && size != 4) {
+				return nil, fmt.Errorf("Size of packet access must be 1, 2 or 4: %s", arg)
+			}
+		}
+		if err := x.expect("]"); err != nil {
+			return nil, err
+		}
+		return x.packetAccess(tkn, idx, size), nil
+	}
+
+	if v, ok := filterArithConsts[tkn]; ok {
+		return &filterArith{val: v}, nil
+	}
+	n, err := parseFilterNumber(tkn)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid arithmetic expression: %s", tkn)
+	}
+	return &filterArith{val: n}, nil
+}
+
+func (x *filterParser) arithOp(op bpf.ALUOp, left, right *filterArith) (*filterArith, error) {
+	if (op == bpf.ALUOpDiv || op == bpf.ALUOpMod) && right.code == nil && right.val == 0 {
+		return nil, fmt.Errorf("Division by zero")
+	}
+
+	if left.code == nil && right.code == nil {
+		return &filterArith{val: evalFilterALU(op, left.val, right.val)}, nil
+	}
+
+	conds := concatNodes(left.conds, right.conds...)
+	if right.code == nil {
+		return &filterArith{code: concatInsts(left.code, bpf.ALUOpConstant{Op: op, Val: right.val}), conds: conds}, nil
+	}
+
+	slot, err := x.allocScratch()
+	if err != nil {
+		return nil, err
+	}
+	code := concatInsts(right.code, bpf.StoreScratch{Src: bpf.RegA, N: slot})
+	code = concatInsts(code, left.load()...)
+	code = concatInsts(code, bpf.LoadScratch{Dst: bpf.RegX, N: slot}, bpf.ALUOpX{Op: op})
+	return &filterArith{code: code, conds: conds}, nil
+}
+
+func evalFilterALU(op bpf.ALUOp, a, b uint32) uint32 {
+	switch op {
+	case bpf.ALUOpAdd:
+		return a + b
+	case bpf.ALUOpSub:
+		return a - b
+	case bpf.ALUOpMul:
+		return a * b
+	case bpf.ALUOpDiv:
+		return a / b
+	case bpf.ALUOpMod:
+		return a % b
+	case bpf.ALUOpOr:
+		return a | b
+	case bpf.ALUOpAnd:
+		return a & b
+	case bpf.ALUOpXor:
+		return a ^ b
+	case bpf.ALUOpShiftLeft:
+		return a << b
+	case bpf.ALUOpShiftRight:
+		return a >> b
+	}
+	return 0
+}
+
+func evalFilterRel(cond bpf.JumpTest, a, b uint32) bool {
+	switch cond {
+	case bpf.JumpGreaterThan:
+		return a > b
+	case bpf.JumpLessThan:
+		return a < b
+	case bpf.JumpGreaterOrEqual:
+		return a >= b
+	case bpf.JumpLessOrEqual:
+		return a <= b
+	case bpf.JumpEqual:
+		return a == b
+	case bpf.JumpNotEqual:
+		return a != b
+	}
+	return false
+}
+
+// packetAccess generates "proto[idx:size]". Index of transport protocols is
+// relative to the header after IPv4 header with options.
+func (x *filterParser) packetAccess(proto string, idx *filterArith, size int) *filterArith {
+	nl := x.netOff()
+	var base uint32
+	var cond filterNode
+	transport := false
+
+	switch proto {
+	case "ether":
+	case "ip", "ip6", "arp", "rarp":
+		base, cond = nl, x.etherType(filterEtherTypes[proto])
+	case "icmp6":
+		base, cond = nl+40, x.ipProto6(filterIPProtocols[proto])
+	default:
+		transport = true
+		cond = andNodes(x.ipProto4(filterIPProtocols[proto]), x.notFragment())
+	}
+
+	var code []bpf.Instruction
+	switch {
+	case idx.code == nil && !transport:
+		code = []bpf.Instruction{bpf.LoadAbsolute{Off: base + idx.val, Size: size}}
+	case idx.code == nil:
+		code = []bpf.Instruction{bpf.LoadMemShift{Off: nl}, bpf.LoadIndirect{Off: nl + idx.val, Size: size}}
+	case !transport:
+		code = concatInsts(idx.code, bpf.TAX{}, bpf.LoadIndirect{Off: base, Size: size})
+	default:
+		code = concatInsts(idx.code, bpf.LoadMemShift{Off: nl}, bpf.ALUOpX{Op: bpf.ALUOpAdd},
+			bpf.TAX{}, bpf.LoadIndirect{Off: nl, Size: size})
+	}
+
+	conds := idx.conds
+	if cond != nil {
+		conds = concatNodes(conds, cond)
+	}
+	return &filterArith{code: code, conds: conds}
+}
+
+// -------------------------
+// Primitives
+
+// netOff returns offset of network layer header.
+func (x *filterParser) netOff() uint32 {
+	return 14 + x.linkOff
+}
+
+func loadFilterValue(off uint32, size int) []bpf.Instruction {
+	return []bpf.Instruction{bpf.LoadAbsolute{Off: off, Size: size}}
+}
+
+func (x *filterParser) etherType(t uint32) filterNode {
+	return &filterTest{load: loadFilterValue(12+x.linkOff, 2), cond: bpf.JumpEqual, val: t}
+}
+
+func (x *filterParser) ipProto4(protos ...uint32) filterNode {
+	var nodes []filterNode
+	for _, p := range protos {
+		nodes = append(nodes, &filterTest{load: loadFilterValue(x.netOff()+9, 1), cond: bpf.JumpEqual, val: p})
+	}
+	return andNodes(x.etherType(etherTypeIPv4), orNodes(nodes...))
+}
+
+func (x *filterParser) ipProto6(protos ...uint32) filterNode {
+	var nodes []filterNode
+	for _, p := range protos {
+		nodes = append(nodes, &filterTest{load: loadFilterValue(x.netOff()+6, 1), cond: bpf.JumpEqual, val: p})
+	}
+	return andNodes(x.etherType(etherTypeIPv6), orNodes(nodes...))
+}
+
+// notFragment matches IPv4 packet of the first fragment that has transport header.
+func (x *filterParser) notFragment() filterNode {
+	return &filterTest{load: loadFilterValue(x.netOff()+6, 2), cond: bpf.JumpBitsNotSet, val: 0x1fff}
+}
+
+func filterDir(dir string, src, dst filterNode) filterNode {
+	switch dir {
+	case "src":
+		return src
+	case "dst":
+		return dst
+	case "src and dst":
+		return andNodes(src, dst)
+	default:
+		return orNodes(src, dst)
+	}
+}
+
+func (x *filterParser) vlanNode() (filterNode, error) {
+	off := x.linkOff
+	x.linkOff += 4
+
+	var tags []filterNode
+	for _, t := range []uint32{0x8100, 0x88a8, 0x9100} {
+		tags = append(tags, &filterTest{load: loadFilterValue(12+off, 2), cond: bpf.JumpEqual, val: t})
+	}
+	node := orNodes(tags...)
+
+	if isFilterDelimiter(x.peek()) {
+		return node, nil
+	}
+	arg, _ := x.next()
+	id, err := strconv.ParseUint(arg, 10, 12)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid VLAN ID: %s", arg)
+	}
+	load := concatInsts(loadFilterValue(14+off, 2), bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0x0fff})
+	return andNodes(node, &filterTest{load: load, cond: bpf.JumpEqual, val: uint32(id)}), nil
+}
+
+func (x *filterParser) protoAbbrevNode(proto string) (filterNode, error) {
+	switch proto {
+	case "ip", "ip6", "arp", "rarp":
+		return x.etherType(filterEtherTypes[proto]), nil
+	case "tcp", "udp", "sctp":
+		p := filterIPProtocols[proto]
+		return orNodes(x.ipProto6(p), x.ipProto4(p)), nil
+	case "icmp", "igmp":
+		return x.ipProto4(filterIPProtocols[proto]), nil
+	case "icmp6":
+		return x.ipProto6(filterIPProtocols[proto]), nil
+	}
+	return nil, fmt.Errorf("'%s' requires qualifiers", proto)
+}
+
+func (x *filterParser) castNode(proto, cast string) (filterNode, error) {
+	switch {
+	case (proto == "" || proto == "ether") && cast == "broadcast":
+		return andNodes(
+			&filterTest{load: loadFilterValue(2, 4), cond: bpf.JumpEqual, val: 0xffffffff},
+			&filterTest{load: loadFilterValue(0, 2), cond: bpf.JumpEqual, val: 0xffff},
+		), nil
+	case (proto == "" || proto == "ether") && cast == "multicast":
+		return &filterTest{load: loadFilterValue(0, 1), cond: bpf.JumpBitsSet, val: 1}, nil
+	case proto == "ip" && cast == "multicast":
+		return andNodes(x.etherType(etherTypeIPv4),
+			&filterTest{load: loadFilterValue(x.netOff()+16, 1), cond: bpf.JumpGreaterOrEqual, val: 224}), nil
+	case proto == "ip6" && cast == "multicast":
+		return andNodes(x.etherType(etherTypeIPv6),
+			&filterTest{load: loadFilterValue(x.netOff()+24, 1), cond: bpf.JumpEqual, val: 0xff}), nil
+	}
+	return nil, fmt.Errorf("'%s %s' is not supported", proto, cast)
+}
+
+func (x *filterParser) hostNode(q filterQualifier, id string) (filterNode, error) {
+	if q.proto == "" || q.proto == "ether" {
+		if mac, err := net.ParseMAC(id); err == nil && len(mac) == 6 {
+			return x.etherHost(q.dir, mac), nil
+		}
+		if q.proto == "ether" {
+			return nil, fmt.Errorf("Invalid MAC address: %s", id)
+		}
+	}
+
+	ip := net.ParseIP(id)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid host address: %s (host name is not supported)", id)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return x.ipv4Net(q, binary.BigEndian.Uint32(ip4), 0xffffffff)
+	}
+	return x.ipv6Net(q, ip, 128)
+}
+
+func (x *filterParser) netNode(q filterQualifier, id string) (filterNode, error) {
+	if x.peek() == "mask" {
+		x.pos++
+		arg, err := x.next()
+		if err != nil {
+			return nil, err
+		}
+		ip, mask := net.ParseIP(id).To4(), net.ParseIP(arg).To4()
+		if ip == nil || mask == nil {
+			return nil, fmt.Errorf("Invalid network: %s mask %s", id, arg)
+		}
+		addr, bits := binary.BigEndian.Uint32(ip), binary.BigEndian.Uint32(mask)
+		if addr&^bits != 0 {
+			return nil, fmt.Errorf("Non-network bits set in %s mask %s", id, arg)
+		}
+		return x.ipv4Net(q, addr, bits)
+	}
+
+	if strings.Contains(id, ":") {
+		if !strings.Contains(id, "/") {
+			id += "/128"
+		}
+		ip, ipnet, err := net.ParseCIDR(id)
+		if err != nil || ip.To4() != nil {
+			return nil, fmt.Errorf("Invalid network: %s", id)
+		}
+		if !ip.Equal(ipnet.IP) {
+			return nil, fmt.Errorf("Non-network bits set in %s", id)
+		}
+		bits, _ := ipnet.Mask.Size()
+		return x.ipv6Net(q, ipnet.IP, bits)
+	}
+
+	addr, mask, err := parseFilterIPv4Net(id)
+	if err != nil {
+		return nil, err
+	}
+	return x.ipv4Net(q, addr, mask)
+}
+
+// parseFilterIPv4Net parses IPv4 network such as "10.0.0.0/8", "10.1.2.3" and
+// "10.1" (same as 10.1.0.0/16).
+func parseFilterIPv4Net(id string) (uint32, uint32, error) {
+	s, bits := id, -1
+	if i := strings.IndexByte(id, '/'); i >= 0 {
+		n, err := strconv.Atoi(id[i+1:])
+		if err != nil || n < 0 || n > 32 {
+			return 0, 0, fmt.Errorf("Invalid network: %s", id)
+		}
+		s, bits = id[:i], n
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) > 4 {
+		return 0, 0, fmt.Errorf("Invalid network: %s", id)
+	}
+	var addr uint32
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Invalid network: %s", id)
+		}
+		addr |= uint32(n) << uint(24-8*i)
+	}
+
+	if bits < 0 {
+		bits = 8 * len(parts)
+	}
+	mask := uint32(0xffffffff) << uint(32-bits)
+	if addr&^mask != 0 {
+		return 0, 0, fmt.Errorf("Non-network bits set in %s", id)
+	}
+	return addr, mask, nil
+}
+
+func (x *filterParser) etherHost(dir string, mac net.HardwareAddr) filterNode {
+	addrNode := func(off uint32) filterNode {
+		return andNodes(
+			&filterTest{load: loadFilterValue(off+2, 4), cond: bpf.JumpEqual, val: binary.BigEndian.Uint32(mac[2:])},
+			&filterTest{load: loadFilterValue(off, 2), cond: bpf.JumpEqual, val: uint32(binary.BigEndian.Uint16(mac))},
+		)
+	}
+	return filterDir(dir, addrNode(6), addrNode(0))
+}
+
+func addrFilterTest(off, addr, mask uint32) filterNode {
+	load := loadFilterValue(off, 4)
+	if mask != 0xffffffff {
+		load = concatInsts(load, bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: mask})
+	}
+	return &filterTest{load: load, cond: bpf.JumpEqual, val: addr & mask}
+}
+
+func (x *filterParser) ipv4Net(q filterQualifier, addr, mask uint32) (filterNode, error) {
+	var types []string
+	switch q.proto {
+	case "":
+		types = []string{"ip", "arp", "rarp"}
+	case "ip", "arp", "rarp":
+		types = []string{q.proto}
+	default:
+		return nil, fmt.Errorf("'%s %s' is not supported for IPv4 address", q.proto, q.typ)
+	}
+
+	nl := x.netOff()
+	var nodes []filterNode
+	for _, t := range types {
+		src, dst := nl+12, nl+16 // IPv4 header
+		if t != "ip" {
+			src, dst = nl+14, nl+24 // Sender and target protocol address of ARP
+		}
+		nodes = append(nodes, andNodes(
+			x.etherType(filterEtherTypes[t]),
+			filterDir(q.dir, addrFilterTest(src, addr, mask), addrFilterTest(dst, addr, mask)),
+		))
+	}
+	return orNodes(nodes...), nil
+}
+
+func (x *filterParser) ipv6Net(q filterQualifier, ip net.IP, bits int) (filterNode, error) {
+	if q.proto != "" && q.proto != "ip6" {
+		return nil, fmt.Errorf("'%s %s' is not supported for IPv6 address", q.proto, q.typ)
+	}
+
+	addrNode := func(off uint32) filterNode {
+		var nodes []filterNode
+		for i := 0; i < 4 && bits > 32*i; i++ {
+			mask := uint32(0xffffffff)
+			if b := bits - 32*i; b < 32 {
+				mask <<= uint(32 - b)
+			}
+			nodes = append(nodes, addrFilterTest(off+uint32(4*i), binary.BigEndian.Uint32(ip[4*i:]), mask))
+		}
+		if len(nodes) == 0 {
+			return filterConst(true)
+		}
+		return andNodes(nodes...)
+	}
+
+	nl := x.netOff()
+	return andNodes(x.etherType(etherTypeIPv6), filterDir(q.dir, addrNode(nl+8), addrNode(nl+24))), nil
+}
+
+func (x *filterParser) portNode(q filterQualifier, id string) (filterNode, error) {
+	var protos []uint32
+	switch q.proto {
+	case "", "ip", "ip6":
+		protos = []uint32{filterIPProtocols["tcp"], filterIPProtocols["udp"], filterIPProtocols["sctp"]}
+	case "tcp", "udp", "sctp":
+		protos = []uint32{filterIPProtocols[q.proto]}
+	default:
+		return nil, fmt.Errorf("'%s %s' is not supported", q.proto, q.typ)
+	}
+
+	lo, hi, err := parseFilterPorts(q.typ, id)
+	if err != nil {
+		return nil, err
+	}
+
+	portTest := func(load []bpf.Instruction) filterNode {
+		if lo == hi {
+			return &filterTest{load: load, cond: bpf.JumpEqual, val: lo}
+		}
+		return andNodes(
+			&filterTest{load: load, cond: bpf.JumpGreaterOrEqual, val: lo},
+			&filterTest{load: load, cond: bpf.JumpLessOrEqual, val: hi},
+		)
+	}
+
+	nl := x.netOff()
+	var nodes []filterNode
+	if q.proto != "ip" {
+		nodes = append(nodes, andNodes(
+			x.ipProto6(protos...),
+			filterDir(q.dir, portTest(loadFilterValue(nl+40, 2)), portTest(loadFilterValue(nl+42, 2))),
+		))
+	}
+	if q.proto != "ip6" {
+		load := func(off uint32) []bpf.Instruction {
+			return []bpf.Instruction{bpf.LoadMemShift{Off: nl}, bpf.LoadIndirect{Off: nl + off, Size: 2}}
+		}
+		nodes = append(nodes, andNodes(
+			x.ipProto4(protos...),
+			x.notFragment(),
+			filterDir(q.dir, portTest(load(0)), portTest(load(2))),
+		))
+	}
+	return orNodes(nodes...), nil
+}
+
+func parseFilterPorts(typ, id string) (uint32, uint32, error) {
+	if typ == "port" {
+		port, err := strconv.ParseUint(id, 10, 16)
+		if err != nil {
+			if strings.Contains(id, "-") {
+				return 0, 0, fmt.Errorf("Invalid port: %s, use portrange for range of ports", id)
+			}
+			return 0, 0, fmt.Errorf("Invalid port: %s (port name is not supported)", id)
+		}
+		return uint32(port), uint32(port), nil
+	}
+
+	ports := strings.Split(id, "-")
+	if len(ports) != 2 {
+		return 0, 0, fmt.Errorf("Invalid port range: %s", id)
+	}
+	lo, err := strconv.ParseUint(ports[0], 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid port range: %s", id)
+	}
+	hi, err := strconv.ParseUint(ports[1], 10, 16)
+	if err != nil || hi < lo {
+		return 0, 0, fmt.Errorf("Invalid port range: %s", id)
+	}
+	return uint32(lo), uint32(hi), nil
+}
+
+func (x *filterParser) protoNode(q filterQualifier, id string) (filterNode, error) {
+	if q.dir != "" {
+		return nil, fmt.Errorf("'%s proto' is not supported", q.dir)
+	}
+	name := strings.TrimPrefix(id, "\\")
+
+	if q.proto == "ether" {
+		t, ok := filterEtherTypes[name]
+		if !ok {
+			n, err := parseFilterNumber(name)
+			if err != nil || n > 0xffff {
+				return nil, fmt.Errorf("Invalid ether protocol: %s", id)
+			}
+			if n <= 1500 {
+				return nil, fmt.Errorf("Ether protocol must be greater than 1500 (802.3 length is not supported): %s", id)
+			}
+			t = n
+		}
+		return x.etherType(t), nil
+	}
+
+	switch q.proto {
+	case "", "ip", "ip6":
+	default:
+		return nil, fmt.Errorf("'%s %s' is not supported", q.proto, q.typ)
+	}
+
+	proto, ok := filterIPProtocols[name]
+	if !ok {
+		n, err := parseFilterNumber(name)
+		if err != nil || n > 0xff {
+			return nil, fmt.Errorf("Invalid protocol: %s", id)
+		}
+		proto = n
+	}
+
+	switch q.proto {
+	case "ip":
+		return x.ipProto4(proto), nil
+	case "ip6":
+		return x.ipProto6(proto), nil
+	}
+	return orNodes(x.ipProto4(proto), x.ipProto6(proto)), nil
+}
@@ -0,0 +1,314 @@
+package vxcap_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/m-mizutani/vxcap/pkg/vxcap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterMatch(t *testing.T) {
+	// Sample packet: 167.71.184.66:53472 -> 172.30.2.104:8088 (TCP)
+	data := genSamplePacketData()
+
+	testCases := []struct {
+		expr   string
+		expect bool
+	}{
+		{"tcp", true},
+		{"udp", false},
+		{"ip", true},
+		{"ip6", false},
+		{"host 167.71.184.66", true},
+		{"src host 167.71.184.66", true},
+		{"dst host 167.71.184.66", false},
+		{"src 167.71.184.66", true},
+		{"ip dst host 172.30.2.104", true},
+		{"net 172.30.0.0/16", true},
+		{"dst net 167.71.0.0/16", false},
+		{"port 8088", true},
+		{"tcp dst port 8088", true},
+		{"udp port 8088", false},
+		{"src port 8088", false},
+		{"portrange 53000-54000", true},
+		{"tcp portrange 1-1024", false},
+		{"portrange 8000-8088", true},
+		{"portrange 8088-8088", true},
+		{"portrange 8089-9000", false},
+		{"tcp dst portrange 8080-8090", true},
+		{"src portrange 8080-8090", false},
+		{"dst portrange 8000-8087 or 8089-9000", false},
+		{"ip proto 6", true},
+		{"ip proto tcp", true},
+		{"proto 17", false},
+		{"ip6 proto 6", false},
+		{"ip proto 6 and not ip proto 17", true},
+		{"ether host 0a:66:53:0c:59:c4", true},
+		{"ether src 0a:66:53:0c:59:c4", false},
+		{"vlan", false},
+		{"greater 100", true},
+		{"less 100", false},
+		{"tcp and port 8088", true},
+		{"tcp && port 80", false},
+		{"port 80 or port 8088", true},
+		{"port 80 || 8088", true},
+		{"host 10.0.0.1 or 172.30.2.104", true},
+		{"not udp", true},
+		{"!tcp", false},
+		{"tcp and not (port 80 or port 443)", true},
+		{"not (tcp and dst port 8088)", false},
+		{"167.71.184.66", true},
+		{"10.0.0.1", false},
+		{"src or dst host 172.30.2.104", true},
+		{"src and dst host 172.30.2.104", false},
+		{"net 172.30", true},
+		{"net 172.30.0.0 mask 255.255.0.0", true},
+		{"ether proto 0x0800", true},
+		{"ether proto \\ip", true},
+		{"ether proto \\arp", false},
+		{"ether broadcast", false},
+		{"multicast", false},
+		{"ip multicast", false},
+		// "and" and "or" have the same precedence as libpcap
+		{"host 10.0.0.1 or 167.71.184.66 and port 80", false},
+		{"port 80 and host 10.0.0.1 or 167.71.184.66", true},
+		// Arithmetic expression (PSH and ACK are set, TTL is 38)
+		{"tcp[13] & 2 != 0", false},
+		{"tcp[13]&0x10!=0", true},
+		{"tcp[tcpflags] & (tcp-push|tcp-ack) = tcp-push|tcp-ack", true},
+		{"tcp[tcpflags] & tcp-syn != 0 or tcp[tcpflags] & tcp-fin != 0", false},
+		{"(tcp[13] & 0x18) = 0x18", true},
+		{"ip[8] < 64", true},
+		{"ip[8] > 64", false},
+		{"ip[2:2] = 289", true},
+		{"tcp[0:2] = 53472 and tcp[2:2] == 8088", true},
+		{"tcp[(tcp[12] >> 4) * 4] = 0x50", true}, // The first byte of payload, "P"
+		{"udp[0:2] = 53472", false},
+		{"ether[0] & 1 = 0", true},
+		{"len = 303", true},
+		{"len - 3 == 300 and 3 * 4 = 12", true},
+		{"len % 2 = 0", false},
+		{"icmp[icmptype] = icmp-echo", false},
+	}
+
+	for _, tc := range testCases {
+		matched, err := vxcap.MatchFilter(tc.expr, data)
+		require.NoError(t, err, tc.expr)
+		assert.Equal(t, tc.expect, matched, tc.expr)
+
+		// Compiled program must be also valid as classic BPF program for kernel
+		_, err = vxcap.AssembleFilter(tc.expr)
+		assert.NoError(t, err, tc.expr)
+	}
+}
+
+func TestFilterLongExpression(t *testing.T) {
+	// Too far conditional jumps are replaced with unconditional jumps
+	var hosts []string
+	for i := 0; i < 50; i++ {
+		hosts = append(hosts, fmt.Sprintf("10.0.0.%d", i))
+	}
+	expr := "host " + strings.Join(hosts, " or ")
+
+	matched, err := vxcap.MatchFilter(expr, genSamplePacketData())
+	require.NoError(t, err)
+	assert.False(t, matched)
+
+	matched, err = vxcap.MatchFilter(expr+" or 167.71.184.66", genSamplePacketData())
+	require.NoError(t, err)
+	assert.True(t, matched)
+
+	_, err = vxcap.AssembleFilter(expr)
+	assert.NoError(t, err)
+}
+
+func TestFilterMatchVLANAndIPv6(t *testing.T) {
+	eth := layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x33, 0x33, 0, 0, 0, 0xfb},
+		EthernetType: layers.EthernetTypeDot1Q,
+	}
+	vlan := layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeIPv6}
+	ip6 := layers.IPv6{
+		Version:    6,
+		HopLimit:   255,
+		NextHeader: layers.IPProtocolUDP,
+		SrcIP:      net.ParseIP("2001:db8::1"),
+		DstIP:      net.ParseIP("ff02::fb"),
+	}
+	udp := layers.UDP{SrcPort: 5353, DstPort: 5353}
+	require.NoError(t, udp.SetNetworkLayerForChecksum(&ip6))
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	require.NoError(t, gopacket.SerializeLayers(buf, opts, &eth, &vlan, &ip6, &udp, gopacket.Payload("test")))
+
+	testCases := []struct {
+		expr   string
+		expect bool
+	}{
+		{"vlan", true},
+		{"vlan 100", true},
+		{"vlan 200", false},
+		{"ip6", false}, // Offsets are shifted only after "vlan"
+		{"vlan and ip6", true},
+		{"vlan and ip", false},
+		{"vlan 100 and udp port 5353", true},
+		{"vlan and tcp", false},
+		{"vlan and ip6 src host 2001:db8::1", true},
+		{"vlan and dst host 2001:db8::1", false},
+		{"vlan and net 2001:db8::/32", true},
+		{"vlan and src net 2001:db9::/32", false},
+		{"vlan and ip6 proto 17", true},
+		{"vlan and ip6 multicast", true},
+		{"vlan and ip6[6] = 17", true},
+		{"vlan and udp[0:2] = 5353", false}, // udp[] is only for IPv4
+		{"ether multicast", true},
+		{"ether broadcast", false},
+	}
+
+	for _, tc := range testCases {
+		matched, err := vxcap.MatchFilter(tc.expr, buf.Bytes())
+		require.NoError(t, err, tc.expr)
+		assert.Equal(t, tc.expect, matched, tc.expr)
+	}
+}
+
+func TestFilterMatchARP(t *testing.T) {
+	eth := layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arp := layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   eth.SrcMAC,
+		SourceProtAddress: net.ParseIP("10.0.0.1").To4(),
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    net.ParseIP("10.0.0.2").To4(),
+	}
+	buf := gopacket.NewSerializeBuffer()
+	require.NoError(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, &eth, &arp))
+
+	testCases := []struct {
+		expr   string
+		expect bool
+	}{
+		{"arp", true},
+		{"ip", false},
+		{"arp host 10.0.0.1", true},
+		{"host 10.0.0.2", true},
+		{"arp src host 10.0.0.2", false},
+		{"ip host 10.0.0.1", false},
+		{"ether broadcast", true},
+		{"ether src 02:00:00:00:00:01", true},
+		{"port 80", false},
+	}
+
+	for _, tc := range testCases {
+		matched, err := vxcap.MatchFilter(tc.expr, buf.Bytes())
+		require.NoError(t, err, tc.expr)
+		assert.Equal(t, tc.expect, matched, tc.expr)
+	}
+}
+
+func TestFilterInvalidExpression(t *testing.T) {
+	for _, expr := range []string{
+		"foo",
+		"host",
+		"host 300.0.0.1",
+		"net 10.0.0.0/33",
+		"port 65536",
+		"portrange 100",
+		"portrange 200-100",
+		"portrange 100-200-300",
+		"portrange 100-",
+		"port 8000-8088",
+		"ip proto 256",
+		"ip proto foo",
+		"tcp proto 6",
+		"src proto 6",
+		"ip6 host 172.30.2.104",
+		"host example.com",
+		"port http",
+		"net 10.0.0.1/8",
+		"net 10.0.0.0 mask 255.0.0.1.1",
+		"ether proto 100",
+		"ip broadcast",
+		"tcp[13] & 2",
+		"tcp[13 = 2",
+		"tcp[0:3] = 1",
+		"tcp[0] / 0 = 1",
+		"(tcp[13] & 2 != 0",
+		"tcp host 10.0.0.1",
+		"icmp port 80",
+		"ether host 10.0.0.1",
+		"vlan 5000",
+		"less abc",
+		"(tcp or udp",
+		"tcp)",
+		"tcp and",
+	} {
+		_, err := vxcap.MatchFilter(expr, genSamplePacketData())
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestProcessorFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vxcap_filter")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	args := vxcap.PacketProcessorArgument{
+		DumperArgs: vxcap.DumperArguments{Format: "json", Target: "packet"},
+		EmitterArgs: vxcap.EmitterArguments{
+			Name:       "fs",
+			FsDirPath:  dir,
+			FsFileName: "filtered.json",
+		},
+		Filter: "udp",
+	}
+
+	proc, err := vxcap.NewPacketProcessor(args)
+	require.NoError(t, err)
+	require.NoError(t, proc.Setup())
+	for i := 0; i < 3; i++ {
+		require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+	}
+	require.NoError(t, proc.Shutdown())
+
+	matched, dropped := proc.FilterStats()
+	assert.Equal(t, uint64(0), matched)
+	assert.Equal(t, uint64(3), dropped)
+	assert.Equal(t, 0, countLines(t, filepath.Join(dir, "filtered.json")))
+
+	args.Filter = "tcp port 8088"
+	proc, err = vxcap.NewPacketProcessor(args)
+	require.NoError(t, err)
+	require.NoError(t, proc.Setup())
+	for i := 0; i < 3; i++ {
+		require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+	}
+	require.NoError(t, proc.Shutdown())
+
+	matched, dropped = proc.FilterStats()
+	assert.Equal(t, uint64(3), matched)
+	assert.Equal(t, uint64(0), dropped)
+	assert.Equal(t, 3, countLines(t, filepath.Join(dir, "filtered.json")))
+
+	args.Filter = "tcp port"
+	_, err = vxcap.NewPacketProcessor(args)
+	assert.Error(t, err)
+}
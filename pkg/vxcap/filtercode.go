@@ -0,0 +1,201 @@
+package vxcap
+
+import (
+	"fmt"
+
+	"golang.org/x/net/bpf"
+)
+
+// filterSnapLen is return value of BPF program for accepted packet.
+const filterSnapLen = 262144
+
+// filterNode is boolean expression of parsed filter. It's one of filterAnd,
+// filterOr, filterNot, filterConst and *filterTest.
+type filterNode interface{}
+
+type filterAnd struct{ left, right filterNode }
+type filterOr struct{ left, right filterNode }
+type filterNot struct{ node filterNode }
+
+// filterConst is result of expression that can be evaluated in compile time,
+// e.g. "1 = 1".
+type filterConst bool
+
+// filterTest loads a value to register A with load instructions and compares
+// it with val, or with register X if cmpX is true.
+type filterTest struct {
+	load []bpf.Instruction
+	cond bpf.JumpTest
+	val  uint32
+	cmpX bool
+}
+
+func andNodes(nodes ...filterNode) filterNode {
+	var node filterNode
+	for _, n := range nodes {
+		if node == nil {
+			node = n
+		} else {
+			node = &filterAnd{node, n}
+		}
+	}
+	return node
+}
+
+func orNodes(nodes ...filterNode) filterNode {
+	var node filterNode
+	for _, n := range nodes {
+		if node == nil {
+			node = n
+		} else {
+			node = &filterOr{node, n}
+		}
+	}
+	return node
+}
+
+// filterCode generates BPF instructions from filterNode. Jumps are forward only
+// and resolved by labels after all instructions are generated.
+type filterCode struct {
+	insts  []bpf.Instruction
+	labels []int // Position of label, -1 if not marked yet
+	jumps  []filterJump
+	// longJump makes conditional jump go through unconditional jumps because
+	// offset of conditional jump is limited to 255.
+	longJump bool
+}
+
+type filterJump struct {
+	pos    int
+	tLabel int
+	fLabel int // Not used for unconditional jump
+}
+
+func (x *filterCode) newLabel() int {
+	x.labels = append(x.labels, -1)
+	return len(x.labels) - 1
+}
+
+func (x *filterCode) mark(label int) {
+	x.labels[label] = len(x.insts)
+}
+
+func (x *filterCode) gen(node filterNode, tLabel, fLabel int) {
+	switch v := node.(type) {
+	case *filterAnd:
+		next := x.newLabel()
+		x.gen(v.left, next, fLabel)
+		x.mark(next)
+		x.gen(v.right, tLabel, fLabel)
+
+	case *filterOr:
+		next := x.newLabel()
+		x.gen(v.left, tLabel, next)
+		x.mark(next)
+		x.gen(v.right, tLabel, fLabel)
+
+	case *filterNot:
+		x.gen(v.node, fLabel, tLabel)
+
+	case filterConst:
+		label := fLabel
+		if v {
+			label = tLabel
+		}
+		x.jumps = append(x.jumps, filterJump{pos: len(x.insts), tLabel: label})
+		x.insts = append(x.insts, bpf.Jump{})
+
+	case *filterTest:
+		x.insts = append(x.insts, v.load...)
+		if x.longJump {
+			if v.cmpX {
+				x.insts = append(x.insts, bpf.JumpIfX{Cond: v.cond, SkipFalse: 1})
+			} else {
+				x.insts = append(x.insts, bpf.JumpIf{Cond: v.cond, Val: v.val, SkipFalse: 1})
+			}
+			x.gen(filterConst(true), tLabel, fLabel)
+			x.gen(filterConst(false), tLabel, fLabel)
+			return
+		}
+
+		x.jumps = append(x.jumps, filterJump{pos: len(x.insts), tLabel: tLabel, fLabel: fLabel})
+		if v.cmpX {
+			x.insts = append(x.insts, bpf.JumpIfX{Cond: v.cond})
+		} else {
+			x.insts = append(x.insts, bpf.JumpIf{Cond: v.cond, Val: v.val})
+		}
+
+	default:
+		panic(fmt.Sprintf("Unknown filter node: %T", node))
+	}
+}
+
+func (x *filterCode) skip(pos, label int) (uint32, error) {
+	dst := x.labels[label]
+	if dst <= pos {
+		return 0, fmt.Errorf("Invalid jump in filter program: %d -> %d", pos, dst)
+	}
+	return uint32(dst - pos - 1), nil
+}
+
+func (x *filterCode) resolve() error {
+	for _, j := range x.jumps {
+		t, err := x.skip(j.pos, j.tLabel)
+		if err != nil {
+			return err
+		}
+
+		switch inst := x.insts[j.pos].(type) {
+		case bpf.Jump:
+			inst.Skip = t
+			x.insts[j.pos] = inst
+
+		case bpf.JumpIf, bpf.JumpIfX:
+			f, err := x.skip(j.pos, j.fLabel)
+			if err != nil {
+				return err
+			}
+			if t > 255 || f > 255 {
+				return errFilterJumpTooFar
+			}
+
+			if v, ok := inst.(bpf.JumpIf); ok {
+				v.SkipTrue, v.SkipFalse = uint8(t), uint8(f)
+				x.insts[j.pos] = v
+			} else {
+				v := inst.(bpf.JumpIfX)
+				v.SkipTrue, v.SkipFalse = uint8(t), uint8(f)
+				x.insts[j.pos] = v
+			}
+		}
+	}
+
+	return nil
+}
+
+var errFilterJumpTooFar = fmt.Errorf("Conditional jump is too far")
+
+// generateFilterProgram converts filterNode to BPF program that returns
+// filterSnapLen for matched packet and 0 for others.
+func generateFilterProgram(node filterNode) ([]bpf.Instruction, error) {
+	for _, longJump := range []bool{false, true} {
+		code := filterCode{longJump: longJump}
+		accept, reject := code.newLabel(), code.newLabel()
+
+		code.gen(node, accept, reject)
+		code.mark(accept)
+		code.insts = append(code.insts, bpf.RetConstant{Val: filterSnapLen})
+		code.mark(reject)
+		code.insts = append(code.insts, bpf.RetConstant{Val: 0})
+
+		if err := code.resolve(); err == errFilterJumpTooFar && !longJump {
+			continue // Retry with unconditional jumps
+		} else if err != nil {
+			return nil, err
+		}
+
+		return code.insts, nil
+	}
+
+	return nil, errFilterJumpTooFar
+}
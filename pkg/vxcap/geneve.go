@@ -0,0 +1,116 @@
+package vxcap
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// DefaultGenevePort is port number of UDP server to receive GENEVE datagram.
+	DefaultGenevePort = 6081
+
+	geneveHeaderLength       = 8
+	geneveOptionHeaderLength = 4
+
+	geneveProtoEthernet = 0x6558 // Transparent Ethernet Bridging
+	geneveProtoIPv4     = 0x0800
+	geneveProtoIPv6     = 0x86DD
+)
+
+// GeneveOption is a TLV option of GENEVE header. Data does not include
+// option header (class, type and length).
+type GeneveOption struct {
+	Class uint16
+	Type  uint8
+	Data  []byte
+}
+
+// GeneveHeader is decoded GENEVE header described in RFC 8926.
+type GeneveHeader struct {
+	Version      uint8
+	OptionLength uint8 // Length of options in 4 byte multiples
+	OAM          bool
+	Critical     bool
+	ProtocolType uint16
+	VNI          uint32
+	Options      []GeneveOption
+}
+
+func parseGeneveOptions(raw []byte) ([]GeneveOption, error) {
+	var options []GeneveOption
+
+	for len(raw) > 0 {
+		if len(raw) < geneveOptionHeaderLength {
+			return nil, fmt.Errorf("Too short data for GENEVE option header: %d", len(raw))
+		}
+
+		optLen := int(raw[3]&0x1f) * 4
+		if len(raw) < geneveOptionHeaderLength+optLen {
+			return nil, fmt.Errorf("GENEVE option length exceeds options field: %d", optLen)
+		}
+
+		options = append(options, GeneveOption{
+			Class: binary.BigEndian.Uint16(raw[0:2]),
+			Type:  raw[2],
+			Data:  append([]byte{}, raw[geneveOptionHeaderLength:geneveOptionHeaderLength+optLen]...),
+		})
+		raw = raw[geneveOptionHeaderLength+optLen:]
+	}
+
+	return options, nil
+}
+
+func parseGENEVE(raw []byte, length int) (*Packet, error) {
+	if length < geneveHeaderLength {
+		return nil, fmt.Errorf("Too short data for GENEVE header: %d", length)
+	}
+
+	hdr := GeneveHeader{
+		Version:      raw[0] >> 6,
+		OptionLength: raw[0] & 0x3f,
+		OAM:          raw[1]&0x80 != 0,
+		Critical:     raw[1]&0x40 != 0,
+		ProtocolType: binary.BigEndian.Uint16(raw[2:4]),
+		VNI:          uint32(raw[4])<<16 | uint32(raw[5])<<8 | uint32(raw[6]),
+	}
+	if hdr.Version != 0 {
+		return nil, fmt.Errorf("Unsupported GENEVE version: %d", hdr.Version)
+	}
+
+	offset := geneveHeaderLength + int(hdr.OptionLength)*4
+	if length < offset {
+		return nil, fmt.Errorf("Too short data for GENEVE options: %d < %d", length, offset)
+	}
+
+	options, err := parseGeneveOptions(raw[geneveHeaderLength:offset])
+	if err != nil {
+		return nil, err
+	}
+	hdr.Options = options
+
+	var pkt *Packet
+	switch hdr.ProtocolType {
+	case geneveProtoEthernet:
+		pkt = newPacketData(raw[offset:length])
+
+	case geneveProtoIPv4, geneveProtoIPv6:
+		// Some senders (e.g. AWS Gateway Load Balancer) encapsulate an IP packet
+		// without ethernet header. Put a dummy ethernet header to be handled
+		// in the same manner with other packets.
+		frame := make([]byte, 14, 14+length-offset)
+		binary.BigEndian.PutUint16(frame[12:14], hdr.ProtocolType)
+		pkt = newPacketData(append(frame, raw[offset:length]...))
+
+	default:
+		return nil, fmt.Errorf("Unsupported GENEVE protocol type: 0x%04x", hdr.ProtocolType)
+	}
+
+	pkt.Geneve = &hdr
+	pkt.VNI = hdr.VNI
+
+	return pkt, nil
+}
+
+func listenGENEVE(port, queueSize int) chan *udpQueue {
+	return startSources([]packetSource{newUDPSource(port, tunnelGENEVE, parseGENEVE)}, newReceiveQueue(queueSize, QueuePolicyBlock, nil))
+}
@@ -0,0 +1,97 @@
+package vxcap_test
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/m-mizutani/vxcap/pkg/vxcap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	sampleGeneveHeader = []byte{0x00, 0x00, 0x65, 0x58, 0x00, 0x12, 0x34, 0x00}
+	// Header with 12 bytes options (AWS GWLB style). Option length is 3 (x 4 bytes).
+	sampleGeneveHeaderWithOpt = []byte{
+		0x03, 0x00, 0x08, 0x00, 0xab, 0xcd, 0xef, 0x00,
+		0x01, 0x08, 0x01, 0x02, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88,
+	}
+)
+
+func TestParseGeneveNormal(t *testing.T) {
+	var data []byte
+	data = append(data, sampleGeneveHeader...)
+	data = append(data, sampleEther...)
+
+	pkt, err := vxcap.ParseGENEVE(data, len(data))
+	require.NoError(t, err)
+	assert.Equal(t, len(sampleEther), len(pkt.Data))
+	assert.Equal(t, uint32(0x1234), pkt.VNI)
+	require.NotNil(t, pkt.Geneve)
+	assert.Equal(t, 0, len(pkt.Geneve.Options))
+}
+
+func TestParseGeneveOptionsAndIPPayload(t *testing.T) {
+	var data []byte
+	data = append(data, sampleGeneveHeaderWithOpt...)
+	data = append(data, sampleIPHeader...)
+	data = append(data, sampleTCPHeader...)
+
+	pkt, err := vxcap.ParseGENEVE(data, len(data))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0xabcdef), pkt.VNI)
+	require.Equal(t, 1, len(pkt.Geneve.Options))
+	assert.Equal(t, uint16(0x0108), pkt.Geneve.Options[0].Class)
+	assert.Equal(t, uint8(0x01), pkt.Geneve.Options[0].Type)
+	assert.Equal(t, []byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88}, pkt.Geneve.Options[0].Data)
+
+	// IP packet should be decoded with dummy ethernet header
+	ipv4 := (*pkt.Packet).Layer(layers.LayerTypeIPv4)
+	require.NotNil(t, ipv4)
+	assert.Equal(t, "167.71.184.66", ipv4.(*layers.IPv4).SrcIP.String())
+}
+
+func TestParseGeneveLength(t *testing.T) {
+	_, err := vxcap.ParseGENEVE(sampleGeneveHeader[:7], 7)
+	assert.Error(t, err)
+
+	// Options are truncated
+	truncated := sampleGeneveHeaderWithOpt[:16]
+	_, err = vxcap.ParseGENEVE(truncated, len(truncated))
+	assert.Error(t, err)
+
+	// Option length exceeds the options field
+	broken := append([]byte{}, sampleGeneveHeaderWithOpt...)
+	broken[11] = 0x03
+	_, err = vxcap.ParseGENEVE(broken, len(broken))
+	assert.Error(t, err)
+}
+
+func TestGeneveListener(t *testing.T) {
+	var data []byte
+	data = append(data, sampleGeneveHeader...)
+	data = append(data, sampleEther...)
+
+	port := 30000 + rand.Int()%10000
+	ch := vxcap.ListenGENEVE(port, 10)
+
+	time.Sleep(time.Second) // Wait for UDP server listening
+
+	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("localhost:%d", port))
+	require.NoError(t, err)
+	sock, err := net.DialUDP("udp", nil, addr)
+	require.NoError(t, err)
+
+	n, err := sock.Write(data)
+	require.NoError(t, err)
+	require.Equal(t, len(data), n)
+
+	q := <-ch
+	assert.NoError(t, q.Err)
+	assert.Equal(t, len(sampleEther), len(q.Pkt.Data))
+	assert.Equal(t, uint32(0x1234), q.Pkt.VNI)
+}
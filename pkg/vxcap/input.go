@@ -0,0 +1,511 @@
+package vxcap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/ipv4"
+)
+
+type udpQueue struct {
+	Pkt *Packet
+	Err error
+}
+
+// packetParser decapsulates a received datagram.
+type packetParser func(raw []byte, length int) (*Packet, error)
+
+// packetSource is an input of encapsulated packets for VXCap. open binds
+// socket or opens file to report error before running. run opens the source if
+// not opened yet and blocks until the source is exhausted (returns nil), is
+// closed by close (returns nil) or fails (returns error).
+type packetSource interface {
+	open() error
+	run(queue *receiveQueue) error
+	close() error
+}
+
+// closeSources closes all sources and logs errors because closing is a part
+// of stopping process and never fails it.
+func closeSources(sources []packetSource) {
+	for _, src := range sources {
+		if err := src.close(); err != nil {
+			Logger.WithError(err).Warn("Fail to close packet source")
+		}
+	}
+}
+
+// startSources runs all sources in background and merges their packets into
+// channel of queue. The channel is closed after all sources finished.
+func startSources(sources []packetSource, queue *receiveQueue) chan *udpQueue {
+	wg := sync.WaitGroup{}
+
+	for _, src := range sources {
+		wg.Add(1)
+		go func(src packetSource) {
+			defer wg.Done()
+			if err := src.run(queue); err != nil {
+				queue.pushError(err)
+			}
+		}(src)
+	}
+
+	go func() {
+		wg.Wait()
+		close(queue.ch)
+	}()
+
+	return queue.ch
+}
+
+const (
+	// DefaultReceiveBatchSize is max number of datagrams read by one system
+	// call (recvmmsg) on Linux.
+	DefaultReceiveBatchSize = 64
+
+	receiveBufferSize = 32768
+)
+
+// packetConnSource receives packets from a socket opened by net.ListenPacket.
+type packetConnSource struct {
+	network   string
+	address   string
+	tunnel    string
+	port      int  // Only for UDP
+	reusePort bool // Set SO_REUSEPORT to bind multiple sockets to the port
+	batchSize int  // Read datagrams in batch if more than 1, only for UDP
+	parse     packetParser
+
+	mutex  sync.Mutex
+	conn   net.PacketConn
+	closed bool
+
+	// Accumulated drop count of the socket reported by SO_RXQ_OVFL
+	lastOverflow uint32
+}
+
+func newUDPSource(port int, tunnel string, parse packetParser) *packetConnSource {
+	src := &packetConnSource{
+		network:   "udp",
+		tunnel:    tunnel,
+		batchSize: DefaultReceiveBatchSize,
+		parse:     parse,
+	}
+	src.setPort(port)
+	return src
+}
+
+func (x *packetConnSource) setPort(port int) {
+	x.port = port
+	x.address = fmt.Sprintf(":%d", port)
+}
+
+// openUDPSources creates and opens n sources bound to the same port. If port
+// is 0, port chosen by OS for the first source is used for others. Opened
+// sources are returned with error, then caller must close them.
+func openUDPSources(port, n int, tunnel string, parse packetParser) ([]packetSource, error) {
+	sources := newUDPSources(port, n, tunnel, parse)
+	for i, src := range sources {
+		if err := src.open(); err != nil {
+			return sources[:i], err
+		}
+
+		if i == 0 && port == 0 {
+			port = src.(*packetConnSource).port
+			for _, s := range sources[1:] {
+				s.(*packetConnSource).setPort(port)
+			}
+		}
+	}
+	return sources, nil
+}
+
+// newUDPSources creates n sources bound to the same port with SO_REUSEPORT.
+// Only one source is created if SO_REUSEPORT is not available.
+func newUDPSources(port, n int, tunnel string, parse packetParser) []packetSource {
+	if n > 1 && !reusePortAvailable {
+		Logger.WithField("receivers", n).Warn("SO_REUSEPORT is not available, only one receiver is used")
+		n = 1
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	sources := make([]packetSource, n)
+	for i := range sources {
+		src := newUDPSource(port, tunnel, parse)
+		src.reusePort = n > 1
+		sources[i] = src
+	}
+	return sources
+}
+
+// control sets socket options before binding.
+func (x *packetConnSource) control(network, address string, c syscall.RawConn) error {
+	if x.reusePort {
+		if err := reusePortControl(network, address, c); err != nil {
+			return err
+		}
+	}
+
+	if x.network == "udp" {
+		// Socket works without SO_RXQ_OVFL, only counting kernel drops is disabled.
+		if err := rxqOverflowControl(network, address, c); err != nil {
+			Logger.WithError(err).WithField("address", address).Warn("Fail to set SO_RXQ_OVFL, kernel drops are not counted")
+		}
+	}
+
+	return nil
+}
+
+// open binds the socket. If port is 0, port is updated to one chosen by OS.
+func (x *packetConnSource) open() error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if x.closed || x.conn != nil {
+		return nil
+	}
+
+	lc := net.ListenConfig{Control: x.control}
+	conn, err := lc.ListenPacket(context.Background(), x.network, x.address)
+	if err != nil {
+		return errors.Wrapf(err, "Fail to create %s socket", x.network)
+	}
+
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && x.port == 0 {
+		x.port = addr.Port
+	}
+	x.conn = conn
+	return nil
+}
+
+// localAddr returns bound address, nil if not opened.
+func (x *packetConnSource) localAddr() net.Addr {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if x.conn == nil {
+		return nil
+	}
+	return x.conn.LocalAddr()
+}
+
+// close closes the socket and makes run() return nil.
+func (x *packetConnSource) close() error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	x.closed = true
+	if x.conn != nil {
+		return x.conn.Close()
+	}
+	return nil
+}
+
+func (x *packetConnSource) isClosed() bool {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return x.closed
+}
+
+func (x *packetConnSource) run(queue *receiveQueue) error {
+	if err := x.open(); err != nil {
+		return err
+	}
+
+	x.mutex.Lock()
+	sock := x.conn
+	x.mutex.Unlock()
+	if sock == nil {
+		return nil // Closed before opening
+	}
+	defer sock.Close()
+
+	var err error
+	if x.network == "udp" && x.batchSize > 1 {
+		err = x.readBatch(sock, queue)
+	} else {
+		err = x.read(sock, queue)
+	}
+
+	if x.isClosed() {
+		return nil
+	}
+	return err
+}
+
+func (x *packetConnSource) read(sock net.PacketConn, queue *receiveQueue) error {
+	buf := make([]byte, receiveBufferSize)
+	oob := make([]byte, rxqOverflowOOBSize)
+	udpConn, isUDP := sock.(*net.UDPConn)
+
+	for {
+		var n, oobn int
+		var addr net.Addr
+		var err error
+
+		if isUDP {
+			n, oobn, _, addr, err = udpConn.ReadMsgUDP(buf, oob)
+		} else {
+			n, addr, err = sock.ReadFrom(buf)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Fail to read %s data", x.network)
+		}
+
+		x.countOverflow(oob[:oobn], queue)
+		x.deliver(buf, n, addr, queue)
+	}
+}
+
+// readBatch reads multiple datagrams by one system call with recvmmsg(2) on
+// Linux. On other platforms, it reads only one datagram at once.
+func (x *packetConnSource) readBatch(sock net.PacketConn, queue *receiveQueue) error {
+	conn := ipv4.NewPacketConn(sock)
+	msgs := make([]ipv4.Message, x.batchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, receiveBufferSize)}
+		msgs[i].OOB = make([]byte, rxqOverflowOOBSize)
+	}
+
+	for {
+		n, err := conn.ReadBatch(msgs, 0)
+		if err != nil {
+			return errors.Wrapf(err, "Fail to read %s data", x.network)
+		}
+
+		for i := 0; i < n; i++ {
+			x.countOverflow(msgs[i].OOB[:msgs[i].NN], queue)
+			x.deliver(msgs[i].Buffers[0], msgs[i].N, msgs[i].Addr, queue)
+		}
+	}
+}
+
+// countOverflow adds number of datagrams dropped by kernel since the last
+// datagram to queue stats. Kernel reports accumulated count of the socket.
+func (x *packetConnSource) countOverflow(oob []byte, queue *receiveQueue) {
+	if len(oob) == 0 {
+		return
+	}
+
+	total, ok := parseRxqOverflow(oob)
+	if !ok || total == x.lastOverflow {
+		return
+	}
+
+	dropped := total - x.lastOverflow // Wraps around correctly
+	x.lastOverflow = total
+	queue.countKernelDrops(uint64(dropped))
+	Logger.WithFields(logrus.Fields{
+		"address": x.address,
+		"dropped": dropped,
+	}).Debug("Datagrams are dropped by kernel")
+}
+
+// deliver decapsulates a datagram and puts it to queue. buf can be reused
+// after deliver because decoded packet has copy of data.
+func (x *packetConnSource) deliver(buf []byte, n int, addr net.Addr, queue *receiveQueue) {
+	pkt, err := x.parse(buf, n)
+	if err != nil {
+		queue.countParseError(x.tunnel)
+		Logger.WithError(err).WithField("address", x.address).Warnf("Fail to parse %s data", x.network)
+		return
+	}
+
+	switch v := addr.(type) {
+	case *net.UDPAddr:
+		pkt.OuterSrcAddr = v.IP
+		pkt.OuterSrcPort = v.Port
+		pkt.OuterDstPort = x.port
+	case *net.IPAddr:
+		pkt.OuterSrcAddr = v.IP
+	}
+
+	queue.push(pkt)
+}
+
+// pcapFileSource reads outer packets from pcap or pcapng file captured on
+// mirror target and decapsulates them. UDP datagrams to vxlanPort and
+// genevePort are handled as VXLAN and GENEVE, and GRE packets as ERSPAN.
+// Timestamps of packets are taken from the file.
+type pcapFileSource struct {
+	path       string
+	vxlanPort  int
+	genevePort int
+
+	mutex  sync.Mutex
+	fd     *os.File
+	reader pcapPacketReader
+	closed bool
+}
+
+// pcapPacketReader is common interface of pcapgo.Reader and pcapgo.NgReader
+type pcapPacketReader interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+func newPcapPacketReader(r io.Reader) (pcapPacketReader, error) {
+	buf := bufio.NewReader(r)
+	magic, err := buf.Peek(len(pcapngMagic))
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to read magic number of pcap file")
+	}
+
+	if bytes.Equal(magic, pcapngMagic) {
+		return pcapgo.NewNgReader(buf, pcapgo.DefaultNgReaderOptions)
+	}
+	return pcapgo.NewReader(buf)
+}
+
+// Tunnel names of packet sources, used as label of metrics.
+const (
+	tunnelVXLAN  = "vxlan"
+	tunnelGENEVE = "geneve"
+	tunnelERSPAN = "erspan"
+)
+
+// decapsulate returns decapsulated packet and its tunnel name. Both of pkt and
+// err are nil if the outer packet is not encapsulated.
+func (x *pcapFileSource) decapsulate(data []byte, linkType layers.LinkType) (pkt *Packet, tunnel string, err error) {
+	outer := gopacket.NewPacket(data, linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+
+	var srcAddr net.IP
+	if netLayer := outer.NetworkLayer(); netLayer != nil {
+		srcAddr = net.IP(netLayer.NetworkFlow().Src().Raw())
+	}
+
+	if udp, ok := outer.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+		var parse packetParser
+		switch int(udp.DstPort) {
+		case x.vxlanPort:
+			parse, tunnel = parseVXLAN, tunnelVXLAN
+		case x.genevePort:
+			parse, tunnel = parseGENEVE, tunnelGENEVE
+		default:
+			return nil, "", nil // Not encapsulated packet
+		}
+
+		pkt, err := parse(udp.Payload, len(udp.Payload))
+		if err != nil {
+			return nil, tunnel, err
+		}
+		pkt.OuterSrcAddr = srcAddr
+		pkt.OuterSrcPort = int(udp.SrcPort)
+		pkt.OuterDstPort = int(udp.DstPort)
+		return pkt, tunnel, nil
+	}
+
+	if ipv4, ok := outer.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok && ipv4.Protocol == layers.IPProtocolGRE {
+		pkt, err := parseERSPAN(ipv4.Payload, len(ipv4.Payload))
+		if err != nil {
+			return nil, tunnelERSPAN, err
+		}
+		pkt.OuterSrcAddr = srcAddr
+		return pkt, tunnelERSPAN, nil
+	}
+
+	return nil, "", nil // Not encapsulated packet
+}
+
+func (x *pcapFileSource) open() error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	if x.closed || x.fd != nil {
+		return nil
+	}
+
+	fd, err := os.Open(x.path)
+	if err != nil {
+		return errors.Wrap(err, "Fail to open pcap file")
+	}
+
+	reader, err := newPcapPacketReader(fd)
+	if err != nil {
+		fd.Close()
+		return errors.Wrapf(err, "Fail to read pcap file: %s", x.path)
+	}
+
+	x.fd, x.reader = fd, reader
+	return nil
+}
+
+// close closes the file and makes run() return nil.
+func (x *pcapFileSource) close() error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	x.closed = true
+	if x.fd != nil {
+		return x.fd.Close()
+	}
+	return nil
+}
+
+func (x *pcapFileSource) isClosed() bool {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return x.closed
+}
+
+func (x *pcapFileSource) run(queue *receiveQueue) error {
+	if err := x.open(); err != nil {
+		return err
+	}
+
+	x.mutex.Lock()
+	reader := x.reader
+	x.mutex.Unlock()
+	if reader == nil {
+		return nil // Closed before opening
+	}
+	defer x.close()
+
+	var total, skipped int
+	for ; ; total++ {
+		data, ci, err := reader.ReadPacketData()
+		if err == io.EOF {
+			break
+		} else if x.isClosed() {
+			Logger.WithField("path", x.path).Info("Stopped reading pcap file")
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "Fail to read packet from %s", x.path)
+		}
+
+		pkt, tunnel, err := x.decapsulate(data, reader.LinkType())
+		if err != nil {
+			Logger.WithError(err).WithField("path", x.path).Warn("Fail to parse packet in file")
+			queue.countParseError(tunnel)
+			skipped++
+			continue
+		} else if pkt == nil {
+			skipped++
+			continue
+		}
+
+		pkt.Timestamp = ci.Timestamp
+		queue.push(pkt)
+	}
+
+	Logger.WithFields(logrus.Fields{
+		"path":    x.path,
+		"total":   total,
+		"skipped": skipped,
+	}).Info("Finished reading pcap file")
+
+	return nil
+}
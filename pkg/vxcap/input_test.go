@@ -0,0 +1,209 @@
+package vxcap_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/m-mizutani/vxcap/pkg/vxcap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// genOuterPacket builds Ethernet/IPv4/UDP packet carrying payload as mirror target receives.
+func genOuterPacket(t *testing.T, srcAddr string, dstPort int, payload []byte) []byte {
+	eth := layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.ParseIP(srcAddr),
+		DstIP:    net.ParseIP("10.0.0.1"),
+	}
+	udp := layers.UDP{
+		SrcPort: 51234,
+		DstPort: layers.UDPPort(dstPort),
+	}
+	require.NoError(t, udp.SetNetworkLayerForChecksum(&ip))
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	require.NoError(t, gopacket.SerializeLayers(buf, opts, &eth, &ip, &udp, gopacket.Payload(payload)))
+	return buf.Bytes()
+}
+
+func writeSamplePcapFile(t *testing.T, path string, packets [][]byte, ts []time.Time) {
+	fd, err := os.Create(path)
+	require.NoError(t, err)
+	defer fd.Close()
+
+	w := pcapgo.NewWriter(fd)
+	require.NoError(t, w.WriteFileHeader(65535, layers.LinkTypeEthernet))
+	for i, pkt := range packets {
+		ci := gopacket.CaptureInfo{Timestamp: ts[i], CaptureLength: len(pkt), Length: len(pkt)}
+		require.NoError(t, w.WritePacket(ci, pkt))
+	}
+}
+
+func TestInputFileSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vxcap_input")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	vxlanPayload := append(append([]byte{}, sampleHeader...), genSamplePacketData()...)
+	genevePayload := append(append([]byte{}, sampleGeneveHeader...), genSamplePacketData()...)
+
+	ts := []time.Time{
+		time.Date(2019, 9, 1, 10, 0, 0, 0, time.UTC),
+		time.Date(2019, 9, 1, 10, 0, 1, 0, time.UTC),
+		time.Date(2019, 9, 1, 10, 0, 2, 0, time.UTC),
+	}
+	inputPath := filepath.Join(dir, "input.pcap")
+	writeSamplePcapFile(t, inputPath, [][]byte{
+		genOuterPacket(t, "10.0.0.2", vxcap.DefaultVxlanPort, vxlanPayload),
+		genOuterPacket(t, "10.0.0.3", 53, []byte("not encapsulated")),
+		genOuterPacket(t, "10.0.0.4", vxcap.DefaultGenevePort, genevePayload),
+	}, ts)
+
+	proc, err := vxcap.NewPacketProcessor(vxcap.PacketProcessorArgument{
+		DumperArgs: vxcap.DumperArguments{
+			Format: "pcap",
+			Target: "packet",
+		},
+		EmitterArgs: vxcap.EmitterArguments{
+			Name:       "fs",
+			FsDirPath:  dir,
+			FsFileName: "output.pcap",
+		},
+	})
+	require.NoError(t, err)
+
+	cap := vxcap.New()
+	cap.InputFile = inputPath
+	require.NoError(t, cap.Start(proc))
+
+	fd, err := os.Open(filepath.Join(dir, "output.pcap"))
+	require.NoError(t, err)
+	defer fd.Close()
+	r, err := pcapgo.NewReader(fd)
+	require.NoError(t, err)
+
+	data, ci, err := r.ReadPacketData()
+	require.NoError(t, err)
+	assert.Equal(t, genSamplePacketData(), data)
+	assert.Equal(t, ts[0].Unix(), ci.Timestamp.Unix())
+
+	data, ci, err = r.ReadPacketData()
+	require.NoError(t, err)
+	assert.Equal(t, genSamplePacketData(), data)
+	assert.Equal(t, ts[2].Unix(), ci.Timestamp.Unix())
+
+	_, _, err = r.ReadPacketData()
+	assert.Error(t, err) // EOF
+}
+
+func TestInputFileNotFound(t *testing.T) {
+	cap := vxcap.New()
+	cap.InputFile = "no_such_file.pcap"
+	proc := DummyProcessor{}
+	assert.Error(t, cap.Start(&proc))
+}
+
+func TestInputUDPSourcesReusePort(t *testing.T) {
+	port := 30000 + rand.Int()%10000
+	ch, _, closeSources := vxcap.StartUDPSources(port, 4, vxcap.DefaultReceiveBatchSize, 1024, vxcap.QueuePolicyBlock)
+
+	time.Sleep(100 * time.Millisecond) // Wait for UDP server listening
+
+	data := append(append([]byte{}, sampleHeader...), sampleEther...)
+
+	// Use multiple senders because SO_REUSEPORT distributes datagrams by hash of address and port
+	for i := 0; i < 8; i++ {
+		sock, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", port))
+		require.NoError(t, err)
+		for j := 0; j < 10; j++ {
+			_, err := sock.Write(data)
+			require.NoError(t, err)
+		}
+		sock.Close()
+	}
+
+	for i := 0; i < 80; i++ {
+		select {
+		case q := <-ch:
+			require.NoError(t, q.Err)
+			assert.Equal(t, uint32(0xa8eed6), q.Pkt.VNI)
+			assert.Equal(t, port, q.Pkt.OuterDstPort)
+		case <-time.After(3 * time.Second):
+			require.Fail(t, "Timeout to receive packets", "received %d packets", i)
+		}
+	}
+
+	// Channel is closed after closing all sources
+	closeSources()
+	_, ok := <-ch
+	assert.False(t, ok)
+}
+
+func TestInputUDPSourceStats(t *testing.T) {
+	port := 30000 + rand.Int()%10000
+	// Small queue without consumer makes receiver block and socket buffer overflow
+	ch, stats, closeSources := vxcap.StartUDPSources(port, 1, 1, 1, vxcap.QueuePolicyBlock)
+	defer closeSources()
+
+	time.Sleep(100 * time.Millisecond) // Wait for UDP server listening
+
+	sock, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	defer sock.Close()
+
+	// Broken VXLAN header
+	for i := 0; i < 3; i++ {
+		_, err = sock.Write([]byte{0x08, 0x00})
+		require.NoError(t, err)
+	}
+
+	data := append(append([]byte{}, sampleHeader...), sampleEther...)
+	for i := 0; i < 10000; i++ {
+		_, err = sock.Write(data)
+		require.NoError(t, err)
+	}
+
+	// Drain queue. Drop count is reported by kernel with a datagram received
+	// after the drop, then send one more datagram after draining.
+	var received int
+	drain := func() {
+		for {
+			select {
+			case q := <-ch:
+				require.NoError(t, q.Err)
+				received++
+			case <-time.After(200 * time.Millisecond):
+				return
+			}
+		}
+	}
+	drain()
+	_, err = sock.Write(data)
+	require.NoError(t, err)
+	drain()
+
+	s := stats()
+	assert.Equal(t, uint64(3), s.ParseErrors)
+	assert.Equal(t, uint64(received), s.Received)
+	assert.Equal(t, uint64(0), s.QueueDropped)
+	assert.NotEqual(t, uint64(0), s.KernelDropped)
+	assert.Equal(t, uint64(10001), s.Received+s.KernelDropped)
+}
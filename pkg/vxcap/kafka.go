@@ -0,0 +1,451 @@
+package vxcap
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/xdg/scram"
+)
+
+const (
+	// DefaultKafkaFlushSize is threshold (bytes) of buffered messages to
+	// send to Kafka. For pcap and pcapng, it's also max size of a chunk and
+	// should be less than max message size of broker.
+	DefaultKafkaFlushSize = 512 * 1024
+	// DefaultKafkaFlushInterval is seconds of interval to send buffered
+	// messages to Kafka.
+	DefaultKafkaFlushInterval = 1
+	// DefaultKafkaPartitionKey is default key of messages to choose partition.
+	DefaultKafkaPartitionKey = "vni"
+)
+
+// Partition keys of Kafka message.
+const (
+	kafkaKeyVNI  = "vni"  // VNI of packet
+	kafkaKeyFlow = "flow" // Hash of VNI and 5-tuple, same for both directions
+	kafkaKeyNone = "none" // No key, partition is chosen randomly
+)
+
+func validateKafkaPartitionKey(key string) error {
+	switch key {
+	case "", kafkaKeyVNI, kafkaKeyFlow, kafkaKeyNone:
+		return nil
+	default:
+		return fmt.Errorf("Invalid partition key: %q, must be one of vni, flow and none", key)
+	}
+}
+
+func parseKafkaCompression(s string) (sarama.CompressionCodec, error) {
+	switch s {
+	case "", "none":
+		return sarama.CompressionNone, nil
+	case "gzip":
+		return sarama.CompressionGZIP, nil
+	case "snappy":
+		return sarama.CompressionSnappy, nil
+	case "lz4":
+		return sarama.CompressionLZ4, nil
+	case "zstd":
+		return sarama.CompressionZSTD, nil
+	default:
+		return sarama.CompressionNone, fmt.Errorf("Invalid compression: %q, must be one of none, gzip, snappy, lz4 and zstd", s)
+	}
+}
+
+func parseKafkaAcks(s string) (sarama.RequiredAcks, error) {
+	switch s {
+	case "", "leader":
+		return sarama.WaitForLocal, nil
+	case "none":
+		return sarama.NoResponse, nil
+	case "all":
+		return sarama.WaitForAll, nil
+	default:
+		return sarama.WaitForLocal, fmt.Errorf("Invalid acks: %q, must be one of none, leader and all", s)
+	}
+}
+
+func parseKafkaSASLMechanism(s string) (sarama.SASLMechanism, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return "", nil
+	case "plain":
+		return sarama.SASLTypePlaintext, nil
+	case "scram-sha-256":
+		return sarama.SASLTypeSCRAMSHA256, nil
+	case "scram-sha-512":
+		return sarama.SASLTypeSCRAMSHA512, nil
+	default:
+		return "", fmt.Errorf("Invalid SASL mechanism: %q, must be one of plain, scram-sha-256 and scram-sha-512", s)
+	}
+}
+
+// kafkaSCRAMClient implements sarama.SCRAMClient with xdg/scram.
+type kafkaSCRAMClient struct {
+	hashGenerator scram.HashGeneratorFcn
+	conversation  *scram.ClientConversation
+}
+
+func (x *kafkaSCRAMClient) Begin(userName, password, authzID string) error {
+	client, err := x.hashGenerator.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	x.conversation = client.NewConversation()
+	return nil
+}
+
+func (x *kafkaSCRAMClient) Step(challenge string) (string, error) {
+	return x.conversation.Step(challenge)
+}
+
+func (x *kafkaSCRAMClient) Done() bool {
+	return x.conversation.Done()
+}
+
+// newKafkaTLSConfig builds TLS config from files of CA certificate, client
+// certificate and key. Files are optional.
+func newKafkaTLSConfig(args EmitterArguments) (*tls.Config, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: args.KafkaTLSSkipVerify, // nolint:gosec
+	}
+
+	if args.KafkaTLSCACert != "" {
+		pem, err := ioutil.ReadFile(args.KafkaTLSCACert)
+		if err != nil {
+			return nil, errors.Wrap(err, "Fail to read CA certificate for Kafka")
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No valid certificate in %s", args.KafkaTLSCACert)
+		}
+	}
+
+	if args.KafkaTLSCert != "" || args.KafkaTLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(args.KafkaTLSCert, args.KafkaTLSKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "Fail to load client certificate for Kafka")
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// newKafkaConfig builds config of Kafka producer from arguments.
+func newKafkaConfig(args EmitterArguments) (*sarama.Config, error) {
+	cfg := sarama.NewConfig()
+	cfg.ClientID = "vxcap"
+	cfg.Producer.Return.Successes = true // Required by SyncProducer
+
+	acks, err := parseKafkaAcks(args.KafkaAcks)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Producer.RequiredAcks = acks
+
+	codec, err := parseKafkaCompression(args.KafkaCompression)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Producer.Compression = codec
+	if codec == sarama.CompressionZSTD {
+		cfg.Version = sarama.V2_1_0_0 // Minimum version supporting zstd
+	}
+
+	if args.KafkaTLS {
+		tlsConfig, err := newKafkaTLSConfig(args)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Net.TLS.Enable = true
+		cfg.Net.TLS.Config = tlsConfig
+	}
+
+	mechanism, err := parseKafkaSASLMechanism(args.KafkaSASLMechanism)
+	if err != nil {
+		return nil, err
+	}
+	if mechanism != "" {
+		cfg.Net.SASL.Enable = true
+		cfg.Net.SASL.Mechanism = mechanism
+		cfg.Net.SASL.User = args.KafkaSASLUser
+		cfg.Net.SASL.Password = args.KafkaSASLPassword
+
+		switch mechanism {
+		case sarama.SASLTypeSCRAMSHA256:
+			cfg.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &kafkaSCRAMClient{hashGenerator: scram.SHA256}
+			}
+		case sarama.SASLTypeSCRAMSHA512:
+			cfg.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &kafkaSCRAMClient{hashGenerator: scram.HashGeneratorFcn(sha512.New)}
+			}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, "Invalid Kafka config")
+	}
+	return cfg, nil
+}
+
+var newKafkaProducer = func(brokers []string, cfg *sarama.Config) (sarama.SyncProducer, error) {
+	return sarama.NewSyncProducer(brokers, cfg)
+}
+
+// kafkaPartitionKey returns key of message for the packet. nil means no key.
+func kafkaPartitionKey(keyType string, pkt *Packet) sarama.Encoder {
+	switch keyType {
+	case kafkaKeyNone:
+		return nil
+	case kafkaKeyFlow:
+		return sarama.StringEncoder(flowKey(pkt))
+	default:
+		return sarama.StringEncoder(strconv.FormatUint(uint64(pkt.VNI), 10))
+	}
+}
+
+// kafkaEmitter publishes records to Kafka topic. In stream mode, a message is
+// a record of a packet or a session (e.g. JSON). In batch mode, packets are
+// buffered by partition key and a message is a chunk (complete file) of them
+// (e.g. pcap).
+type kafkaEmitter struct {
+	baseEmitter
+	Argument      EmitterArguments
+	chunked       bool
+	partitionKey  string
+	flushSize     int
+	flushInterval int
+	lastFlush     time.Time
+
+	producer sarama.SyncProducer
+	messages []*sarama.ProducerMessage // Stream mode
+	chunks   map[string][]*Packet      // Batch mode, by partition key
+	bufSize  int
+	unsent   []*sarama.ProducerMessage // Failed in last flush, sent again at next flush
+}
+
+func newKafkaEmitter(args EmitterArguments, dumper Dumper) (Emitter, error) {
+	if len(args.KafkaBrokers) == 0 {
+		return nil, fmt.Errorf("KafkaBrokers is not set for Kafka emitter")
+	}
+	if args.KafkaTopic == "" {
+		return nil, fmt.Errorf("KafkaTopic is not set for Kafka emitter")
+	}
+	if err := validateKafkaPartitionKey(args.KafkaPartitionKey); err != nil {
+		return nil, err
+	}
+
+	emitter := kafkaEmitter{
+		baseEmitter:   baseEmitter{Dumper: dumper},
+		Argument:      args,
+		chunked:       args.mode == "batch",
+		partitionKey:  DefaultKafkaPartitionKey,
+		flushSize:     DefaultKafkaFlushSize,
+		flushInterval: DefaultKafkaFlushInterval,
+		lastFlush:     time.Now(),
+		chunks:        make(map[string][]*Packet),
+	}
+
+	if args.KafkaPartitionKey != "" {
+		emitter.partitionKey = args.KafkaPartitionKey
+	}
+	if args.KafkaFlushSize > 0 {
+		emitter.flushSize = args.KafkaFlushSize
+	}
+	if args.KafkaFlushInterval > 0 {
+		emitter.flushInterval = args.KafkaFlushInterval
+	}
+
+	Logger.WithFields(logrus.Fields{
+		"brokers":       args.KafkaBrokers,
+		"topic":         args.KafkaTopic,
+		"chunked":       emitter.chunked,
+		"partitionKey":  emitter.partitionKey,
+		"flushSize":     emitter.flushSize,
+		"flushInterval": emitter.flushInterval,
+	}).Info("Configured Kafka Emitter")
+
+	return &emitter, nil
+}
+
+func (x *kafkaEmitter) Setup() error {
+	cfg, err := newKafkaConfig(x.Argument)
+	if err != nil {
+		return err
+	}
+
+	producer, err := newKafkaProducer(x.Argument.KafkaBrokers, cfg)
+	if err != nil {
+		return errors.Wrapf(err, "Fail to connect Kafka brokers %v", x.Argument.KafkaBrokers)
+	}
+	x.producer = producer
+	return nil
+}
+
+// encode dumps packets as a complete stream of the dumper.
+func (x *kafkaEmitter) encode(packets []*Packet) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := x.Dumper.Open(buf); err != nil {
+		return nil, err
+	}
+	if err := x.Dumper.Dump(packets, buf); err != nil {
+		return nil, err
+	}
+	if err := x.Dumper.Close(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (x *kafkaEmitter) newMessage(key sarama.Encoder, value []byte) *sarama.ProducerMessage {
+	return &sarama.ProducerMessage{
+		Topic: x.Argument.KafkaTopic,
+		Key:   key,
+		Value: sarama.ByteEncoder(value),
+	}
+}
+
+// copyKafkaMessage returns a message to send again. A sent message can not be
+// reused because producer keeps internal state in it.
+func copyKafkaMessage(msg *sarama.ProducerMessage) *sarama.ProducerMessage {
+	return &sarama.ProducerMessage{
+		Topic: msg.Topic,
+		Key:   msg.Key,
+		Value: msg.Value,
+	}
+}
+
+func (x *kafkaEmitter) Emit(packets []*Packet) error {
+	for _, pkt := range packets {
+		key := kafkaPartitionKey(x.partitionKey, pkt)
+
+		if x.chunked {
+			var k string
+			if key != nil {
+				k = string(key.(sarama.StringEncoder))
+			}
+			x.chunks[k] = append(x.chunks[k], pkt)
+			x.bufSize += len(pkt.Data)
+		} else {
+			raw, err := x.encode([]*Packet{pkt})
+			if err != nil {
+				return errors.Wrap(err, "Fail to encode data for Kafka message")
+			}
+			x.messages = append(x.messages, x.newMessage(key, raw))
+			x.bufSize += len(raw)
+		}
+
+		if x.bufSize >= x.flushSize {
+			if err := x.flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// chunkMessages encodes buffered packets to a message for each partition key.
+func (x *kafkaEmitter) chunkMessages() ([]*sarama.ProducerMessage, error) {
+	var messages []*sarama.ProducerMessage
+	for k, packets := range x.chunks {
+		raw, err := x.encode(packets)
+		if err != nil {
+			return nil, errors.Wrap(err, "Fail to encode chunk for Kafka message")
+		}
+
+		var key sarama.Encoder
+		if x.partitionKey != kafkaKeyNone {
+			key = sarama.StringEncoder(k)
+		}
+		messages = append(messages, x.newMessage(key, raw))
+	}
+	return messages, nil
+}
+
+func (x *kafkaEmitter) flush() error {
+	x.lastFlush = time.Now()
+
+	messages := x.messages
+	if x.chunked {
+		var err error
+		if messages, err = x.chunkMessages(); err != nil {
+			return err
+		}
+	}
+
+	messages = append(x.unsent, messages...)
+	x.unsent = nil
+	x.messages = nil
+	x.chunks = make(map[string][]*Packet)
+	x.bufSize = 0
+
+	if len(messages) == 0 {
+		return nil
+	}
+
+	var size int
+	for _, msg := range messages {
+		size += msg.Value.Length()
+	}
+
+	Logger.WithField("messages", len(messages)).Trace("trying flush to Kafka")
+	err := x.producer.SendMessages(messages)
+	observeFlush("kafka", x.lastFlush, size, err)
+	if err != nil {
+		// Producer has already retried them. Failed messages are kept to be
+		// sent again at next flush, and lost if it's the last flush.
+		if errs, ok := err.(sarama.ProducerErrors); ok {
+			for _, e := range errs {
+				if e.Msg != nil {
+					x.unsent = append(x.unsent, copyKafkaMessage(e.Msg))
+				}
+			}
+			return errors.Wrapf(errs[0].Err, "Fail to send %d of %d messages to Kafka", len(errs), len(messages))
+		}
+		for _, msg := range messages {
+			x.unsent = append(x.unsent, copyKafkaMessage(msg))
+		}
+		return errors.Wrap(err, "Fail to send messages to Kafka")
+	}
+
+	Logger.WithFields(logrus.Fields{
+		"messages": len(messages),
+		"bytes":    size,
+	}).Trace("Flushed data to Kafka")
+
+	return nil
+}
+
+func (x *kafkaEmitter) Tick(now time.Time) error {
+	if now.Sub(x.lastFlush) >= time.Second*time.Duration(x.flushInterval) {
+		if err := x.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *kafkaEmitter) Teardown() error {
+	if x.producer == nil {
+		return nil
+	}
+
+	err := x.flush()
+	if closeErr := x.producer.Close(); closeErr != nil && err == nil {
+		err = errors.Wrap(closeErr, "Fail to close Kafka producer")
+	}
+	return err
+}
@@ -0,0 +1,326 @@
+package vxcap_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/m-mizutani/vxcap/pkg/vxcap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// genReversePacketData returns sample packet of opposite direction.
+func genReversePacketData(t *testing.T) []byte {
+	pkt := gopacket.NewPacket(genSamplePacketData(), layers.LayerTypeEthernet, gopacket.Default)
+	eth := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	ip := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	tcp := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+
+	eth.SrcMAC, eth.DstMAC = eth.DstMAC, eth.SrcMAC
+	ip.SrcIP, ip.DstIP = ip.DstIP, ip.SrcIP
+	tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+	require.NoError(t, tcp.SetNetworkLayerForChecksum(ip))
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	require.NoError(t, gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(tcp.Payload)))
+	return buf.Bytes()
+}
+
+func messageValue(t *testing.T, msg *sarama.ProducerMessage) []byte {
+	raw, err := msg.Value.Encode()
+	require.NoError(t, err)
+	return raw
+}
+
+func messageKey(t *testing.T, msg *sarama.ProducerMessage) string {
+	if msg.Key == nil {
+		return ""
+	}
+	raw, err := msg.Key.Encode()
+	require.NoError(t, err)
+	return string(raw)
+}
+
+// kafkaTestArgs returns arguments of processor sending packets in format to
+// Kafka topic "vxcap-test".
+func kafkaTestArgs(format string) vxcap.PacketProcessorArgument {
+	return vxcap.PacketProcessorArgument{
+		DumperArgs: vxcap.DumperArguments{Format: format, Target: "packet"},
+		EmitterArgs: vxcap.EmitterArguments{
+			Name:         "kafka",
+			KafkaBrokers: []string{"127.0.0.1:9092"},
+			KafkaTopic:   "vxcap-test",
+		},
+	}
+}
+
+func TestKafkaEmitterJSON(t *testing.T) {
+	producer := &vxcap.KafkaTestProducer{}
+	defer vxcap.ReplaceNewKafkaProducer(producer)()
+
+	proc := newTestProcessor(t, kafkaTestArgs("json"))
+	for _, vni := range []uint32{1, 1, 2} {
+		pkt := vxcap.NewPacketData(genSamplePacketData())
+		pkt.VNI = vni
+		require.NoError(t, proc.Put(pkt))
+	}
+	assert.Equal(t, 0, len(producer.Messages)) // Buffered
+	require.NoError(t, proc.Shutdown())
+	assert.True(t, producer.Closed)
+
+	// A message per packet, VNI is partition key by default
+	require.Equal(t, 3, len(producer.Messages))
+	for i, vni := range []string{"1", "1", "2"} {
+		msg := producer.Messages[i]
+		assert.Equal(t, "vxcap-test", msg.Topic)
+		assert.Equal(t, vni, messageKey(t, msg))
+
+		var rec vxcap.JSONRecord
+		require.NoError(t, json.Unmarshal(messageValue(t, msg), &rec))
+		assert.Equal(t, "167.71.184.66", rec.SrcAddr)
+	}
+}
+
+func TestKafkaEmitterPcapChunk(t *testing.T) {
+	producer := &vxcap.KafkaTestProducer{}
+	defer vxcap.ReplaceNewKafkaProducer(producer)()
+
+	proc := newTestProcessor(t, kafkaTestArgs("pcap"))
+	for _, vni := range []uint32{1, 2, 1} {
+		pkt := vxcap.NewPacketData(genSamplePacketData())
+		pkt.VNI = vni
+		require.NoError(t, proc.Put(pkt))
+	}
+	require.NoError(t, proc.Shutdown())
+
+	// A chunk per partition key, and each chunk is a complete pcap file
+	require.Equal(t, 2, len(producer.Messages))
+	counts := make(map[string]int)
+	for _, msg := range producer.Messages {
+		r, err := pcapgo.NewReader(bytes.NewReader(messageValue(t, msg)))
+		require.NoError(t, err)
+		for {
+			if _, _, err := r.ReadPacketData(); err != nil {
+				break
+			}
+			counts[messageKey(t, msg)]++
+		}
+	}
+	assert.Equal(t, map[string]int{"1": 2, "2": 1}, counts)
+}
+
+func TestKafkaEmitterFlush(t *testing.T) {
+	producer := &vxcap.KafkaTestProducer{}
+	defer vxcap.ReplaceNewKafkaProducer(producer)()
+
+	args := kafkaTestArgs("json")
+	args.EmitterArgs.KafkaFlushInterval = 5
+	proc := newTestProcessor(t, args)
+	pkt := vxcap.NewPacketData(genSamplePacketData())
+	require.NoError(t, proc.Put(pkt))
+
+	require.NoError(t, proc.Tick(time.Now()))
+	assert.Equal(t, 0, len(producer.Messages))
+	require.NoError(t, proc.Tick(time.Now().Add(6*time.Second)))
+	assert.Equal(t, 1, len(producer.Messages))
+	require.NoError(t, proc.Shutdown())
+
+	// Flush by size
+	producer = &vxcap.KafkaTestProducer{}
+	defer vxcap.ReplaceNewKafkaProducer(producer)()
+
+	args = kafkaTestArgs("pcap")
+	args.EmitterArgs.KafkaFlushSize = len(pkt.Data) * 2
+	proc = newTestProcessor(t, args)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, proc.Put(pkt))
+	}
+	assert.Equal(t, 2, len(producer.Messages))
+	require.NoError(t, proc.Shutdown())
+	assert.Equal(t, 3, len(producer.Messages))
+}
+
+func TestKafkaEmitterSendError(t *testing.T) {
+	producer := &vxcap.KafkaTestProducer{Err: sarama.ProducerErrors{
+		&sarama.ProducerError{Err: sarama.ErrNotLeaderForPartition},
+	}}
+	defer vxcap.ReplaceNewKafkaProducer(producer)()
+
+	proc := newTestProcessor(t, kafkaTestArgs("json"))
+	require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+	err := proc.Shutdown()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), sarama.ErrNotLeaderForPartition.Error())
+	assert.True(t, producer.Closed)
+
+	// Unsent messages are sent again at next flush
+	producer = &vxcap.KafkaTestProducer{Err: sarama.ErrOutOfBrokers}
+	defer vxcap.ReplaceNewKafkaProducer(producer)()
+
+	proc = newTestProcessor(t, kafkaTestArgs("json"))
+	for i := 0; i < 2; i++ {
+		require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+	}
+	require.Error(t, proc.Tick(time.Now().Add(time.Minute)))
+	producer.Err = nil
+	require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+	require.NoError(t, proc.Shutdown())
+	assert.Equal(t, 3, len(producer.Messages))
+}
+
+func TestKafkaEmitterPartitionKey(t *testing.T) {
+	producer := &vxcap.KafkaTestProducer{}
+	defer vxcap.ReplaceNewKafkaProducer(producer)()
+
+	args := kafkaTestArgs("json")
+	args.EmitterArgs.KafkaPartitionKey = "flow"
+	proc := newTestProcessor(t, args)
+	for _, data := range [][]byte{genSamplePacketData(), genReversePacketData(t)} {
+		pkt := vxcap.NewPacketData(data)
+		pkt.VNI = 1
+		require.NoError(t, proc.Put(pkt))
+	}
+	pkt := vxcap.NewPacketData(genSamplePacketData())
+	pkt.VNI = 2
+	require.NoError(t, proc.Put(pkt))
+	require.NoError(t, proc.Shutdown())
+
+	// Both directions of a flow have same key, but VNI makes difference
+	require.Equal(t, 3, len(producer.Messages))
+	keys := []string{
+		messageKey(t, producer.Messages[0]),
+		messageKey(t, producer.Messages[1]),
+		messageKey(t, producer.Messages[2]),
+	}
+	assert.NotEqual(t, "", keys[0])
+	assert.Equal(t, keys[0], keys[1])
+	assert.NotEqual(t, keys[0], keys[2])
+
+	producer = &vxcap.KafkaTestProducer{}
+	defer vxcap.ReplaceNewKafkaProducer(producer)()
+	args = kafkaTestArgs("json")
+	args.EmitterArgs.KafkaPartitionKey = "none"
+	proc = newTestProcessor(t, args)
+	require.NoError(t, proc.Put(pkt))
+	require.NoError(t, proc.Shutdown())
+	require.Equal(t, 1, len(producer.Messages))
+	assert.Nil(t, producer.Messages[0].Key)
+}
+
+func TestKafkaConfig(t *testing.T) {
+	cfg, err := vxcap.NewKafkaConfig(vxcap.EmitterArguments{})
+	require.NoError(t, err)
+	assert.Equal(t, sarama.WaitForLocal, cfg.Producer.RequiredAcks)
+	assert.Equal(t, sarama.CompressionNone, cfg.Producer.Compression)
+	assert.False(t, cfg.Net.TLS.Enable)
+	assert.False(t, cfg.Net.SASL.Enable)
+
+	cfg, err = vxcap.NewKafkaConfig(vxcap.EmitterArguments{
+		KafkaAcks:          "all",
+		KafkaCompression:   "zstd",
+		KafkaTLS:           true,
+		KafkaTLSSkipVerify: true,
+		KafkaSASLMechanism: "scram-sha-512",
+		KafkaSASLUser:      "blue",
+		KafkaSASLPassword:  "five",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, sarama.WaitForAll, cfg.Producer.RequiredAcks)
+	assert.Equal(t, sarama.CompressionZSTD, cfg.Producer.Compression)
+	assert.True(t, cfg.Version.IsAtLeast(sarama.V2_1_0_0))
+	assert.True(t, cfg.Net.TLS.Enable)
+	assert.True(t, cfg.Net.TLS.Config.InsecureSkipVerify)
+	assert.True(t, cfg.Net.SASL.Enable)
+	assert.Equal(t, sarama.SASLMechanism(sarama.SASLTypeSCRAMSHA512), cfg.Net.SASL.Mechanism)
+	require.NotNil(t, cfg.Net.SASL.SCRAMClientGeneratorFunc)
+	assert.NoError(t, cfg.Net.SASL.SCRAMClientGeneratorFunc().Begin("blue", "five", ""))
+
+	for _, args := range []vxcap.EmitterArguments{
+		{KafkaAcks: "some"},
+		{KafkaCompression: "brotli"},
+		{KafkaSASLMechanism: "gssapi"},
+		{KafkaSASLMechanism: "plain"}, // No user
+		{KafkaTLS: true, KafkaTLSCACert: "no-such-file.pem"},
+	} {
+		_, err := vxcap.NewKafkaConfig(args)
+		assert.Error(t, err, fmt.Sprintf("%+v", args))
+	}
+}
+
+func TestKafkaEmitterMockBroker(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("vxcap-test", 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t),
+	})
+
+	args := kafkaTestArgs("json")
+	args.EmitterArgs.KafkaBrokers = []string{broker.Addr()}
+	proc := newTestProcessor(t, args)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+	}
+	require.NoError(t, proc.Shutdown())
+
+	var produced int
+	for _, rr := range broker.History() {
+		if _, ok := rr.Request.(*sarama.ProduceRequest); ok {
+			produced++
+		}
+	}
+	assert.True(t, produced > 0)
+}
+
+func TestKafkaEmitterMockBrokerError(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	metadata := sarama.NewMockMetadataResponse(t).
+		SetBroker(broker.Addr(), broker.BrokerID()).
+		SetLeader("vxcap-test", 0, broker.BrokerID())
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": metadata,
+		"ProduceRequest": sarama.NewMockProduceResponse(t).
+			SetError("vxcap-test", 0, sarama.ErrMessageSizeTooLarge),
+	})
+
+	args := kafkaTestArgs("json")
+	args.EmitterArgs.KafkaBrokers = []string{broker.Addr()}
+	proc := newTestProcessor(t, args)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+	}
+	err := proc.Tick(time.Now().Add(time.Minute))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Fail to send 3 of 3 messages")
+
+	// Broker recovers, and failed messages are sent at shutdown without new packets
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": metadata,
+		"ProduceRequest":  sarama.NewMockProduceResponse(t),
+	})
+	produced := func() int {
+		var n int
+		for _, rr := range broker.History() {
+			if _, ok := rr.Request.(*sarama.ProduceRequest); ok {
+				n++
+			}
+		}
+		return n
+	}
+	failed := produced()
+	require.NoError(t, proc.Shutdown())
+	assert.True(t, produced() > failed)
+}
@@ -0,0 +1,255 @@
+package vxcap
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultAwsKinesisFlushSize is threshold of flush to Kinesis Data Streams.
+	DefaultAwsKinesisFlushSize = 1024 * 1024 // 1MB
+	// DefaultAwsKinesisFlushInterval is seconds of interval to flush data for
+	// Kinesis emitter
+	DefaultAwsKinesisFlushInterval = 1
+
+	// Limits of PutRecords API
+	kinesisMaxRecords     = 500
+	kinesisMaxRequestSize = 5 * 1024 * 1024 // 5MB including partition keys
+	kinesisMaxRecordSize  = 1024 * 1024     // 1MB including partition key
+
+	// kinesisMaxRetry is max number of retries for records failed in
+	// PutRecords, e.g. by throughput limit of shard.
+	kinesisMaxRetry = 3
+
+	// kinesisRetainFactor limits records kept for retry after failed flush to
+	// kinesisRetainFactor times of flush size. Oldest records are dropped
+	// beyond the limit.
+	kinesisRetainFactor = 4
+)
+
+// kinesisRetryWait is wait before first retry of failed records, and it's
+// doubled at every retry.
+var kinesisRetryWait = 100 * time.Millisecond
+
+type vxcapKinesisClient interface {
+	PutRecords(*kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error)
+}
+
+var newKinesisClient = func(args EmitterArguments) (vxcapKinesisClient, error) {
+	ssn, err := newAwsSession(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return kinesis.New(ssn), nil
+}
+
+func kinesisRecordSize(record *kinesis.PutRecordsRequestEntry) int {
+	return len(record.Data) + len(aws.StringValue(record.PartitionKey))
+}
+
+// kinesisEmitter puts a record for each packet (or session record) to
+// Kinesis Data Streams. Partition key is derived from the flow, so records of
+// a flow go to the same shard. A record failed in PutRecords is retried after
+// other records of the request, so order of records is not kept on retry.
+// After a failed flush, records are retried only by Tick at flush interval.
+type kinesisEmitter struct {
+	baseEmitter
+	Argument      EmitterArguments
+	kinesisClient vxcapKinesisClient
+	records       []*kinesis.PutRecordsRequestEntry
+	bufferSize    int
+	flushSize     int
+	flushInterval int
+	lastFlush     time.Time
+	retrying      bool // Last flush failed and records are kept for retry
+}
+
+func newKinesisEmitter(args EmitterArguments, dumper Dumper) (Emitter, error) {
+	emitter := kinesisEmitter{
+		baseEmitter:   baseEmitter{Dumper: dumper},
+		Argument:      args,
+		flushSize:     DefaultAwsKinesisFlushSize,
+		flushInterval: DefaultAwsKinesisFlushInterval,
+		lastFlush:     time.Now(),
+	}
+
+	if args.AwsKinesisFlushSize > 0 {
+		emitter.flushSize = args.AwsKinesisFlushSize
+	}
+	if args.AwsKinesisFlushInterval > 0 {
+		emitter.flushInterval = args.AwsKinesisFlushInterval
+	}
+
+	Logger.WithFields(logrus.Fields{
+		"region":        emitter.Argument.AwsRegion,
+		"name":          emitter.Argument.AwsKinesisStreamName,
+		"flushSize":     emitter.flushSize,
+		"flushInterval": emitter.flushInterval,
+	}).Info("Configured AWS Kinesis Emitter")
+
+	return &emitter, nil
+}
+
+// flush puts buffered records with requests split by limits of PutRecords.
+// Records failed or not sent yet are kept in buffer if it fails.
+func (x *kinesisEmitter) flush() (err error) {
+	Logger.WithField("bufferLength", len(x.records)).Trace("trying flush to Kinesis")
+
+	x.lastFlush = time.Now()
+	records := x.records
+	x.records = nil
+	x.bufferSize = 0
+	defer func() { x.retrying = err != nil }()
+
+	for len(records) > 0 {
+		n, size := 0, 0
+		for n < len(records) && n < kinesisMaxRecords {
+			s := kinesisRecordSize(records[n])
+			if size+s > kinesisMaxRequestSize {
+				break
+			}
+			size += s
+			n++
+		}
+
+		if unsent, err := x.putRecords(records[:n]); err != nil {
+			x.records = append(unsent, records[n:]...)
+			for _, record := range x.records {
+				x.bufferSize += kinesisRecordSize(record)
+			}
+			return err
+		}
+		records = records[n:]
+	}
+
+	return nil
+}
+
+// putRecords calls PutRecords and retries only failed records. Records not
+// put are returned with error.
+func (x *kinesisEmitter) putRecords(records []*kinesis.PutRecordsRequestEntry) ([]*kinesis.PutRecordsRequestEntry, error) {
+	wait := kinesisRetryWait
+
+	for retry := 0; ; retry++ {
+		start := time.Now()
+		resp, err := x.kinesisClient.PutRecords(&kinesis.PutRecordsInput{
+			StreamName: aws.String(x.Argument.AwsKinesisStreamName),
+			Records:    records,
+		})
+		if err != nil {
+			observeFlush("kinesis", start, 0, err)
+			return records, errors.Wrap(err, "Fail to put kinesis records")
+		}
+
+		var failed []*kinesis.PutRecordsRequestEntry
+		var uploaded int
+		var errCode string
+		for i, result := range resp.Records {
+			if result.ErrorCode != nil {
+				failed = append(failed, records[i])
+				errCode = aws.StringValue(result.ErrorCode)
+			} else {
+				uploaded += kinesisRecordSize(records[i])
+			}
+		}
+		observeFlush("kinesis", start, uploaded, nil)
+
+		if len(failed) == 0 {
+			Logger.WithField("recordNum", len(records)).Trace("Flushed data to Kinesis")
+			return nil, nil
+		}
+		if retry >= kinesisMaxRetry {
+			return failed, fmt.Errorf("Fail to put %d kinesis records after %d retries: %s", len(failed), retry, errCode)
+		}
+
+		Logger.WithFields(logrus.Fields{
+			"failed":    len(failed),
+			"errorCode": errCode,
+			"retry":     retry + 1,
+		}).Debug("Retry failed Kinesis records")
+
+		time.Sleep(wait)
+		wait *= 2
+		records = failed
+	}
+}
+
+func (x *kinesisEmitter) Setup() error {
+	client, err := newKinesisClient(x.Argument)
+	if err != nil {
+		return err
+	}
+	x.kinesisClient = client
+	return nil
+}
+
+func (x *kinesisEmitter) Emit(pkt []*Packet) error {
+	for _, p := range pkt {
+		buf := new(bytes.Buffer)
+		if err := x.Dumper.Dump([]*Packet{p}, buf); err != nil {
+			return errors.Wrap(err, "Fail to encode data for kinesis record")
+		}
+
+		record := &kinesis.PutRecordsRequestEntry{
+			Data:         buf.Bytes(),
+			PartitionKey: aws.String(flowKey(p)),
+		}
+		size := kinesisRecordSize(record)
+		if size > kinesisMaxRecordSize {
+			return fmt.Errorf("Kinesis record is too large: %d bytes", size)
+		}
+
+		x.records = append(x.records, record)
+		x.bufferSize += size
+
+		if x.retrying {
+			x.dropOldest()
+		} else if x.bufferSize >= x.flushSize {
+			if err := x.flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// dropOldest discards oldest records while buffer exceeds limit of records
+// kept for retry.
+func (x *kinesisEmitter) dropOldest() {
+	var n int
+	for n < len(x.records) && x.bufferSize > x.flushSize*kinesisRetainFactor {
+		x.bufferSize -= kinesisRecordSize(x.records[n])
+		n++
+	}
+	if n == 0 {
+		return
+	}
+
+	x.records = x.records[n:]
+	observeDropped("kinesis", n)
+	Logger.WithFields(logrus.Fields{
+		"dropped": n,
+		"kept":    len(x.records),
+	}).Debug("Kinesis buffer is full, oldest records are dropped")
+}
+
+func (x *kinesisEmitter) Teardown() error {
+	return x.flush()
+}
+
+func (x *kinesisEmitter) Tick(now time.Time) error {
+	if now.Sub(x.lastFlush) >= time.Second*time.Duration(x.flushInterval) {
+		if err := x.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package vxcap_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/m-mizutani/vxcap/pkg/vxcap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// genLargePacketData returns sample packet having payload of the size.
+func genLargePacketData(t *testing.T, size int) []byte {
+	pkt := gopacket.NewPacket(genSamplePacketData(), layers.LayerTypeEthernet, gopacket.Default)
+	eth := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	ip := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	tcp := pkt.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	require.NoError(t, tcp.SetNetworkLayerForChecksum(ip))
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	require.NoError(t, gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(make([]byte, size))))
+	return buf.Bytes()
+}
+
+// kinesisTestArgs returns arguments of processor sending JSON records to
+// Kinesis stream "blue".
+func kinesisTestArgs() vxcap.PacketProcessorArgument {
+	return vxcap.PacketProcessorArgument{
+		DumperArgs: vxcap.DumperArguments{Format: "json", Target: "packet"},
+		EmitterArgs: vxcap.EmitterArguments{
+			Name:                 "kinesis",
+			AwsRegion:            "somewhere",
+			AwsKinesisStreamName: "blue",
+		},
+	}
+}
+
+func TestKinesisEmitter(t *testing.T) {
+	mock := vxcap.KinesisTestClient{}
+	defer vxcap.ReplaceNewKinesisClient(&mock)()
+
+	proc := newTestProcessor(t, kinesisTestArgs())
+	for _, data := range [][]byte{genSamplePacketData(), genReversePacketData(t), genSamplePacketData()} {
+		require.NoError(t, proc.Put(vxcap.NewPacketData(data)))
+	}
+	pkt := vxcap.NewPacketData(genSamplePacketData())
+	pkt.VNI = 2
+	require.NoError(t, proc.Put(pkt))
+	require.NoError(t, proc.Shutdown())
+
+	require.Equal(t, 1, len(mock.Input))
+	assert.Equal(t, "blue", aws.StringValue(mock.Input[0].StreamName))
+	records := mock.Input[0].Records
+	require.Equal(t, 4, len(records))
+
+	// Records of a flow have same partition key regardless of direction
+	assert.Equal(t, aws.StringValue(records[0].PartitionKey), aws.StringValue(records[1].PartitionKey))
+	assert.Equal(t, aws.StringValue(records[0].PartitionKey), aws.StringValue(records[2].PartitionKey))
+	assert.NotEqual(t, aws.StringValue(records[0].PartitionKey), aws.StringValue(records[3].PartitionKey))
+
+	var rec vxcap.JSONRecord
+	require.NoError(t, json.Unmarshal(records[0].Data, &rec))
+	assert.Equal(t, "167.71.184.66", rec.SrcAddr)
+}
+
+func TestKinesisEmitterTick(t *testing.T) {
+	mock := vxcap.KinesisTestClient{}
+	defer vxcap.ReplaceNewKinesisClient(&mock)()
+
+	args := kinesisTestArgs()
+	args.EmitterArgs.AwsKinesisFlushInterval = 5
+	proc := newTestProcessor(t, args)
+	require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+	require.NoError(t, proc.Tick(time.Now()))
+	assert.Equal(t, 0, len(mock.Input))
+	require.NoError(t, proc.Tick(time.Now().Add(6*time.Second)))
+	assert.Equal(t, 1, len(mock.Input))
+	require.NoError(t, proc.Shutdown())
+	assert.Equal(t, 1, len(mock.Input))
+}
+
+func TestKinesisEmitterRequestLimits(t *testing.T) {
+	mock := vxcap.KinesisTestClient{}
+	defer vxcap.ReplaceNewKinesisClient(&mock)()
+
+	// Split by number of records
+	args := kinesisTestArgs()
+	args.EmitterArgs.AwsKinesisFlushSize = 1024 * 1024 * 1024
+	proc := newTestProcessor(t, args)
+	pkt := vxcap.NewPacketData(genSamplePacketData())
+	for i := 0; i < 1201; i++ {
+		require.NoError(t, proc.Put(pkt))
+	}
+	require.NoError(t, proc.Shutdown())
+
+	require.Equal(t, 3, len(mock.Input))
+	assert.Equal(t, 500, len(mock.Input[0].Records))
+	assert.Equal(t, 500, len(mock.Input[1].Records))
+	assert.Equal(t, 201, len(mock.Input[2].Records))
+
+	// Split by size of request
+	mock = vxcap.KinesisTestClient{}
+	defer vxcap.ReplaceNewKinesisClient(&mock)()
+
+	args = kinesisTestArgs()
+	args.DumperArgs.EnableJSONRawPayload = true
+	args.EmitterArgs.AwsKinesisFlushSize = 1024 * 1024 * 1024
+	proc = newTestProcessor(t, args)
+	pkt = vxcap.NewPacketData(genLargePacketData(t, 60000))
+	for i := 0; i < 100; i++ {
+		require.NoError(t, proc.Put(pkt))
+	}
+	require.NoError(t, proc.Shutdown())
+
+	require.True(t, len(mock.Input) > 1)
+	var total int
+	for _, input := range mock.Input {
+		var size int
+		for _, r := range input.Records {
+			size += len(r.Data) + len(aws.StringValue(r.PartitionKey))
+		}
+		assert.True(t, size <= 5*1024*1024, "request size %d", size)
+		total += len(input.Records)
+	}
+	assert.Equal(t, 100, total)
+}
+
+func TestKinesisEmitterRetry(t *testing.T) {
+	// Every other record fails at first attempt
+	attempts := make(map[*kinesis.PutRecordsRequestEntry]int)
+	var n int
+	mock := vxcap.KinesisTestClient{
+		Fail: func(record *kinesis.PutRecordsRequestEntry) bool {
+			if _, ok := attempts[record]; !ok {
+				n++
+				attempts[record] = 0
+				if n%2 == 0 {
+					attempts[record] = 1
+					return true
+				}
+			}
+			return false
+		},
+	}
+	defer vxcap.ReplaceNewKinesisClient(&mock)()
+
+	proc := newTestProcessor(t, kinesisTestArgs())
+	for i := 0; i < 10; i++ {
+		require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+	}
+	require.NoError(t, proc.Shutdown())
+
+	// Only failed records are retried
+	require.Equal(t, 2, len(mock.Input))
+	assert.Equal(t, 10, len(mock.Input[0].Records))
+	assert.Equal(t, 5, len(mock.Input[1].Records))
+	for _, r := range mock.Input[1].Records {
+		assert.Equal(t, 1, attempts[r])
+	}
+
+	// Give up after retries
+	mock = vxcap.KinesisTestClient{
+		Fail: func(record *kinesis.PutRecordsRequestEntry) bool { return true },
+	}
+	defer vxcap.ReplaceNewKinesisClient(&mock)()
+
+	proc = newTestProcessor(t, kinesisTestArgs())
+	require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+	err := proc.Shutdown()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "ProvisionedThroughputExceededException")
+	assert.Equal(t, 4, len(mock.Input))
+}
+
+func TestKinesisEmitterKeepUnsent(t *testing.T) {
+	down := true
+	mock := vxcap.KinesisTestClient{
+		Fail: func(record *kinesis.PutRecordsRequestEntry) bool { return down },
+	}
+	defer vxcap.ReplaceNewKinesisClient(&mock)()
+
+	args := kinesisTestArgs()
+	args.EmitterArgs.AwsKinesisFlushSize = 1024 * 1024 * 1024
+	proc := newTestProcessor(t, args)
+	for i := 0; i < 600; i++ {
+		require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+	}
+
+	// First request of 500 records fails, and the second one is not sent
+	require.Error(t, proc.Tick(time.Now().Add(time.Minute)))
+	require.Equal(t, 4, len(mock.Input))
+	failed := mock.Input[0].Records
+
+	// Both of failed and unsent records are put at next flush in order
+	down = false
+	mock.Input = nil
+	require.NoError(t, proc.Shutdown())
+	require.Equal(t, 2, len(mock.Input))
+	assert.Equal(t, 500, len(mock.Input[0].Records))
+	assert.Equal(t, 100, len(mock.Input[1].Records))
+	assert.Equal(t, failed, mock.Input[0].Records)
+}
+
+func TestKinesisEmitterDropOldest(t *testing.T) {
+	server, err := vxcap.StartMetricsServer("127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+	const dropped = `vxcap_emitter_dropped_packets_total{emitter="kinesis"}`
+	before := scrapeMetrics(t, server.Addr)
+
+	down := false
+	mock := vxcap.KinesisTestClient{
+		Fail: func(record *kinesis.PutRecordsRequestEntry) bool { return down },
+	}
+	defer vxcap.ReplaceNewKinesisClient(&mock)()
+
+	// Get size of a record
+	base := time.Date(2019, 9, 1, 10, 0, 0, 0, time.UTC)
+	pkt := vxcap.NewPacketData(genSamplePacketData())
+	pkt.Timestamp = base
+	proc := newTestProcessor(t, kinesisTestArgs())
+	require.NoError(t, proc.Put(pkt))
+	require.NoError(t, proc.Shutdown())
+	require.Equal(t, 1, len(mock.Input))
+	r := mock.Input[0].Records[0]
+	size := len(r.Data) + len(aws.StringValue(r.PartitionKey))
+
+	// Flush by 2 records, and up to 8 records are kept after failure
+	args := kinesisTestArgs()
+	args.EmitterArgs.AwsKinesisFlushSize = size * 2
+	proc = newTestProcessor(t, args)
+	down = true
+	mock.Input = nil
+	for i := 0; i < 12; i++ {
+		pkt := vxcap.NewPacketData(genSamplePacketData())
+		pkt.Timestamp = base.Add(time.Duration(i) * time.Second)
+		if i == 1 {
+			require.Error(t, proc.Put(pkt))
+		} else {
+			require.NoError(t, proc.Put(pkt))
+		}
+	}
+
+	// Oldest records are dropped instead of retry by Put after failure
+	require.Equal(t, 4, len(mock.Input))
+
+	// Kept records are retried by Tick at flush interval
+	mock.Input = nil
+	require.NoError(t, proc.Tick(time.Now()))
+	require.Equal(t, 0, len(mock.Input))
+
+	down = false
+	require.NoError(t, proc.Tick(time.Now().Add(time.Minute)))
+	require.Equal(t, 1, len(mock.Input))
+	require.Equal(t, 8, len(mock.Input[0].Records))
+
+	var sent []int
+	for _, r := range mock.Input[0].Records {
+		var v struct {
+			Timestamp time.Time `json:"timestamp"`
+		}
+		require.NoError(t, json.Unmarshal(r.Data, &v))
+		sent = append(sent, int(v.Timestamp.Sub(base)/time.Second))
+	}
+	assert.Equal(t, []int{4, 5, 6, 7, 8, 9, 10, 11}, sent)
+	require.NoError(t, proc.Shutdown())
+
+	after := scrapeMetrics(t, server.Addr)
+	assert.Equal(t, float64(4), after[dropped]-before[dropped])
+}
@@ -0,0 +1,218 @@
+package vxcap
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus metrics of vxcap. They are registered to metricsRegistry, not
+// the default registry of client_golang, to avoid conflict with application
+// that imports the package.
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	metricsReceivedPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vxcap",
+		Name:      "received_packets_total",
+		Help:      "Number of decapsulated packets put into receiver queue by VNI.",
+	}, []string{"vni"})
+	metricsReceivedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vxcap",
+		Name:      "received_bytes_total",
+		Help:      "Bytes of decapsulated (inner) packets put into receiver queue by VNI.",
+	}, []string{"vni"})
+	metricsSenderPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vxcap",
+		Name:      "sender_received_packets_total",
+		Help:      "Number of decapsulated packets by VNI and sender (outer source address), enabled by SetSenderMetrics.",
+	}, []string{"vni", "sender"})
+	metricsSenderBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vxcap",
+		Name:      "sender_received_bytes_total",
+		Help:      "Bytes of decapsulated (inner) packets by VNI and sender, enabled by SetSenderMetrics.",
+	}, []string{"vni", "sender"})
+	metricsParseErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vxcap",
+		Name:      "parse_errors_total",
+		Help:      "Number of datagrams or packets failed to decapsulate.",
+	}, []string{"tunnel"})
+	metricsQueueDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "vxcap",
+		Name:      "queue_dropped_packets_total",
+		Help:      "Number of packets discarded by overflow policy of receiver queue.",
+	})
+	metricsKernelDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "vxcap",
+		Name:      "kernel_dropped_packets_total",
+		Help:      "Number of datagrams dropped by kernel because socket buffer was full (Linux only).",
+	})
+	metricsQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "vxcap",
+		Name:      "queue_depth",
+		Help:      "Number of packets waiting in receiver queue, updated every second.",
+	})
+	metricsQueueCapacity = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "vxcap",
+		Name:      "queue_capacity",
+		Help:      "Size of receiver queue.",
+	})
+
+	metricsDumpedPackets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vxcap",
+		Name:      "dumped_packets_total",
+		Help:      "Number of packets (or session records) encoded by dumper.",
+	}, []string{"format", "target"})
+
+	metricsEmitterFlushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vxcap",
+		Name:      "emitter_flushes_total",
+		Help:      "Number of flushes to remote service by emitter.",
+	}, []string{"emitter"})
+	metricsEmitterFlushFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vxcap",
+		Name:      "emitter_flush_failures_total",
+		Help:      "Number of failed flushes to remote service by emitter.",
+	}, []string{"emitter"})
+	metricsEmitterFlushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "vxcap",
+		Name:      "emitter_flush_duration_seconds",
+		Help:      "Latency of flush to remote service by emitter.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"emitter"})
+	metricsEmitterUploadedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vxcap",
+		Name:      "emitter_uploaded_bytes_total",
+		Help:      "Bytes successfully uploaded to remote service by emitter.",
+	}, []string{"emitter"})
+	metricsEmitterDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "vxcap",
+		Name:      "emitter_dropped_packets_total",
+		Help:      "Number of packets (or session records) discarded by emitter because buffer kept for retry was full.",
+	}, []string{"emitter"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		metricsReceivedPackets,
+		metricsReceivedBytes,
+		metricsSenderPackets,
+		metricsSenderBytes,
+		metricsParseErrors,
+		metricsQueueDropped,
+		metricsKernelDropped,
+		metricsQueueDepth,
+		metricsQueueCapacity,
+		metricsDumpedPackets,
+		metricsEmitterFlushes,
+		metricsEmitterFlushFailures,
+		metricsEmitterFlushDuration,
+		metricsEmitterUploadedBytes,
+		metricsEmitterDropped,
+	)
+}
+
+// metricsPerSender is 1 if metrics by sender are enabled.
+var metricsPerSender int32
+
+// SetSenderMetrics enables or disables metrics of received packets by VNI and
+// sender (outer source address). It's disabled by default because any sender,
+// including spoofed one, creates new time series.
+func SetSenderMetrics(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&metricsPerSender, v)
+}
+
+func observeReceived(pkt *Packet) {
+	vni := strconv.FormatUint(uint64(pkt.VNI), 10)
+	metricsReceivedPackets.WithLabelValues(vni).Inc()
+	metricsReceivedBytes.WithLabelValues(vni).Add(float64(len(pkt.Data)))
+
+	if atomic.LoadInt32(&metricsPerSender) == 0 {
+		return
+	}
+	sender := ""
+	if pkt.OuterSrcAddr != nil {
+		sender = pkt.OuterSrcAddr.String()
+	}
+	metricsSenderPackets.WithLabelValues(vni, sender).Inc()
+	metricsSenderBytes.WithLabelValues(vni, sender).Add(float64(len(pkt.Data)))
+}
+
+// observeFlush records result of a flush by emitter. uploaded is bytes sent
+// to remote service and ignored if the flush failed.
+func observeFlush(emitter string, start time.Time, uploaded int, err error) {
+	metricsEmitterFlushes.WithLabelValues(emitter).Inc()
+	metricsEmitterFlushDuration.WithLabelValues(emitter).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metricsEmitterFlushFailures.WithLabelValues(emitter).Inc()
+		return
+	}
+	metricsEmitterUploadedBytes.WithLabelValues(emitter).Add(float64(uploaded))
+}
+
+// observeDropped records packets (or session records) discarded by emitter.
+func observeDropped(emitter string, n int) {
+	metricsEmitterDropped.WithLabelValues(emitter).Add(float64(n))
+}
+
+// metricsDumper counts packets dumped by the wrapped dumper.
+type metricsDumper struct {
+	Dumper
+	packets prometheus.Counter
+}
+
+func newMetricsDumper(d Dumper, args DumperArguments) Dumper {
+	return &metricsDumper{
+		Dumper:  d,
+		packets: metricsDumpedPackets.WithLabelValues(args.Format, args.Target),
+	}
+}
+
+func (x *metricsDumper) Dump(packets []*Packet, w io.Writer) error {
+	if err := x.Dumper.Dump(packets, w); err != nil {
+		return err
+	}
+	x.packets.Add(float64(len(packets)))
+	return nil
+}
+
+// MetricsHandler returns HTTP handler exposing metrics of vxcap in Prometheus
+// text format.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// StartMetricsServer listens addr (e.g. ":9100") and serves metrics at
+// /metrics in background. Listening error is returned immediately.
+func StartMetricsServer(addr string) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Fail to listen metrics address %s", addr)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+	server := &http.Server{Addr: ln.Addr().String(), Handler: mux}
+
+	go func() {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			Logger.WithError(err).Error("Metrics server stopped")
+		}
+	}()
+
+	Logger.WithField("address", server.Addr).Info("Started metrics server")
+	return server, nil
+}
@@ -0,0 +1,167 @@
+package vxcap_test
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/vxcap/pkg/vxcap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scrapeMetrics gets metrics from server and returns values by metric name
+// with labels, e.g. `vxcap_parse_errors_total{tunnel="vxlan"}`.
+func scrapeMetrics(t *testing.T, addr string) map[string]float64 {
+	resp, err := http.Get(fmt.Sprintf("http://%s/metrics", addr))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	metrics := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		sep := strings.LastIndex(line, " ")
+		require.NotEqual(t, -1, sep)
+		v, err := strconv.ParseFloat(line[sep+1:], 64)
+		require.NoError(t, err)
+		metrics[line[:sep]] = v
+	}
+	require.NoError(t, scanner.Err())
+	return metrics
+}
+
+func TestMetricsReceive(t *testing.T) {
+	server, err := vxcap.StartMetricsServer("127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+
+	const received = `vxcap_received_packets_total{vni="11071190"}`
+	const receivedBytes = `vxcap_received_bytes_total{vni="11071190"}`
+	const senderReceived = `vxcap_sender_received_packets_total{sender="127.0.0.1",vni="11071190"}`
+	const parseErrors = `vxcap_parse_errors_total{tunnel="vxlan"}`
+	before := scrapeMetrics(t, server.Addr)
+
+	vxcap.SetSenderMetrics(true)
+	defer vxcap.SetSenderMetrics(false)
+
+	port := 30000 + rand.Int()%10000
+	ch, _, closeSources := vxcap.StartUDPSources(port, 1, 1, 16, vxcap.QueuePolicyBlock)
+	defer closeSources()
+	time.Sleep(100 * time.Millisecond) // Wait for UDP server listening
+
+	sock, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	defer sock.Close()
+
+	_, err = sock.Write([]byte{0x08}) // Broken VXLAN header
+	require.NoError(t, err)
+	data := append(append([]byte{}, sampleHeader...), sampleEther...)
+	for i := 0; i < 3; i++ {
+		_, err = sock.Write(data)
+		require.NoError(t, err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case q := <-ch:
+			require.NoError(t, q.Err)
+		case <-time.After(3 * time.Second):
+			require.Fail(t, "Timeout to receive packets")
+		}
+	}
+
+	after := scrapeMetrics(t, server.Addr)
+	assert.Equal(t, float64(3), after[received]-before[received])
+	assert.Equal(t, float64(3*len(sampleEther)), after[receivedBytes]-before[receivedBytes])
+	assert.Equal(t, float64(3), after[senderReceived]-before[senderReceived])
+	assert.Equal(t, float64(1), after[parseErrors]-before[parseErrors])
+	assert.Contains(t, after, "vxcap_queue_depth")
+	assert.Contains(t, after, "go_goroutines")
+}
+
+func TestMetricsReceivedExcludesDropped(t *testing.T) {
+	server, err := vxcap.StartMetricsServer("127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+
+	const received = `vxcap_received_packets_total{vni="4242"}`
+	const dropped = `vxcap_queue_dropped_packets_total`
+	before := scrapeMetrics(t, server.Addr)
+
+	// Sender metrics are disabled by default
+	q := vxcap.NewReceiveQueue(2, vxcap.QueuePolicyDropNewest)
+	for i := 0; i < 5; i++ {
+		pkt := newQueuedPacket(4242)
+		pkt.OuterSrcAddr = net.ParseIP("10.0.0.1")
+		vxcap.ReceiveQueuePush(q, pkt)
+	}
+
+	after := scrapeMetrics(t, server.Addr)
+	assert.Equal(t, float64(2), after[received]-before[received])
+	assert.Equal(t, float64(3), after[dropped]-before[dropped])
+	assert.Equal(t, float64(5), after[received]-before[received]+after[dropped]-before[dropped])
+	for name := range after {
+		assert.False(t, strings.HasPrefix(name, "vxcap_sender_received_packets_total{sender=\"10.0.0.1\""), name)
+	}
+
+	stats := vxcap.ReceiveQueueStats(q)
+	assert.Equal(t, uint64(2), stats.Received)
+	assert.Equal(t, uint64(3), stats.QueueDropped)
+}
+
+func TestMetricsEmitter(t *testing.T) {
+	server, err := vxcap.StartMetricsServer("127.0.0.1:0")
+	require.NoError(t, err)
+	defer server.Close()
+
+	const dumped = `vxcap_dumped_packets_total{format="json",target="packet"}`
+	const flushes = `vxcap_emitter_flushes_total{emitter="firehose"}`
+	const uploaded = `vxcap_emitter_uploaded_bytes_total{emitter="firehose"}`
+	const latency = `vxcap_emitter_flush_duration_seconds_count{emitter="firehose"}`
+	before := scrapeMetrics(t, server.Addr)
+
+	mock := vxcap.FirehoseTestClient{}
+	vxcap.ReplaceNewFirehoseClient(&mock)
+	proc, err := vxcap.NewPacketProcessor(vxcap.PacketProcessorArgument{
+		DumperArgs: vxcap.DumperArguments{Format: "json", Target: "packet"},
+		EmitterArgs: vxcap.EmitterArguments{
+			Name:            "firehose",
+			AwsRegion:       "somewhere",
+			AwsFirehoseName: "heretics",
+		},
+	})
+	require.NoError(t, err)
+
+	pkt := vxcap.NewPacketData(genSamplePacketData())
+	require.NoError(t, proc.Setup())
+	for i := 0; i < 5; i++ {
+		require.NoError(t, proc.Put(pkt))
+	}
+	require.NoError(t, proc.Shutdown())
+
+	var size int
+	for _, r := range mock.Input[0].Records {
+		size += len(r.Data)
+	}
+
+	after := scrapeMetrics(t, server.Addr)
+	assert.Equal(t, float64(5), after[dumped]-before[dumped])
+	assert.Equal(t, float64(1), after[flushes]-before[flushes])
+	assert.Equal(t, float64(1), after[latency]-before[latency])
+	assert.Equal(t, float64(size), after[uploaded]-before[uploaded])
+}
+
+func TestMetricsServerListenError(t *testing.T) {
+	_, err := vxcap.StartMetricsServer("127.0.0.1:-1")
+	assert.Error(t, err)
+}
@@ -1,28 +1,55 @@
 package vxcap
 
 import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
-type vxlanHeader struct {
+// VXLANHeader is VXLAN header described in RFC 7348.
+type VXLANHeader struct {
 	Flag               uint16
 	GroupPolicyID      uint16
 	NetworkIndentifier [3]byte
 	Reserved           [1]byte
 }
 
-type packetData struct {
+func (x *VXLANHeader) vni() uint32 {
+	return uint32(x.NetworkIndentifier[0])<<16 |
+		uint32(x.NetworkIndentifier[1])<<8 |
+		uint32(x.NetworkIndentifier[2])
+}
+
+// Packet is a decapsulated (inner) packet with information of tunnel. It's
+// given to Dumper and Emitter, and they must not modify it.
+type Packet struct {
 	Data      []byte
 	Packet    *gopacket.Packet
-	Header    vxlanHeader
+	Header    VXLANHeader
+	Geneve    *GeneveHeader // Set only if the packet is encapsulated by GENEVE
+	ERSPAN    *ERSPANHeader // Set only if the packet is received via ERSPAN
+	VNI       uint32
 	Timestamp time.Time
+
+	// Outer header of tunnel. Ports are zero for ERSPAN (GRE).
+	OuterSrcAddr net.IP
+	OuterSrcPort int
+	OuterDstPort int
+
+	// Session is set only for a finished session record of "session" target.
+	// Other fields are empty in the case.
+	Session *SessionRecord
 }
 
-func newPacketData(buf []byte) *packetData {
-	pkt := new(packetData)
+func newPacketData(buf []byte) *Packet {
+	pkt := new(Packet)
 	pkt.Timestamp = time.Now()
 
 	gopkt := gopacket.NewPacket(buf, layers.LayerTypeEthernet, gopacket.Lazy)
@@ -31,3 +58,31 @@ func newPacketData(buf []byte) *packetData {
 
 	return pkt
 }
+
+// flowKey returns hash of VNI and 5-tuple of the packet (or session record).
+// Both directions of a flow have same key. VNI is used instead if flow can
+// not be identified, e.g. non IP packet.
+func flowKey(pkt *Packet) string {
+	h := fnv.New64a()
+	binary.Write(h, binary.BigEndian, pkt.VNI) // nolint:errcheck
+
+	if ssn := pkt.Session; ssn != nil {
+		endpoints := []string{
+			fmt.Sprintf("%s/%d", ssn.SrcAddr, ssn.SrcPort),
+			fmt.Sprintf("%s/%d", ssn.DstAddr, ssn.DstPort),
+		}
+		sort.Strings(endpoints)
+		fmt.Fprintf(h, "%s|%s|%s", ssn.Protocol, endpoints[0], endpoints[1])
+		return fmt.Sprintf("%016x", h.Sum64())
+	}
+
+	if pkt.Packet == nil || (*pkt.Packet).NetworkLayer() == nil {
+		return strconv.FormatUint(uint64(pkt.VNI), 10)
+	}
+
+	binary.Write(h, binary.BigEndian, (*pkt.Packet).NetworkLayer().NetworkFlow().FastHash()) // nolint:errcheck
+	if tpLayer := (*pkt.Packet).TransportLayer(); tpLayer != nil {
+		binary.Write(h, binary.BigEndian, tpLayer.TransportFlow().FastHash()) // nolint:errcheck
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
@@ -0,0 +1,237 @@
+package vxcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// pcapng block types and options. See
+// https://tools.ietf.org/html/draft-tuexen-opsawg-pcapng
+const (
+	pcapngBlockSectionHeader        = 0x0A0D0D0A
+	pcapngBlockInterfaceDescription = 0x00000001
+	pcapngBlockEnhancedPacket       = 0x00000006
+	pcapngByteOrderMagic            = 0x1A2B3C4D
+
+	pcapngOptEndOfOpt       = 0
+	pcapngOptComment        = 1
+	pcapngOptIfName         = 2
+	pcapngOptIfDescription  = 3
+	pcapngOptShbUserAppl    = 4
+	pcapngOptIfTsResolution = 9
+
+	pcapngLinkTypeEthernet = 1
+	pcapngTsResolutionNano = 9
+)
+
+// pcapngInterfaceKey identifies a mirror session. One Interface Description
+// Block is written for each key.
+type pcapngInterfaceKey struct {
+	Sender string
+	Tunnel string // vxlan, geneve or erspan
+	ID     uint32 // VNI for VXLAN and GENEVE, session ID for ERSPAN
+}
+
+func newPcapngInterfaceKey(pkt *Packet) pcapngInterfaceKey {
+	key := pcapngInterfaceKey{Sender: "unknown", Tunnel: "vxlan", ID: pkt.VNI}
+	if pkt.OuterSrcAddr != nil {
+		key.Sender = pkt.OuterSrcAddr.String()
+	}
+
+	switch {
+	case pkt.Geneve != nil:
+		key.Tunnel = "geneve"
+	case pkt.ERSPAN != nil:
+		key.Tunnel = "erspan"
+		key.ID = uint32(pkt.ERSPAN.SessionID)
+	}
+
+	return key
+}
+
+func (x pcapngInterfaceKey) name() string {
+	return fmt.Sprintf("%s/%s/%d", x.Sender, x.Tunnel, x.ID)
+}
+
+func (x pcapngInterfaceKey) description() string {
+	if x.Tunnel == "erspan" {
+		return fmt.Sprintf("ERSPAN session %d from %s", x.ID, x.Sender)
+	}
+	return fmt.Sprintf("%s VNI %d from %s", map[string]string{
+		"vxlan":  "VXLAN",
+		"geneve": "GENEVE",
+	}[x.Tunnel], x.ID, x.Sender)
+}
+
+// pcapngComment builds comment of Enhanced Packet Block from tunnel header.
+func pcapngComment(pkt *Packet) string {
+	var outer string
+	if pkt.OuterSrcAddr != nil {
+		outer = fmt.Sprintf(" outer_src=%s outer_src_port=%d outer_dst_port=%d",
+			pkt.OuterSrcAddr, pkt.OuterSrcPort, pkt.OuterDstPort)
+	}
+
+	switch {
+	case pkt.Geneve != nil:
+		h := pkt.Geneve
+		return fmt.Sprintf("geneve vni=%d version=%d oam=%t critical=%t protocol_type=0x%04x options=%d%s",
+			h.VNI, h.Version, h.OAM, h.Critical, h.ProtocolType, len(h.Options), outer)
+
+	case pkt.ERSPAN != nil:
+		h := pkt.ERSPAN
+		comment := fmt.Sprintf("erspan type=%d session_id=%d vlan=%d cos=%d", h.Type, h.SessionID, h.VLAN, h.COS)
+		switch h.Type {
+		case 2:
+			comment += fmt.Sprintf(" index=%d", h.Index)
+		case 3:
+			comment += fmt.Sprintf(" timestamp=%d sgt=%d hw_id=%d direction=%d granularity=%d",
+				h.Timestamp, h.SGT, h.HardwareID, h.Direction, h.Granularity)
+		}
+		return comment + outer
+
+	default:
+		h := pkt.Header
+		return fmt.Sprintf("vxlan vni=%d flags=0x%04x group_policy_id=%d%s",
+			pkt.VNI, h.Flag, h.GroupPolicyID, outer)
+	}
+}
+
+// pcapngBlock is a buffer to build a pcapng block. All values are written
+// in little endian.
+type pcapngBlock struct {
+	buf []byte
+}
+
+func (x *pcapngBlock) uint16(v uint16) {
+	x.buf = append(x.buf, 0, 0)
+	binary.LittleEndian.PutUint16(x.buf[len(x.buf)-2:], v)
+}
+
+func (x *pcapngBlock) uint32(v uint32) {
+	x.buf = append(x.buf, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(x.buf[len(x.buf)-4:], v)
+}
+
+func (x *pcapngBlock) padded(data []byte) {
+	x.buf = append(x.buf, data...)
+	for len(x.buf)%4 != 0 {
+		x.buf = append(x.buf, 0)
+	}
+}
+
+func (x *pcapngBlock) option(code uint16, value []byte) {
+	x.uint16(code)
+	x.uint16(uint16(len(value)))
+	x.padded(value)
+}
+
+func (x *pcapngBlock) endOfOptions() {
+	x.option(pcapngOptEndOfOpt, nil)
+}
+
+// write completes block with block type and total length and writes it.
+func (x *pcapngBlock) write(w io.Writer, blockType uint32) error {
+	total := uint32(len(x.buf) + 12)
+	block := make([]byte, 8, total)
+	binary.LittleEndian.PutUint32(block[0:4], blockType)
+	binary.LittleEndian.PutUint32(block[4:8], total)
+	block = append(block, x.buf...)
+	block = append(block, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(block[len(block)-4:], total)
+
+	_, err := w.Write(block)
+	return err
+}
+
+// pcapngDumper writes packets in pcapng format. Interface Description Block
+// is written when a packet of new mirror session appears. It is not
+// concurrency safe as pcapDumper.
+type pcapngDumper struct {
+	snapLen    int
+	interfaces map[pcapngInterfaceKey]uint32
+}
+
+func newPcapngDumper(args DumperArguments) Dumper {
+	return &pcapngDumper{snapLen: args.SnapLen}
+}
+
+func (x *pcapngDumper) Open(w io.Writer) error {
+	x.interfaces = make(map[pcapngInterfaceKey]uint32)
+
+	var shb pcapngBlock
+	shb.uint32(pcapngByteOrderMagic)
+	shb.uint16(1)          // Major version
+	shb.uint16(0)          // Minor version
+	shb.uint32(0xffffffff) // Section length (unspecified), 64 bit
+	shb.uint32(0xffffffff)
+	shb.option(pcapngOptShbUserAppl, []byte("vxcap"))
+	shb.endOfOptions()
+
+	if err := shb.write(w, pcapngBlockSectionHeader); err != nil {
+		return errors.Wrap(err, "Fail to write section header block of pcapng")
+	}
+	return nil
+}
+
+func (x *pcapngDumper) Close(w io.Writer) error {
+	x.interfaces = nil
+	return nil
+}
+
+func (x *pcapngDumper) writeInterface(key pcapngInterfaceKey, w io.Writer) (uint32, error) {
+	var idb pcapngBlock
+	idb.uint16(pcapngLinkTypeEthernet)
+	idb.uint16(0) // Reserved
+	idb.uint32(uint32(x.snapLen))
+	idb.option(pcapngOptIfName, []byte(key.name()))
+	idb.option(pcapngOptIfDescription, []byte(key.description()))
+	idb.option(pcapngOptIfTsResolution, []byte{pcapngTsResolutionNano})
+	idb.endOfOptions()
+
+	if err := idb.write(w, pcapngBlockInterfaceDescription); err != nil {
+		return 0, errors.Wrap(err, "Fail to write interface description block of pcapng")
+	}
+
+	id := uint32(len(x.interfaces))
+	x.interfaces[key] = id
+	return id, nil
+}
+
+func (x *pcapngDumper) Dump(packets []*Packet, w io.Writer) error {
+	if x.interfaces == nil {
+		return fmt.Errorf("pcapngDumper is not opened, assertion error")
+	}
+
+	for _, pkt := range packets {
+		key := newPcapngInterfaceKey(pkt)
+		id, ok := x.interfaces[key]
+		if !ok {
+			var err error
+			if id, err = x.writeInterface(key, w); err != nil {
+				return err
+			}
+		}
+
+		data := snapData(pkt.Data, x.snapLen)
+		ts := uint64(pkt.Timestamp.UnixNano())
+
+		var epb pcapngBlock
+		epb.uint32(id)
+		epb.uint32(uint32(ts >> 32))
+		epb.uint32(uint32(ts))
+		epb.uint32(uint32(len(data)))
+		epb.uint32(uint32(len(pkt.Data)))
+		epb.padded(data)
+		epb.option(pcapngOptComment, []byte(pcapngComment(pkt)))
+		epb.endOfOptions()
+
+		if err := epb.write(w, pcapngBlockEnhancedPacket); err != nil {
+			return errors.Wrap(err, "Fail to write enhanced packet block of pcapng")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package vxcap_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/pcapgo"
+	"github.com/m-mizutani/vxcap/pkg/vxcap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPcapngDump(t *testing.T) {
+	genPacket := func(hdr []byte, parse func([]byte, int) (*vxcap.Packet, error), sender string) *vxcap.Packet {
+		var data []byte
+		data = append(data, hdr...)
+		data = append(data, genSamplePacketData()...)
+		pkt, err := parse(data, len(data))
+		require.NoError(t, err)
+		pkt.OuterSrcAddr = net.ParseIP(sender)
+		pkt.Timestamp = time.Date(2019, 9, 1, 10, 0, 0, 123456789, time.UTC)
+		return pkt
+	}
+
+	packets := []*vxcap.Packet{
+		genPacket(sampleHeader, vxcap.ParseVXLAN, "10.0.0.5"),
+		genPacket(sampleHeader, vxcap.ParseVXLAN, "10.0.0.6"),
+		genPacket(sampleGeneveHeader, vxcap.ParseGENEVE, "10.0.0.5"),
+		genPacket(sampleHeader, vxcap.ParseVXLAN, "10.0.0.5"),
+		genPacket(sampleERSPANTypeII, vxcap.ParseERSPAN, "10.0.0.7"),
+	}
+
+	buf := new(bytes.Buffer)
+	dumper := vxcap.NewPcapngDumper(vxcap.DumperArguments{
+		Format:  "pcapng",
+		Target:  "packet",
+		SnapLen: 64,
+	})
+	require.NoError(t, dumpAll(dumper, packets, buf))
+	raw := buf.Bytes()
+
+	assert.Contains(t, string(raw), "vxlan vni=11071190 flags=0x0800 group_policy_id=1 outer_src=10.0.0.5")
+	assert.Contains(t, string(raw), "geneve vni=4660")
+	assert.Contains(t, string(raw), "erspan type=2 session_id=291 vlan=100")
+
+	r, err := pcapgo.NewNgReader(bytes.NewReader(raw), pcapgo.DefaultNgReaderOptions)
+	require.NoError(t, err)
+
+	var n int
+	for ; ; n++ {
+		data, ci, err := r.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		assert.Equal(t, 64, len(data))
+		assert.Equal(t, 64, ci.CaptureLength)
+		assert.Equal(t, len(genSamplePacketData()), ci.Length)
+		assert.Equal(t, packets[n].Timestamp.UnixNano(), ci.Timestamp.UnixNano())
+	}
+	assert.Equal(t, 5, n)
+
+	// Interfaces of 3 VXLAN packets are merged to 2 by sender
+	require.Equal(t, 4, r.NInterfaces())
+	var names []string
+	for i := 0; i < r.NInterfaces(); i++ {
+		iface, err := r.Interface(i)
+		require.NoError(t, err)
+		names = append(names, iface.Name)
+	}
+	assert.Equal(t, []string{
+		"10.0.0.5/vxlan/11071190",
+		"10.0.0.6/vxlan/11071190",
+		"10.0.0.5/geneve/4660",
+		"10.0.0.7/erspan/291",
+	}, names)
+}
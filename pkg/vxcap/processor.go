@@ -2,15 +2,20 @@ package vxcap
 
 import (
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
-// Processor is interface of packet processing main feature.
+// Processor is interface of packet processing main feature. Put is called by
+// multiple workers of VXCap concurrently and Tick can be called during Put.
+// Then implementation must be concurrency safe.
 type Processor interface {
 	Setup() error
-	Put(pkt *packetData) error
+	Put(pkt *Packet) error
 	Tick(now time.Time) error
 	Shutdown() error
 }
@@ -18,15 +23,41 @@ type Processor interface {
 // PacketProcessor controls both of dumper (log enconder) and emitter (log forwarder).
 // And it works as interface of log processing by Put() function.
 type PacketProcessor struct {
+	// Counters of Filter. They must be at the top of struct for 64 bit
+	// atomic operation on 32 bit platforms.
+	filterMatched uint64
+	filterDropped uint64
+
 	argument PacketProcessorArgument
-	emitter  recordEmitter
+	emitter  Emitter // Default route, nil if DropUnmatched is true
+	routes   []*processorRoute
+	filter   *packetFilter // nil if no filter
+	sessions *sessionTable // nil if target is not "session"
 	ready    bool
+
+	done     chan struct{} // Closed when Shutdown() has finished
+	doneOnce sync.Once
 }
 
 // PacketProcessorArgument is argument to construct new PacketProcessor
 type PacketProcessorArgument struct {
-	DumperArgs  DumperArguments
-	EmitterArgs EmitterArguments
+	DumperArgs  DumperArguments  `yaml:",inline"`
+	EmitterArgs EmitterArguments `yaml:",inline"`
+
+	// Routes dispatches packets to dedicated emitters by VNI. Packets that
+	// do not match any route are sent to default emitter configured by
+	// DumperArgs and EmitterArgs, or discarded if DropUnmatched is true.
+	Routes        []RouteArgument `yaml:"-"`
+	DropUnmatched bool            `yaml:"drop-unmatched" env:"VXCAP_DROP_UNMATCHED"`
+
+	// Filter is tcpdump style filter expression compiled to BPF and run on inner
+	// (decapsulated) frame. Packets not matched are dropped before dumping.
+	Filter string `yaml:"filter" env:"VXCAP_FILTER"`
+
+	// Timeouts (seconds) of session for "session" target. Default values are
+	// used if zero.
+	SessionIdleTimeout   int `yaml:"session-idle-timeout" env:"VXCAP_SESSION_IDLE_TIMEOUT"`
+	SessionActiveTimeout int `yaml:"session-active-timeout" env:"VXCAP_SESSION_ACTIVE_TIMEOUT"`
 }
 
 type emitterModeKey struct {
@@ -43,32 +74,98 @@ type emitterParams struct {
 var emitterModeMap = map[emitterModeKey]emitterParams{
 	{Emitter: "fs", Format: "pcap", Target: "packet"}:       {"stream", "pcap", ""},
 	{Emitter: "fs", Format: "json", Target: "packet"}:       {"stream", "json", "ndjson"},
+	{Emitter: "fs", Format: "pcapng", Target: "packet"}:     {"stream", "pcapng", ""},
 	{Emitter: "s3", Format: "pcap", Target: "packet"}:       {"stream", "pcap", ""},
+	{Emitter: "s3", Format: "pcapng", Target: "packet"}:     {"stream", "pcapng", ""},
 	{Emitter: "s3", Format: "json", Target: "packet"}:       {"stream", "json", "ndjson"},
 	{Emitter: "firehose", Format: "json", Target: "packet"}: {"stream", "json", ""},
+	{Emitter: "kinesis", Format: "json", Target: "packet"}:  {"stream", "json", ""},
+	{Emitter: "kafka", Format: "json", Target: "packet"}:    {"stream", "json", ""},
+	{Emitter: "kafka", Format: "pcap", Target: "packet"}:    {"batch", "pcap", ""},
+	{Emitter: "kafka", Format: "pcapng", Target: "packet"}:  {"batch", "pcapng", ""},
+
+	{Emitter: "fs", Format: "json", Target: "session"}:       {"stream", "json", "ndjson"},
+	{Emitter: "s3", Format: "json", Target: "session"}:       {"stream", "json", "ndjson"},
+	{Emitter: "firehose", Format: "json", Target: "session"}: {"stream", "json", ""},
+	{Emitter: "kinesis", Format: "json", Target: "session"}:  {"stream", "json", ""},
+	{Emitter: "kafka", Format: "json", Target: "session"}:    {"stream", "json", ""},
 }
 
 // NewPacketProcessor is constructor of PacketProcessor. Not only creating instance
 // but also setting up emitter and dumper.
 func NewPacketProcessor(args PacketProcessorArgument) (*PacketProcessor, error) {
+	proc := PacketProcessor{
+		argument: args,
+		done:     make(chan struct{}),
+	}
+
+	filter, err := compileFilter(args.Filter)
+	if err != nil {
+		return nil, err
+	}
+	if filter != nil {
+		Logger.WithField("filter", args.Filter).Info("Configure packet filter")
+		proc.filter = filter
+	}
+
+	if args.DumperArgs.Target == "session" {
+		proc.sessions = newSessionTable(args.SessionIdleTimeout, args.SessionActiveTimeout)
+	}
+
+	for _, route := range args.Routes {
+		Logger.WithFields(logrus.Fields{
+			"vniFrom": route.VNIFrom,
+			"vniTo":   route.VNITo,
+		}).Info("Configure route")
+
+		emitter, err := newProcessorEmitter(route.DumperArgs, route.EmitterArgs)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Fail to configure route for VNI %d-%d", route.VNIFrom, route.VNITo)
+		}
+
+		proc.routes = append(proc.routes, &processorRoute{
+			vniFrom: route.VNIFrom,
+			vniTo:   route.VNITo,
+			emitter: emitter,
+		})
+	}
+
+	if args.DropUnmatched {
+		if len(args.Routes) == 0 {
+			return nil, fmt.Errorf("No route is configured although DropUnmatched is enabled")
+		}
+		Logger.Info("Packets not matched with any route will be dropped")
+	} else {
+		emitter, err := newProcessorEmitter(args.DumperArgs, args.EmitterArgs)
+		if err != nil {
+			return nil, err
+		}
+		proc.emitter = emitter
+	}
+
+	return &proc, nil
+}
+
+// newProcessorEmitter constructs a pair of emitter and dumper
+func newProcessorEmitter(dumperArgs DumperArguments, emitterArgs EmitterArguments) (Emitter, error) {
 	// Choose emitter mode
 	modeKey := emitterModeKey{
-		Emitter: args.EmitterArgs.Name,
-		Format:  args.DumperArgs.Format,
-		Target:  args.DumperArgs.Target,
+		Emitter: emitterArgs.Name,
+		Format:  dumperArgs.Format,
+		Target:  dumperArgs.Target,
 	}
 	Logger.WithFields(logrus.Fields{
-		"emitter": args.EmitterArgs.Name,
-		"format":  args.DumperArgs.Format,
-		"target":  args.DumperArgs.Target,
+		"emitter": emitterArgs.Name,
+		"format":  dumperArgs.Format,
+		"target":  dumperArgs.Target,
 	}).Info("Configure PacketProcessor")
 
-	params, ok := emitterModeMap[modeKey]
+	params, ok := lookupEmitterParams(modeKey)
 	if !ok {
 		return nil, fmt.Errorf("The settings for emitter and dumper are not allowed: %v", modeKey)
 	}
-	args.EmitterArgs.mode = params.Mode
-	args.EmitterArgs.extension = params.Extension
+	emitterArgs.mode = params.Mode
+	emitterArgs.extension = params.Extension
 	Logger.WithFields(logrus.Fields{
 		"emitMode":        params.Mode,
 		"extention":       params.Extension,
@@ -78,41 +175,89 @@ func NewPacketProcessor(args PacketProcessorArgument) (*PacketProcessor, error)
 	// Overwrite dumper foramt if required.
 	if params.OverwriteFormat != "" {
 		Logger.WithFields(logrus.Fields{
-			"before": args.DumperArgs.Format,
+			"before": dumperArgs.Format,
 			"after":  params.OverwriteFormat,
 		}).Debug("Format will be overwritten")
-		args.DumperArgs.Format = params.OverwriteFormat
+		dumperArgs.Format = params.OverwriteFormat
 	}
 	// construct dumper and emitter
-	dumper, err := newDumper(args.DumperArgs)
+	dumper, err := newDumper(dumperArgs)
 	if err != nil {
 		return nil, err
 	}
 
-	args.EmitterArgs.dumper = dumper
-	emitter, err := newEmitter(args.EmitterArgs)
+	emitter, err := newEmitter(emitterArgs, newMetricsDumper(dumper, dumperArgs))
 	if err != nil {
 		return nil, err
 	}
 
-	proc := PacketProcessor{
-		argument: args,
-		emitter:  emitter,
+	return &syncEmitter{Emitter: emitter}, nil
+}
+
+// emitters returns all emitters of default route and VNI routes.
+func (x *PacketProcessor) emitters() []Emitter {
+	var emitters []Emitter
+	for _, route := range x.routes {
+		emitters = append(emitters, route.emitter)
 	}
+	if x.emitter != nil {
+		emitters = append(emitters, x.emitter)
+	}
+	return emitters
+}
 
-	return &proc, nil
+// fsEmitters returns emitters writing to local files.
+func (x *PacketProcessor) fsEmitters() []*fsStreamEmitter {
+	var result []*fsStreamEmitter
+	for _, emitter := range x.emitters() {
+		if e, ok := emitter.(*syncEmitter); ok {
+			emitter = e.Emitter
+		}
+		if fs, ok := emitter.(*fsStreamEmitter); ok {
+			result = append(result, fs)
+		}
+	}
+	return result
+}
+
+// takeOver is invoked by VXCap on reload before Setup(). Files written by prev
+// without rotation are appended by x after prev is shut down, instead of
+// being truncated.
+func (x *PacketProcessor) takeOver(prev Processor) {
+	p, ok := prev.(*PacketProcessor)
+	if !ok {
+		return
+	}
+
+	handoff := &fsHandoff{prev: p.fsEmitters(), done: p.done}
+	for _, fs := range x.fsEmitters() {
+		fs.handoff = handoff
+	}
+}
+
+// lookupEmitter returns emitter for the VNI. nil means the packet should be dropped.
+func (x *PacketProcessor) lookupEmitter(vni uint32) Emitter {
+	for _, route := range x.routes {
+		if route.match(vni) {
+			return route.emitter
+		}
+	}
+	return x.emitter
 }
 
 // Setup must be invoked before calling Put()
 func (x *PacketProcessor) Setup() error {
-	if x.emitter == nil {
+	emitters := x.emitters()
+	if len(emitters) == 0 {
 		Logger.Warn("Emitter is not set and the processor will be fail when calling Put(). " +
 			"This is allowed for only debugging and testing.")
 		return nil
 	}
 
-	if err := x.emitter.setup(); err != nil {
-		return err
+	for _, emitter := range emitters {
+		if err := emitter.Setup(); err != nil {
+			return err
+		}
 	}
 
 	x.ready = true
@@ -120,33 +265,107 @@ func (x *PacketProcessor) Setup() error {
 }
 
 // Put method input a packet to emitter.
-func (x *PacketProcessor) Put(pkt *packetData) error {
+func (x *PacketProcessor) Put(pkt *Packet) error {
 	if !x.ready {
 		return fmt.Errorf("PacketProcessor is not ready, run Setup() at first")
 	}
 
-	if err := x.emitter.emit([]*packetData{pkt}); err != nil {
+	if x.filter != nil {
+		if !x.filter.match(pkt.Data) {
+			atomic.AddUint64(&x.filterDropped, 1)
+			return nil
+		}
+		atomic.AddUint64(&x.filterMatched, 1)
+	}
+
+	if x.sessions != nil {
+		if !x.sessions.put(pkt) {
+			Logger.WithField("vni", pkt.VNI).Trace("Ignore non IP packet for session")
+		}
+		return nil
+	}
+
+	return x.emitPacket(pkt)
+}
+
+// emitPacket sends a packet (or session record) to emitter for the VNI.
+func (x *PacketProcessor) emitPacket(pkt *Packet) error {
+	emitter := x.lookupEmitter(pkt.VNI)
+	if emitter == nil {
+		Logger.WithField("vni", pkt.VNI).Trace("Drop unmatched packet")
+		return nil
+	}
+
+	if err := emitter.Emit([]*Packet{pkt}); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+func (x *PacketProcessor) emitSessions(sessions []*SessionRecord) error {
+	for _, ssn := range sessions {
+		if err := x.emitPacket(&Packet{VNI: ssn.VNI, Session: ssn}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Tick involves timer handler to manage timeout process.
 func (x *PacketProcessor) Tick(now time.Time) error {
-	if x.emitter != nil {
-		if err := x.emitter.tick(now); err != nil {
+	if x.sessions != nil && x.ready {
+		if err := x.emitSessions(x.sessions.expire(now)); err != nil {
+			return err
+		}
+	}
+
+	for _, emitter := range x.emitters() {
+		if err := emitter.Tick(now); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// Shutdown starts closing process of emitter.
+// FilterStats returns number of packets matched and dropped by Filter.
+func (x *PacketProcessor) FilterStats() (matched, dropped uint64) {
+	return atomic.LoadUint64(&x.filterMatched), atomic.LoadUint64(&x.filterDropped)
+}
+
+// Shutdown starts closing process of emitter. All emitters are closed even if
+// one of them fails and the first error is returned.
 func (x *PacketProcessor) Shutdown() error {
-	if err := x.emitter.teardown(); err != nil {
-		return err
+	defer x.doneOnce.Do(func() {
+		if x.done != nil {
+			close(x.done)
+		}
+	})
+
+	if x.filter != nil {
+		matched, dropped := x.FilterStats()
+		Logger.WithFields(logrus.Fields{
+			"matched": matched,
+			"dropped": dropped,
+		}).Info("Packet filter stats")
 	}
 
-	return nil
+	var firstErr error
+	if x.sessions != nil && x.ready {
+		if err := x.emitSessions(x.sessions.flush()); err != nil {
+			Logger.WithError(err).Error("Fail to emit remaining sessions")
+			firstErr = err
+		}
+	}
+
+	for _, emitter := range x.emitters() {
+		if err := emitter.Teardown(); err != nil {
+			Logger.WithError(err).Error("Fail to teardown emitter")
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
 }
@@ -19,6 +19,14 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// newTestProcessor builds PacketProcessor and sets it up.
+func newTestProcessor(t *testing.T, args vxcap.PacketProcessorArgument) *vxcap.PacketProcessor {
+	proc, err := vxcap.NewPacketProcessor(args)
+	require.NoError(t, err)
+	require.NoError(t, proc.Setup())
+	return proc
+}
+
 func TestProcessorPcapFsOutput(t *testing.T) {
 	payload := genSamplePacketData()
 	pkt := vxcap.NewPacketData(payload)
@@ -274,7 +282,7 @@ func TestProcessorJsonFirehoseFlushSize(t *testing.T) {
 			Name:                 "firehose",
 			AwsRegion:            "somewhere",
 			AwsFirehoseName:      "heretics",
-			AwsFirehoseFlushSize: 500,
+			AwsFirehoseFlushSize: 800, // One JSON record is about 630 bytes
 		},
 	})
 	require.NoError(t, err)
@@ -0,0 +1,225 @@
+package vxcap
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Overflow policies of queue between packet sources and processor.
+const (
+	// QueuePolicyBlock makes receivers wait until the queue has space.
+	// Datagrams are dropped by kernel while waiting if socket buffer is full.
+	QueuePolicyBlock = "block"
+	// QueuePolicyDropNewest discards a received packet if the queue is full.
+	QueuePolicyDropNewest = "drop-newest"
+	// QueuePolicyDropOldest discards the oldest packet in the queue to put a
+	// received packet if the queue is full.
+	QueuePolicyDropOldest = "drop-oldest"
+
+	// DefaultQueuePolicy is default overflow policy of the queue.
+	DefaultQueuePolicy = QueuePolicyBlock
+)
+
+func validateQueuePolicy(policy string) error {
+	switch policy {
+	case QueuePolicyBlock, QueuePolicyDropNewest, QueuePolicyDropOldest:
+		return nil
+	default:
+		return fmt.Errorf("Invalid queue policy: %q, must be one of %s, %s and %s",
+			policy, QueuePolicyBlock, QueuePolicyDropNewest, QueuePolicyDropOldest)
+	}
+}
+
+// ReceiveStats is a snapshot of counters in receiving path.
+type ReceiveStats struct {
+	Received      uint64 // Packets put into the queue, including ones discarded later by QueuePolicyDropOldest
+	QueueDropped  uint64 // Packets discarded by overflow policy of the queue
+	KernelDropped uint64 // Datagrams dropped by kernel because socket buffer was full (Linux only)
+	ParseErrors   uint64 // Datagrams or packets failed to decapsulate
+
+	// Packets discarded at shutdown because draining queue was not completed
+	// in VXCap.ShutdownTimeout or processor failed
+	ShutdownDropped uint64
+}
+
+// Lost returns number of packets that were received (or should have been
+// received) but are never processed.
+func (x ReceiveStats) Lost() uint64 {
+	return x.QueueDropped + x.KernelDropped + x.ParseErrors + x.ShutdownDropped
+}
+
+// receiveStats holds counters updated by packet sources concurrently.
+type receiveStats struct {
+	received        uint64
+	queueDropped    uint64
+	kernelDropped   uint64
+	parseErrors     uint64
+	shutdownDropped uint64
+}
+
+func (x *receiveStats) snapshot() ReceiveStats {
+	if x == nil {
+		return ReceiveStats{}
+	}
+	return ReceiveStats{
+		Received:      atomic.LoadUint64(&x.received),
+		QueueDropped:  atomic.LoadUint64(&x.queueDropped),
+		KernelDropped: atomic.LoadUint64(&x.kernelDropped),
+		ParseErrors:   atomic.LoadUint64(&x.parseErrors),
+
+		ShutdownDropped: atomic.LoadUint64(&x.shutdownDropped),
+	}
+}
+
+// receiveQueue is the queue between packet sources and processor. Packets are
+// put by push() according to the overflow policy. Errors are always queued
+// even if the queue is full. After abort(), push() and pushError() never
+// block and discard given item because nobody takes it.
+type receiveQueue struct {
+	ch        chan *udpQueue
+	policy    string
+	stats     *receiveStats
+	aborted   chan struct{}
+	abortOnce sync.Once
+}
+
+func newReceiveQueue(size int, policy string, stats *receiveStats) *receiveQueue {
+	if stats == nil {
+		stats = &receiveStats{}
+	}
+	return &receiveQueue{
+		ch:      make(chan *udpQueue, size),
+		policy:  policy,
+		stats:   stats,
+		aborted: make(chan struct{}),
+	}
+}
+
+// abort unblocks packet sources waiting for space of the queue.
+func (x *receiveQueue) abort() {
+	x.abortOnce.Do(func() { close(x.aborted) })
+}
+
+func (x *receiveQueue) push(pkt *Packet) {
+	q := &udpQueue{Pkt: pkt}
+
+	switch x.policy {
+	case QueuePolicyDropNewest:
+		select {
+		case x.ch <- q:
+		default:
+			x.countQueueDrop()
+			return
+		}
+
+	case QueuePolicyDropOldest:
+		for {
+			select {
+			case x.ch <- q:
+				x.countReceived(pkt)
+				return
+			default:
+			}
+
+			// Queue is full. Discard the oldest one and retry. Another
+			// goroutine may take or put an item between them.
+			select {
+			case old := <-x.ch:
+				if old.Err != nil {
+					// Never discard error, put it back and drop new one.
+					x.putBack(old)
+					x.countQueueDrop()
+					return
+				}
+				x.countQueueDrop()
+			default:
+			}
+		}
+
+	default:
+		if !x.pushItem(q) {
+			atomic.AddUint64(&x.stats.shutdownDropped, 1)
+			return
+		}
+	}
+
+	x.countReceived(pkt)
+}
+
+func (x *receiveQueue) pushError(err error) {
+	x.pushItem(&udpQueue{Err: err})
+}
+
+// pushItem waits for space of the queue and returns false if aborted.
+func (x *receiveQueue) pushItem(q *udpQueue) bool {
+	select {
+	case x.ch <- q:
+		return true
+	case <-x.aborted:
+		return false
+	}
+}
+
+// putBack puts an error taken from the full queue back without blocking. If
+// another packet source filled the space meanwhile, packets in the queue are
+// discarded to make space. Workers stop at the first error, then another
+// error taken here is discarded.
+func (x *receiveQueue) putBack(q *udpQueue) {
+	for {
+		select {
+		case x.ch <- q:
+			return
+		default:
+		}
+
+		select {
+		case old := <-x.ch:
+			if old.Pkt != nil {
+				x.countQueueDrop()
+			}
+		default:
+		}
+	}
+}
+
+// discard removes all items remaining in the queue without blocking and
+// returns number of discarded packets. It's called after abort() and workers
+// stopped.
+func (x *receiveQueue) discard() uint64 {
+	var n uint64
+	for {
+		select {
+		case q, ok := <-x.ch:
+			if !ok {
+				return n
+			}
+			if q.Pkt != nil {
+				n++
+				atomic.AddUint64(&x.stats.shutdownDropped, 1)
+			}
+		default:
+			return n
+		}
+	}
+}
+
+func (x *receiveQueue) countReceived(pkt *Packet) {
+	atomic.AddUint64(&x.stats.received, 1)
+	observeReceived(pkt)
+}
+
+func (x *receiveQueue) countQueueDrop() {
+	atomic.AddUint64(&x.stats.queueDropped, 1)
+	metricsQueueDropped.Inc()
+}
+
+func (x *receiveQueue) countParseError(tunnel string) {
+	atomic.AddUint64(&x.stats.parseErrors, 1)
+	metricsParseErrors.WithLabelValues(tunnel).Inc()
+}
+
+func (x *receiveQueue) countKernelDrops(n uint64) {
+	atomic.AddUint64(&x.stats.kernelDropped, n)
+	metricsKernelDropped.Add(float64(n))
+}
@@ -0,0 +1,127 @@
+package vxcap_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/vxcap/pkg/vxcap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newQueuedPacket(vni uint32) *vxcap.Packet {
+	return &vxcap.Packet{VNI: vni}
+}
+
+func TestQueueDropNewest(t *testing.T) {
+	q := vxcap.NewReceiveQueue(2, vxcap.QueuePolicyDropNewest)
+	for i := 1; i <= 4; i++ {
+		vxcap.ReceiveQueuePush(q, newQueuedPacket(uint32(i)))
+	}
+
+	ch := vxcap.ReceiveQueueChan(q)
+	require.Equal(t, 2, len(ch))
+	assert.Equal(t, uint32(1), (<-ch).Pkt.VNI)
+	assert.Equal(t, uint32(2), (<-ch).Pkt.VNI)
+
+	stats := vxcap.ReceiveQueueStats(q)
+	assert.Equal(t, uint64(2), stats.Received)
+	assert.Equal(t, uint64(2), stats.QueueDropped)
+	assert.Equal(t, uint64(2), stats.Lost())
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	q := vxcap.NewReceiveQueue(2, vxcap.QueuePolicyDropOldest)
+	for i := 1; i <= 4; i++ {
+		vxcap.ReceiveQueuePush(q, newQueuedPacket(uint32(i)))
+	}
+
+	ch := vxcap.ReceiveQueueChan(q)
+	require.Equal(t, 2, len(ch))
+	assert.Equal(t, uint32(3), (<-ch).Pkt.VNI)
+	assert.Equal(t, uint32(4), (<-ch).Pkt.VNI)
+
+	stats := vxcap.ReceiveQueueStats(q)
+	assert.Equal(t, uint64(4), stats.Received)
+	assert.Equal(t, uint64(2), stats.QueueDropped)
+}
+
+func TestQueueDropOldestKeepsError(t *testing.T) {
+	q := vxcap.NewReceiveQueue(1, vxcap.QueuePolicyDropOldest)
+	vxcap.ReceiveQueuePushError(q, fmt.Errorf("socket error"))
+	vxcap.ReceiveQueuePush(q, newQueuedPacket(1))
+
+	ch := vxcap.ReceiveQueueChan(q)
+	require.Equal(t, 1, len(ch))
+	assert.Error(t, (<-ch).Err)
+	assert.Equal(t, uint64(1), vxcap.ReceiveQueueStats(q).QueueDropped)
+}
+
+func TestQueueDropOldestPutBackNeverBlocks(t *testing.T) {
+	// Another receiver filled the queue after the error was taken. The
+	// error is put back by discarding the packet instead of waiting.
+	q := vxcap.NewReceiveQueue(1, vxcap.QueuePolicyDropOldest)
+	vxcap.ReceiveQueuePush(q, newQueuedPacket(1))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		vxcap.ReceiveQueuePutBack(q, fmt.Errorf("socket error"))
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.Fail(t, "put back is blocked")
+	}
+
+	ch := vxcap.ReceiveQueueChan(q)
+	require.Equal(t, 1, len(ch))
+	assert.Error(t, (<-ch).Err)
+	assert.Equal(t, uint64(1), vxcap.ReceiveQueueStats(q).QueueDropped)
+}
+
+func TestQueueBlock(t *testing.T) {
+	q := vxcap.NewReceiveQueue(1, vxcap.QueuePolicyBlock)
+	vxcap.ReceiveQueuePush(q, newQueuedPacket(1))
+
+	pushed := make(chan struct{})
+	go func() {
+		vxcap.ReceiveQueuePush(q, newQueuedPacket(2))
+		close(pushed)
+	}()
+
+	ch := vxcap.ReceiveQueueChan(q)
+	assert.Equal(t, uint32(1), (<-ch).Pkt.VNI)
+	<-pushed
+	assert.Equal(t, uint32(2), (<-ch).Pkt.VNI)
+	assert.Equal(t, uint64(0), vxcap.ReceiveQueueStats(q).QueueDropped)
+}
+
+func TestQueueBlockAbort(t *testing.T) {
+	q := vxcap.NewReceiveQueue(1, vxcap.QueuePolicyBlock)
+	vxcap.ReceiveQueuePush(q, newQueuedPacket(1))
+
+	pushed := make(chan struct{})
+	go func() {
+		vxcap.ReceiveQueuePush(q, newQueuedPacket(2))
+		vxcap.ReceiveQueuePushError(q, fmt.Errorf("socket error"))
+		close(pushed)
+	}()
+
+	vxcap.ReceiveQueueAbort(q)
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "push is not released by abort")
+	}
+	assert.Equal(t, 1, len(vxcap.ReceiveQueueChan(q)))
+	assert.Equal(t, uint64(1), vxcap.ReceiveQueueStats(q).Received)
+}
+
+func TestQueueInvalidPolicy(t *testing.T) {
+	cap := vxcap.New()
+	cap.QueuePolicy = "drop-all"
+	proc := DummyProcessor{}
+	assert.Error(t, cap.Start(&proc))
+}
@@ -0,0 +1,123 @@
+package vxcap
+
+import (
+	"fmt"
+	"sync"
+)
+
+// plugins has dumpers and emitters registered by RegisterDumper and
+// RegisterEmitter in addition to built-in ones.
+var plugins = struct {
+	mutex    sync.RWMutex
+	dumpers  map[dumperKey]DumperConstructor
+	emitters map[string]EmitterConstructor
+}{
+	dumpers:  make(map[dumperKey]DumperConstructor),
+	emitters: make(map[string]EmitterConstructor),
+}
+
+// RegisterDumper adds a dumper for format (DumperArguments.Format) and target
+// ("packet" or "session") that NewPacketProcessor can use. For "session"
+// target, Packet.Session is set and other fields are empty. A format that is
+// already registered, including built-in ones, can not be overwritten.
+// Registered dumper can be used with both of built-in and registered emitters.
+func RegisterDumper(format, target string, constructor DumperConstructor) error {
+	if format == "" {
+		return fmt.Errorf("Format of dumper is required")
+	}
+	if target != "packet" && target != "session" {
+		return fmt.Errorf("Invalid target of dumper: %q, must be packet or session", target)
+	}
+	if constructor == nil {
+		return fmt.Errorf("Constructor of dumper is required")
+	}
+
+	key := dumperKey{Format: format, Target: target}
+
+	plugins.mutex.Lock()
+	defer plugins.mutex.Unlock()
+
+	if _, ok := dumperMap[key]; ok {
+		return fmt.Errorf("Dumper is already registered: %s for %s", format, target)
+	}
+	if _, ok := plugins.dumpers[key]; ok {
+		return fmt.Errorf("Dumper is already registered: %s for %s", format, target)
+	}
+
+	plugins.dumpers[key] = constructor
+	return nil
+}
+
+// RegisterEmitter adds an emitter with name (EmitterArguments.Name) that
+// NewPacketProcessor can use. A name that is already registered, including
+// built-in ones, can not be overwritten. Registered emitter can be used with
+// all dumpers and also as destination of route; EmitterArguments.Destination
+// has destination part of the route spec.
+func RegisterEmitter(name string, constructor EmitterConstructor) error {
+	if name == "" {
+		return fmt.Errorf("Name of emitter is required")
+	}
+	if constructor == nil {
+		return fmt.Errorf("Constructor of emitter is required")
+	}
+
+	plugins.mutex.Lock()
+	defer plugins.mutex.Unlock()
+
+	if isBuiltinEmitter(name) {
+		return fmt.Errorf("Emitter is already registered: %s", name)
+	}
+	if _, ok := plugins.emitters[name]; ok {
+		return fmt.Errorf("Emitter is already registered: %s", name)
+	}
+
+	plugins.emitters[name] = constructor
+	return nil
+}
+
+func isBuiltinEmitter(name string) bool {
+	for key := range emitterMap {
+		if key.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func lookupDumperPlugin(key dumperKey) (DumperConstructor, bool) {
+	plugins.mutex.RLock()
+	defer plugins.mutex.RUnlock()
+	constructor, ok := plugins.dumpers[key]
+	return constructor, ok
+}
+
+func lookupEmitterPlugin(name string) (EmitterConstructor, bool) {
+	plugins.mutex.RLock()
+	defer plugins.mutex.RUnlock()
+	constructor, ok := plugins.emitters[name]
+	return constructor, ok
+}
+
+// lookupEmitterParams returns parameters for a combination of emitter, dumper
+// format and target. Combinations of built-in ones are defined by
+// emitterModeMap. A combination including registered dumper or emitter is
+// allowed if both of them exist, and format is used as file extension.
+func lookupEmitterParams(key emitterModeKey) (emitterParams, bool) {
+	if params, ok := emitterModeMap[key]; ok {
+		return params, true
+	}
+
+	dKey := dumperKey{Format: key.Format, Target: key.Target}
+	_, dumperPlugin := lookupDumperPlugin(dKey)
+	_, emitterPlugin := lookupEmitterPlugin(key.Emitter)
+
+	switch {
+	case dumperPlugin && emitterPlugin:
+	case dumperPlugin && isBuiltinEmitter(key.Emitter):
+	case emitterPlugin && dumperMap[dKey] != nil:
+	default:
+		return emitterParams{}, false
+	}
+
+	return emitterParams{Mode: "stream", Extension: key.Format}, true
+}
@@ -0,0 +1,230 @@
+package vxcap_test
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/vxcap/pkg/vxcap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// vniDumper writes VNI of each packet as a line.
+type vniDumper struct{}
+
+func (x *vniDumper) Open(w io.Writer) error  { return nil }
+func (x *vniDumper) Close(w io.Writer) error { return nil }
+func (x *vniDumper) Dump(packets []*vxcap.Packet, w io.Writer) error {
+	for _, pkt := range packets {
+		if _, err := fmt.Fprintf(w, "%d\n", pkt.VNI); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memoryEmitter keeps emitted packets.
+type memoryEmitter struct {
+	args     vxcap.EmitterArguments
+	dumper   vxcap.Dumper
+	packets  []*vxcap.Packet
+	ticked   bool
+	setup    bool
+	teardown bool
+}
+
+func (x *memoryEmitter) Setup() error { x.setup = true; return nil }
+func (x *memoryEmitter) Emit(packets []*vxcap.Packet) error {
+	x.packets = append(x.packets, packets...)
+	return nil
+}
+func (x *memoryEmitter) Tick(now time.Time) error { x.ticked = true; return nil }
+func (x *memoryEmitter) Teardown() error          { x.teardown = true; return nil }
+
+func registerMemoryEmitter(t *testing.T, name string) map[string]*memoryEmitter {
+	emitters := make(map[string]*memoryEmitter)
+	err := vxcap.RegisterEmitter(name, func(args vxcap.EmitterArguments, dumper vxcap.Dumper) (vxcap.Emitter, error) {
+		e := &memoryEmitter{args: args, dumper: dumper}
+		emitters[args.Destination] = e
+		return e, nil
+	})
+	require.NoError(t, err)
+	return emitters
+}
+
+func TestRegisterEmitter(t *testing.T) {
+	emitters := registerMemoryEmitter(t, "test-memory")
+
+	proc, err := vxcap.NewPacketProcessor(vxcap.PacketProcessorArgument{
+		DumperArgs: vxcap.DumperArguments{
+			Format: "pcap",
+			Target: "packet",
+		},
+		EmitterArgs: vxcap.EmitterArguments{
+			Name: "test-memory",
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, proc.Setup())
+
+	pkt := vxcap.NewPacketData(genSamplePacketData())
+	require.NoError(t, proc.Put(pkt))
+	require.NoError(t, proc.Tick(time.Now()))
+	require.NoError(t, proc.Shutdown())
+
+	e := emitters[""]
+	require.NotNil(t, e)
+	assert.True(t, e.setup)
+	assert.True(t, e.ticked)
+	assert.True(t, e.teardown)
+	assert.Equal(t, []*vxcap.Packet{pkt}, e.packets)
+	assert.Equal(t, "pcap", e.args.Extension())
+	assert.NotNil(t, e.dumper)
+}
+
+func TestRegisterEmitterRoute(t *testing.T) {
+	emitters := registerMemoryEmitter(t, "test-route")
+
+	base := vxcap.PacketProcessorArgument{
+		DumperArgs: vxcap.DumperArguments{
+			Format: "json",
+			Target: "packet",
+		},
+		DropUnmatched: true,
+	}
+	route, err := vxcap.ParseRoute("100=test-route:topic-a", base)
+	require.NoError(t, err)
+	assert.Equal(t, "topic-a", route.EmitterArgs.Destination)
+	base.Routes = append(base.Routes, route)
+
+	proc, err := vxcap.NewPacketProcessor(base)
+	require.NoError(t, err)
+	require.NoError(t, proc.Setup())
+
+	pkt := vxcap.NewPacketData(genSamplePacketData())
+	pkt.VNI = 100
+	require.NoError(t, proc.Put(pkt))
+	pkt = vxcap.NewPacketData(genSamplePacketData())
+	pkt.VNI = 101
+	require.NoError(t, proc.Put(pkt))
+	require.NoError(t, proc.Shutdown())
+
+	require.Contains(t, emitters, "topic-a")
+	assert.Equal(t, 1, len(emitters["topic-a"].packets))
+
+	_, err = vxcap.ParseRoute("100=no-such-emitter:x", base)
+	assert.Error(t, err)
+}
+
+func TestRegisterDumper(t *testing.T) {
+	require.NoError(t, vxcap.RegisterDumper("test-vni", "packet",
+		func(args vxcap.DumperArguments) (vxcap.Dumper, error) {
+			return &vniDumper{}, nil
+		}))
+
+	dir, err := ioutil.TempDir("", "vxcap-registry")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := vxcap.DefaultConfig()
+	cfg.Processor.DumperArgs.Format = "test-vni"
+	cfg.Processor.EmitterArgs.FsDirPath = dir
+	cfg.Processor.EmitterArgs.FsFileName = ""
+	require.NoError(t, cfg.Validate())
+
+	proc, err := vxcap.NewPacketProcessor(cfg.Processor)
+	require.NoError(t, err)
+	require.NoError(t, proc.Setup())
+
+	for _, vni := range []uint32{1, 2, 3} {
+		pkt := vxcap.NewPacketData(genSamplePacketData())
+		pkt.VNI = vni
+		require.NoError(t, proc.Put(pkt))
+	}
+	require.NoError(t, proc.Shutdown())
+
+	// File extension is format name of the dumper
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "dump.test-vni"))
+	require.NoError(t, err)
+	assert.Equal(t, "1\n2\n3\n", string(raw))
+
+	// Not registered for session target
+	cfg.Processor.DumperArgs.Target = "session"
+	assert.Error(t, cfg.Validate())
+}
+
+func TestRegisterDumperAndEmitter(t *testing.T) {
+	require.NoError(t, vxcap.RegisterDumper("test-pair", "session",
+		func(args vxcap.DumperArguments) (vxcap.Dumper, error) {
+			return &vniDumper{}, nil
+		}))
+	emitters := registerMemoryEmitter(t, "test-pair")
+
+	proc, err := vxcap.NewPacketProcessor(vxcap.PacketProcessorArgument{
+		DumperArgs: vxcap.DumperArguments{
+			Format: "test-pair",
+			Target: "session",
+		},
+		EmitterArgs: vxcap.EmitterArguments{
+			Name: "test-pair",
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, proc.Setup())
+	require.NoError(t, proc.Put(vxcap.NewPacketData(genSamplePacketData())))
+	require.NoError(t, proc.Shutdown())
+
+	e := emitters[""]
+	require.NotNil(t, e)
+	require.Equal(t, 1, len(e.packets))
+	assert.NotNil(t, e.packets[0].Session)
+	assert.Equal(t, "test-pair", e.args.Extension())
+}
+
+func TestRegisterConflict(t *testing.T) {
+	newDumper := func(args vxcap.DumperArguments) (vxcap.Dumper, error) {
+		return &vniDumper{}, nil
+	}
+	newEmitter := func(args vxcap.EmitterArguments, dumper vxcap.Dumper) (vxcap.Emitter, error) {
+		return &memoryEmitter{}, nil
+	}
+
+	// Built-in ones can not be overwritten
+	assert.Error(t, vxcap.RegisterDumper("pcap", "packet", newDumper))
+	assert.Error(t, vxcap.RegisterEmitter("fs", newEmitter))
+
+	require.NoError(t, vxcap.RegisterDumper("test-conflict", "packet", newDumper))
+	assert.Error(t, vxcap.RegisterDumper("test-conflict", "packet", newDumper))
+	require.NoError(t, vxcap.RegisterEmitter("test-conflict", newEmitter))
+	assert.Error(t, vxcap.RegisterEmitter("test-conflict", newEmitter))
+
+	// Invalid arguments
+	assert.Error(t, vxcap.RegisterDumper("", "packet", newDumper))
+	assert.Error(t, vxcap.RegisterDumper("test-invalid", "flow", newDumper))
+	assert.Error(t, vxcap.RegisterDumper("test-invalid", "packet", nil))
+	assert.Error(t, vxcap.RegisterEmitter("", newEmitter))
+	assert.Error(t, vxcap.RegisterEmitter("test-invalid", nil))
+}
+
+func TestRegisterConstructorError(t *testing.T) {
+	require.NoError(t, vxcap.RegisterEmitter("test-broken",
+		func(args vxcap.EmitterArguments, dumper vxcap.Dumper) (vxcap.Emitter, error) {
+			return nil, fmt.Errorf("broken")
+		}))
+
+	_, err := vxcap.NewPacketProcessor(vxcap.PacketProcessorArgument{
+		DumperArgs: vxcap.DumperArguments{
+			Format: "pcap",
+			Target: "packet",
+		},
+		EmitterArgs: vxcap.EmitterArguments{
+			Name: "test-broken",
+		},
+	})
+	assert.Error(t, err)
+}
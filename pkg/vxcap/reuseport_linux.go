@@ -0,0 +1,24 @@
+//go:build linux
+// +build linux
+
+package vxcap
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const reusePortAvailable = true
+
+// reusePortControl sets SO_REUSEPORT to a socket. It's used as Control of
+// net.ListenConfig.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
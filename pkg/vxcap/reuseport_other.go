@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package vxcap
+
+import "syscall"
+
+const reusePortAvailable = false
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
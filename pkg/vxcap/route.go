@@ -0,0 +1,127 @@
+package vxcap
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const maxVNI = 0xffffff // VNI is 24 bit
+
+// RouteArgument is a routing rule of PacketProcessor. Packets having VNI in
+// range of VNIFrom to VNITo (both inclusive) are sent to emitter constructed
+// by DumperArgs and EmitterArgs.
+type RouteArgument struct {
+	VNIFrom     uint32
+	VNITo       uint32
+	DumperArgs  DumperArguments
+	EmitterArgs EmitterArguments
+}
+
+type processorRoute struct {
+	vniFrom uint32
+	vniTo   uint32
+	emitter Emitter
+}
+
+func (x *processorRoute) match(vni uint32) bool {
+	return x.vniFrom <= vni && vni <= x.vniTo
+}
+
+func parseVNIRange(s string) (uint32, uint32, error) {
+	parts := strings.SplitN(s, "-", 2)
+
+	var vni [2]uint32
+	for i, p := range parts {
+		n, err := strconv.ParseUint(strings.TrimSpace(p), 10, 32)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "Invalid VNI: %s", p)
+		}
+		if n > maxVNI {
+			return 0, 0, fmt.Errorf("VNI must be less than or equal %d: %d", maxVNI, n)
+		}
+		vni[i] = uint32(n)
+	}
+
+	if len(parts) == 1 {
+		vni[1] = vni[0]
+	}
+	if vni[0] > vni[1] {
+		return 0, 0, fmt.Errorf("Invalid VNI range: %s", s)
+	}
+
+	return vni[0], vni[1], nil
+}
+
+// ParseRoute builds RouteArgument from route spec string. Format of the spec
+// is "<VNI>[-<VNI>]=<emitter>:<destination>" and meaning of destination
+// depends on emitter.
+//
+//   - fs: File path, e.g. "100=fs:/var/log/vxcap/session_a.pcap"
+//   - s3: S3 bucket and optional key prefix, e.g. "200-299=s3:my-bucket/team-b/"
+//   - firehose: Firehose name, e.g. "300=firehose:my-hose"
+//   - kinesis: Kinesis stream name, e.g. "400=kinesis:my-stream"
+//   - kafka: Kafka topic, e.g. "500=kafka:my-topic"
+//   - Emitter registered by RegisterEmitter: EmitterArguments.Destination
+//
+// Other options of dumper and emitter are inherited from base.
+func ParseRoute(spec string, base PacketProcessorArgument) (RouteArgument, error) {
+	route := RouteArgument{
+		DumperArgs:  base.DumperArgs,
+		EmitterArgs: base.EmitterArgs,
+	}
+
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 {
+		return route, fmt.Errorf("Route must be '<VNI>[-<VNI>]=<emitter>:<destination>': %s", spec)
+	}
+
+	vniFrom, vniTo, err := parseVNIRange(parts[0])
+	if err != nil {
+		return route, err
+	}
+	route.VNIFrom, route.VNITo = vniFrom, vniTo
+
+	dest := strings.SplitN(parts[1], ":", 2)
+	if len(dest) != 2 || dest[1] == "" {
+		return route, fmt.Errorf("Destination of route must be '<emitter>:<destination>': %s", parts[1])
+	}
+
+	route.EmitterArgs.Name = dest[0]
+	switch dest[0] {
+	case "fs":
+		dir, file := filepath.Split(dest[1])
+		if dir != "" {
+			route.EmitterArgs.FsDirPath = dir
+		}
+		route.EmitterArgs.FsFileName = file
+
+	case "s3":
+		s3dest := strings.SplitN(dest[1], "/", 2)
+		route.EmitterArgs.AwsS3Bucket = s3dest[0]
+		route.EmitterArgs.AwsS3Prefix = ""
+		if len(s3dest) == 2 {
+			route.EmitterArgs.AwsS3Prefix = s3dest[1]
+		}
+
+	case "firehose":
+		route.EmitterArgs.AwsFirehoseName = dest[1]
+
+	case "kinesis":
+		route.EmitterArgs.AwsKinesisStreamName = dest[1]
+
+	case "kafka":
+		route.EmitterArgs.KafkaTopic = dest[1]
+
+	default:
+		if _, ok := lookupEmitterPlugin(dest[0]); !ok {
+			return route, fmt.Errorf("Unsupported emitter for route: %s", dest[0])
+		}
+		route.EmitterArgs.Destination = dest[1]
+	}
+
+	return route, nil
+}
@@ -0,0 +1,153 @@
+package vxcap_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/m-mizutani/vxcap/pkg/vxcap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRoute(t *testing.T) {
+	base := vxcap.PacketProcessorArgument{
+		DumperArgs: vxcap.DumperArguments{Format: "json", Target: "packet"},
+		EmitterArgs: vxcap.EmitterArguments{
+			Name:        "fs",
+			AwsRegion:   "ap-northeast-1",
+			AwsS3Prefix: "base/",
+		},
+	}
+
+	route, err := vxcap.ParseRoute("100=fs:/tmp/session_a.json", base)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(100), route.VNIFrom)
+	assert.Equal(t, uint32(100), route.VNITo)
+	assert.Equal(t, "fs", route.EmitterArgs.Name)
+	assert.Equal(t, "/tmp/", route.EmitterArgs.FsDirPath)
+	assert.Equal(t, "session_a.json", route.EmitterArgs.FsFileName)
+	assert.Equal(t, "json", route.DumperArgs.Format)
+
+	route, err = vxcap.ParseRoute("200-299=s3:my-bucket/team-b/", base)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(200), route.VNIFrom)
+	assert.Equal(t, uint32(299), route.VNITo)
+	assert.Equal(t, "s3", route.EmitterArgs.Name)
+	assert.Equal(t, "my-bucket", route.EmitterArgs.AwsS3Bucket)
+	assert.Equal(t, "team-b/", route.EmitterArgs.AwsS3Prefix)
+	assert.Equal(t, "ap-northeast-1", route.EmitterArgs.AwsRegion)
+
+	route, err = vxcap.ParseRoute("300=s3:my-bucket", base)
+	require.NoError(t, err)
+	assert.Equal(t, "", route.EmitterArgs.AwsS3Prefix)
+
+	route, err = vxcap.ParseRoute("300=firehose:my-hose", base)
+	require.NoError(t, err)
+	assert.Equal(t, "my-hose", route.EmitterArgs.AwsFirehoseName)
+
+	route, err = vxcap.ParseRoute("400=kinesis:my-stream", base)
+	require.NoError(t, err)
+	assert.Equal(t, "my-stream", route.EmitterArgs.AwsKinesisStreamName)
+
+	route, err = vxcap.ParseRoute("500=kafka:my-topic", base)
+	require.NoError(t, err)
+	assert.Equal(t, "my-topic", route.EmitterArgs.KafkaTopic)
+
+	for _, spec := range []string{
+		"100",               // No destination
+		"abc=fs:dump.pcap",  // Invalid VNI
+		"299-200=fs:a.pcap", // Invalid range
+		"16777216=fs:a",     // VNI is 24 bit
+		"100=fs",            // No destination
+		"100=gcs:bucket",    // Unsupported emitter
+	} {
+		_, err := vxcap.ParseRoute(spec, base)
+		assert.Error(t, err, spec)
+	}
+}
+
+func countLines(t *testing.T, path string) int {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return 0
+	}
+	require.NoError(t, err)
+	return strings.Count(string(raw), "\n")
+}
+
+func TestProcessorRoute(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vxcap_route")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	base := vxcap.PacketProcessorArgument{
+		DumperArgs: vxcap.DumperArguments{Format: "json", Target: "packet"},
+		EmitterArgs: vxcap.EmitterArguments{
+			Name:       "fs",
+			FsDirPath:  dir,
+			FsFileName: "default.json",
+		},
+	}
+	for _, spec := range []string{"100=fs:a.json", "200-299=fs:b.json"} {
+		route, err := vxcap.ParseRoute(spec, base)
+		require.NoError(t, err)
+		base.Routes = append(base.Routes, route)
+	}
+
+	proc, err := vxcap.NewPacketProcessor(base)
+	require.NoError(t, err)
+	require.NoError(t, proc.Setup())
+
+	for _, vni := range []uint32{100, 200, 250, 299, 300, 1} {
+		pkt := vxcap.NewPacketData(genSamplePacketData())
+		pkt.VNI = vni
+		require.NoError(t, proc.Put(pkt))
+	}
+	require.NoError(t, proc.Shutdown())
+
+	assert.Equal(t, 1, countLines(t, filepath.Join(dir, "a.json")))
+	assert.Equal(t, 3, countLines(t, filepath.Join(dir, "b.json")))
+	assert.Equal(t, 2, countLines(t, filepath.Join(dir, "default.json")))
+}
+
+func TestProcessorRouteDropUnmatched(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vxcap_route")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	base := vxcap.PacketProcessorArgument{
+		DumperArgs: vxcap.DumperArguments{Format: "json", Target: "packet"},
+		EmitterArgs: vxcap.EmitterArguments{
+			Name:       "fs",
+			FsDirPath:  dir,
+			FsFileName: "default.json",
+		},
+		DropUnmatched: true,
+	}
+
+	// DropUnmatched requires routes
+	_, err = vxcap.NewPacketProcessor(base)
+	assert.Error(t, err)
+
+	route, err := vxcap.ParseRoute("100=fs:a.json", base)
+	require.NoError(t, err)
+	base.Routes = append(base.Routes, route)
+
+	proc, err := vxcap.NewPacketProcessor(base)
+	require.NoError(t, err)
+	require.NoError(t, proc.Setup())
+
+	for _, vni := range []uint32{100, 200, 100} {
+		pkt := vxcap.NewPacketData(genSamplePacketData())
+		pkt.VNI = vni
+		require.NoError(t, proc.Put(pkt))
+	}
+	require.NoError(t, proc.Shutdown())
+
+	assert.Equal(t, 2, countLines(t, filepath.Join(dir, "a.json")))
+	_, err = os.Stat(filepath.Join(dir, "default.json"))
+	assert.True(t, os.IsNotExist(err))
+}
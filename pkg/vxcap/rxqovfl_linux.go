@@ -0,0 +1,52 @@
+//go:build linux
+// +build linux
+
+package vxcap
+
+import (
+	"encoding/binary"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// rxqOverflowOOBSize is buffer size of control message to receive SO_RXQ_OVFL.
+var rxqOverflowOOBSize = unix.CmsgSpace(4)
+
+// rxqOverflowControl sets SO_RXQ_OVFL to a socket. Then kernel attaches number
+// of datagrams dropped on the socket to received datagram as control message.
+func rxqOverflowControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RXQ_OVFL, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// parseRxqOverflow extracts accumulated drop count of the socket from
+// control message. It returns false if the message has no drop count.
+func parseRxqOverflow(oob []byte) (uint32, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, false
+	}
+
+	for _, msg := range msgs {
+		if msg.Header.Level == unix.SOL_SOCKET && msg.Header.Type == unix.SO_RXQ_OVFL && len(msg.Data) >= 4 {
+			return nativeEndian.Uint32(msg.Data), true
+		}
+	}
+	return 0, false
+}
+
+// nativeEndian is byte order of the platform used in control message.
+var nativeEndian = func() binary.ByteOrder {
+	v := uint16(1)
+	if *(*byte)(unsafe.Pointer(&v)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package vxcap
+
+import "syscall"
+
+var rxqOverflowOOBSize = 0
+
+func rxqOverflowControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+func parseRxqOverflow(oob []byte) (uint32, bool) {
+	return 0, false
+}
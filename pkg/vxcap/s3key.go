@@ -0,0 +1,151 @@
+package vxcap
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Key templates used if AwsS3KeyTemplate is not set.
+const (
+	defaultS3KeyTemplate     = "{prefix}{start}_{uuid}.{ext}"
+	defaultS3TimeKeyTemplate = "{prefix}{yyyy}/{MM}/{dd}/{HH}/{start}_{uuid}.{ext}"
+)
+
+var (
+	s3KeyPlaceholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+	s3KeyDatePattern        = regexp.MustCompile(`^(?:yyyy|MM|dd|HH|mm|ss|[-_/.: ])+$`)
+	s3KeyDateReplacer       = strings.NewReplacer(
+		"yyyy", "2006", "MM", "01", "dd", "02", "HH", "15", "mm", "04", "ss", "05")
+)
+
+// s3KeyParams is values for placeholders of S3 key template.
+type s3KeyParams struct {
+	Prefix string
+	VNI    uint32
+	Sensor string
+	Time   time.Time // Time of first packet in the object
+	UUID   string
+	Ext    string
+}
+
+type s3KeySegment struct {
+	text   string // Literal text if name is empty
+	name   string // Name of placeholder
+	layout string // Go time layout for date placeholder
+}
+
+// s3KeyTemplate builds S3 object key from template having placeholders in
+// braces.
+//
+//   - {prefix}: AwsS3Prefix
+//   - {vni}: VNI, packets are split into objects by VNI if it's used
+//   - {sensor}: Sensor ID (AwsS3SensorID)
+//   - {start}: Time of first packet, e.g. 20191001_120000
+//   - {uuid}: Random UUID without hyphens, required to avoid overwriting
+//   - {ext}: File extension of format
+//   - Date pattern of yyyy, MM, dd, HH, mm and ss, e.g. {yyyy-MM-dd}, {HH}
+//
+// Time is in UTC.
+type s3KeyTemplate struct {
+	segments []s3KeySegment
+	hasVNI   bool
+}
+
+func parseS3KeyTemplate(tmpl string) (*s3KeyTemplate, error) {
+	var x s3KeyTemplate
+	var hasUUID bool
+
+	pos := 0
+	for _, loc := range s3KeyPlaceholderPattern.FindAllStringIndex(tmpl, -1) {
+		if loc[0] > pos {
+			x.segments = append(x.segments, s3KeySegment{text: tmpl[pos:loc[0]]})
+		}
+		pos = loc[1]
+
+		name := tmpl[loc[0]+1 : loc[1]-1]
+		seg := s3KeySegment{name: name}
+		switch name {
+		case "prefix", "sensor", "start", "ext":
+		case "vni":
+			x.hasVNI = true
+		case "uuid":
+			hasUUID = true
+		default:
+			if !s3KeyDatePattern.MatchString(name) {
+				return nil, fmt.Errorf("Unknown placeholder of S3 key template: {%s}", name)
+			}
+			seg.layout = s3KeyDateReplacer.Replace(name)
+		}
+		x.segments = append(x.segments, seg)
+	}
+	if pos < len(tmpl) {
+		x.segments = append(x.segments, s3KeySegment{text: tmpl[pos:]})
+	}
+
+	if strings.ContainsAny(strings.Join(s3KeyPlaceholderPattern.Split(tmpl, -1), ""), "{}") {
+		return nil, fmt.Errorf("Unbalanced brace in S3 key template: %s", tmpl)
+	}
+	if !hasUUID {
+		return nil, fmt.Errorf("S3 key template must have {uuid} to avoid overwriting objects: %s", tmpl)
+	}
+
+	return &x, nil
+}
+
+// render returns S3 key. Repeated "/" (e.g. by prefix ending with "/") are
+// merged and leading "/" is removed.
+func (x *s3KeyTemplate) render(p s3KeyParams) string {
+	t := p.Time.UTC()
+
+	var b strings.Builder
+	for _, seg := range x.segments {
+		switch {
+		case seg.name == "":
+			b.WriteString(seg.text)
+		case seg.layout != "":
+			b.WriteString(t.Format(seg.layout))
+		case seg.name == "prefix":
+			b.WriteString(p.Prefix)
+		case seg.name == "vni":
+			b.WriteString(strconv.FormatUint(uint64(p.VNI), 10))
+		case seg.name == "sensor":
+			b.WriteString(p.Sensor)
+		case seg.name == "start":
+			b.WriteString(t.Format("20060102_150405"))
+		case seg.name == "uuid":
+			b.WriteString(p.UUID)
+		case seg.name == "ext":
+			b.WriteString(p.Ext)
+		}
+	}
+
+	key := b.String()
+	for strings.Contains(key, "//") {
+		key = strings.Replace(key, "//", "/", -1)
+	}
+	return strings.TrimLeft(key, "/")
+}
+
+// splitPacketsByVNI returns packets grouped by VNI in order of VNI. Order of
+// packets in a group is kept.
+func splitPacketsByVNI(packets []*Packet) [][]*Packet {
+	groups := make(map[uint32][]*Packet)
+	var vniList []uint32
+	for _, pkt := range packets {
+		if _, ok := groups[pkt.VNI]; !ok {
+			vniList = append(vniList, pkt.VNI)
+		}
+		groups[pkt.VNI] = append(groups[pkt.VNI], pkt)
+	}
+	sort.Slice(vniList, func(i, j int) bool { return vniList[i] < vniList[j] })
+
+	var result [][]*Packet
+	for _, vni := range vniList {
+		result = append(result, groups[vni])
+	}
+	return result
+}
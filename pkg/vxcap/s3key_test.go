@@ -0,0 +1,54 @@
+package vxcap_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/vxcap/pkg/vxcap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3KeyTemplate(t *testing.T) {
+	ts := time.Date(2019, 10, 1, 9, 8, 7, 0, time.FixedZone("JST", 9*3600))
+
+	for _, tc := range []struct {
+		tmpl   string
+		prefix string
+		key    string
+	}{
+		{
+			"{prefix}/vni={vni}/dt={yyyy-MM-dd}/hour={HH}/{sensor}_{start}_{uuid}.{ext}", "mirror",
+			"mirror/vni=100/dt=2019-10-01/hour=00/sensor-a_20191001_000807_abc.pcap",
+		},
+		{
+			// Repeated and leading slashes are merged or removed
+			"{prefix}/{yyyy}/{MM}/{dd}/{uuid}.{ext}", "mirror/",
+			"mirror/2019/10/01/abc.pcap",
+		},
+		{
+			"{prefix}/{yyyyMMdd}T{HHmmss}_{uuid}", "",
+			"20191001T000807_abc",
+		},
+		{
+			// Default template
+			"{prefix}{start}_{uuid}.{ext}", "mirror/",
+			"mirror/20191001_000807_abc.pcap",
+		},
+	} {
+		key, err := vxcap.RenderS3Key(tc.tmpl, tc.prefix, 100, "sensor-a", ts, "abc", "pcap")
+		require.NoError(t, err, tc.tmpl)
+		assert.Equal(t, tc.key, key)
+	}
+
+	for _, tmpl := range []string{
+		"{prefix}/{start}.{ext}",        // No {uuid}
+		"{prefix}/{unknown}/{uuid}",     // Unknown placeholder
+		"{prefix}/{yyyy-MM-ddd}/{uuid}", // Invalid date pattern
+		"{prefix}/{uuid}.{ext",          // Unbalanced brace
+		"{prefix}/}{uuid}",              // Unbalanced brace
+	} {
+		_, err := vxcap.RenderS3Key(tmpl, "", 100, "", ts, "abc", "pcap")
+		assert.Error(t, err, tmpl)
+	}
+}
@@ -0,0 +1,307 @@
+package vxcap
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// DefaultSessionIdleTimeout is seconds to close a session without any packet.
+	DefaultSessionIdleTimeout = 60
+	// DefaultSessionActiveTimeout is seconds to emit a long lived session record.
+	// Packets after the timeout are counted in a new session record.
+	DefaultSessionActiveTimeout = 1800
+)
+
+// Termination reasons of session
+const (
+	sessionReasonIdle     = "idle"
+	sessionReasonActive   = "active"
+	sessionReasonFin      = "fin"
+	sessionReasonRst      = "rst"
+	sessionReasonShutdown = "shutdown"
+)
+
+// sessionKey is 5-tuple and VNI of a session. Src is the side that sent the
+// first packet of the session.
+type sessionKey struct {
+	VNI      uint32
+	Protocol string
+	SrcAddr  string
+	DstAddr  string
+	SrcPort  int
+	DstPort  int
+}
+
+func (x sessionKey) reverse() sessionKey {
+	return sessionKey{
+		VNI:      x.VNI,
+		Protocol: x.Protocol,
+		SrcAddr:  x.DstAddr,
+		DstAddr:  x.SrcAddr,
+		SrcPort:  x.DstPort,
+		DstPort:  x.SrcPort,
+	}
+}
+
+// SessionRecord is a bidirectional flow. It's emitted to dumper as
+// Packet.Session when the session is finished.
+type SessionRecord struct {
+	VNI      uint32 `json:"vni,omitempty"`
+	Protocol string `json:"proto"`
+	SrcAddr  string `json:"src_addr"`
+	DstAddr  string `json:"dst_addr"`
+	SrcPort  int    `json:"src_port,omitempty"`
+	DstPort  int    `json:"dst_port,omitempty"`
+
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+
+	// Src to Dst
+	SrcPackets uint64 `json:"src_packets"`
+	SrcBytes   uint64 `json:"src_bytes"`
+	// Dst to Src
+	DstPackets uint64 `json:"dst_packets"`
+	DstBytes   uint64 `json:"dst_bytes"`
+
+	TCPFlags string `json:"tcp_flags,omitempty"` // Flags seen in the session, e.g. "SYN,ACK,FIN"
+	Reason   string `json:"reason"`              // idle, active, fin, rst or shutdown
+
+	tcpFlags  uint16
+	srcFin    bool
+	dstFin    bool
+	closed    string    // Termination reason by TCP flag, expired at next tick
+	createdAt time.Time // Wall clock time to manage timeout
+	updatedAt time.Time
+}
+
+const (
+	tcpFlagFIN uint16 = 1 << iota
+	tcpFlagSYN
+	tcpFlagRST
+	tcpFlagPSH
+	tcpFlagACK
+	tcpFlagURG
+	tcpFlagECE
+	tcpFlagCWR
+)
+
+var tcpFlagNames = []string{"FIN", "SYN", "RST", "PSH", "ACK", "URG", "ECE", "CWR"}
+
+func tcpFlagBits(tcp *layers.TCP) uint16 {
+	var flags uint16
+	for i, set := range []bool{tcp.FIN, tcp.SYN, tcp.RST, tcp.PSH, tcp.ACK, tcp.URG, tcp.ECE, tcp.CWR} {
+		if set {
+			flags |= 1 << uint(i)
+		}
+	}
+	return flags
+}
+
+func tcpFlagString(flags uint16) string {
+	var names []string
+	for i, name := range tcpFlagNames {
+		if flags&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// sessionTable tracks sessions of packets given by put(). Timeouts are
+// evaluated with wall clock (not timestamp of packet) because packets read
+// from file have past timestamps. It's concurrency safe.
+type sessionTable struct {
+	mutex         sync.Mutex
+	idleTimeout   time.Duration
+	activeTimeout time.Duration
+	sessions      map[sessionKey]*SessionRecord
+	now           func() time.Time
+}
+
+func newSessionTable(idleTimeout, activeTimeout int) *sessionTable {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultSessionIdleTimeout
+	}
+	if activeTimeout <= 0 {
+		activeTimeout = DefaultSessionActiveTimeout
+	}
+
+	return &sessionTable{
+		idleTimeout:   time.Duration(idleTimeout) * time.Second,
+		activeTimeout: time.Duration(activeTimeout) * time.Second,
+		sessions:      make(map[sessionKey]*SessionRecord),
+		now:           time.Now,
+	}
+}
+
+func newSessionKey(pkt *Packet) (sessionKey, *layers.TCP, bool) {
+	key := sessionKey{VNI: pkt.VNI}
+
+	netLayer := (*pkt.Packet).NetworkLayer()
+	if netLayer == nil {
+		return key, nil, false
+	}
+	src, dst := netLayer.NetworkFlow().Endpoints()
+	key.SrcAddr, key.DstAddr = src.String(), dst.String()
+
+	switch v := netLayer.(type) {
+	case *layers.IPv4:
+		key.Protocol = v.Protocol.String()
+	case *layers.IPv6:
+		key.Protocol = v.NextHeader.String()
+	default:
+		return key, nil, false
+	}
+
+	tpLayer := (*pkt.Packet).TransportLayer()
+	if tpLayer == nil {
+		return key, nil, true
+	}
+	srcPort, dstPort := tpLayer.TransportFlow().Endpoints()
+	key.SrcPort, _ = strconv.Atoi(srcPort.String())
+	key.DstPort, _ = strconv.Atoi(dstPort.String())
+
+	tcp, _ := tpLayer.(*layers.TCP)
+	return key, tcp, true
+}
+
+// put updates a session of the packet. It returns false if the packet is not
+// IP packet and can not be a part of session.
+func (x *sessionTable) put(pkt *Packet) bool {
+	key, tcp, ok := newSessionKey(pkt)
+	if !ok {
+		return false
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	now := x.now()
+	forward := true
+	ssn, ok := x.sessions[key]
+	if !ok {
+		if ssn, ok = x.sessions[key.reverse()]; ok {
+			forward = false
+		}
+	}
+
+	if ssn == nil {
+		ssn = &SessionRecord{
+			VNI:       key.VNI,
+			Protocol:  key.Protocol,
+			SrcAddr:   key.SrcAddr,
+			DstAddr:   key.DstAddr,
+			SrcPort:   key.SrcPort,
+			DstPort:   key.DstPort,
+			StartTime: pkt.Timestamp,
+			createdAt: now,
+		}
+		x.sessions[key] = ssn
+	}
+
+	if pkt.Timestamp.Before(ssn.StartTime) {
+		ssn.StartTime = pkt.Timestamp
+	}
+	if pkt.Timestamp.After(ssn.EndTime) {
+		ssn.EndTime = pkt.Timestamp
+	}
+	ssn.updatedAt = now
+
+	if forward {
+		ssn.SrcPackets++
+		ssn.SrcBytes += uint64(len(pkt.Data))
+	} else {
+		ssn.DstPackets++
+		ssn.DstBytes += uint64(len(pkt.Data))
+	}
+
+	if tcp != nil {
+		flags := tcpFlagBits(tcp)
+		ssn.tcpFlags |= flags
+
+		if flags&tcpFlagFIN != 0 {
+			if forward {
+				ssn.srcFin = true
+			} else {
+				ssn.dstFin = true
+			}
+		}
+
+		switch {
+		case flags&tcpFlagRST != 0:
+			ssn.closed = sessionReasonRst
+		case ssn.srcFin && ssn.dstFin && ssn.closed == "":
+			ssn.closed = sessionReasonFin
+		}
+	}
+
+	return true
+}
+
+func (x *sessionTable) remove(ssn *SessionRecord, reason string) *SessionRecord {
+	delete(x.sessions, sessionKey{
+		VNI:      ssn.VNI,
+		Protocol: ssn.Protocol,
+		SrcAddr:  ssn.SrcAddr,
+		DstAddr:  ssn.DstAddr,
+		SrcPort:  ssn.SrcPort,
+		DstPort:  ssn.DstPort,
+	})
+
+	ssn.Reason = reason
+	ssn.TCPFlags = tcpFlagString(ssn.tcpFlags)
+	return ssn
+}
+
+func sortSessions(sessions []*SessionRecord) []*SessionRecord {
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartTime.Before(sessions[j].StartTime)
+	})
+	return sessions
+}
+
+// expire removes and returns finished sessions in order of start time.
+// Sessions closed by TCP FIN or RST are finished at the first tick after
+// closing to include the last ACK.
+func (x *sessionTable) expire(now time.Time) []*SessionRecord {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	var finished []*SessionRecord
+
+	for _, ssn := range x.sessions {
+		switch {
+		case ssn.closed != "":
+			finished = append(finished, x.remove(ssn, ssn.closed))
+		case now.Sub(ssn.updatedAt) >= x.idleTimeout:
+			finished = append(finished, x.remove(ssn, sessionReasonIdle))
+		case now.Sub(ssn.createdAt) >= x.activeTimeout:
+			finished = append(finished, x.remove(ssn, sessionReasonActive))
+		}
+	}
+
+	return sortSessions(finished)
+}
+
+// flush removes and returns all sessions.
+func (x *sessionTable) flush() []*SessionRecord {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	var finished []*SessionRecord
+	for _, ssn := range x.sessions {
+		reason := sessionReasonShutdown
+		if ssn.closed != "" {
+			reason = ssn.closed
+		}
+		finished = append(finished, x.remove(ssn, reason))
+	}
+
+	return sortSessions(finished)
+}
@@ -0,0 +1,243 @@
+package vxcap_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/m-mizutani/vxcap/pkg/vxcap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type tcpFlags struct {
+	SYN, ACK, FIN, RST bool
+}
+
+func genInnerPacket(t *testing.T, src, dst string, sport, dport int, flags *tcpFlags, payload []byte) []byte {
+	eth := layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := layers.IPv4{
+		Version: 4,
+		TTL:     64,
+		SrcIP:   net.ParseIP(src),
+		DstIP:   net.ParseIP(dst),
+	}
+
+	var tp gopacket.SerializableLayer
+	if flags != nil {
+		ip.Protocol = layers.IPProtocolTCP
+		tcp := &layers.TCP{
+			SrcPort: layers.TCPPort(sport),
+			DstPort: layers.TCPPort(dport),
+			SYN:     flags.SYN,
+			ACK:     flags.ACK,
+			FIN:     flags.FIN,
+			RST:     flags.RST,
+			Window:  1024,
+		}
+		require.NoError(t, tcp.SetNetworkLayerForChecksum(&ip))
+		tp = tcp
+	} else {
+		ip.Protocol = layers.IPProtocolUDP
+		udp := &layers.UDP{
+			SrcPort: layers.UDPPort(sport),
+			DstPort: layers.UDPPort(dport),
+		}
+		require.NoError(t, udp.SetNetworkLayerForChecksum(&ip))
+		tp = udp
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	require.NoError(t, gopacket.SerializeLayers(buf, opts, &eth, &ip, tp, gopacket.Payload(payload)))
+	return buf.Bytes()
+}
+
+func readSessionRecords(t *testing.T, dir string) []vxcap.SessionRecord {
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "session.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	require.NoError(t, err)
+
+	var records []vxcap.SessionRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+		if line == "" {
+			continue
+		}
+		var r vxcap.SessionRecord
+		require.NoError(t, json.Unmarshal([]byte(line), &r))
+		records = append(records, r)
+	}
+	return records
+}
+
+// sessionTestArgs returns arguments of processor writing session records to
+// session.json in dir.
+func sessionTestArgs(dir string) vxcap.PacketProcessorArgument {
+	return vxcap.PacketProcessorArgument{
+		DumperArgs: vxcap.DumperArguments{Format: "json", Target: "session"},
+		EmitterArgs: vxcap.EmitterArguments{
+			Name:       "fs",
+			FsDirPath:  dir,
+			FsFileName: "session.json",
+		},
+	}
+}
+
+func TestSessionTCPFin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vxcap_session")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	proc := newTestProcessor(t, sessionTestArgs(dir))
+
+	base := time.Date(2019, 9, 1, 10, 0, 0, 0, time.UTC)
+	client, server := "10.0.0.1", "10.0.0.2"
+	packets := []struct {
+		toServer bool
+		flags    tcpFlags
+		payload  []byte
+	}{
+		{true, tcpFlags{SYN: true}, nil},
+		{false, tcpFlags{SYN: true, ACK: true}, nil},
+		{true, tcpFlags{ACK: true}, []byte("hello")},
+		{false, tcpFlags{ACK: true}, []byte("world!")},
+		{true, tcpFlags{FIN: true, ACK: true}, nil},
+		{false, tcpFlags{FIN: true, ACK: true}, nil},
+		{true, tcpFlags{ACK: true}, nil},
+	}
+
+	var srcBytes, dstBytes uint64
+	for i, p := range packets {
+		flags := p.flags
+		var data []byte
+		if p.toServer {
+			data = genInnerPacket(t, client, server, 40000, 443, &flags, p.payload)
+			srcBytes += uint64(len(data))
+		} else {
+			data = genInnerPacket(t, server, client, 443, 40000, &flags, p.payload)
+			dstBytes += uint64(len(data))
+		}
+		pkt := vxcap.NewPacketData(data)
+		pkt.VNI = 100
+		pkt.Timestamp = base.Add(time.Duration(i) * time.Second)
+		require.NoError(t, proc.Put(pkt))
+	}
+
+	require.NoError(t, proc.Tick(time.Now()))
+	records := readSessionRecords(t, dir)
+	require.Equal(t, 1, len(records))
+
+	r := records[0]
+	assert.Equal(t, uint32(100), r.VNI)
+	assert.Equal(t, "TCP", r.Protocol)
+	assert.Equal(t, client, r.SrcAddr)
+	assert.Equal(t, server, r.DstAddr)
+	assert.Equal(t, 40000, r.SrcPort)
+	assert.Equal(t, 443, r.DstPort)
+	assert.Equal(t, base, r.StartTime)
+	assert.Equal(t, base.Add(6*time.Second), r.EndTime)
+	assert.Equal(t, uint64(4), r.SrcPackets)
+	assert.Equal(t, uint64(3), r.DstPackets)
+	assert.Equal(t, srcBytes, r.SrcBytes)
+	assert.Equal(t, dstBytes, r.DstBytes)
+	assert.Equal(t, "FIN,SYN,ACK", r.TCPFlags)
+	assert.Equal(t, "fin", r.Reason)
+
+	require.NoError(t, proc.Shutdown())
+	assert.Equal(t, 1, len(readSessionRecords(t, dir)))
+}
+
+func TestSessionTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vxcap_session")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	args := sessionTestArgs(dir)
+	args.SessionIdleTimeout = 30
+	args.SessionActiveTimeout = 300
+	proc := newTestProcessor(t, args)
+
+	put := func(src, dst string, sport, dport int) {
+		pkt := vxcap.NewPacketData(genInnerPacket(t, src, dst, sport, dport, nil, []byte("x")))
+		require.NoError(t, proc.Put(pkt))
+	}
+
+	now := time.Now()
+	put("10.0.0.1", "10.0.0.53", 5353, 53)
+	put("10.0.0.53", "10.0.0.1", 53, 5353)
+	put("10.0.0.1", "10.0.0.2", 1000, 2000)
+
+	// Not expired yet
+	require.NoError(t, proc.Tick(now.Add(10*time.Second)))
+	assert.Equal(t, 0, len(readSessionRecords(t, dir)))
+
+	// Idle timeout
+	require.NoError(t, proc.Tick(now.Add(31*time.Second)))
+	records := readSessionRecords(t, dir)
+	require.Equal(t, 2, len(records))
+	for _, r := range records {
+		assert.Equal(t, "idle", r.Reason)
+		assert.Equal(t, "UDP", r.Protocol)
+		assert.Equal(t, "", r.TCPFlags)
+	}
+
+	// Shutdown flushes remaining sessions
+	put("10.0.0.1", "10.0.0.53", 5353, 53)
+	require.NoError(t, proc.Shutdown())
+	records = readSessionRecords(t, dir)
+	require.Equal(t, 3, len(records))
+	assert.Equal(t, "shutdown", records[2].Reason)
+	assert.Equal(t, uint64(1), records[2].SrcPackets)
+	assert.Equal(t, uint64(0), records[2].DstPackets)
+}
+
+func TestSessionActiveTimeoutAndRst(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vxcap_session")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	args := sessionTestArgs(dir)
+	args.SessionIdleTimeout = 60
+	args.SessionActiveTimeout = 10
+	proc := newTestProcessor(t, args)
+
+	now := time.Now()
+	data := genInnerPacket(t, "10.0.0.1", "10.0.0.2", 40000, 80, &tcpFlags{ACK: true}, []byte("GET /"))
+	require.NoError(t, proc.Put(vxcap.NewPacketData(data)))
+	require.NoError(t, proc.Tick(now.Add(11*time.Second)))
+
+	// A new session record starts after active timeout and it's closed by RST
+	data = genInnerPacket(t, "10.0.0.2", "10.0.0.1", 80, 40000, &tcpFlags{RST: true}, nil)
+	require.NoError(t, proc.Put(vxcap.NewPacketData(data)))
+	require.NoError(t, proc.Tick(now.Add(12*time.Second)))
+
+	records := readSessionRecords(t, dir)
+	require.Equal(t, 2, len(records))
+	assert.Equal(t, "active", records[0].Reason)
+	assert.Equal(t, "rst", records[1].Reason)
+	assert.Equal(t, "10.0.0.2", records[1].SrcAddr)
+	assert.Equal(t, "RST", records[1].TCPFlags)
+
+	require.NoError(t, proc.Shutdown())
+}
+
+func TestSessionTargetNotSupported(t *testing.T) {
+	_, err := vxcap.NewPacketProcessor(vxcap.PacketProcessorArgument{
+		DumperArgs:  vxcap.DumperArguments{Format: "pcap", Target: "session"},
+		EmitterArgs: vxcap.EmitterArguments{Name: "fs"},
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,76 @@
+package vxcap
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// strftime formats t with strftime(3) style directives. Supported directives
+// are %Y, %y, %m, %d, %H, %M, %S, %j, %s (UNIX epoch) and %%. Unknown
+// directives are kept as is.
+func strftime(format string, t time.Time) string {
+	var b strings.Builder
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 >= len(format) {
+			b.WriteByte(format[i])
+			continue
+		}
+
+		i++
+		switch format[i] {
+		case 'Y':
+			fmt.Fprintf(&b, "%04d", t.Year())
+		case 'y':
+			fmt.Fprintf(&b, "%02d", t.Year()%100)
+		case 'm':
+			fmt.Fprintf(&b, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case 'H':
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case 'M':
+			fmt.Fprintf(&b, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&b, "%02d", t.Second())
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 's':
+			fmt.Fprintf(&b, "%d", t.Unix())
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(format[i])
+		}
+	}
+
+	return b.String()
+}
+
+// strftimePattern converts format to regular expression that matches strings
+// generated by strftime(format, t) for any t.
+func strftimePattern(format string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 >= len(format) {
+			b.WriteString(regexp.QuoteMeta(format[i : i+1]))
+			continue
+		}
+
+		i++
+		switch format[i] {
+		case 'Y', 'y', 'm', 'd', 'H', 'M', 'S', 'j', 's':
+			b.WriteString(`\d+`)
+		case '%':
+			b.WriteString("%")
+		default:
+			b.WriteString(regexp.QuoteMeta(format[i-1 : i+1]))
+		}
+	}
+
+	return b.String()
+}
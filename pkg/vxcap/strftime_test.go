@@ -0,0 +1,25 @@
+package vxcap_test
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/m-mizutani/vxcap/pkg/vxcap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStrftime(t *testing.T) {
+	ts := time.Date(2019, 9, 8, 7, 6, 5, 0, time.UTC)
+	assert.Equal(t, "dump_20190908_070605.pcap", vxcap.Strftime("dump_%Y%m%d_%H%M%S.pcap", ts))
+	assert.Equal(t, "19/251/1567926365", vxcap.Strftime("%y/%j/%s", ts))
+	assert.Equal(t, "100%_%Q.pcap", vxcap.Strftime("100%%_%Q.pcap", ts))
+	assert.Equal(t, "dump%", vxcap.Strftime("dump%", ts))
+}
+
+func TestStrftimePattern(t *testing.T) {
+	ptn := regexp.MustCompile("^" + vxcap.StrftimePattern("dump_%Y%m%d.%%.pcap") + "$")
+	assert.True(t, ptn.MatchString("dump_20190908.%.pcap"))
+	assert.False(t, ptn.MatchString("dump_2019090a.%.pcap"))
+	assert.False(t, ptn.MatchString("dump_20190908x%.pcap"))
+}
@@ -1,8 +1,12 @@
 package vxcap
 
 import (
+	"context"
+	"fmt"
+	"net"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -18,74 +22,631 @@ func init() {
 	Logger.SetLevel(logrus.FatalLevel)
 }
 
+// DefaultShutdownTimeout is default value of VXCap.ShutdownTimeout.
+const DefaultShutdownTimeout = 30
+
 // VXCap is one of main components of the package
 type VXCap struct {
-	RecvPort  int
-	QueueSize int
+	RecvPort     int  `yaml:"port" env:"VXCAP_PORT"`
+	GenevePort   int  `yaml:"geneve-port" env:"VXCAP_GENEVE_PORT"` // GENEVE receiver is disabled if 0
+	EnableERSPAN bool `yaml:"erspan" env:"VXCAP_ERSPAN"`           // Receive ERSPAN over GRE with raw socket, root privilege is required
+	QueueSize    int  `yaml:"receiver-queue-size" env:"VXCAP_RECEIVER_QUEUE_SIZE"`
+
+	// QueuePolicy is behavior when the queue between receivers and workers
+	// is full: QueuePolicyBlock (default), QueuePolicyDropNewest or
+	// QueuePolicyDropOldest. It's ignored for InputFile.
+	QueuePolicy string `yaml:"receiver-queue-policy" env:"VXCAP_RECEIVER_QUEUE_POLICY"`
+
+	// Receivers is number of sockets bound to each UDP port with SO_REUSEPORT
+	// (Linux only). Workers is number of goroutines calling Processor.Put.
+	// Order of packets is not kept if Workers is more than 1.
+	Receivers int `yaml:"receivers" env:"VXCAP_RECEIVERS"`
+	Workers   int `yaml:"workers" env:"VXCAP_WORKERS"`
+
+	// InputFile is path of pcap or pcapng file. If set, VXCap reads packets
+	// from the file instead of listening sockets and exits at end of the file.
+	InputFile string `yaml:"read-file" env:"VXCAP_READ_FILE"`
+
+	// ReloadProcessor is called on SIGHUP (or Capture.Reload) to build new
+	// processor. The new processor replaces current one after its Setup
+	// succeeded, then current one is shut down. Sockets and queued packets
+	// are kept. Reload is ignored if nil.
+	ReloadProcessor func() (Processor, error) `yaml:"-"`
+
+	// ShutdownTimeout is seconds to wait for each of draining queued packets
+	// and stop of processing (exit of workers and shutdown (flush) of
+	// processor) after stop of capture. Remaining packets are discarded when
+	// it's exceeded. 0 means no timeout.
+	ShutdownTimeout int `yaml:"shutdown-timeout" env:"VXCAP_SHUTDOWN_TIMEOUT"`
+
+	// HandleSignals makes StartContext and Run handle SIGTERM and SIGINT to
+	// shut down and SIGHUP to reload. Start always handles them.
+	HandleSignals bool `yaml:"-"`
+
+	stats *receiveStats
 }
 
 // New is constructor of VXCap
 func New() *VXCap {
 	cap := VXCap{
-		RecvPort:  DefaultVxlanPort,
-		QueueSize: DefaultReceiverQueueSize,
+		RecvPort:    DefaultVxlanPort,
+		QueueSize:   DefaultReceiverQueueSize,
+		QueuePolicy: DefaultQueuePolicy,
+		Receivers:   1,
+		Workers:     1,
+
+		ShutdownTimeout: DefaultShutdownTimeout,
+		stats:           &receiveStats{},
 	}
 	return &cap
 }
 
-// Start invokes UDP listener for VXLAN and forward captured packets to processor.
+// Stats returns counters of receiving path. It can be called while Start is
+// running.
+func (x *VXCap) Stats() ReceiveStats {
+	return x.stats.snapshot()
+}
+
+func (x *VXCap) queue() (*receiveQueue, error) {
+	policy := x.QueuePolicy
+	if policy == "" {
+		policy = DefaultQueuePolicy
+	}
+	if err := validateQueuePolicy(policy); err != nil {
+		return nil, err
+	}
+
+	// Reading file can wait for processor without loss.
+	if x.InputFile != "" && policy != QueuePolicyBlock {
+		Logger.WithField("policy", policy).Info("Queue policy is ignored for input file")
+		policy = QueuePolicyBlock
+	}
+
+	if x.stats == nil {
+		x.stats = &receiveStats{}
+	}
+	return newReceiveQueue(x.QueueSize, policy, x.stats), nil
+}
+
+// openSources opens packet sources and returns them with bound addresses of
+// VXLAN and GENEVE sockets (nil if not used). Sources opened before error are
+// closed.
+func (x *VXCap) openSources() (sources []packetSource, vxlanAddr, geneveAddr net.Addr, err error) {
+	defer func() {
+		if err != nil {
+			closeSources(sources)
+		}
+	}()
+
+	if x.InputFile != "" {
+		src := &pcapFileSource{
+			path:       x.InputFile,
+			vxlanPort:  x.RecvPort,
+			genevePort: x.GenevePort,
+		}
+		if src.genevePort == 0 {
+			src.genevePort = DefaultGenevePort
+		}
+		sources = append(sources, src)
+		return sources, nil, nil, src.open()
+	}
+
+	vxlan, err := openUDPSources(x.RecvPort, x.Receivers, tunnelVXLAN, parseVXLAN)
+	sources = append(sources, vxlan...)
+	if err != nil {
+		return sources, nil, nil, err
+	}
+	vxlanAddr = vxlan[0].(*packetConnSource).localAddr()
+
+	if x.GenevePort > 0 {
+		geneve, err := openUDPSources(x.GenevePort, x.Receivers, tunnelGENEVE, parseGENEVE)
+		sources = append(sources, geneve...)
+		if err != nil {
+			return sources, nil, nil, err
+		}
+		geneveAddr = geneve[0].(*packetConnSource).localAddr()
+	}
+
+	if x.EnableERSPAN {
+		src := newERSPANSource()
+		sources = append(sources, src)
+		if err := src.open(); err != nil {
+			return sources, nil, nil, err
+		}
+	}
+
+	return sources, vxlanAddr, geneveAddr, nil
+}
+
+// Capture is a running capture started by VXCap.StartContext.
+type Capture struct {
+	vxlanAddr  net.Addr
+	geneveAddr net.Addr
+	reloadCh   chan struct{}
+	done       chan struct{}
+	err        error
+}
+
+// Addr returns bound address of VXLAN socket. It's useful to get port number
+// chosen by OS when RecvPort is 0. nil if InputFile is set.
+func (x *Capture) Addr() net.Addr {
+	return x.vxlanAddr
+}
+
+// GeneveAddr returns bound address of GENEVE socket. nil if GENEVE is
+// disabled or InputFile is set.
+func (x *Capture) GeneveAddr() net.Addr {
+	return x.geneveAddr
+}
+
+// Reload replaces processor with new one built by VXCap.ReloadProcessor in
+// the same way as SIGHUP. It does not wait for completion of reload.
+func (x *Capture) Reload() {
+	select {
+	case x.reloadCh <- struct{}{}:
+	default: // Reload is already requested
+	}
+}
+
+// Done returns a channel closed when the capture is stopped.
+func (x *Capture) Done() <-chan struct{} {
+	return x.done
+}
+
+// Wait blocks until the capture is stopped and returns error that stopped
+// it. nil is returned if it's stopped by cancel of context, signal or end of
+// InputFile and the processor is shut down successfully.
+func (x *Capture) Wait() error {
+	<-x.done
+	return x.err
+}
+
+// Start invokes UDP listener for VXLAN (and GENEVE if GenevePort is set,
+// ERSPAN if EnableERSPAN is true) and forward captured packets to processor.
+// If InputFile is set, packets in the file are forwarded instead and Start
+// returns after all packets are processed. Start handles SIGTERM and SIGINT
+// to shut down and SIGHUP to reload regardless of HandleSignals.
 func (x *VXCap) Start(proc Processor) error {
+	capture, err := x.start(context.Background(), proc, true)
+	if err != nil {
+		return err
+	}
+	return capture.Wait()
+}
+
+// Run is same as Start, but stops when ctx is canceled and handles signals
+// only if HandleSignals is true. It returns after processor is shut down.
+func (x *VXCap) Run(ctx context.Context, proc Processor) error {
+	capture, err := x.StartContext(ctx, proc)
+	if err != nil {
+		return err
+	}
+	return capture.Wait()
+}
+
+// StartContext opens packet sources, sets up processor and starts capture in
+// background. Errors of opening sources and Setup of processor are returned
+// immediately. Cancel of ctx stops the capture, drains queued packets and
+// shuts down processor within ShutdownTimeout, and Capture.Wait returns the
+// result. Signals are handled only if HandleSignals is true.
+func (x *VXCap) StartContext(ctx context.Context, proc Processor) (*Capture, error) {
+	return x.start(ctx, proc, x.HandleSignals)
+}
+
+func (x *VXCap) start(ctx context.Context, proc Processor, handleSignals bool) (*Capture, error) {
+	queue, err := x.queue()
+	if err != nil {
+		return nil, err
+	}
+
+	Logger.WithFields(logrus.Fields{
+		"port":       x.RecvPort,
+		"genevePort": x.GenevePort,
+		"erspan":     x.EnableERSPAN,
+		"inputFile":  x.InputFile,
+		"queueSize":  x.QueueSize,
+		"policy":     queue.policy,
+		"receivers":  x.Receivers,
+		"workers":    x.Workers,
+	}).Trace("Opening packet sources...")
+	sources, vxlanAddr, geneveAddr, err := x.openSources()
+	if err != nil {
+		return nil, err
+	}
+
 	Logger.Trace("Setting up processor...")
 	if err := proc.Setup(); err != nil {
-		return err
+		closeSources(sources)
+		return nil, err
 	}
 
-	// Setup channels
+	capture := &Capture{
+		vxlanAddr:  vxlanAddr,
+		geneveAddr: geneveAddr,
+		reloadCh:   make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+
+	// Signal handlers are set before receiving packets. Then SIGHUP does not
+	// kill the process after packets arrive.
+	var signalCh chan os.Signal
+	if handleSignals {
+		signalCh = make(chan os.Signal, 1)
+		signal.Notify(signalCh, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	}
+
+	queueCh := startSources(sources, queue)
+	metricsQueueCapacity.Set(float64(cap(queueCh)))
+	procSwitch := &processorSwitch{proc: proc}
+	workers := startWorkers(procSwitch, queueCh, x.Workers)
+
+	go func() {
+		defer close(capture.done)
+		if signalCh != nil {
+			defer signal.Stop(signalCh)
+		}
+
+		capture.err = x.loop(ctx, capture, procSwitch, workers, queueCh, signalCh)
+
+		// Queued packets are put to processor only if processor works.
+		graceful := capture.err == nil
+		if err := x.shutdown(sources, queue, workers, procSwitch, graceful, signalCh); err != nil {
+			if capture.err == nil {
+				capture.err = err
+			} else {
+				Logger.WithError(err).Error("Fail in shutdown process")
+			}
+		}
+
+		x.logStats()
+		if capture.err != nil {
+			Logger.WithError(capture.err).Error("Stopped with error")
+		} else {
+			Logger.Info("Exit normally")
+		}
+	}()
+
 	Logger.WithFields(logrus.Fields{
-		"port":      x.RecvPort,
-		"queueSize": x.QueueSize,
-	}).Trace("Opening UDP port...")
-	queueCh := listenVXLAN(x.RecvPort, x.QueueSize)
+		"vxlanAddr":  vxlanAddr,
+		"geneveAddr": geneveAddr,
+	}).Info("Started capture")
 
-	Logger.Trace("Setting up channels")
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
-	tickerCh := ticker.C
+	return capture, nil
+}
+
+// ShutdownTimeoutError is returned by Capture.Wait if draining queued
+// packets or shutdown of processor is not completed in ShutdownTimeout.
+type ShutdownTimeoutError struct {
+	Lost    uint64 // Packets discarded in queue without processing
+	Flushed bool   // Shutdown of processor (flush of emitters) is completed
+}
+
+func (x *ShutdownTimeoutError) Error() string {
+	if x.Flushed {
+		return fmt.Sprintf("Shutdown timeout exceeded in draining queue, %d packets are lost", x.Lost)
+	}
+	return fmt.Sprintf("Shutdown timeout exceeded, %d packets in queue and data not flushed by processor are lost", x.Lost)
+}
+
+// shutdown stops reading packet sources, puts queued packets to processor if
+// graceful is true and shuts down processor. Draining is given up when
+// ShutdownTimeout is exceeded or SIGTERM/SIGINT is caught again. Then stop of
+// workers and shutdown of processor must be completed in ShutdownTimeout.
+func (x *VXCap) shutdown(sources []packetSource, queue *receiveQueue, workers *processWorkers, proc Processor, graceful bool, signalCh chan os.Signal) error {
+	closeSources(sources)
+
+	timedOut := false
+	if graceful {
+		timedOut = x.drain(queue, workers, signalCh)
+	}
+
+	timer := x.shutdownTimer()
+	defer timer.Stop()
+
+	queue.abort()
+	workers.interrupt()
+	stopped := true
+	select {
+	case <-workers.done:
+	case <-timer.C:
+		stopped = false
+	}
+	queue.discard()
+	lost := x.Stats().ShutdownDropped
+	if lost > 0 {
+		Logger.WithField("lost", lost).Warn("Queued packets are discarded in shutdown")
+	}
 
-	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, syscall.SIGTERM)
-	signal.Notify(signalCh, syscall.SIGINT)
-	defer signal.Stop(signalCh)
+	if !stopped {
+		// Processor can not be shut down safely while Put is in progress
+		Logger.Error("Shutdown timeout exceeded, workers are not stopped and processor is not shut down")
+		return &ShutdownTimeoutError{Lost: lost, Flushed: false}
+	}
+
+	var err error
+	select {
+	case err = <-workers.errCh: // Error while draining
+	default:
+	}
+
+	Logger.Trace("Shutting down processor...")
+	shutdownCh := make(chan error, 1)
+	go func() { shutdownCh <- proc.Shutdown() }()
+
+	select {
+	case shutdownErr := <-shutdownCh:
+		if shutdownErr != nil && err == nil {
+			err = errors.Wrap(shutdownErr, "Fail in shutdown process")
+		}
+	case <-timer.C:
+		Logger.Error("Shutdown timeout exceeded, processor is not shut down")
+		return &ShutdownTimeoutError{Lost: lost, Flushed: false}
+	}
+
+	if timedOut && err == nil {
+		return &ShutdownTimeoutError{Lost: lost, Flushed: true}
+	}
+	return err
+}
 
-	Logger.Infof("Starting loop: port %d", x.RecvPort)
+// drain waits for workers exiting after the queue is closed by sources and
+// emptied. It returns true if ShutdownTimeout is exceeded. SIGHUP is ignored
+// because reload is not available in shutdown.
+func (x *VXCap) drain(queue *receiveQueue, workers *processWorkers, signalCh chan os.Signal) bool {
+	Logger.WithField("queued", len(queue.ch)).Info("Draining queued packets...")
+	timer := x.shutdownTimer()
+	defer timer.Stop()
 
-MainLoop:
 	for {
 		select {
-		case q := <-queueCh:
-			if q.Err != nil {
-				return errors.Wrap(q.Err, "Fail to receive UDP")
+		case <-workers.done:
+			return false
+		case <-timer.C:
+			Logger.Warn("Shutdown timeout exceeded in draining queue")
+			return true
+		case s := <-signalCh:
+			if s == syscall.SIGHUP {
+				Logger.WithField("signal", s).Info("Ignore signal while draining queue")
+				continue
 			}
+			Logger.WithField("signal", s).Warn("Caught signal again, Discarding queued packets...")
+			return false
+		}
+	}
+}
 
-			if err := proc.Put(q.Pkt); err != nil {
-				return errors.Wrap(err, "Fail to handle packet")
+// shutdownTimer returns timer of ShutdownTimeout. It never fires if
+// ShutdownTimeout is 0.
+func (x *VXCap) shutdownTimer() *time.Timer {
+	timer := time.NewTimer(time.Duration(x.ShutdownTimeout) * time.Second)
+	if x.ShutdownTimeout <= 0 {
+		timer.Stop()
+	}
+	return timer
+}
+
+// loop runs until capture should be stopped. Error from sources, workers and
+// processor is returned.
+func (x *VXCap) loop(ctx context.Context, capture *Capture, procSwitch *processorSwitch, workers *processWorkers, queueCh chan *udpQueue, signalCh chan os.Signal) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastStats := x.Stats()
+
+	for {
+		select {
+		case <-workers.done:
+			select {
+			case err := <-workers.errCh:
+				return err
+			default:
 			}
 
-		case t := <-tickerCh:
-			if err := proc.Tick(t); err != nil {
+			Logger.Info("All packet sources are exhausted, Shutting down...")
+			return nil
+
+		case err := <-workers.errCh:
+			return err
+
+		case t := <-ticker.C:
+			if err := procSwitch.Tick(t); err != nil {
 				return errors.Wrap(err, "Fail in tick process")
 			}
+			lastStats = x.warnLoss(lastStats)
+			metricsQueueDepth.Set(float64(len(queueCh)))
+
+		case <-capture.reloadCh:
+			x.reload(procSwitch)
 
 		case s := <-signalCh:
+			if s == syscall.SIGHUP {
+				Logger.Info("Caught SIGHUP")
+				x.reload(procSwitch)
+				continue
+			}
+
 			Logger.WithField("signal", s).Warn("Caught signal, Shutting down...")
-			if err := proc.Shutdown(); err != nil {
-				return errors.Wrap(err, "Fail in shutdown process")
+			return nil
+
+		case <-ctx.Done():
+			Logger.Info("Context is done, Shutting down...")
+			return nil
+		}
+	}
+}
+
+// reload replaces processor with new one built by ReloadProcessor. Current
+// processor is kept if building or setting up new one fails.
+func (x *VXCap) reload(procSwitch *processorSwitch) {
+	if x.ReloadProcessor == nil {
+		Logger.Warn("Reload is requested, but not configured")
+		return
+	}
+
+	Logger.Info("Reloading processor...")
+	newProc, err := x.ReloadProcessor()
+	if err != nil {
+		Logger.WithError(err).Error("Fail to build new processor, keep current one")
+		return
+	}
+	if successor, ok := newProc.(processorSuccessor); ok {
+		successor.takeOver(procSwitch.current())
+	}
+	if err := newProc.Setup(); err != nil {
+		Logger.WithError(err).Error("Fail to setup new processor, keep current one")
+		return
+	}
+
+	// Packets are put to new processor after swap. Then old one can flush
+	// buffered packets and sessions safely.
+	oldProc := procSwitch.swap(newProc)
+	if err := oldProc.Shutdown(); err != nil {
+		Logger.WithError(err).Error("Fail to shutdown old processor")
+		return
+	}
+	Logger.Info("Reloaded processor")
+}
+
+// processorSuccessor is Processor taking over state (e.g. files being written)
+// from the processor replaced by reload.
+type processorSuccessor interface {
+	takeOver(prev Processor)
+}
+
+// processorSwitch is a Processor forwarding to replaceable processor. swap()
+// waits for Put and Tick in progress.
+type processorSwitch struct {
+	mutex sync.RWMutex
+	proc  Processor
+}
+
+func (x *processorSwitch) current() Processor {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	return x.proc
+}
+
+func (x *processorSwitch) swap(proc Processor) Processor {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	old := x.proc
+	x.proc = proc
+	return old
+}
+
+func (x *processorSwitch) Setup() error {
+	return x.current().Setup()
+}
+
+func (x *processorSwitch) Put(pkt *Packet) error {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	return x.proc.Put(pkt)
+}
+
+func (x *processorSwitch) Tick(now time.Time) error {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	return x.proc.Tick(now)
+}
+
+func (x *processorSwitch) Shutdown() error {
+	return x.current().Shutdown()
+}
+
+// warnLoss logs number of packets lost since last stats and returns current
+// stats.
+func (x *VXCap) warnLoss(last ReceiveStats) ReceiveStats {
+	stats := x.Stats()
+	if stats.Lost() != last.Lost() {
+		Logger.WithFields(logrus.Fields{
+			"queueDropped":  stats.QueueDropped - last.QueueDropped,
+			"kernelDropped": stats.KernelDropped - last.KernelDropped,
+			"parseErrors":   stats.ParseErrors - last.ParseErrors,
+		}).Warn("Packets are lost in receiving path")
+	}
+	return stats
+}
+
+func (x *VXCap) logStats() {
+	stats := x.Stats()
+	Logger.WithFields(logrus.Fields{
+		"received":      stats.Received,
+		"queueDropped":  stats.QueueDropped,
+		"kernelDropped": stats.KernelDropped,
+		"parseErrors":   stats.ParseErrors,
+
+		"shutdownDropped": stats.ShutdownDropped,
+	}).Info("Receive stats")
+}
+
+// processWorkers is a set of goroutines to put packets from packet sources
+// to processor.
+type processWorkers struct {
+	done     chan struct{} // Closed when all workers exited
+	errCh    chan error
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+func startWorkers(proc Processor, queueCh chan *udpQueue, n int) *processWorkers {
+	if n < 1 {
+		n = 1
+	}
+
+	workers := &processWorkers{
+		done:   make(chan struct{}),
+		errCh:  make(chan error, n),
+		stopCh: make(chan struct{}),
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := workers.run(proc, queueCh); err != nil {
+				workers.errCh <- err
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(workers.done)
+	}()
+
+	return workers
+}
+
+func (x *processWorkers) run(proc Processor, queueCh chan *udpQueue) error {
+	for {
+		select {
+		case <-x.stopCh:
+			return nil
+
+		case q, ok := <-queueCh:
+			if !ok {
+				return nil
+			}
+			if q.Err != nil {
+				return errors.Wrap(q.Err, "Fail to receive UDP")
+			}
+
+			if err := proc.Put(q.Pkt); err != nil {
+				return errors.Wrap(err, "Fail to handle packet")
 			}
-			break MainLoop
 		}
 	}
+}
 
-	Logger.Info("Exit normally")
+// interrupt makes workers exit without waiting for them. A worker exits after
+// Put in progress.
+func (x *processWorkers) interrupt() {
+	x.stopOnce.Do(func() { close(x.stopCh) })
+}
 
-	return nil
+// stop makes workers exit and waits for them.
+func (x *processWorkers) stop() {
+	x.interrupt()
+	<-x.done
 }
@@ -1,7 +1,15 @@
 package vxcap_test
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -45,3 +53,444 @@ func TestVxcapTimerAndSignal(t *testing.T) {
 	assert.True(t, dummy.calledShutdown)
 	assert.NotEqual(t, 0, dummy.tickCount)
 }
+
+func TestVxcapWorkers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vxcap_workers")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	payload := append(append([]byte{}, sampleHeader...), genSamplePacketData()...)
+	var packets [][]byte
+	var ts []time.Time
+	for i := 0; i < 100; i++ {
+		packets = append(packets, genOuterPacket(t, "10.0.0.2", vxcap.DefaultVxlanPort, payload))
+		ts = append(ts, time.Now())
+	}
+	inputPath := filepath.Join(dir, "input.pcap")
+	writeSamplePcapFile(t, inputPath, packets, ts)
+
+	proc, err := vxcap.NewPacketProcessor(vxcap.PacketProcessorArgument{
+		DumperArgs: vxcap.DumperArguments{Format: "json", Target: "packet"},
+		EmitterArgs: vxcap.EmitterArguments{
+			Name:       "fs",
+			FsDirPath:  dir,
+			FsFileName: "output.json",
+		},
+		Filter: "tcp",
+	})
+	require.NoError(t, err)
+
+	cap := vxcap.New()
+	cap.InputFile = inputPath
+	cap.Workers = 4
+	require.NoError(t, cap.Start(proc))
+
+	matched, _ := proc.FilterStats()
+	assert.Equal(t, uint64(100), matched)
+	assert.Equal(t, 100, countLines(t, filepath.Join(dir, "output.json")))
+}
+
+// BenchmarkVxcapReceive measures throughput of receiving VXLAN packets via
+// loopback and putting them to processor. ns/op is time per packet. Packets
+// dropped by kernel are reported in log.
+func BenchmarkVxcapReceive(b *testing.B) {
+	for _, bc := range []struct {
+		receivers int
+		batchSize int
+		workers   int
+	}{
+		{1, 1, 1}, // Single socket with ReadFrom and single processing loop
+		{1, vxcap.DefaultReceiveBatchSize, 1},
+		{2, vxcap.DefaultReceiveBatchSize, 2},
+		{4, vxcap.DefaultReceiveBatchSize, 4},
+	} {
+		name := fmt.Sprintf("receivers=%d/batch=%d/workers=%d", bc.receivers, bc.batchSize, bc.workers)
+		b.Run(name, func(b *testing.B) {
+			benchmarkReceive(b, bc.receivers, bc.batchSize, bc.workers)
+		})
+	}
+}
+
+func benchmarkReceive(b *testing.B, receivers, batchSize, workers int) {
+	dir, err := ioutil.TempDir("", "vxcap_bench")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	// JSON encoding and filter are typical load of processor
+	proc, err := vxcap.NewPacketProcessor(vxcap.PacketProcessorArgument{
+		DumperArgs: vxcap.DumperArguments{Format: "json", Target: "packet"},
+		EmitterArgs: vxcap.EmitterArguments{
+			Name:       "fs",
+			FsDirPath:  dir,
+			FsFileName: "output.json",
+		},
+		Filter: "tcp and port 8088",
+	})
+	require.NoError(b, err)
+	require.NoError(b, proc.Setup())
+
+	port := 30000 + rand.Int()%10000
+	queueCh, stats, closeSources := vxcap.StartUDPSources(port, receivers, batchSize,
+		vxcap.DefaultReceiverQueueSize, vxcap.QueuePolicyBlock)
+	done, stopWorkers := vxcap.StartWorkers(proc, queueCh, workers)
+	time.Sleep(100 * time.Millisecond) // Wait for UDP server listening
+
+	payload := append(append([]byte{}, sampleHeader...), genSamplePacketData()...)
+	const senders = 8
+	// Max packets in flight to avoid overflow of socket buffer. Throughput is
+	// limited by the receiver side because senders wait for processed packets.
+	const window = 64
+	var sent uint64
+
+	b.ResetTimer()
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sock, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", port))
+			require.NoError(b, err)
+			defer sock.Close()
+
+			for {
+				n := atomic.AddUint64(&sent, 1)
+				if n > uint64(b.N) {
+					return
+				}
+				// Give up waiting if packets seem dropped
+				for deadline := time.Now().Add(100 * time.Millisecond); time.Now().Before(deadline); {
+					if matched, _ := proc.FilterStats(); n-matched <= window {
+						break
+					}
+					time.Sleep(10 * time.Microsecond)
+				}
+				sock.Write(payload) // nolint
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Wait until processor catches up or no progress (packets dropped)
+	var last uint64
+	for {
+		matched, _ := proc.FilterStats()
+		if matched >= uint64(b.N) || matched == last {
+			break
+		}
+		last = matched
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.StopTimer()
+	matched, _ := proc.FilterStats()
+	b.ReportMetric(float64(matched)/time.Since(start).Seconds(), "pkts/s")
+
+	closeSources()
+	<-done
+	stopWorkers()
+	require.NoError(b, proc.Shutdown())
+
+	if matched, _ := proc.FilterStats(); matched < uint64(b.N) {
+		b.Logf("%d of %d packets are dropped, %d by kernel", uint64(b.N)-matched, b.N, stats().KernelDropped)
+	}
+}
+
+func waitLines(t *testing.T, path string, n int) {
+	for i := 0; i < 300 && countLines(t, path) < n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, n, countLines(t, path), path)
+}
+
+func TestVxcapReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vxcap_reload")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	newProc := func() (vxcap.Processor, error) {
+		return vxcap.NewPacketProcessor(vxcap.PacketProcessorArgument{
+			DumperArgs: vxcap.DumperArguments{Format: "json", Target: "packet"},
+			EmitterArgs: vxcap.EmitterArguments{
+				Name:       "fs",
+				FsDirPath:  dir,
+				FsFileName: "output.json",
+			},
+		})
+	}
+	proc, err := newProc()
+	require.NoError(t, err)
+
+	var reloaded int32
+	reloadErr := fmt.Errorf("invalid settings")
+	cap := vxcap.New()
+	cap.RecvPort = 30000 + rand.Int()%10000
+	cap.ReloadProcessor = func() (vxcap.Processor, error) {
+		defer atomic.AddInt32(&reloaded, 1)
+		if atomic.LoadInt32(&reloaded) == 0 {
+			return nil, reloadErr // First reload fails and current processor is kept
+		}
+		return newProc()
+	}
+
+	errCh := make(chan error)
+	go func() { errCh <- cap.Start(proc) }()
+	time.Sleep(100 * time.Millisecond) // Wait for UDP server listening
+
+	sock, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", cap.RecvPort))
+	require.NoError(t, err)
+	defer sock.Close()
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			_, err := sock.Write(append(append([]byte{}, sampleHeader...), sampleEther...))
+			require.NoError(t, err)
+		}
+	}
+	signal := func(sig os.Signal, n int32) {
+		p, err := os.FindProcess(os.Getpid())
+		require.NoError(t, err)
+		require.NoError(t, p.Signal(sig))
+		for i := 0; i < 300 && atomic.LoadInt32(&reloaded) < n; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	path := filepath.Join(dir, "output.json")
+	send(3)
+	waitLines(t, path, 3)
+
+	signal(syscall.SIGHUP, 1) // Fail to reload
+	send(1)
+	waitLines(t, path, 4)
+
+	signal(syscall.SIGHUP, 2)
+	time.Sleep(100 * time.Millisecond) // Wait for swap of processor
+	send(2)
+	// New processor appends to the file instead of overwriting it
+	waitLines(t, path, 6)
+	_, err = os.Stat(filepath.Join(dir, "output.1.json"))
+	assert.True(t, os.IsNotExist(err))
+
+	signal(syscall.SIGTERM, 2)
+	require.NoError(t, <-errCh)
+}
+
+func TestVxcapRunContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vxcap_context")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	proc, err := vxcap.NewPacketProcessor(vxcap.PacketProcessorArgument{
+		DumperArgs: vxcap.DumperArguments{Format: "json", Target: "packet"},
+		EmitterArgs: vxcap.EmitterArguments{
+			Name:       "fs",
+			FsDirPath:  dir,
+			FsFileName: "output.json",
+		},
+	})
+	require.NoError(t, err)
+
+	cap := vxcap.New()
+	cap.RecvPort = 0 // Port is chosen by OS
+	cap.Receivers = 2
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	capture, err := cap.StartContext(ctx, proc)
+	require.NoError(t, err)
+	require.NotNil(t, capture.Addr())
+	assert.Nil(t, capture.GeneveAddr())
+	port := capture.Addr().(*net.UDPAddr).Port
+	assert.NotEqual(t, 0, port)
+
+	sock, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	defer sock.Close()
+	for i := 0; i < 3; i++ {
+		_, err := sock.Write(append(append([]byte{}, sampleHeader...), sampleEther...))
+		require.NoError(t, err)
+	}
+	waitLines(t, filepath.Join(dir, "output.json"), 3)
+
+	cancel()
+	select {
+	case <-capture.Done():
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "capture is not stopped by cancel")
+	}
+	require.NoError(t, capture.Wait())
+
+	// Socket is closed and the port is available again
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestVxcapStartContextBindError(t *testing.T) {
+	conn, err := net.ListenPacket("udp", ":0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	cap := vxcap.New()
+	cap.RecvPort = conn.LocalAddr().(*net.UDPAddr).Port
+	dummy := DummyProcessor{}
+	capture, err := cap.StartContext(context.Background(), &dummy)
+	assert.Error(t, err)
+	assert.Nil(t, capture)
+	assert.False(t, dummy.calledShutdown)
+}
+
+func TestVxcapRunProcessorError(t *testing.T) {
+	cap := vxcap.New()
+	cap.RecvPort = 0
+
+	// DummyProcessor fails Put because embedded PacketProcessor is not ready
+	dummy := DummyProcessor{}
+	capture, err := cap.StartContext(context.Background(), &dummy)
+	require.NoError(t, err)
+
+	sock, err := net.Dial("udp", capture.Addr().String())
+	require.NoError(t, err)
+	defer sock.Close()
+	_, err = sock.Write(append(append([]byte{}, sampleHeader...), sampleEther...))
+	require.NoError(t, err)
+
+	select {
+	case <-capture.Done():
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "capture is not stopped by error of processor")
+	}
+	assert.Error(t, capture.Wait())
+	assert.True(t, dummy.calledShutdown)
+}
+
+func TestVxcapCaptureReload(t *testing.T) {
+	current := &DummyProcessor{}
+	reloaded := make(chan *DummyProcessor, 1)
+
+	cap := vxcap.New()
+	cap.RecvPort = 0
+	cap.ReloadProcessor = func() (vxcap.Processor, error) {
+		proc := &DummyProcessor{}
+		reloaded <- proc
+		return proc, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	capture, err := cap.StartContext(ctx, current)
+	require.NoError(t, err)
+
+	capture.Reload()
+	var next *DummyProcessor
+	select {
+	case next = <-reloaded:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "processor is not reloaded")
+	}
+
+	cancel()
+	require.NoError(t, capture.Wait())
+	assert.True(t, current.calledShutdown)
+	assert.True(t, next.calledShutdown)
+}
+
+// slowProcessor takes delay for each packet.
+type slowProcessor struct {
+	delay    time.Duration
+	put      uint64
+	shutdown bool
+}
+
+func (x *slowProcessor) Setup() error { return nil }
+func (x *slowProcessor) Put(pkt *vxcap.Packet) error {
+	time.Sleep(x.delay)
+	atomic.AddUint64(&x.put, 1)
+	return nil
+}
+func (x *slowProcessor) Tick(now time.Time) error { return nil }
+func (x *slowProcessor) Shutdown() error          { x.shutdown = true; return nil }
+
+func startSlowCapture(t *testing.T, proc *slowProcessor, timeout, n int, handleSignals bool) (*vxcap.VXCap, *vxcap.Capture, context.CancelFunc) {
+	cap := vxcap.New()
+	cap.RecvPort = 0
+	cap.ShutdownTimeout = timeout
+	cap.HandleSignals = handleSignals
+
+	ctx, cancel := context.WithCancel(context.Background())
+	capture, err := cap.StartContext(ctx, proc)
+	require.NoError(t, err)
+
+	sock, err := net.Dial("udp", capture.Addr().String())
+	require.NoError(t, err)
+	defer sock.Close()
+	for i := 0; i < n; i++ {
+		_, err := sock.Write(append(append([]byte{}, sampleHeader...), sampleEther...))
+		require.NoError(t, err)
+	}
+	for i := 0; i < 300 && cap.Stats().Received < uint64(n); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Equal(t, uint64(n), cap.Stats().Received)
+
+	return cap, capture, cancel
+}
+
+func TestVxcapDrainQueue(t *testing.T) {
+	proc := &slowProcessor{delay: 10 * time.Millisecond}
+	cap, capture, cancel := startSlowCapture(t, proc, 10, 50, false)
+
+	cancel()
+	require.NoError(t, capture.Wait())
+	assert.Equal(t, uint64(50), atomic.LoadUint64(&proc.put))
+	assert.True(t, proc.shutdown)
+	assert.Equal(t, uint64(0), cap.Stats().Lost())
+}
+
+func TestVxcapDrainTimeout(t *testing.T) {
+	proc := &slowProcessor{delay: 100 * time.Millisecond}
+	cap, capture, cancel := startSlowCapture(t, proc, 1, 30, false)
+
+	cancel()
+	err := capture.Wait()
+	require.Error(t, err)
+	timeoutErr, ok := err.(*vxcap.ShutdownTimeoutError)
+	require.True(t, ok, err.Error())
+	assert.True(t, timeoutErr.Flushed)
+	assert.True(t, proc.shutdown)
+
+	put := atomic.LoadUint64(&proc.put)
+	assert.NotEqual(t, uint64(0), timeoutErr.Lost)
+	assert.Equal(t, timeoutErr.Lost, cap.Stats().ShutdownDropped)
+	assert.Equal(t, uint64(30), put+timeoutErr.Lost)
+}
+
+func TestVxcapDrainIgnoreSIGHUP(t *testing.T) {
+	proc := &slowProcessor{delay: 20 * time.Millisecond}
+	cap, capture, cancel := startSlowCapture(t, proc, 10, 30, true)
+
+	cancel()
+	time.Sleep(100 * time.Millisecond) // Wait for start of draining
+	p, err := os.FindProcess(os.Getpid())
+	require.NoError(t, err)
+	require.NoError(t, p.Signal(syscall.SIGHUP))
+
+	// Draining continues
+	require.NoError(t, capture.Wait())
+	assert.Equal(t, uint64(30), atomic.LoadUint64(&proc.put))
+	assert.True(t, proc.shutdown)
+	assert.Equal(t, uint64(0), cap.Stats().Lost())
+}
+
+func TestVxcapStopTimeout(t *testing.T) {
+	// Put in progress exceeds timeouts of both of draining and stop
+	proc := &slowProcessor{delay: 3 * time.Second}
+	_, capture, cancel := startSlowCapture(t, proc, 1, 1, false)
+
+	start := time.Now()
+	cancel()
+	err := capture.Wait()
+	assert.True(t, time.Since(start) < 3*time.Second)
+	require.Error(t, err)
+	timeoutErr, ok := err.(*vxcap.ShutdownTimeoutError)
+	require.True(t, ok, err.Error())
+	assert.False(t, timeoutErr.Flushed)
+}
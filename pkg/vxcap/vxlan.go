@@ -4,16 +4,10 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"net"
 
 	"github.com/pkg/errors"
 )
 
-type udpQueue struct {
-	Pkt *packetData
-	Err error
-}
-
 const (
 	// DefaultReceiverQueueSize is default queue size of channel from UDP server to packet processor.
 	DefaultReceiverQueueSize = 1024
@@ -23,7 +17,7 @@ const (
 	vxlanHeaderLength = 8
 )
 
-func parseVXLAN(raw []byte, length int) (*packetData, error) {
+func parseVXLAN(raw []byte, length int) (*Packet, error) {
 	if length < vxlanHeaderLength {
 		return nil, fmt.Errorf("Too short data for VXLAN header: %d", length)
 	}
@@ -34,43 +28,11 @@ func parseVXLAN(raw []byte, length int) (*packetData, error) {
 	if err := binary.Read(buffer, binary.BigEndian, &pkt.Header); err != nil {
 		return nil, errors.Wrap(err, "Fail to parse VXLAN header")
 	}
+	pkt.VNI = pkt.Header.vni()
 
 	return pkt, nil
 }
 
 func listenVXLAN(port, queueSize int) chan *udpQueue {
-	ch := make(chan *udpQueue, queueSize)
-
-	go func() {
-		defer close(ch)
-
-		sock, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
-		if err != nil {
-			ch <- &udpQueue{Err: errors.Wrap(err, "Fail to create UDP socket")}
-			return
-		}
-		defer sock.Close()
-
-		buf := make([]byte, 32768)
-
-		for {
-			n, _, err := sock.ReadFrom(buf)
-			if err != nil {
-				ch <- &udpQueue{Err: errors.Wrap(err, "Fail to read UDP data")}
-				return
-			}
-
-			pkt, err := parseVXLAN(buf, n)
-			if err != nil {
-				Logger.WithError(err).Warn("Fail to parse VXLAN data")
-				continue
-			}
-
-			q := new(udpQueue)
-			q.Pkt = pkt
-			ch <- q
-		}
-	}()
-
-	return ch
+	return startSources([]packetSource{newUDPSource(port, tunnelVXLAN, parseVXLAN)}, newReceiveQueue(queueSize, QueuePolicyBlock, nil))
 }
@@ -33,6 +33,7 @@ func TestParseVxlanNormal(t *testing.T) {
 	assert.Equal(t, len(ether), len(pkt.Data))
 	assert.Equal(t, uint16(1), pkt.Header.GroupPolicyID)
 	assert.Equal(t, [3]byte{0xa8, 0xee, 0xd6}, pkt.Header.NetworkIndentifier)
+	assert.Equal(t, uint32(0xa8eed6), pkt.VNI)
 }
 
 func TestParseVxlanLength(t *testing.T) {
@@ -73,4 +74,7 @@ func TestVxlanListener(t *testing.T) {
 	assert.NoError(t, q.Err)
 	assert.Equal(t, len(ether), len(q.Pkt.Data))
 	assert.Equal(t, uint16(1), q.Pkt.Header.GroupPolicyID)
+	assert.True(t, q.Pkt.OuterSrcAddr.IsLoopback())
+	assert.Equal(t, sock.LocalAddr().(*net.UDPAddr).Port, q.Pkt.OuterSrcPort)
+	assert.Equal(t, port, q.Pkt.OuterDstPort)
 }